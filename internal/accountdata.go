@@ -0,0 +1,444 @@
+package internal
+
+import (
+	"archive/zip"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"github.com/uptrace/bun"
+)
+
+var ErrPlayerDeleted = errors.New("this account has been deleted")
+
+// exportedPlayer is the player's own row in their data export, without anything secret like their password hash.
+type exportedPlayer struct {
+	ID             int        `json:"id"`
+	CreatedDate    time.Time  `json:"created_date"`
+	Name           string     `json:"name"`
+	DiscordID      string     `json:"discord_id"`
+	DiscordAvatar  string     `json:"discord_avatar,omitempty"`
+	Role           Role       `json:"role"`
+	PasswordSet    bool       `json:"password_set"`
+	TOTPEnabled    bool       `json:"totp_enabled"`
+	Timezone       string     `json:"timezone"`
+	Clock24h       bool       `json:"clock_24h"`
+	NotifyStarting bool       `json:"notify_starting"`
+	NotifyChanges  bool       `json:"notify_changes"`
+	NotifyCreated  bool       `json:"notify_created"`
+	Email          string     `json:"email,omitempty"`
+	EmailVerified  *time.Time `json:"email_verified_date,omitempty"`
+	LastLoginDate  *time.Time `json:"last_login_date,omitempty"`
+	BannedDate     *time.Time `json:"banned_date,omitempty"`
+}
+
+// optionalTime leaves a nullzero column out of the export rather than showing year one.
+func optionalTime(t time.Time) *time.Time {
+	if t.IsZero() {
+		return nil
+	}
+	return &t
+}
+
+type exportedAttendance struct {
+	PlayDateID int        `json:"playdate_id"`
+	Game       string     `json:"game"`
+	Date       time.Time  `json:"date"`
+	Attending  Attendance `json:"attending"`
+}
+
+type exportedPlayDate struct {
+	ID          int            `json:"id"`
+	CreatedDate time.Time      `json:"created_date"`
+	Game        string         `json:"game"`
+	Date        time.Time      `json:"date"`
+	Status      PlayDateStatus `json:"status"`
+}
+
+// playerExport gathers everything kept about the player, one JSON file per kind of row.
+func (a *Api) playerExport(ctx context.Context, player *Player) (map[string]any, error) {
+	attendances := []*PlayDateToPlayer{}
+	err := a.db.NewSelect().
+		Model(&attendances).
+		Relation("PlayDate").
+		Where("player_id = ?", player.ID).
+		Order("play_date.date asc").
+		Scan(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find attendance: %w", err)
+	}
+	playdates := []*PlayDate{}
+	err = a.db.NewSelect().Model(&playdates).Where("owner_id = ?", player.ID).Order("date asc").Scan(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find owned playdates: %w", err)
+	}
+	sessions := []*Session{}
+	err = a.db.NewSelect().Model(&sessions).Where("player_id = ?", player.ID).Order("created_date asc").Scan(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find sessions: %w", err)
+	}
+
+	exportedAttendances := make([]exportedAttendance, 0, len(attendances))
+	for _, attendance := range attendances {
+		exportedAttendances = append(exportedAttendances, exportedAttendance{
+			PlayDateID: attendance.PlayDateID,
+			Game:       attendance.PlayDate.Game,
+			Date:       attendance.PlayDate.Date,
+			Attending:  attendance.Attending,
+		})
+	}
+	exportedPlayDates := make([]exportedPlayDate, 0, len(playdates))
+	for _, playdate := range playdates {
+		exportedPlayDates = append(exportedPlayDates, exportedPlayDate{
+			ID:          playdate.ID,
+			CreatedDate: playdate.CreatedDate,
+			Game:        playdate.Game,
+			Date:        playdate.Date,
+			Status:      playdate.Status,
+		})
+	}
+	pushSubscriptions := []*PushSubscription{}
+	err = a.db.NewSelect().Model(&pushSubscriptions).Where("player_id = ?", player.ID).Order("created_date asc").Scan(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to find push subscriptions: %w", err)
+	}
+
+	// NOTE: Session's json tags already leave out the token hash and csrf token, PushSubscription's the keys
+	for _, session := range sessions {
+		session.Player = nil
+	}
+
+	return map[string]any{
+		"player.json": exportedPlayer{
+			ID:             player.ID,
+			CreatedDate:    player.CreatedDate,
+			Name:           player.Name,
+			DiscordID:      player.DiscordID,
+			DiscordAvatar:  player.DiscordAvatar,
+			Role:           player.Role,
+			PasswordSet:    player.PasswordSet,
+			TOTPEnabled:    player.TOTPEnabled,
+			Timezone:       player.Timezone,
+			Clock24h:       player.Clock24h,
+			NotifyStarting: player.NotifyStarting,
+			NotifyChanges:  player.NotifyChanges,
+			NotifyCreated:  player.NotifyCreated,
+			Email:          player.Email,
+			EmailVerified:  optionalTime(player.EmailVerifiedDate),
+			LastLoginDate:  optionalTime(player.LastLoginDate),
+			BannedDate:     optionalTime(player.BannedDate),
+		},
+		"attendances.json":        exportedAttendances,
+		"playdates.json":          exportedPlayDates,
+		"sessions.json":           sessions,
+		"push_subscriptions.json": pushSubscriptions,
+	}, nil
+}
+
+// writePlayerExport answers with the player's data export as a ZIP download.
+func (a *Api) writePlayerExport(c *gin.Context, player *Player) {
+	files, err := a.playerExport(c.Request.Context(), player)
+	if err != nil {
+		log.Err(err).Int("playerID", player.ID).Msg("failed to gather player data export")
+		c.String(http.StatusInternalServerError, "Failed to gather the data, please try again.")
+		return
+	}
+
+	filename := fmt.Sprintf("playdate-%s-%s.zip", player.Name, time.Now().Format("2006-01-02"))
+	c.Header("Content-Type", "application/zip")
+	c.Header("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	c.Status(http.StatusOK)
+
+	archive := zip.NewWriter(c.Writer)
+	for name, data := range files {
+		w, err := archive.Create(name)
+		if err == nil {
+			encoder := json.NewEncoder(w)
+			encoder.SetIndent("", "  ")
+			err = encoder.Encode(data)
+		}
+		if err != nil {
+			// NOTE: the download already started, all that's left is to cut it short
+			log.Err(err).Int("playerID", player.ID).Str("file", name).Msg("failed to write player data export")
+			return
+		}
+	}
+	if err := archive.Close(); err != nil {
+		log.Err(err).Int("playerID", player.ID).Msg("failed to finish player data export")
+		return
+	}
+	log.Info().Int("playerID", player.ID).Msg("exported player data")
+}
+
+func (a *Api) exportMyData(c *gin.Context) {
+	player, err := a.findPlayerFromCookie(c)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+	a.writePlayerExport(c, player)
+}
+
+// deletedPlayDates is what happened to the pending playdates a deleted player owned, to announce once it's saved.
+type deletedPlayDates struct {
+	// the deleted player, who owned every one of them
+	PlayerID   int
+	Reassigned []*PlayDate
+	Cancelled  []*PlayDate
+}
+
+// deletePlayer deletes the player's account. Their row stays behind under an anonymous name so the attendance of
+// past playdates still adds up, everything else about them is removed. Pending playdates they own are handed to
+// someone going to it, or cancelled when nobody is.
+// NOTE: the player's name, discord id and email are scrubbed from the audit log too, only their id is left in it.
+func (a *Api) deletePlayer(ctx context.Context, player *Player, actor AuditActor) (*deletedPlayDates, error) {
+	if player.Deleted() {
+		return nil, ErrPlayerDeleted
+	}
+
+	// NOTE: a failed revocation is only logged by revokeDiscordCredential, the tokens are gone on our end regardless
+	if err := a.revokeDiscordCredential(ctx, player.ID); err != nil {
+		return nil, fmt.Errorf("failed to revoke discord credential: %w", err)
+	}
+	password, err := GenerateRandomState()
+	if err != nil {
+		return nil, err
+	}
+	hashedPassword, err := hashPassword(password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash placeholder password: %w", err)
+	}
+
+	result := &deletedPlayDates{PlayerID: player.ID}
+	err = a.db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		playdates := []*PlayDate{}
+		err := tx.NewSelect().
+			Model(&playdates).
+			Relation("Attendances", func(q *bun.SelectQuery) *bun.SelectQuery {
+				return q.Where("player_id != ?", player.ID).Where("attending != ?", AttendanceNo).Order("attending desc", "player_id asc")
+			}).
+			Where("owner_id = ?", player.ID).
+			Where("status = ?", PlayDateStatusPending).
+			For("UPDATE").
+			Scan(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to find owned playdates: %w", err)
+		}
+		for _, playdate := range playdates {
+			before := playdate.auditSnapshot()
+			// NOTE: the attendances are ordered so someone who said yes gets it before someone who said maybe
+			if len(playdate.Attendances) > 0 {
+				playdate.OwnerId = playdate.Attendances[0].PlayerID
+				_, err = tx.NewUpdate().Model(playdate).Column("owner_id").WherePK().Exec(ctx)
+				result.Reassigned = append(result.Reassigned, playdate)
+			} else {
+				playdate.Status = PlayDateStatusCancelled
+				_, err = tx.NewUpdate().Model(playdate).Column("status").WherePK().Exec(ctx)
+				result.Cancelled = append(result.Cancelled, playdate)
+			}
+			if err != nil {
+				return fmt.Errorf("failed to hand off playdate %d: %w", playdate.ID, err)
+			}
+			if err := recordAudit(ctx, tx, actor, before, playdate.auditSnapshot()); err != nil {
+				return err
+			}
+		}
+
+		// the player won't be showing up to anything that hasn't happened yet
+		attendances := []*PlayDateToPlayer{}
+		err = tx.NewDelete().
+			Model(&attendances).
+			Where("player_id = ?", player.ID).
+			Where("playdate_id IN (?)", tx.NewSelect().Model((*PlayDate)(nil)).Column("id").Where("status = ?", PlayDateStatusPending)).
+			Returning("*").
+			Scan(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to drop attendance to pending playdates: %w", err)
+		}
+		for _, attendance := range attendances {
+			if err := recordAudit(ctx, tx, actor, attendance.auditSnapshot(), auditSnapshot{}); err != nil {
+				return err
+			}
+		}
+
+		// NOTE: these would cascade if the row itself was deleted, it's kept so they have to go by hand
+		for _, model := range []any{
+			(*Session)(nil),
+			(*PlayerOAuthCredential)(nil),
+			(*PasswordReset)(nil),
+			(*EmailVerification)(nil),
+			(*PushSubscription)(nil),
+			(*LoginLink)(nil),
+			(*WebAuthnCredential)(nil),
+			(*WebAuthnCeremony)(nil),
+			(*TOTPRecoveryCode)(nil),
+			(*TOTPChallenge)(nil),
+		} {
+			if _, err := tx.NewDelete().Model(model).Where("player_id = ?", player.ID).Exec(ctx); err != nil {
+				return fmt.Errorf("failed to delete %T: %w", model, err)
+			}
+		}
+		if player.DiscordID != "" {
+			_, err = tx.NewDelete().
+				Model((*DiscordOutboxMessage)(nil)).
+				Where("kind = ?", DiscordMessageDirect).
+				Where("target = ?", player.DiscordID).
+				Exec(ctx)
+			if err != nil {
+				return fmt.Errorf("failed to delete queued discord messages: %w", err)
+			}
+		}
+		_, err = tx.NewUpdate().
+			Model((*Session)(nil)).
+			Set("merge_player_id = NULL, merge_expires_date = NULL").
+			Where("merge_player_id = ?", player.ID).
+			Exec(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to cancel pending account merges: %w", err)
+		}
+
+		before := player.auditSnapshot()
+		anonymous := &Player{
+			ID:          player.ID,
+			CreatedDate: player.CreatedDate,
+			// NOTE: the space keeps these out of the way of real names, which have to be alphanumeric
+			Name:        fmt.Sprintf("Deleted Player %d", player.ID),
+			Password:    hashedPassword,
+			DiscordID:   fmt.Sprintf("deleted:%d", player.ID),
+			Role:        RoleMember,
+			Timezone:    player.Timezone,
+			DeletedDate: time.Now(),
+		}
+		_, err = tx.NewUpdate().Model(anonymous).ExcludeColumn("id", "created_date").WherePK().Exec(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to anonymize player: %w", err)
+		}
+		if err := recordAudit(ctx, tx, actor, before, anonymous.auditSnapshot()); err != nil {
+			return err
+		}
+		if err := scrubAuditEvents(ctx, tx, anonymous); err != nil {
+			return err
+		}
+
+		// NOTE: the webhooks are only queued now the player is anonymized, so their name doesn't go out with them
+		for _, playdate := range result.Reassigned {
+			playdate.Owner = &Player{ID: playdate.OwnerId}
+			if err := tx.NewSelect().Model(playdate.Owner).WherePK().Scan(ctx); err != nil {
+				return fmt.Errorf("failed to find new owner of playdate %d: %w", playdate.ID, err)
+			}
+			if err := emitWebhookEvent(ctx, tx, WebhookEventPlayDateUpdated, newWebhookPlayDate(playdate)); err != nil {
+				return err
+			}
+		}
+		for _, playdate := range result.Cancelled {
+			playdate.Owner = anonymous
+			if err := emitWebhookEvent(ctx, tx, WebhookEventPlayDateCancelled, newWebhookPlayDate(playdate)); err != nil {
+				return err
+			}
+		}
+		*player = *anonymous
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	log.Info().Int("playerID", player.ID).Int("reassigned", len(result.Reassigned)).Int("cancelled", len(result.Cancelled)).Msg("deleted player")
+	return result, nil
+}
+
+// announceDeletedPlayDates lets everyone know about the playdates that changed hands or were called off because
+// their owner deleted their account.
+func (a *Api) announceDeletedPlayDates(result *deletedPlayDates, actor *Player) {
+	for _, playdate := range result.Reassigned {
+		previous := *playdate
+		previous.OwnerId, previous.Owner = result.PlayerID, nil
+		a.notify(Notification{Event: NotificationPlayDateUpdated, PlayDate: playdate, Previous: &previous, Actor: actor})
+		a.publishPlayDate(playdate.ID, homeRowUpdated)
+	}
+	if len(result.Reassigned) > 0 {
+		a.kickWebhookWorker()
+	}
+	for _, playdate := range result.Cancelled {
+		a.announceCancelledPlayDate(playdate, actor)
+	}
+}
+
+// deleteMyAccount deletes the signed in player's account once they've typed in their name to confirm.
+func (a *Api) deleteMyAccount(c *gin.Context) {
+	session, err := a.findSessionFromCookie(c)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+	player := session.Player
+
+	if strings.TrimSpace(c.PostForm("confirm")) != player.Name {
+		state := a.profileState(c, session)
+		state["Errors"] = map[string]string{"deleteConfirm": "type your name exactly to confirm"}
+		c.HTML(http.StatusOK, "partials/profile.html", state)
+		return
+	}
+
+	// NOTE: the actor is a copy so the announcements below can still say who left
+	actor := *player
+	result, err := a.deletePlayer(c.Request.Context(), player, AuditActor{Player: &actor, Source: AuditSourceWeb})
+	if err != nil {
+		log.Err(err).Int("playerID", player.ID).Msg("failed to delete player")
+		state := a.profileState(c, session)
+		state["ServerError"] = "Failed to delete your account, please try again."
+		c.HTML(http.StatusOK, "partials/profile.html", state)
+		return
+	}
+	a.announceDeletedPlayDates(result, &actor)
+
+	// NOTE: the session is already gone along with the rest, only the cookies are left to clear
+	setCookie(c, sessionCookieName, "", -1, true)
+	setCookie(c, csrfCookieName, "", -1, false)
+	c.Header("HX-Location", "/")
+	c.Status(http.StatusOK)
+}
+
+func (a *Api) adminExportPlayer(c *gin.Context) {
+	admin, _ := a.findPlayerFromCookie(c)
+	player, err := a.findPlayerFromParam(c)
+	if err != nil {
+		c.String(http.StatusNotFound, "That player doesn't exist anymore.")
+		return
+	}
+	log.Info().Int("playerID", player.ID).Int("adminID", admin.ID).Msg("admin exporting player data")
+	a.writePlayerExport(c, player)
+}
+
+// adminDeletePlayer deletes someone's account for them, i.e. when they asked over discord.
+func (a *Api) adminDeletePlayer(c *gin.Context) {
+	admin, _ := a.findPlayerFromCookie(c)
+	player, err := a.findPlayerFromParam(c)
+	if err != nil {
+		a.renderAdminPlayers(c, "That player doesn't exist anymore.")
+		return
+	}
+	if player.ID == admin.ID {
+		a.renderAdminPlayers(c, "Delete your own account from your profile instead.")
+		return
+	}
+
+	result, err := a.deletePlayer(c.Request.Context(), player, AuditActor{Player: admin, Source: AuditSourceWeb})
+	if errors.Is(err, ErrPlayerDeleted) {
+		a.renderAdminPlayers(c, "They already deleted their account.")
+		return
+	}
+	if err != nil {
+		log.Err(err).Int("playerID", player.ID).Msg("failed to delete player")
+		a.renderAdminPlayers(c, "Failed to delete them, please try again.")
+		return
+	}
+	log.Info().Int("playerID", player.ID).Int("adminID", admin.ID).Msg("admin deleted player")
+	a.announceDeletedPlayDates(result, admin)
+	a.renderAdminPlayers(c, "")
+}
@@ -0,0 +1,454 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"github.com/uptrace/bun"
+	"github.com/uptrace/bun/driver/pgdriver"
+)
+
+const (
+	// how long a player has to confirm merging two accounts after proving they own both
+	accountMergeTTL = 10 * time.Minute
+	// retries when someone else grabs the generated name between picking and inserting it
+	createPlayerAttempts = 3
+)
+
+var nonAlphanumeric = regexp.MustCompile("[^a-zA-Z0-9]")
+
+// isUniqueViolation reports whether err is postgres rejecting a duplicate for the given constraint.
+func isUniqueViolation(err error, constraint string) bool {
+	var pgErr pgdriver.Error
+	return errors.As(err, &pgErr) && pgErr.Field('C') == "23505" && pgErr.Field('n') == constraint
+}
+
+// validatePlayerName checks a name picked by a player, it has to be alphanumeric and not someone else's.
+// playerID is the player being renamed, or zero for a new one. The returned problem is empty when the name is fine.
+func (a *Api) validatePlayerName(ctx context.Context, name string, playerID int) (string, error) {
+	if name == "" {
+		return "name is required", nil
+	}
+	if nonAlphanumeric.MatchString(name) {
+		return "name must be alphanumeric", nil
+	}
+	taken, err := a.db.NewSelect().Model((*Player)(nil)).Where("name = ?", name).Where("id != ?", playerID).Exists(ctx)
+	if err != nil {
+		return "", err
+	}
+	if taken {
+		return "name is taken", nil
+	}
+	return "", nil
+}
+
+// freePlayerName turns a discord username into a player name nobody has taken yet, i.e. "cool.gamer" becomes
+// "coolgamer", or "coolgamer2" when that is already someone else's.
+func (a *Api) freePlayerName(ctx context.Context, username string) (string, error) {
+	base := nonAlphanumeric.ReplaceAllString(username, "")
+	if base == "" {
+		base = "player"
+	}
+
+	taken := []string{}
+	err := a.db.NewSelect().Model((*Player)(nil)).Column("name").Where("name LIKE ?", base+"%").Scan(ctx, &taken)
+	if err != nil {
+		return "", err
+	}
+	names := make(map[string]bool, len(taken))
+	for _, name := range taken {
+		names[name] = true
+	}
+
+	name := base
+	for i := 2; names[name]; i++ {
+		name = fmt.Sprintf("%s%d", base, i)
+	}
+	return name, nil
+}
+
+// resolveOAuthPlayer finds the player a discord login belongs to. A signed in player gets the discord account
+// linked to them when nobody else has it yet, otherwise a new player is created under a free name.
+func (a *Api) resolveOAuthPlayer(ctx context.Context, discordUser *DiscordUser, session *Session) (*Player, error) {
+	player := &Player{}
+	err := a.db.NewSelect().Model(player).Where("discord_id = ?", discordUser.ID).Scan(ctx)
+	if err == nil {
+		return player, a.verifyDiscordAccount(ctx, player)
+	}
+	if !errors.Is(err, sql.ErrNoRows) {
+		return nil, err
+	}
+
+	if session != nil {
+		player = session.Player
+		log.Info().Int("playerID", player.ID).Str("previousDiscordID", player.DiscordID).Str("discordID", discordUser.ID).Msg("linking discord account to signed in player")
+		before := player.auditSnapshot()
+		player.DiscordID = discordUser.ID
+		player.DiscordVerifiedDate = time.Now()
+		err = a.db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+			_, err := tx.NewUpdate().Model(player).Column("discord_id", "discord_verified_date").WherePK().Exec(ctx)
+			if err != nil {
+				return err
+			}
+			return recordAudit(ctx, tx, AuditActor{Player: player, Source: AuditSourceWeb}, before, player.auditSnapshot())
+		})
+		return player, err
+	}
+	return a.createOAuthPlayer(ctx, discordUser)
+}
+
+// verifyDiscordAccount records that whoever is signing in proved they own the player's discord account, by signing
+// in with discord or through a link sent to it. Until then the password may belong to someone who only typed that
+// discord id at registration, so the first proof takes the account over: the password stops working and every
+// session is signed out.
+func (a *Api) verifyDiscordAccount(ctx context.Context, player *Player) error {
+	if player.DiscordVerified() {
+		return nil
+	}
+	return a.db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		err := tx.NewSelect().Model(player).WherePK().For("UPDATE").Scan(ctx)
+		if err != nil || player.DiscordVerified() {
+			return err
+		}
+		before := player.auditSnapshot()
+		player.DiscordVerifiedDate = time.Now()
+		columns := []string{"discord_verified_date"}
+		if player.PasswordSet {
+			log.Warn().Int("playerID", player.ID).Msg("discord account proved for a player with a password, dropping the password")
+			password, err := GenerateRandomState()
+			if err != nil {
+				return err
+			}
+			player.Password, err = hashPassword(password)
+			if err != nil {
+				return fmt.Errorf("failed to hash placeholder password: %w", err)
+			}
+			player.PasswordSet = false
+			columns = append(columns, "password", "password_set")
+		}
+		_, err = tx.NewUpdate().Model(player).Column(columns...).WherePK().Exec(ctx)
+		if err != nil {
+			return err
+		}
+		_, err = tx.NewDelete().Model((*Session)(nil)).Where("player_id = ?", player.ID).Exec(ctx)
+		if err != nil {
+			return err
+		}
+		return recordAudit(ctx, tx, AuditActor{Player: player, Source: AuditSourceWeb}, before, player.auditSnapshot())
+	})
+}
+
+func (a *Api) createOAuthPlayer(ctx context.Context, discordUser *DiscordUser) (*Player, error) {
+	// NOTE: nobody knows this password, the player has to set their own from their profile to use the login form
+	password, err := GenerateRandomState()
+	if err != nil {
+		return nil, err
+	}
+	hashedPassword, err := hashPassword(password)
+	if err != nil {
+		return nil, fmt.Errorf("failed to hash placeholder password: %w", err)
+	}
+
+	for attempt := 1; ; attempt++ {
+		name, err := a.freePlayerName(ctx, discordUser.Username)
+		if err != nil {
+			return nil, fmt.Errorf("failed to pick a player name: %w", err)
+		}
+		player := &Player{
+			Name:                name,
+			Password:            hashedPassword,
+			DiscordID:           discordUser.ID,
+			DiscordVerifiedDate: time.Now(),
+		}
+		err = a.db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+			// NOTE: the no-op update is only there so the id is returned if the same discord user raced us here,
+			// xmax is only zero for a row that was really inserted
+			var inserted bool
+			err := tx.NewInsert().
+				Model(player).
+				On("CONFLICT (discord_id) DO UPDATE").
+				Set("discord_id = EXCLUDED.discord_id").
+				Returning("id, name, (xmax = 0) AS inserted").
+				Scan(ctx, &player.ID, &player.Name, &inserted)
+			if err != nil || !inserted {
+				return err
+			}
+			return recordAudit(ctx, tx, AuditActor{Player: player, Source: AuditSourceWeb}, auditSnapshot{}, player.auditSnapshot())
+		})
+		if isUniqueViolation(err, "player_name_key") && attempt < createPlayerAttempts {
+			log.Warn().Str("name", name).Msg("generated player name was taken before we could use it, trying another")
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		log.Info().Int("playerID", player.ID).Str("name", player.Name).Str("discordID", discordUser.ID).Msg("created player from discord login")
+		return player, nil
+	}
+}
+
+// requestAccountMerge asks a signed in player to confirm folding the player owning the discord account they just
+// signed in with into their own account. Both are proven at this point, the session and the discord login.
+func (a *Api) requestAccountMerge(c *gin.Context, session *Session, source *Player) {
+	session.MergePlayerID = source.ID
+	session.MergeExpiresDate = time.Now().Add(accountMergeTTL)
+	_, err := a.db.NewUpdate().
+		Model(session).
+		Column("merge_player_id", "merge_expires_date").
+		WherePK().
+		Exec(c.Request.Context())
+	if err != nil {
+		log.Err(err).Int("sessionID", session.ID).Int("sourcePlayerID", source.ID).Msg("failed to store pending account merge")
+		c.String(http.StatusInternalServerError, "Failed to start merging your accounts, please try again.")
+		return
+	}
+
+	log.Info().Int("playerID", session.PlayerID).Int("sourcePlayerID", source.ID).Msg("asking player to confirm account merge")
+	c.HTML(http.StatusOK, "pages/merge.html", gin.H{"Player": session.Player, "Source": source})
+}
+
+// mergePlayers moves everything source has over to target, along with its discord account, passkeys and the
+// browsers it gets pushes on, then deletes source.
+func (a *Api) mergePlayers(ctx context.Context, target *Player, source *Player) error {
+	actor := AuditActor{Player: target, Source: AuditSourceWeb}
+	return a.db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		// NOTE: everything about to move is loaded first so each row gets its own audit event
+		playdates := []*PlayDate{}
+		err := tx.NewSelect().Model(&playdates).Where("owner_id = ?", source.ID).Scan(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to find playdates to move: %w", err)
+		}
+		attendances := []*PlayDateToPlayer{}
+		err = tx.NewSelect().Model(&attendances).Where("player_id = ?", source.ID).Scan(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to find attendance to move: %w", err)
+		}
+		answered := []int{}
+		err = tx.NewSelect().Model((*PlayDateToPlayer)(nil)).Column("playdate_id").Where("player_id = ?", target.ID).Scan(ctx, &answered)
+		if err != nil {
+			return fmt.Errorf("failed to find attendance to keep: %w", err)
+		}
+
+		_, err = tx.NewUpdate().
+			Model((*PlayDate)(nil)).
+			Set("owner_id = ?", target.ID).
+			Where("owner_id = ?", source.ID).
+			Exec(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to move playdates: %w", err)
+		}
+
+		// NOTE: when both players answered the same playdate the target's answer wins
+		_, err = tx.NewUpdate().
+			Model((*PlayDateToPlayer)(nil)).
+			Set("player_id = ?", target.ID).
+			Where("player_id = ?", source.ID).
+			Where("playdate_id NOT IN (?)", tx.NewSelect().Model((*PlayDateToPlayer)(nil)).Column("playdate_id").Where("player_id = ?", target.ID)).
+			Exec(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to move attendance: %w", err)
+		}
+		_, err = tx.NewDelete().Model((*PlayDateToPlayer)(nil)).Where("player_id = ?", source.ID).Exec(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to drop duplicate attendance: %w", err)
+		}
+
+		// the discord account comes along with its tokens, replacing whatever the target had
+		_, err = tx.NewDelete().Model((*PlayerOAuthCredential)(nil)).Where("player_id = ?", target.ID).Exec(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to drop old discord credential: %w", err)
+		}
+		_, err = tx.NewUpdate().
+			Model((*PlayerOAuthCredential)(nil)).
+			Set("player_id = ?", target.ID).
+			Where("player_id = ?", source.ID).
+			Exec(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to move discord credential: %w", err)
+		}
+
+		// NOTE: passkeys keep the user handle they were made under, see WebAuthnCredential
+		_, err = tx.NewUpdate().
+			Model((*WebAuthnCredential)(nil)).
+			Set("player_id = ?", target.ID).
+			Where("player_id = ?", source.ID).
+			Exec(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to move passkeys: %w", err)
+		}
+
+		_, err = tx.NewUpdate().
+			Model((*PushSubscription)(nil)).
+			Set("player_id = ?", target.ID).
+			Where("player_id = ?", source.ID).
+			Exec(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to move push subscriptions: %w", err)
+		}
+
+		// NOTE: the source's sessions go with it through the cascade
+		_, err = tx.NewDelete().Model(source).WherePK().Exec(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to delete merged player: %w", err)
+		}
+		targetBefore := target.auditSnapshot()
+		target.DiscordID = source.DiscordID
+		target.DiscordVerifiedDate = source.DiscordVerifiedDate
+		columns := []string{"discord_id", "discord_verified_date"}
+		// NOTE: the verified email only comes along when the target doesn't have one of its own
+		if target.Email == "" && source.Email != "" {
+			target.Email = source.Email
+			target.EmailVerifiedDate = source.EmailVerifiedDate
+			columns = append(columns, "email", "email_verified_date")
+		}
+		_, err = tx.NewUpdate().Model(target).Column(columns...).WherePK().Exec(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to move discord account: %w", err)
+		}
+
+		for _, playdate := range playdates {
+			before := playdate.auditSnapshot()
+			playdate.OwnerId = target.ID
+			if err := recordAudit(ctx, tx, actor, before, playdate.auditSnapshot()); err != nil {
+				return err
+			}
+		}
+		for _, attendance := range attendances {
+			before := attendance.auditSnapshot()
+			after := auditSnapshot{}
+			if !slices.Contains(answered, attendance.PlayDateID) {
+				attendance.PlayerID = target.ID
+				after = attendance.auditSnapshot()
+			}
+			if err := recordAudit(ctx, tx, actor, before, after); err != nil {
+				return err
+			}
+		}
+		if err := recordAudit(ctx, tx, actor, source.auditSnapshot(), auditSnapshot{}); err != nil {
+			return err
+		}
+		return recordAudit(ctx, tx, actor, targetBefore, target.auditSnapshot())
+	})
+}
+
+func (a *Api) confirmAccountMerge(c *gin.Context) {
+	session, err := a.findSessionFromCookie(c)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+
+	state := gin.H{"Player": session.Player}
+	if session.MergePlayerID == 0 || time.Now().After(session.MergeExpiresDate) {
+		state["ServerError"] = "This merge has expired, sign in with Discord again from your profile to start over."
+		c.HTML(http.StatusOK, "partials/merge.html", state)
+		return
+	}
+
+	source := &Player{ID: session.MergePlayerID}
+	err = a.db.NewSelect().Model(source).WherePK().Scan(c.Request.Context())
+	if err != nil {
+		log.Err(err).Int("sourcePlayerID", session.MergePlayerID).Msg("failed to find player to merge")
+		state["ServerError"] = "The other account doesn't exist anymore."
+		c.HTML(http.StatusOK, "partials/merge.html", state)
+		return
+	}
+	state["Source"] = source
+
+	err = a.mergePlayers(c.Request.Context(), session.Player, source)
+	if err != nil {
+		log.Err(err).Int("playerID", session.PlayerID).Int("sourcePlayerID", source.ID).Msg("failed to merge accounts")
+		state["ServerError"] = "Not your fault, server is cooked. Try again?"
+		c.HTML(http.StatusOK, "partials/merge.html", state)
+		return
+	}
+	log.Info().Int("playerID", session.PlayerID).Int("sourcePlayerID", source.ID).Msg("merged accounts")
+
+	c.Header("HX-Location", "/me")
+	c.Status(http.StatusOK)
+}
+
+func (a *Api) cancelAccountMerge(c *gin.Context) {
+	session, err := a.findSessionFromCookie(c)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+
+	session.MergePlayerID = 0
+	session.MergeExpiresDate = time.Time{}
+	_, err = a.db.NewUpdate().
+		Model(session).
+		Column("merge_player_id", "merge_expires_date").
+		WherePK().
+		Exec(c.Request.Context())
+	if err != nil {
+		log.Err(err).Int("sessionID", session.ID).Msg("failed to cancel account merge")
+	}
+
+	c.Header("HX-Location", "/me")
+	c.Status(http.StatusOK)
+}
+
+// setPassword lets a player pick a password, i.e. so someone who signed up through discord can also use the login form.
+func (a *Api) setPassword(c *gin.Context) {
+	session, err := a.findSessionFromCookie(c)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+	player := session.Player
+	current := c.PostForm("currentPassword")
+	pass := c.PostForm("password")
+
+	state := a.profileState(c, session)
+	errors := map[string]string{}
+	state["Errors"] = errors
+	if problem := validatePassword(pass, player.Name); problem != "" {
+		errors["password"] = problem
+	}
+	// NOTE: a player who already has a password has to know it, a stolen session alone isn't enough to take the account
+	if player.PasswordSet && comparePassword(player.Password, current) != nil {
+		errors["currentPassword"] = "current password is incorrect"
+	}
+	if len(errors) > 0 {
+		c.HTML(http.StatusOK, "partials/profile.html", state)
+		return
+	}
+
+	hashedPassword, err := hashPassword(pass)
+	if err != nil {
+		log.Err(err).Msg("failed to hash password")
+		state["ServerError"] = err.Error()
+		c.HTML(http.StatusOK, "partials/profile.html", state)
+		return
+	}
+	before := player.auditSnapshot()
+	player.Password = hashedPassword
+	player.PasswordSet = true
+	err = a.db.RunInTx(c.Request.Context(), nil, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewUpdate().Model(player).Column("password", "password_set").WherePK().Exec(ctx)
+		if err != nil {
+			return err
+		}
+		return recordAudit(ctx, tx, AuditActor{Player: player, Source: AuditSourceWeb}, before, player.auditSnapshot())
+	})
+	if err != nil {
+		log.Err(err).Int("playerID", player.ID).Msg("failed to set password")
+		state["ServerError"] = err.Error()
+		c.HTML(http.StatusOK, "partials/profile.html", state)
+		return
+	}
+	log.Info().Int("playerID", player.ID).Msg("player set their password")
+
+	state["PasswordUpdated"] = true
+	c.HTML(http.StatusOK, "partials/profile.html", state)
+}
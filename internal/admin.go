@@ -0,0 +1,396 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"github.com/uptrace/bun"
+)
+
+const (
+	// the dashboard only lists this many players, search to find anyone else
+	adminPlayersLimit  = 100
+	adminFailuresLimit = 50
+	// playdates are listed a page at a time, newest first
+	adminPlayDatesLimit = 50
+	// failures older than this are cleaned up whenever a new one is recorded
+	failureRetention = 30 * 24 * time.Hour
+)
+
+var ErrPlayerBanned = errors.New("this account has been banned")
+
+// adminPlayer is a player along with how much they've been playing, for the dashboard.
+type adminPlayer struct {
+	Player `bun:",extend"`
+
+	PlayDatesOwned    int `bun:"playdates_owned"`
+	PlayDatesAttended int `bun:"playdates_attended"`
+}
+
+// recordFailure keeps an error from the bot or watchdog for the admin dashboard. It's in addition to logging the
+// error, not instead of it.
+func (a *Api) recordFailure(source FailureSource, message string, err error) {
+	failure := &Failure{Source: source, Message: message, Error: err.Error()}
+	_, insertErr := a.db.NewInsert().Model(failure).Exec(a.ctx)
+	if insertErr != nil {
+		log.Err(insertErr).Str("source", string(source)).Msg("failed to record failure")
+		return
+	}
+	_, err = a.db.NewDelete().Model((*Failure)(nil)).Where("created_date < ?", time.Now().Add(-failureRetention)).Exec(a.ctx)
+	if err != nil {
+		log.Err(err).Msg("failed to clean up old failures")
+	}
+}
+
+func (a *Api) adminPlayersState(c *gin.Context) gin.H {
+	search := strings.TrimSpace(c.Query("q"))
+	state := gin.H{"Errors": map[string]string{}, "Search": search}
+
+	players := []*adminPlayer{}
+	query := a.db.NewSelect().
+		Model(&players).
+		ColumnExpr("player.*").
+		ColumnExpr("(SELECT count(*) FROM playdate WHERE playdate.owner_id = player.id) AS playdates_owned").
+		ColumnExpr("(SELECT count(*) FROM playdate_player WHERE playdate_player.player_id = player.id AND playdate_player.attending != ?) AS playdates_attended", AttendanceNo).
+		Order("player.name asc").
+		Limit(adminPlayersLimit)
+	if search != "" {
+		// NOTE: names are alphanumeric so there's nothing to escape for ILIKE, discord ids have to match exactly
+		query = query.Where("(player.name ILIKE ? OR player.discord_id = ?)", "%"+search+"%", search)
+	}
+	err := query.Scan(c.Request.Context())
+	if err != nil {
+		log.Err(err).Str("search", search).Msg("failed to query for players")
+		state["ServerError"] = "Failed to retrieve players due to a server error. Please try again later."
+	}
+	state["Players"] = players
+	return state
+}
+
+// adminPlayDatesState lists a page of playdates, optionally only those with the given status. Both come from the
+// query or, when cancelling or deleting, from the form so the admin stays where they were.
+func (a *Api) adminPlayDatesState(c *gin.Context) gin.H {
+	status := PlayDateStatus(c.Request.FormValue("status"))
+	if status != PlayDateStatusPending && status != PlayDateStatusDone && status != PlayDateStatusCancelled {
+		status = ""
+	}
+	page, err := strconv.Atoi(c.Request.FormValue("page"))
+	if err != nil || page < 1 {
+		page = 1
+	}
+	state := gin.H{"Errors": map[string]string{}, "Status": status, "Page": page}
+
+	// NOTE: one extra is fetched to know whether there's a next page
+	playdates := []*PlayDate{}
+	query := a.db.NewSelect().
+		Model(&playdates).
+		Relation("Owner").
+		Relation("Players").
+		Order("play_date.date desc", "play_date.id desc").
+		Limit(adminPlayDatesLimit + 1).
+		Offset((page - 1) * adminPlayDatesLimit)
+	if status != "" {
+		query = query.Where("play_date.status = ?", status)
+	}
+	err = query.Scan(c.Request.Context())
+	if err != nil {
+		log.Err(err).Any("status", status).Int("page", page).Msg("failed to query for playdates")
+		state["ServerError"] = "Failed to retrieve playdates due to a server error. Please try again later."
+	}
+	if len(playdates) > adminPlayDatesLimit {
+		playdates = playdates[:adminPlayDatesLimit]
+		state["NextPage"] = page + 1
+	}
+	if page > 1 {
+		state["PreviousPage"] = page - 1
+	}
+	admin, _ := a.findPlayerFromCookie(c)
+	state["PlayDates"] = playDateRows(playdates, admin.TimeDisplay())
+	return state
+}
+
+func (a *Api) adminFailuresState(c *gin.Context) gin.H {
+	state := gin.H{"Errors": map[string]string{}}
+
+	failures := []*Failure{}
+	err := a.db.NewSelect().
+		Model(&failures).
+		Order("created_date desc").
+		Limit(adminFailuresLimit).
+		Scan(c.Request.Context())
+	if err != nil {
+		log.Err(err).Msg("failed to query for failures")
+		state["ServerError"] = "Failed to retrieve recent failures due to a server error. Please try again later."
+	}
+	state["Failures"] = failures
+	return state
+}
+
+func (a *Api) getAdminTemplate(c *gin.Context) {
+	player, _ := a.findPlayerFromCookie(c)
+	c.HTML(http.StatusOK, "pages/admin.html", gin.H{
+		"Player":    player,
+		"Players":   a.adminPlayersState(c),
+		"PlayDates": a.adminPlayDatesState(c),
+		"Failures":  a.adminFailuresState(c),
+		"Outbox":    a.adminOutboxState(c),
+	})
+}
+
+func (a *Api) getAdminPlayersTemplate(c *gin.Context) {
+	c.HTML(http.StatusOK, "partials/admin-players.html", a.adminPlayersState(c))
+}
+
+func (a *Api) getAdminPlayDatesTemplate(c *gin.Context) {
+	c.HTML(http.StatusOK, "partials/admin-playdates.html", a.adminPlayDatesState(c))
+}
+
+func (a *Api) getAdminFailuresTemplate(c *gin.Context) {
+	c.HTML(http.StatusOK, "partials/admin-failures.html", a.adminFailuresState(c))
+}
+
+// findPlayerFromParam loads the player named by the :id route parameter.
+func (a *Api) findPlayerFromParam(c *gin.Context) (*Player, error) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		log.Err(err).Str("playerID", c.Param("id")).Msg("failed to parse given player id")
+		return nil, err
+	}
+	player := &Player{ID: id}
+	err = a.db.NewSelect().Model(player).WherePK().Scan(c.Request.Context())
+	if err != nil {
+		log.Err(err).Int("playerID", id).Msg("failed to find player")
+		return nil, err
+	}
+	return player, nil
+}
+
+// endPlayerSessions signs the player out everywhere.
+func endPlayerSessions(ctx context.Context, db bun.IDB, player *Player) (int64, error) {
+	res, err := db.NewDelete().Model((*Session)(nil)).Where("player_id = ?", player.ID).Exec(ctx)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+// renderAdminPlayers answers a player action with the refreshed player list, keeping the admin's search.
+func (a *Api) renderAdminPlayers(c *gin.Context, serverError string) {
+	state := a.adminPlayersState(c)
+	if serverError != "" {
+		state["ServerError"] = serverError
+	}
+	c.HTML(http.StatusOK, "partials/admin-players.html", state)
+}
+
+func (a *Api) adminLogoutPlayer(c *gin.Context) {
+	admin, _ := a.findPlayerFromCookie(c)
+	player, err := a.findPlayerFromParam(c)
+	if err != nil {
+		a.renderAdminPlayers(c, "That player doesn't exist anymore.")
+		return
+	}
+
+	n, err := endPlayerSessions(c.Request.Context(), a.db, player)
+	if err != nil {
+		log.Err(err).Int("playerID", player.ID).Msg("failed to end player sessions")
+		a.renderAdminPlayers(c, "Failed to sign them out, please try again.")
+		return
+	}
+	log.Info().Int("playerID", player.ID).Int("adminID", admin.ID).Int64("sessions", n).Msg("admin signed player out everywhere")
+	a.renderAdminPlayers(c, "")
+}
+
+func (a *Api) adminBanPlayer(c *gin.Context) {
+	admin, _ := a.findPlayerFromCookie(c)
+	player, err := a.findPlayerFromParam(c)
+	if err != nil {
+		a.renderAdminPlayers(c, "That player doesn't exist anymore.")
+		return
+	}
+	if player.ID == admin.ID {
+		a.renderAdminPlayers(c, "You can't ban yourself.")
+		return
+	}
+
+	before := player.auditSnapshot()
+	player.BannedDate = time.Now()
+	err = a.db.RunInTx(c.Request.Context(), nil, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewUpdate().Model(player).Column("banned_date").WherePK().Exec(ctx)
+		if err != nil {
+			return err
+		}
+		_, err = endPlayerSessions(ctx, tx, player)
+		if err != nil {
+			return err
+		}
+		return recordAudit(ctx, tx, AuditActor{Player: admin, Source: AuditSourceWeb}, before, player.auditSnapshot())
+	})
+	if err != nil {
+		log.Err(err).Int("playerID", player.ID).Msg("failed to ban player")
+		a.renderAdminPlayers(c, "Failed to ban them, please try again.")
+		return
+	}
+	log.Info().Int("playerID", player.ID).Int("adminID", admin.ID).Msg("banned player")
+	a.renderAdminPlayers(c, "")
+}
+
+func (a *Api) adminUnbanPlayer(c *gin.Context) {
+	admin, _ := a.findPlayerFromCookie(c)
+	player, err := a.findPlayerFromParam(c)
+	if err != nil {
+		a.renderAdminPlayers(c, "That player doesn't exist anymore.")
+		return
+	}
+
+	before := player.auditSnapshot()
+	player.BannedDate = time.Time{}
+	err = a.db.RunInTx(c.Request.Context(), nil, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewUpdate().Model(player).Set("banned_date = NULL").WherePK().Exec(ctx)
+		if err != nil {
+			return err
+		}
+		return recordAudit(ctx, tx, AuditActor{Player: admin, Source: AuditSourceWeb}, before, player.auditSnapshot())
+	})
+	if err != nil {
+		log.Err(err).Int("playerID", player.ID).Msg("failed to unban player")
+		a.renderAdminPlayers(c, "Failed to unban them, please try again.")
+		return
+	}
+	log.Info().Int("playerID", player.ID).Int("adminID", admin.ID).Msg("unbanned player")
+	a.renderAdminPlayers(c, "")
+}
+
+func (a *Api) adminRenamePlayer(c *gin.Context) {
+	admin, _ := a.findPlayerFromCookie(c)
+	player, err := a.findPlayerFromParam(c)
+	if err != nil {
+		a.renderAdminPlayers(c, "That player doesn't exist anymore.")
+		return
+	}
+
+	name := strings.TrimSpace(c.PostForm("name"))
+	problem, err := a.validatePlayerName(c.Request.Context(), name, player.ID)
+	if err != nil {
+		log.Err(err).Int("playerID", player.ID).Msg("failed to check for an existing player name")
+		a.renderAdminPlayers(c, "Failed to rename them, please try again.")
+		return
+	}
+	if problem != "" {
+		a.renderAdminPlayers(c, "Can't rename them, the "+problem+".")
+		return
+	}
+
+	before, oldName := player.auditSnapshot(), player.Name
+	player.Name = name
+	err = a.db.RunInTx(c.Request.Context(), nil, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewUpdate().Model(player).Column("name").WherePK().Exec(ctx)
+		if err != nil {
+			return err
+		}
+		return recordAudit(ctx, tx, AuditActor{Player: admin, Source: AuditSourceWeb}, before, player.auditSnapshot())
+	})
+	if err != nil {
+		log.Err(err).Int("playerID", player.ID).Msg("failed to rename player")
+		a.renderAdminPlayers(c, "Failed to rename them, please try again.")
+		return
+	}
+	log.Info().Int("playerID", player.ID).Int("adminID", admin.ID).Str("from", oldName).Str("to", name).Msg("renamed player")
+	a.renderAdminPlayers(c, "")
+}
+
+// selectedPlayDateIDs parses the playdates ticked in the dashboard's bulk action form.
+func selectedPlayDateIDs(c *gin.Context) []int {
+	ids := []int{}
+	for _, input := range c.PostFormArray("ids") {
+		id, err := strconv.Atoi(input)
+		if err != nil {
+			log.Err(err).Str("playdateID", input).Msg("failed to parse given playdate id")
+			continue
+		}
+		ids = append(ids, id)
+	}
+	return ids
+}
+
+func (a *Api) adminCancelPlayDates(c *gin.Context) {
+	admin, _ := a.findPlayerFromCookie(c)
+	ids := selectedPlayDateIDs(c)
+
+	playdates := []*PlayDate{}
+	var err error
+	if len(ids) > 0 {
+		err = a.db.NewSelect().
+			Model(&playdates).
+			Relation("Owner").
+			Where("play_date.id IN (?)", bun.In(ids)).
+			Where("play_date.status = ?", PlayDateStatusPending).
+			Scan(c.Request.Context())
+	}
+	if err != nil {
+		log.Err(err).Ints("playdateIDs", ids).Msg("failed to find playdates to cancel")
+	}
+	failed := 0
+	for _, playdate := range playdates {
+		err := a.cancelPlayDate(c.Request.Context(), playdate, AuditActor{Player: admin, Source: AuditSourceWeb})
+		if err != nil && !errors.Is(err, ErrPlayDateNotPending) {
+			log.Err(err).Int("playdateID", playdate.ID).Msg("failed to cancel playdate")
+			failed++
+		}
+	}
+
+	state := a.adminPlayDatesState(c)
+	if err != nil || failed > 0 {
+		state["ServerError"] = "Some playdates couldn't be cancelled, please try again."
+	}
+	c.HTML(http.StatusOK, "partials/admin-playdates.html", state)
+}
+
+func (a *Api) adminDeletePlayDates(c *gin.Context) {
+	admin, _ := a.findPlayerFromCookie(c)
+	ids := selectedPlayDateIDs(c)
+
+	var err error
+	if len(ids) > 0 {
+		// NOTE: attendance doesn't cascade, so it has to go first
+		actor := AuditActor{Player: admin, Source: AuditSourceWeb}
+		err = a.db.RunInTx(c.Request.Context(), nil, func(ctx context.Context, tx bun.Tx) error {
+			rels := []*PlayDateToPlayer{}
+			_, err := tx.NewDelete().Model(&rels).Where("playdate_id IN (?)", bun.In(ids)).Returning("*").Exec(ctx)
+			if err != nil {
+				return err
+			}
+			playdates := []*PlayDate{}
+			_, err = tx.NewDelete().Model(&playdates).Where("id IN (?)", bun.In(ids)).Returning("*").Exec(ctx)
+			if err != nil {
+				return err
+			}
+			for _, rel := range rels {
+				if err := recordAudit(ctx, tx, actor, rel.auditSnapshot(), auditSnapshot{}); err != nil {
+					return err
+				}
+			}
+			for _, playdate := range playdates {
+				if err := recordAudit(ctx, tx, actor, playdate.auditSnapshot(), auditSnapshot{}); err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+	}
+
+	state := a.adminPlayDatesState(c)
+	if err != nil {
+		log.Err(err).Ints("playdateIDs", ids).Msg("failed to delete playdates")
+		state["ServerError"] = "Failed to delete the playdates, please try again."
+	} else if len(ids) > 0 {
+		log.Info().Ints("playdateIDs", ids).Int("adminID", admin.ID).Msg("deleted playdates")
+	}
+	c.HTML(http.StatusOK, "partials/admin-playdates.html", state)
+}
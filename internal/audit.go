@@ -0,0 +1,302 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"github.com/uptrace/bun"
+)
+
+const (
+	auditTargetPlayDate   = "playdate"
+	auditTargetPlayer     = "player"
+	auditTargetAttendance = "playdate_player"
+	discordMessageLimit   = 2000
+	// /playdate history only shows the latest few changes to stay under discord's message limit
+	discordHistoryLimit = 15
+)
+
+// AuditActor is who made a change and where they made it from. Changes made by the watchdog or synced from
+// discord on their own don't have a player.
+type AuditActor struct {
+	Player *Player
+	Source AuditSource
+}
+
+// auditSnapshot is the state of one row as it's kept in the audit log. The zero value stands for a row that
+// doesn't exist, i.e. before it was created or after it was deleted.
+type auditSnapshot struct {
+	targetType string
+	targetID   string
+	playdateID int
+	data       map[string]any
+}
+
+func (p *PlayDate) auditSnapshot() auditSnapshot {
+	return auditSnapshot{
+		targetType: auditTargetPlayDate,
+		targetID:   strconv.Itoa(p.ID),
+		playdateID: p.ID,
+		data: map[string]any{
+			"game":     p.Game,
+			"date":     p.Date.UTC(),
+			"status":   p.Status,
+			"owner_id": p.OwnerId,
+		},
+	}
+}
+
+// auditSnapshot leaves out anything secret. Password changes still show up, as a fingerprint of the hash.
+// Bookkeeping like the last login isn't part of it, so updating only that isn't audited.
+func (p *Player) auditSnapshot() auditSnapshot {
+	sum := sha256.Sum256([]byte(p.Password))
+	data := map[string]any{
+		"name":                 p.Name,
+		"discord_id":           p.DiscordID,
+		"discord_verified":     p.DiscordVerified(),
+		"role":                 p.Role,
+		"password_set":         p.PasswordSet,
+		"password_fingerprint": hex.EncodeToString(sum[:4]),
+		"totp_enabled":         p.TOTPEnabled,
+		"email":                p.Email,
+	}
+	if p.Banned() {
+		data["banned_date"] = p.BannedDate.UTC()
+	}
+	if p.Deleted() {
+		data["deleted_date"] = p.DeletedDate.UTC()
+	}
+	return auditSnapshot{targetType: auditTargetPlayer, targetID: strconv.Itoa(p.ID), data: data}
+}
+
+func (p *PlayDateToPlayer) auditSnapshot() auditSnapshot {
+	data := map[string]any{
+		"playdate_id": p.PlayDateID,
+		"player_id":   p.PlayerID,
+		"attending":   p.Attending,
+	}
+	if p.Player != nil {
+		data["player_name"] = p.Player.Name
+	}
+	return auditSnapshot{
+		targetType: auditTargetAttendance,
+		targetID:   fmt.Sprintf("%d:%d", p.PlayDateID, p.PlayerID),
+		playdateID: p.PlayDateID,
+		data:       data,
+	}
+}
+
+// recordAudit adds the change from before to after to the audit log. It has to be given the transaction the change
+// is made in, so the change and its event are saved or rolled back together. Pass an empty snapshot as before for
+// a create or as after for a delete. Updates that didn't change anything aren't recorded.
+func recordAudit(ctx context.Context, db bun.IDB, actor AuditActor, before auditSnapshot, after auditSnapshot) error {
+	event := &AuditEvent{Source: actor.Source, ActorName: string(actor.Source)}
+	if actor.Player != nil {
+		event.ActorID = actor.Player.ID
+		event.ActorName = actor.Player.Name
+	}
+
+	target := after
+	switch {
+	case before.targetType == "":
+		event.Action = AuditActionCreate
+	case after.targetType == "":
+		event.Action = AuditActionDelete
+		target = before
+	default:
+		event.Action = AuditActionUpdate
+	}
+	event.TargetType = target.targetType
+	event.TargetID = target.targetID
+	event.PlayDateID = target.playdateID
+
+	var err error
+	if before.data != nil {
+		if event.Before, err = json.Marshal(before.data); err != nil {
+			return err
+		}
+	}
+	if after.data != nil {
+		if event.After, err = json.Marshal(after.data); err != nil {
+			return err
+		}
+	}
+	if event.Action == AuditActionUpdate && bytes.Equal(event.Before, event.After) {
+		return nil
+	}
+
+	_, err = db.NewInsert().Model(event).Exec(ctx)
+	return err
+}
+
+// scrubAuditEvents swaps a deleted player's name, discord id and email for their anonymous ones in every event they
+// made or are the subject of. It has to run in the deletion's transaction, after its last event is recorded.
+func scrubAuditEvents(ctx context.Context, db bun.IDB, anonymous *Player) error {
+	// NOTE: the append-only trigger lets this one kind of update through for the rest of the transaction only
+	if _, err := db.ExecContext(ctx, "SET LOCAL playdate.audit_scrub = 'on'"); err != nil {
+		return err
+	}
+	_, err := db.NewUpdate().
+		Model((*AuditEvent)(nil)).
+		Set("actor_name = ?", anonymous.Name).
+		Where("actor_id = ?", anonymous.ID).
+		Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to scrub the actor name: %w", err)
+	}
+
+	personal, err := json.Marshal(map[string]any{"name": anonymous.Name, "discord_id": anonymous.DiscordID, "email": anonymous.Email})
+	if err != nil {
+		return err
+	}
+	for _, column := range []bun.Ident{"before", "after"} {
+		_, err = db.NewUpdate().
+			Model((*AuditEvent)(nil)).
+			Set("? = ? || ?::jsonb", column, column, string(personal)).
+			Where("target_type = ?", auditTargetPlayer).
+			Where("target_id = ?", strconv.Itoa(anonymous.ID)).
+			Where("? IS NOT NULL", column).
+			Exec(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to scrub player events: %w", err)
+		}
+		_, err = db.NewUpdate().
+			Model((*AuditEvent)(nil)).
+			Set("? = jsonb_set(?, '{player_name}', to_jsonb(?::text))", column, column, anonymous.Name).
+			Where("target_type = ?", auditTargetAttendance).
+			Where("?->>'player_id' = ?", column, strconv.Itoa(anonymous.ID)).
+			Where("?->>'player_name' IS NOT NULL", column).
+			Exec(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to scrub attendance events: %w", err)
+		}
+	}
+
+	_, err = db.ExecContext(ctx, "SET LOCAL playdate.audit_scrub = 'off'")
+	return err
+}
+
+// Changes lists what the event did field by field, i.e. "attending: maybe → yes".
+func (e *AuditEvent) Changes() []string {
+	before, after := map[string]any{}, map[string]any{}
+	if len(e.Before) > 0 {
+		_ = json.Unmarshal(e.Before, &before)
+	}
+	if len(e.After) > 0 {
+		_ = json.Unmarshal(e.After, &after)
+	}
+
+	keys := []string{}
+	for k := range before {
+		keys = append(keys, k)
+	}
+	for k := range after {
+		if _, ok := before[k]; !ok {
+			keys = append(keys, k)
+		}
+	}
+	slices.Sort(keys)
+
+	changes := []string{}
+	for _, k := range keys {
+		b, inBefore := before[k]
+		a, inAfter := after[k]
+		switch {
+		case e.Action == AuditActionCreate:
+			changes = append(changes, fmt.Sprintf("%s: %v", k, a))
+		case e.Action == AuditActionDelete:
+			changes = append(changes, fmt.Sprintf("%s: %v", k, b))
+		case !inBefore:
+			changes = append(changes, fmt.Sprintf("%s: → %v", k, a))
+		case !inAfter:
+			changes = append(changes, fmt.Sprintf("%s: %v →", k, b))
+		case fmt.Sprint(a) != fmt.Sprint(b):
+			changes = append(changes, fmt.Sprintf("%s: %v → %v", k, b, a))
+		}
+	}
+	return changes
+}
+
+// playDateHistory is every audit event for the playdate and its attendance, oldest first.
+func (a *Api) playDateHistory(ctx context.Context, playdateID int) ([]*AuditEvent, error) {
+	events := []*AuditEvent{}
+	err := a.db.NewSelect().
+		Model(&events).
+		Where("playdate_id = ?", playdateID).
+		Order("created_date asc", "id asc").
+		Scan(ctx)
+	return events, err
+}
+
+func (a *Api) getPlayDateHistoryTemplate(c *gin.Context) {
+	player, _ := a.findPlayerFromCookie(c)
+	state := gin.H{"Errors": map[string]string{}, "Player": player}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		log.Err(err).Str("playdateID", c.Param("id")).Msg("failed to parse given playdate id")
+		c.Redirect(http.StatusFound, "/admin")
+		return
+	}
+	state["PlayDateID"] = id
+
+	// NOTE: the playdate may have been deleted, its history is still worth showing
+	playdate := &PlayDate{ID: id}
+	if err := a.db.NewSelect().Model(playdate).WherePK().Scan(c.Request.Context()); err == nil {
+		state["PlayDate"] = playdate
+	}
+
+	events, err := a.playDateHistory(c.Request.Context(), id)
+	if err != nil {
+		log.Err(err).Int("playdateID", id).Msg("failed to query for playdate history")
+		state["ServerError"] = "Failed to retrieve the playdate's history due to a server error. Please try again later."
+	}
+	state["Events"] = events
+	c.HTML(http.StatusOK, "pages/audit.html", state)
+}
+
+func playDateHistoryCommand(a *Api, s *discordgo.Session, i *discordgo.InteractionCreate, botContext *BotContext, id int) {
+	if !authorizeInteraction(s, i, botContext.player, PermissionManagePlayDates) {
+		return
+	}
+
+	events, err := a.playDateHistory(a.ctx, id)
+	if err != nil {
+		log.Err(err).Int("playdateID", id).Msg("failed to query for playdate history")
+		respondEphemeral(s, i, "Failed to look up the playdate's history, please try again.")
+		return
+	}
+	if len(events) == 0 {
+		respondEphemeral(s, i, fmt.Sprintf("There's no history for playdate %d.", id))
+		return
+	}
+
+	lines := []string{fmt.Sprintf("History for playdate %d:", id)}
+	if len(events) > discordHistoryLimit {
+		lines = append(lines, fmt.Sprintf("…%d older changes, see %s/admin/playdates/%d/history", len(events)-discordHistoryLimit, Config.PublicURL, id))
+		events = events[len(events)-discordHistoryLimit:]
+	}
+	for _, e := range events {
+		line := fmt.Sprintf("<t:%d:f> %s (%s) %s %s", e.CreatedDate.Unix(), e.ActorName, e.Source, e.Action, e.TargetType)
+		if changes := e.Changes(); len(changes) > 0 {
+			line += ": " + strings.Join(changes, ", ")
+		}
+		lines = append(lines, line)
+	}
+	msg := strings.Join(lines, "\n")
+	if runes := []rune(msg); len(runes) > discordMessageLimit {
+		msg = string(runes[:discordMessageLimit-1]) + "…"
+	}
+	respondEphemeral(s, i, msg)
+}
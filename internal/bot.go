@@ -1,6 +1,8 @@
 package internal
 
 import (
+	"errors"
+
 	"github.com/bwmarrin/discordgo"
 	"github.com/rs/zerolog/log"
 	"github.com/uptrace/bun"
@@ -12,13 +14,76 @@ var (
 			Name:        "idme",
 			Description: "Get your Discord User ID",
 		},
+		{
+			Name:        "playdate",
+			Description: "Manage playdates",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "cancel",
+					Description: "Cancel a playdate, moderators can cancel anyone's",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionInteger,
+							Name:        "id",
+							Description: "The playdate's id, the number at the end of its link",
+							Required:    true,
+						},
+					},
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionSubCommand,
+					Name:        "history",
+					Description: "Show every change made to a playdate and who made it (moderators only)",
+					Options: []*discordgo.ApplicationCommandOption{
+						{
+							Type:        discordgo.ApplicationCommandOptionInteger,
+							Name:        "id",
+							Description: "The playdate's id, the number at the end of its link",
+							Required:    true,
+						},
+					},
+				},
+			},
+		},
+		{
+			Name:        "role",
+			Description: "Set a player's role (admins only)",
+			Options: []*discordgo.ApplicationCommandOption{
+				{
+					Type:        discordgo.ApplicationCommandOptionUser,
+					Name:        "player",
+					Description: "Who to change",
+					Required:    true,
+				},
+				{
+					Type:        discordgo.ApplicationCommandOptionString,
+					Name:        "role",
+					Description: "Their new role",
+					Required:    true,
+					Choices: []*discordgo.ApplicationCommandOptionChoice{
+						{Name: "Member", Value: string(RoleMember)},
+						{Name: "Moderator", Value: string(RoleModerator)},
+						{Name: "Admin", Value: string(RoleAdmin)},
+					},
+				},
+			},
+		},
 	}
 
 	commandHandlers = map[string]func(s *discordgo.Session, i *discordgo.InteractionCreate, botContext *BotContext){
 		"idme": getUserId,
 	}
+
+	// NOTE: these need the api, i.e. to notify webhooks, so they're only handled once it has started
+	apiCommandHandlers = map[string]func(a *Api, s *discordgo.Session, i *discordgo.InteractionCreate, botContext *BotContext){
+		"playdate": playdateCommand,
+		"role":     roleCommand,
+	}
 )
 
+var ErrUnknownDiscordPlayer = errors.New("discord user has no player")
+
 type BotContext struct {
 	player *Player
 	db     *bun.DB
@@ -53,11 +118,50 @@ func deleteDiscordCommands(dg *discordgo.Session) error {
 	return nil
 }
 
-func InitAttendanceReactions(a *Api, msg *discordgo.Message) {
-	log.Info().Msg("Adding Reactions to playdate")
-	a.dg.MessageReactionAdd(Config.DiscordConfig.ChannelID, msg.ID, "👍")
-	a.dg.MessageReactionAdd(Config.DiscordConfig.ChannelID, msg.ID, "🤔")
-	a.dg.MessageReactionAdd(Config.DiscordConfig.ChannelID, msg.ID, "👎")
+// handleCommand dispatches the bot commands that need the api, see apiCommandHandlers.
+func (a *Api) handleCommand(s *discordgo.Session, i *discordgo.InteractionCreate) {
+	if i.Type != discordgo.InteractionApplicationCommand {
+		return
+	}
+	handler, ok := apiCommandHandlers[i.ApplicationCommandData().Name]
+	if !ok {
+		return
+	}
+	botContext := &BotContext{
+		player: extractPlayerFromDiscord(i, a.db),
+		db:     a.db,
+	}
+	if botContext.player != nil && botContext.player.Banned() {
+		respondEphemeral(s, i, "Your PlayDate account has been banned.")
+		return
+	}
+	// NOTE: commands come with the member's guild roles, so their role is kept in sync here too
+	if botContext.player != nil && i.Member != nil {
+		a.syncGuildRole(a.ctx, botContext.player, i.Member.Roles)
+	}
+	handler(a, s, i, botContext)
+}
+
+// interactionUser is whoever used the command, discord only fills in Member for commands used in a guild.
+func interactionUser(i *discordgo.InteractionCreate) *discordgo.User {
+	if i.Member != nil && i.Member.User != nil {
+		return i.Member.User
+	}
+	return i.User
+}
+
+// respondEphemeral replies to the command with a message only the person who used it can see.
+func respondEphemeral(s *discordgo.Session, i *discordgo.InteractionCreate, content string) {
+	err := s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
+		Type: discordgo.InteractionResponseChannelMessageWithSource,
+		Data: &discordgo.InteractionResponseData{
+			Content: content,
+			Flags:   discordgo.MessageFlagsEphemeral,
+		},
+	})
+	if err != nil {
+		log.Err(err).Str("command", i.ApplicationCommandData().Name).Msg("failed to respond to discord command")
+	}
 }
 
 func createDiscordBot(db *bun.DB) (dg *discordgo.Session) {
@@ -69,6 +173,9 @@ func createDiscordBot(db *bun.DB) (dg *discordgo.Session) {
 
 	log.Info().Msg("Adding Bot handlers.")
 	dg.AddHandler(func(session *discordgo.Session, interaction *discordgo.InteractionCreate) {
+		if interaction.Type != discordgo.InteractionApplicationCommand {
+			return
+		}
 		if handler, ok := commandHandlers[interaction.ApplicationCommandData().Name]; ok {
 			botContext := &BotContext{
 				player: extractPlayerFromDiscord(interaction, db),
@@ -0,0 +1,226 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// chatTestPlayDate is a playdate whose game and owner need escaping on every chat platform.
+func chatTestPlayDate() *PlayDate {
+	owner := &Player{ID: 1, Name: "<b>owner</b>"}
+	return &PlayDate{ID: 3, Game: "<Mario & Luigi>", Date: time.Now().Add(time.Hour), OwnerId: owner.ID, Owner: owner}
+}
+
+// chatRequest is what the fake chat server received.
+type chatRequest struct {
+	method        string
+	path          string
+	contentType   string
+	authorization string
+	body          []byte
+}
+
+// newChatTestServer answers every request with the status, and with the body when it's an error.
+func newChatTestServer(t *testing.T, status int, rejection string) (*httptest.Server, chan chatRequest) {
+	t.Helper()
+	requests := make(chan chatRequest, 1)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, _ := io.ReadAll(r.Body)
+		requests <- chatRequest{
+			method:        r.Method,
+			path:          r.URL.Path,
+			contentType:   r.Header.Get("Content-Type"),
+			authorization: r.Header.Get("Authorization"),
+			body:          body,
+		}
+		w.WriteHeader(status)
+		if status >= 300 {
+			w.Write([]byte(rejection))
+		}
+	}))
+	t.Cleanup(server.Close)
+	return server, requests
+}
+
+// decodeChatRequest unmarshals the request body, failing the test when it isn't json.
+func decodeChatRequest(t *testing.T, received chatRequest, v any) {
+	t.Helper()
+	if err := json.Unmarshal(received.body, v); err != nil {
+		t.Fatalf("server got a body that isn't json: %v", err)
+	}
+}
+
+// matrixTestMessage is the message a homeserver received, its mentions are decoded separately so an empty mention
+// shows up as missing rather than false.
+type matrixTestMessage struct {
+	matrixMessage
+	mentions map[string]any
+}
+
+func decodeMatrixRequest(t *testing.T, received chatRequest) matrixTestMessage {
+	t.Helper()
+	msg := matrixTestMessage{}
+	decodeChatRequest(t, received, &msg.matrixMessage)
+	var mentions struct {
+		Mentions map[string]any `json:"m.mentions"`
+	}
+	decodeChatRequest(t, received, &mentions)
+	msg.mentions = mentions.Mentions
+	return msg
+}
+
+func decodeSlackText(t *testing.T, received chatRequest) string {
+	t.Helper()
+	payload := map[string]any{}
+	decodeChatRequest(t, received, &payload)
+	if len(payload) != 1 {
+		t.Errorf("expected only the text field, got %v", payload)
+	}
+	text, _ := payload["text"].(string)
+	return text
+}
+
+func TestChatNotifiers(t *testing.T) {
+	tests := []struct {
+		name        string
+		newNotifier func(a *Api) (Notifier, error)
+		// configure points the notifier at the fake server, the config is restored when the test ends
+		configure func(t *testing.T, serverURL string)
+		// what the platform answers with when it rejects a message
+		rejectStatus int
+		rejection    string
+		announced    func(t *testing.T, received chatRequest)
+		// started gets a message for a playdate starting with an attendee named "<!channel>" and one named "c"
+		started func(t *testing.T, received chatRequest)
+	}{
+		{
+			name:        "matrix",
+			newNotifier: newMatrixNotifier,
+			configure: func(t *testing.T, serverURL string) {
+				previous := Config.MatrixConfig
+				Config.MatrixConfig = &MatrixConfig{
+					HomeserverURL: serverURL,
+					AccessToken:   "secret-token",
+					Rooms:         map[string]string{Config.DiscordConfig.GuildID: "!games:localhost", "*": "!other:localhost"},
+				}
+				t.Cleanup(func() { Config.MatrixConfig = previous })
+			},
+			rejectStatus: http.StatusForbidden,
+			rejection:    `{"errcode":"M_FORBIDDEN"}`,
+			announced: func(t *testing.T, received chatRequest) {
+				if received.method != http.MethodPut {
+					t.Errorf("expected a PUT, got %s", received.method)
+				}
+				prefix := "/_matrix/client/v3/rooms/!games:localhost/send/m.room.message/"
+				if !strings.HasPrefix(received.path, prefix) || len(received.path) == len(prefix) {
+					t.Errorf("expected a send to the guild's room with a transaction id, got %s", received.path)
+				}
+				if received.authorization != "Bearer secret-token" {
+					t.Errorf("expected the access token as a bearer token, got %q", received.authorization)
+				}
+				msg := decodeMatrixRequest(t, received)
+				if msg.MsgType != "m.notice" || msg.Format != "org.matrix.custom.html" {
+					t.Errorf("expected an html notice, got %s in %q", msg.MsgType, msg.Format)
+				}
+				for _, want := range []string{"<strong>&lt;Mario &amp; Luigi&gt;</strong>", "&lt;b&gt;owner&lt;/b&gt;", `<a href="http://localhost:8080/playdate/3">`} {
+					if !strings.Contains(msg.FormattedBody, want) {
+						t.Errorf("formatted body %q is missing %q", msg.FormattedBody, want)
+					}
+				}
+				for _, want := range []string{"<Mario & Luigi>", "<b>owner</b>", "Check it out here: http://localhost:8080/playdate/3"} {
+					if !strings.Contains(msg.Body, want) {
+						t.Errorf("plaintext body %q is missing %q", msg.Body, want)
+					}
+				}
+				if len(msg.mentions) != 0 {
+					t.Errorf("expected nobody to be mentioned, got %v", msg.mentions)
+				}
+			},
+			started: func(t *testing.T, received chatRequest) {
+				msg := decodeMatrixRequest(t, received)
+				if msg.MsgType != "m.text" || msg.mentions["room"] != true {
+					t.Errorf("expected a room mention in an m.text, got %s mentioning %v", msg.MsgType, msg.mentions)
+				}
+				if !strings.HasSuffix(msg.FormattedBody, "<br>Going: &lt;!channel&gt;, c") {
+					t.Errorf("expected escaped attendees at the end of %q", msg.FormattedBody)
+				}
+				if !strings.HasSuffix(msg.Body, "\nGoing: <!channel>, c") {
+					t.Errorf("expected attendees at the end of %q", msg.Body)
+				}
+			},
+		},
+		{
+			name:        "slack",
+			newNotifier: newSlackNotifier,
+			configure: func(t *testing.T, serverURL string) {
+				previous := Config.SlackConfig
+				Config.SlackConfig = &SlackConfig{Webhooks: map[string]string{"*": serverURL + "/hook"}}
+				t.Cleanup(func() { Config.SlackConfig = previous })
+			},
+			rejectStatus: http.StatusBadRequest,
+			rejection:    "invalid_payload",
+			announced: func(t *testing.T, received chatRequest) {
+				if received.method != http.MethodPost || received.contentType != "application/json" {
+					t.Errorf("expected a json POST, got %s with %q", received.method, received.contentType)
+				}
+				text := decodeSlackText(t, received)
+				for _, want := range []string{"*&lt;Mario &amp; Luigi&gt;*", "by &lt;b&gt;owner&lt;/b&gt;", "<http://localhost:8080/playdate/3|Check it out here>"} {
+					if !strings.Contains(text, want) {
+						t.Errorf("text %q is missing %q", text, want)
+					}
+				}
+			},
+			started: func(t *testing.T, received chatRequest) {
+				text := decodeSlackText(t, received)
+				if !strings.HasPrefix(text, "<!here> ") {
+					t.Errorf("expected %q to ping the channel", text)
+				}
+				// NOTE: a player named after a mention mustn't be able to ping anyone
+				if !strings.HasSuffix(text, "\n>Going: &lt;!channel&gt;, c") {
+					t.Errorf("expected escaped attendees at the end of %q", text)
+				}
+			},
+		},
+	}
+
+	for _, tt := range tests {
+		announce := func(t *testing.T, status int, n *Notification) (chatRequest, error) {
+			server, requests := newChatTestServer(t, status, tt.rejection)
+			tt.configure(t, server.URL)
+			notifier, err := tt.newNotifier(nil)
+			if err != nil {
+				t.Fatalf("failed to create notifier: %v", err)
+			}
+			err = notifier.Announce(context.Background(), n)
+			return <-requests, err
+		}
+
+		t.Run(tt.name+"/announces", func(t *testing.T) {
+			received, err := announce(t, http.StatusOK, &Notification{Event: NotificationPlayDateCreated, PlayDate: chatTestPlayDate()})
+			if err != nil {
+				t.Fatalf("failed to announce: %v", err)
+			}
+			tt.announced(t, received)
+		})
+		t.Run(tt.name+"/pings when starting", func(t *testing.T) {
+			attendees := []*PlayDateToPlayer{{Player: &Player{Name: "<!channel>"}}, {Player: &Player{Name: "c"}}}
+			received, err := announce(t, http.StatusOK, &Notification{Event: NotificationPlayDateStarted, PlayDate: chatTestPlayDate(), Attendees: attendees})
+			if err != nil {
+				t.Fatalf("failed to announce: %v", err)
+			}
+			tt.started(t, received)
+		})
+		t.Run(tt.name+"/reports rejection", func(t *testing.T) {
+			_, err := announce(t, tt.rejectStatus, &Notification{Event: NotificationPlayDateCancelled, PlayDate: chatTestPlayDate()})
+			if err == nil || !strings.Contains(err.Error(), tt.rejection) {
+				t.Errorf("expected the server's error, got %v", err)
+			}
+		})
+	}
+}
@@ -1,7 +1,11 @@
 package internal
 
 import (
+	"encoding/base64"
 	"os"
+	"strconv"
+	"strings"
+	"time"
 
 	"github.com/rs/zerolog/log"
 )
@@ -18,8 +22,54 @@ type DiscordConfig struct {
 	RedirectURI  string
 	AuthURL      string
 	TokenURL     string
+	RevokeURL    string
 	UserAPIURL   string
 	Scopes       string
+	// Guild membership requirements for signing in
+	UserGuildsAPIURL   string
+	RequireGuildMember bool
+	RequiredRoleID     string
+	// guild roles that grant the matching player role, leave both empty to manage roles from the site only
+	AdminRoleID     string
+	ModeratorRoleID string
+}
+
+// SMTPConfig is the mail server emails go out through, leave the host empty to not send any.
+type SMTPConfig struct {
+	Host     string
+	Port     string
+	Username string
+	Password string `json:"-"`
+	// the From address, i.e. PlayDate <playdate@example.com>
+	From string
+	// one of starttls, tls or none. none is only meant for local mail catchers like MailHog
+	TLS string
+}
+
+// MatrixConfig is the homeserver matrix announcements are posted through, as whoever the access token belongs to.
+type MatrixConfig struct {
+	// i.e. https://matrix.example.com, http works for local stand-ins
+	HomeserverURL string
+	AccessToken   string `json:"-"`
+	// room IDs announcements go to by discord guild ID, see guildChannel
+	Rooms map[string]string
+}
+
+// SlackConfig is where announcements go for slack, or anything else that takes slack's incoming webhooks.
+type SlackConfig struct {
+	// incoming webhook URLs by discord guild ID, see guildChannel. Anyone with one can post, so they're secret
+	Webhooks map[string]string `json:"-"`
+}
+
+type PasswordConfig struct {
+	MinLength int
+	// one of argon2id or bcrypt, stored hashes using anything else are upgraded the next time the player signs in
+	HashAlgorithm string
+	BcryptCost    int
+	// argon2id memory in KiB, passes over it and threads
+	Argon2Memory      uint32
+	Argon2Iterations  uint32
+	Argon2Parallelism uint8
 }
 
 type AppConfig struct {
@@ -29,7 +79,37 @@ type AppConfig struct {
 	PostgresUser      string
 	PostgresPassword  string
 	TemplateDirectory string
-	DiscordConfig     *DiscordConfig
+	// where players reach the site, used to build links sent to them over discord
+	PublicURL string
+	// one of auto, true or false. auto only marks cookies as Secure when served over https
+	CookieSecure    string
+	AdminDiscordIDs []string
+	// admins can't reach admin pages until they've enabled two-factor authentication
+	RequireAdminTOTP bool
+	// brute force protection for logins and verification codes
+	LoginAccountMaxFailures int
+	LoginIPMaxFailures      int
+	LoginFailureWindow      time.Duration
+	LoginLockout            time.Duration
+	// transports notifications go out over, see notifierFactories
+	Notifiers []string
+	// notification events announced to the whole guild, players still get the ones they asked for
+	NotifyGuildEvents []string
+	// how long before a playdate starts to remind everyone, 0 turns reminders off
+	ReminderLead time.Duration
+	// how often the scheduler reloads every playdate, in case it missed hearing about a change
+	SchedulerSweepInterval time.Duration
+	// who push services can contact about our web pushes, a mailto: or https: URL
+	VAPIDSubject string
+	// 32 byte AES-256 key used to encrypt discord tokens, the VAPID key and two-factor secrets at rest
+	TokenEncryptionKey []byte `json:"-"`
+	// 32 byte HMAC key used to sign links sent to players
+	SigningKey     []byte `json:"-"`
+	DiscordConfig  *DiscordConfig
+	PasswordConfig *PasswordConfig
+	SMTPConfig     *SMTPConfig
+	MatrixConfig   *MatrixConfig
+	SlackConfig    *SlackConfig
 }
 
 func init() {
@@ -45,6 +125,98 @@ func getOrDefault(name string, defaultValue string) string {
 	return value
 }
 
+func getIntOrDefault(name string, defaultValue int) int {
+	value, present := os.LookupEnv(name)
+	if !present {
+		return defaultValue
+	}
+	parsed, err := strconv.Atoi(value)
+	if err != nil {
+		log.Err(err).Str("name", name).Str("value", value).Msg("invalid integer in environment, using default")
+		return defaultValue
+	}
+	return parsed
+}
+
+func getBoolOrDefault(name string, defaultValue bool) bool {
+	value, present := os.LookupEnv(name)
+	if !present {
+		return defaultValue
+	}
+	parsed, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Err(err).Str("name", name).Str("value", value).Msg("invalid boolean in environment, using default")
+		return defaultValue
+	}
+	return parsed
+}
+
+// getDurationOrDefault parses values like 15m or 1h30m.
+func getDurationOrDefault(name string, defaultValue time.Duration) time.Duration {
+	value, present := os.LookupEnv(name)
+	if !present {
+		return defaultValue
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil {
+		log.Err(err).Str("name", name).Str("value", value).Msg("invalid duration in environment, using default")
+		return defaultValue
+	}
+	return parsed
+}
+
+// getKey decodes a base64 encoded 32 byte key, refusing to start when it's set to anything else. An unset key is
+// nil, see RequireKeys.
+func getKey(name string) []byte {
+	value := os.Getenv(name)
+	if value == "" {
+		return nil
+	}
+	key, err := base64.StdEncoding.DecodeString(value)
+	if err != nil || len(key) != 32 {
+		log.Panic().Err(err).Str("name", name).Int("length", len(key)).Msg("key must be 32 base64 encoded bytes, i.e. from openssl rand -base64 32")
+	}
+	return key
+}
+
+// RequireKeys refuses to start the server without its keys. A key made up on the spot would differ between servers
+// and change on every restart, breaking every link sent out and every secret stored with the old one.
+func (c *AppConfig) RequireKeys() {
+	if c.TokenEncryptionKey == nil {
+		log.Panic().Msg("TOKEN_ENCRYPTION_KEY is required, discord tokens, the VAPID key and two-factor secrets are stored encrypted with it")
+	}
+	if c.SigningKey == nil {
+		log.Panic().Msg("SIGNING_KEY is required, password reset, login and RSVP links are signed with it")
+	}
+}
+
+// getListOrDefault reads a comma separated environment variable into a slice, skipping empty entries.
+func getListOrDefault(name string, defaultValue string) []string {
+	values := []string{}
+	for _, v := range strings.Split(getOrDefault(name, defaultValue), ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			values = append(values, v)
+		}
+	}
+	return values
+}
+
+// getMapOrDefault reads a comma separated list of key=value pairs. An entry without a key is stored under "*",
+// so a single value works for every key. Keys can't have a : or / in them, that way URLs and matrix room IDs
+// with an = in them still count as a single value.
+func getMapOrDefault(name string, defaultValue string) map[string]string {
+	values := map[string]string{}
+	for _, entry := range getListOrDefault(name, defaultValue) {
+		key, value, found := strings.Cut(entry, "=")
+		if !found || strings.ContainsAny(key, ":/") {
+			key, value = "*", entry
+		}
+		values[strings.TrimSpace(key)] = strings.TrimSpace(value)
+	}
+	return values
+}
+
 func newAppConfig() *AppConfig {
 	discordConfig := &DiscordConfig{
 		APIKey:       getOrDefault("DISCORD_API_KEY", "fake-discord-api-key"),
@@ -55,8 +227,40 @@ func newAppConfig() *AppConfig {
 		RedirectURI:  getOrDefault("DISCORD_REDIRECT_URI", "http://localhost:8080/discord/callback"),
 		AuthURL:      getOrDefault("DISCORD_AUTH_URL", "https://discord.com/api/oauth2/authorize"),
 		TokenURL:     getOrDefault("DISCORD_TOKEN_URL", "https://discord.com/api/oauth2/token"),
+		RevokeURL:    getOrDefault("DISCORD_REVOKE_URL", "https://discord.com/api/oauth2/token/revoke"),
 		UserAPIURL:   getOrDefault("DISCORD_USER_API_URL", "https://discord.com/api/users/@me"),
 		Scopes:       getOrDefault("DISCORD_SCOPES", "identify"),
+
+		UserGuildsAPIURL:   getOrDefault("DISCORD_USER_GUILDS_API_URL", "https://discord.com/api/users/@me/guilds"),
+		RequireGuildMember: getBoolOrDefault("DISCORD_REQUIRE_GUILD_MEMBER", false),
+		RequiredRoleID:     getOrDefault("DISCORD_REQUIRED_ROLE_ID", ""),
+		AdminRoleID:        getOrDefault("DISCORD_ADMIN_ROLE_ID", ""),
+		ModeratorRoleID:    getOrDefault("DISCORD_MODERATOR_ROLE_ID", ""),
+	}
+	// NOTE: argon2id defaults are OWASP's minimum recommendation
+	passwordConfig := &PasswordConfig{
+		MinLength:         getIntOrDefault("PASSWORD_MIN_LENGTH", 10),
+		HashAlgorithm:     getOrDefault("PASSWORD_HASH_ALGORITHM", "argon2id"),
+		BcryptCost:        getIntOrDefault("BCRYPT_COST", 12),
+		Argon2Memory:      uint32(getIntOrDefault("ARGON2_MEMORY", 19*1024)),
+		Argon2Iterations:  uint32(getIntOrDefault("ARGON2_ITERATIONS", 2)),
+		Argon2Parallelism: uint8(getIntOrDefault("ARGON2_PARALLELISM", 1)),
+	}
+	smtpConfig := &SMTPConfig{
+		Host:     getOrDefault("SMTP_HOST", ""),
+		Port:     getOrDefault("SMTP_PORT", "587"),
+		Username: getOrDefault("SMTP_USERNAME", ""),
+		Password: getOrDefault("SMTP_PASSWORD", ""),
+		From:     getOrDefault("SMTP_FROM", "PlayDate <playdate@localhost>"),
+		TLS:      getOrDefault("SMTP_TLS", "starttls"),
+	}
+	matrixConfig := &MatrixConfig{
+		HomeserverURL: strings.TrimSuffix(getOrDefault("MATRIX_HOMESERVER_URL", ""), "/"),
+		AccessToken:   getOrDefault("MATRIX_ACCESS_TOKEN", ""),
+		Rooms:         getMapOrDefault("MATRIX_ROOMS", ""),
+	}
+	slackConfig := &SlackConfig{
+		Webhooks: getMapOrDefault("SLACK_WEBHOOKS", ""),
 	}
 	config := &AppConfig{
 		PostgresHost:      getOrDefault("POSTGRES_HOST", "localhost"),
@@ -65,7 +269,27 @@ func newAppConfig() *AppConfig {
 		PostgresUser:      getOrDefault("POSTGRES_USER", "postgres"),
 		PostgresPassword:  getOrDefault("POSTGRES_PASSWORD", "postgres"),
 		TemplateDirectory: getOrDefault("TEMPLATE_DIRECTORY", "templates/"),
-		DiscordConfig:     discordConfig,
+		PublicURL:         strings.TrimSuffix(getOrDefault("PUBLIC_URL", "http://localhost:8080"), "/"),
+		CookieSecure:      getOrDefault("COOKIE_SECURE", "auto"),
+		AdminDiscordIDs:   getListOrDefault("ADMIN_DISCORD_IDS", ""),
+		RequireAdminTOTP:  getBoolOrDefault("REQUIRE_ADMIN_TOTP", false),
+
+		LoginAccountMaxFailures: getIntOrDefault("LOGIN_ACCOUNT_MAX_FAILURES", 5),
+		LoginIPMaxFailures:      getIntOrDefault("LOGIN_IP_MAX_FAILURES", 20),
+		LoginFailureWindow:      getDurationOrDefault("LOGIN_FAILURE_WINDOW", 15*time.Minute),
+		LoginLockout:            getDurationOrDefault("LOGIN_LOCKOUT", 15*time.Minute),
+		Notifiers:               getListOrDefault("NOTIFIERS", "discord,webpush"),
+		NotifyGuildEvents:       getListOrDefault("NOTIFY_GUILD_EVENTS", "playdate.created,playdate.reminder,playdate.started,playdate.updated,playdate.cancelled"),
+		ReminderLead:            getDurationOrDefault("REMINDER_LEAD", 30*time.Minute),
+		SchedulerSweepInterval:  getDurationOrDefault("SCHEDULER_SWEEP_INTERVAL", 15*time.Minute),
+		VAPIDSubject:            getOrDefault("VAPID_SUBJECT", ""),
+		TokenEncryptionKey:      getKey("TOKEN_ENCRYPTION_KEY"),
+		SigningKey:              getKey("SIGNING_KEY"),
+		DiscordConfig:           discordConfig,
+		PasswordConfig:          passwordConfig,
+		SMTPConfig:              smtpConfig,
+		MatrixConfig:            matrixConfig,
+		SlackConfig:             slackConfig,
 	}
 	return config
 }
@@ -0,0 +1,135 @@
+package internal
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/uptrace/bun"
+)
+
+var (
+	ErrInvalidSignedToken = errors.New("link is invalid or has expired")
+	ErrTokenEncryptionKey = errors.New("TOKEN_ENCRYPTION_KEY isn't set or changed, so stored secrets can't be read")
+	ErrSigningKey         = errors.New("SIGNING_KEY isn't set, so links can't be signed")
+	ErrAlreadyUsed        = errors.New("already used")
+)
+
+// encryptSecret seals the plaintext with AES-256-GCM using the configured key. The random nonce is
+// prepended to the ciphertext and the whole thing is base64 encoded so it can live in a text column.
+func encryptSecret(plaintext string) (string, error) {
+	gcm, err := newSecretCipher()
+	if err != nil {
+		return "", err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return "", err
+	}
+	sealed := gcm.Seal(nonce, nonce, []byte(plaintext), nil)
+	return base64.StdEncoding.EncodeToString(sealed), nil
+}
+
+// decryptSecret reverses encryptSecret, failing if the ciphertext was tampered with or the key changed.
+func decryptSecret(ciphertext string) (string, error) {
+	gcm, err := newSecretCipher()
+	if err != nil {
+		return "", err
+	}
+	sealed, err := base64.StdEncoding.DecodeString(ciphertext)
+	if err != nil {
+		return "", err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return "", errors.New("ciphertext is too short")
+	}
+	nonce, sealed := sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():]
+	plaintext, err := gcm.Open(nil, nonce, sealed, nil)
+	if err != nil {
+		return "", err
+	}
+	return string(plaintext), nil
+}
+
+func newSecretCipher() (cipher.AEAD, error) {
+	if Config.TokenEncryptionKey == nil {
+		return nil, ErrTokenEncryptionKey
+	}
+	block, err := aes.NewCipher(Config.TokenEncryptionKey)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+// newSignedToken creates a "nonce.expiry.signature" token for links sent to players. The signature covers the
+// purpose too, so a token minted for one kind of link can't be replayed against another. The nonce is returned
+// separately so the caller can store it (hashed) to make the token single use.
+func newSignedToken(purpose string, ttl time.Duration) (token string, nonce string, expires time.Time, err error) {
+	if Config.SigningKey == nil {
+		return "", "", time.Time{}, ErrSigningKey
+	}
+	nonce, err = GenerateRandomState()
+	if err != nil {
+		return "", "", time.Time{}, err
+	}
+	expires = time.Now().Add(ttl)
+	payload := nonce + "." + strconv.FormatInt(expires.Unix(), 10)
+	return payload + "." + signPayload(purpose, payload), nonce, expires, nil
+}
+
+// verifySignedToken checks the token's signature and expiry, returning its nonce.
+func verifySignedToken(purpose string, token string) (string, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 || Config.SigningKey == nil {
+		return "", ErrInvalidSignedToken
+	}
+	payload := parts[0] + "." + parts[1]
+	if !hmac.Equal([]byte(parts[2]), []byte(signPayload(purpose, payload))) {
+		return "", ErrInvalidSignedToken
+	}
+	expires, err := strconv.ParseInt(parts[1], 10, 64)
+	if err != nil || time.Now().After(time.Unix(expires, 0)) {
+		return "", ErrInvalidSignedToken
+	}
+	return parts[0], nil
+}
+
+func signPayload(purpose string, payload string) string {
+	mac := hmac.New(sha256.New, Config.SigningKey)
+	mac.Write([]byte(purpose + ":" + payload))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// deleteExpired clears out the model's table before a new row goes in: the player's older rows, so only their newest
+// works, and expired rows from anyone, so the table doesn't need a sweeper of its own. playerID is zero to only clear
+// expired rows.
+func deleteExpired(ctx context.Context, db bun.IDB, model any, playerID int) error {
+	q := db.NewDelete().Model(model).WhereOr("expires_date <= ?", time.Now())
+	if playerID != 0 {
+		q = q.WhereOr("player_id = ?", playerID)
+	}
+	_, err := q.Exec(ctx)
+	return err
+}
+
+// consumeSingleUse deletes the row by its primary key, which is what makes it single use. ErrAlreadyUsed means
+// nothing was deleted, i.e. a concurrent request used it first.
+func consumeSingleUse(ctx context.Context, db bun.IDB, model any) error {
+	res, err := db.NewDelete().Model(model).WherePK().Exec(ctx)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrAlreadyUsed
+	}
+	return nil
+}
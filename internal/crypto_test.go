@@ -0,0 +1,64 @@
+package internal
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func withSigningKey(t *testing.T, key []byte) {
+	previous := Config.SigningKey
+	Config.SigningKey = key
+	t.Cleanup(func() { Config.SigningKey = previous })
+}
+
+func TestVerifySignedToken(t *testing.T) {
+	withSigningKey(t, []byte("0123456789abcdef0123456789abcdef"))
+	token, nonce, _, err := newSignedToken("login", time.Hour)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := verifySignedToken("login", token); err != nil || got != nonce {
+		t.Fatalf("expected nonce %q, got %q and %v", nonce, got, err)
+	}
+
+	parts := strings.Split(token, ".")
+	resign := func(payload string) string { return payload + "." + signPayload("login", payload) }
+	expired := parts[0] + "." + strconv.FormatInt(time.Now().Add(-time.Second).Unix(), 10)
+	tests := map[string]string{
+		"expired":            resign(expired),
+		"later expiry":       parts[0] + "." + strconv.FormatInt(time.Now().Add(24*time.Hour).Unix(), 10) + "." + parts[2],
+		"different nonce":    "someone-else." + parts[1] + "." + parts[2],
+		"different purpose":  parts[0] + "." + parts[1] + "." + signPayload("reset", parts[0]+"."+parts[1]),
+		"truncated":          parts[0] + "." + parts[1] + "." + parts[2][:len(parts[2])-1],
+		"missing signature":  parts[0] + "." + parts[1],
+		"extra part":         token + ".more",
+		"unparseable expiry": resign(parts[0] + ".soon"),
+		"empty":              "",
+	}
+	for name, token := range tests {
+		t.Run(name, func(t *testing.T) {
+			if _, err := verifySignedToken("login", token); !errors.Is(err, ErrInvalidSignedToken) {
+				t.Errorf("expected %v, got %v", ErrInvalidSignedToken, err)
+			}
+		})
+	}
+
+	t.Run("other signing key", func(t *testing.T) {
+		withSigningKey(t, []byte("fedcba9876543210fedcba9876543210"))
+		if _, err := verifySignedToken("login", token); !errors.Is(err, ErrInvalidSignedToken) {
+			t.Errorf("expected %v, got %v", ErrInvalidSignedToken, err)
+		}
+	})
+	t.Run("no signing key", func(t *testing.T) {
+		withSigningKey(t, nil)
+		if _, err := verifySignedToken("login", token); !errors.Is(err, ErrInvalidSignedToken) {
+			t.Errorf("expected %v, got %v", ErrInvalidSignedToken, err)
+		}
+		if _, _, _, err := newSignedToken("login", time.Hour); !errors.Is(err, ErrSigningKey) {
+			t.Errorf("expected %v, got %v", ErrSigningKey, err)
+		}
+	})
+}
@@ -0,0 +1,143 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/uptrace/bun"
+)
+
+// attendanceReactions are added to announced playdates, reacting with one sets the player's attendance.
+var attendanceReactions = []string{"👍", "🤔", "👎"}
+
+// discordNotifier announces to the configured channel and sends players DMs through the bot. Messages go through
+// the outbox, see discordoutbox.go, so an outage or rate limit only delays them.
+type discordNotifier struct {
+	a         *Api
+	db        bun.IDB
+	channelID string
+}
+
+func newDiscordNotifier(a *Api) (Notifier, error) {
+	return &discordNotifier{a: a, db: a.db, channelID: Config.DiscordConfig.ChannelID}, nil
+}
+
+func (d *discordNotifier) WithTx(tx bun.IDB) Notifier {
+	return &discordNotifier{a: d.a, db: tx, channelID: d.channelID}
+}
+
+func (d *discordNotifier) Committed() {
+	d.a.kickDiscordOutbox()
+}
+
+// queue adds the message to the outbox, waking up the worker unless it's part of a transaction that hasn't
+// committed yet, notify wakes it up once it has.
+func (d *discordNotifier) queue(ctx context.Context, msg *DiscordOutboxMessage) error {
+	if err := queueDiscordMessage(ctx, d.db, msg); err != nil {
+		return err
+	}
+	if _, inTx := d.db.(bun.Tx); !inTx {
+		d.a.kickDiscordOutbox()
+	}
+	return nil
+}
+
+func (d *discordNotifier) Name() string {
+	return "discord"
+}
+
+// discordTimestamp is shown by discord in the reader's own timezone, see
+// https://discord.com/developers/docs/reference#message-formatting-timestamp-styles for the styles.
+func discordTimestamp(t time.Time, style string) string {
+	return fmt.Sprintf("<t:%d:%s>", t.Unix(), style)
+}
+
+// mentionAttendees pings everyone going to the playdate who wants to hear about it starting.
+func mentionAttendees(n *Notification) string {
+	mentions := ""
+	for _, attendance := range n.Attendees {
+		if attendance.Player.wantsNotification(NotificationPlayDateStarted) {
+			mentions += fmt.Sprintf("<@%s>", attendance.Player.DiscordID)
+		}
+	}
+	return mentions
+}
+
+// NOTE: setPlayDateAttendenceFromDisc finds the playdate from the link at the end of the message, so anything
+// reacted to has to end with it.
+func (d *discordNotifier) Announce(ctx context.Context, n *Notification) error {
+	playdate := n.PlayDate
+	var msg string
+	switch n.Event {
+	case NotificationPlayDateCreated:
+		msg = fmt.Sprintf("Playdate %s at %s by %s! Check it out here: %s", playdate.Game, discordTimestamp(playdate.Date, "f"), playdate.Owner.Name, n.Link())
+	case NotificationPlayDateReminder:
+		msg = fmt.Sprintf("Playdate %s created by <@%s> starts %s! %s\n%s", playdate.Game, playdate.Owner.DiscordID, discordTimestamp(playdate.Date, "R"), n.Link(), mentionAttendees(n))
+	case NotificationPlayDateStarted:
+		msg = fmt.Sprintf("Playdate %s created by <@%s> is happening now! Make sure to join :video_game:!\n%s", playdate.Game, playdate.Owner.DiscordID, mentionAttendees(n))
+	case NotificationPlayDateUpdated:
+		if n.Previous != nil && n.Previous.OwnerId != playdate.OwnerId {
+			msg = fmt.Sprintf("Playdate %s at %s now belongs to <@%s>. Check it out here: %s", playdate.Game, discordTimestamp(playdate.Date, "f"), playdate.Owner.DiscordID, n.Link())
+		} else {
+			msg = fmt.Sprintf("Playdate %s is now at %s, changed by %s. Check it out here: %s", playdate.Game, discordTimestamp(playdate.Date, "f"), n.ActorName(), n.Link())
+		}
+	case NotificationPlayDateCancelled:
+		msg = fmt.Sprintf("Playdate %s at %s was cancelled by %s.", playdate.Game, discordTimestamp(playdate.Date, "f"), n.ActorName())
+	case NotificationAttendanceChanged:
+		msg = fmt.Sprintf("%s said %s to playdate %s at %s. Check it out here: %s", n.ActorName(), n.Attending, playdate.Game, discordTimestamp(playdate.Date, "f"), n.Link())
+	default:
+		return nil
+	}
+
+	return d.queue(ctx, &DiscordOutboxMessage{
+		Kind:         DiscordMessageChannel,
+		Target:       d.channelID,
+		Content:      msg,
+		AddReactions: n.Event == NotificationPlayDateCreated,
+		PlayDateID:   playdate.ID,
+	})
+}
+
+func (d *discordNotifier) Send(ctx context.Context, player *Player, n *Notification) error {
+	playdate := n.PlayDate
+	var msg string
+	switch n.Event {
+	case NotificationPlayDateReminder:
+		if n.Announced {
+			return nil // they were already mentioned in the channel
+		}
+		msg = fmt.Sprintf("Playdate %s you're going to starts %s: %s", playdate.Game, discordTimestamp(playdate.Date, "R"), n.Link())
+	case NotificationPlayDateStarted:
+		if n.Announced {
+			return nil
+		}
+		msg = fmt.Sprintf("Playdate %s you're going to is happening now! Make sure to join :video_game:: %s", playdate.Game, n.Link())
+	case NotificationPlayDateUpdated:
+		if n.Previous != nil && n.Previous.OwnerId != playdate.OwnerId {
+			msg = fmt.Sprintf("Playdate %s you're going to now belongs to %s: %s", playdate.Game, playdate.Owner.Name, n.Link())
+		} else {
+			msg = fmt.Sprintf("Playdate %s you're going to is now at %s, changed by %s: %s", playdate.Game, discordTimestamp(playdate.Date, "f"), n.ActorName(), n.Link())
+		}
+	case NotificationPlayDateCancelled:
+		msg = fmt.Sprintf("Playdate %s you were going to at %s was cancelled by %s.", playdate.Game, discordTimestamp(playdate.Date, "f"), n.ActorName())
+	default:
+		return nil
+	}
+	if player.DiscordID == "" {
+		return nil
+	}
+	return d.queue(ctx, &DiscordOutboxMessage{Kind: DiscordMessageDirect, Target: player.DiscordID, Content: msg, PlayDateID: playdate.ID})
+}
+
+// sendDiscordDirectMessage DMs the discord user through the bot right away, for messages like sign in codes that
+// are no use late.
+func sendDiscordDirectMessage(dg *discordgo.Session, discordID string, msg string) error {
+	channel, err := dg.UserChannelCreate(discordID)
+	if err != nil {
+		return fmt.Errorf("failed to create private channel: %w", err)
+	}
+	_, err = dg.ChannelMessageSend(channel.ID, msg)
+	return err
+}
@@ -2,17 +2,19 @@ package internal
 
 import (
 	"bytes"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
 	"encoding/json"
 	"fmt"
 	"io"
 	"net/http"
 	"net/url"
-	"sync"
+	"time"
 
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
 	"github.com/rs/zerolog/log"
-	"golang.org/x/crypto/bcrypt"
 )
 
 // TokenResponse represents the structure of the JSON response from Discord's token endpoint
@@ -33,13 +35,26 @@ type DiscordUser struct {
 	Email         string `json:"email"` // Only present if 'email' scope is requested
 }
 
-// In-memory storage for OAuth2 states. In a production application,
-// this should be a secure, persistent storage (e.g., database, secure session store)
-// associated with the user's session to prevent CSRF attacks.
-var oauthStates = make(map[string]bool)
-var mu sync.Mutex // Mutex to protect access to oauthStates
+const (
+	// short lived cookie tying an oauth state to the browser that started the login
+	oauthCookieName     = "playdate_oauth"
+	oauthStateTTL       = 10 * time.Minute
+	oauthSweepInterval  = 5 * time.Minute
+	pkceChallengeMethod = "S256"
+)
+
+// newPKCEVerifier creates a code verifier and its S256 challenge, see https://datatracker.ietf.org/doc/html/rfc7636#section-4.1
+func newPKCEVerifier() (verifier string, challenge string, err error) {
+	b := make([]byte, 32)
+	if _, err := rand.Read(b); err != nil {
+		return "", "", err
+	}
+	verifier = base64.RawURLEncoding.EncodeToString(b)
+	sum := sha256.Sum256([]byte(verifier))
+	return verifier, base64.RawURLEncoding.EncodeToString(sum[:]), nil
+}
 
-func DiscordOAuthLogin(a *Api) (string, error) {
+func DiscordOAuthLogin(c *gin.Context, a *Api) (string, error) {
 	// Generate a cryptographically secure random state string for CSRF protection
 	state, err := GenerateRandomState()
 	if err != nil {
@@ -47,18 +62,40 @@ func DiscordOAuthLogin(a *Api) (string, error) {
 		log.Err(err).Msg("error generating state.")
 		return "", err
 	}
+	binding, err := GenerateRandomState()
+	if err != nil {
+		log.Err(err).Msg("error generating pre-auth cookie.")
+		return "", err
+	}
+	verifier, challenge, err := newPKCEVerifier()
+	if err != nil {
+		log.Err(err).Msg("error generating pkce verifier.")
+		return "", err
+	}
 
-	mu.Lock()
-	oauthStates[state] = true
-	mu.Unlock()
+	// NOTE: states live in postgres so they survive restarts and work no matter which replica gets the callback
+	oauthState := &OAuthState{
+		State:        state,
+		BindingHash:  hashSessionToken(binding),
+		CodeVerifier: verifier,
+		ExpiresDate:  time.Now().Add(oauthStateTTL),
+	}
+	_, err = a.db.NewInsert().Model(oauthState).Exec(c.Request.Context())
+	if err != nil {
+		log.Err(err).Msg("failed to store oauth state")
+		return "", err
+	}
+	setCookie(c, oauthCookieName, binding, int(oauthStateTTL.Seconds()), true)
 
 	params := url.Values{}
 	params.Add("client_id", Config.DiscordConfig.ClientID)
 	params.Add("redirect_uri", Config.DiscordConfig.RedirectURI)
-	params.Add("response_type", "code")              // For Authorization Code Grant flow
-	params.Add("scope", Config.DiscordConfig.Scopes) // Requested permissions
-	params.Add("state", state)                       // CSRF protection
-	params.Add("prompt", "none")                     // if already authorized skip the screen if a user selects oauth again
+	params.Add("response_type", "code")     // For Authorization Code Grant flow
+	params.Add("scope", oauthScopes())      // Requested permissions
+	params.Add("state", state)              // CSRF protection
+	params.Add("code_challenge", challenge) // PKCE
+	params.Add("code_challenge_method", pkceChallengeMethod)
+	params.Add("prompt", "none") // if already authorized skip the screen if a user selects oauth again
 
 	// create proper authorization redirection url
 	// https://discord.com/developers/docs/topics/oauth2#authorization-code-grant-authorization-url-example
@@ -84,20 +121,28 @@ func DiscordOAuthCallback(c *gin.Context, a *Api) (*Player, error) {
 		return nil, fmt.Errorf("authorization code missing from callback")
 	}
 
-	mu.Lock()
-	stateValid := oauthStates[state]
-	delete(oauthStates, state)
-	mu.Unlock()
-
-	// Validate the 'state' parameter to prevent CSRF attacks
+	// consume the state so it can only ever be used once
+	oauthState := &OAuthState{}
+	_, err := a.db.NewDelete().
+		Model(oauthState).
+		Where("state = ?", state).
+		Where("expires_date > ?", time.Now()).
+		Returning("*").
+		Exec(c.Request.Context())
+	binding, _ := c.Cookie(oauthCookieName)
+	setCookie(c, oauthCookieName, "", -1, true)
+
+	// Validate the 'state' parameter to prevent CSRF attacks, it must also have been started in this browser
+	stateValid := err == nil && oauthState.State != "" && binding != "" &&
+		subtle.ConstantTimeCompare([]byte(oauthState.BindingHash), []byte(hashSessionToken(binding))) == 1
 	if !stateValid {
 		c.String(http.StatusUnauthorized, "Invalid or missing state parameter. Possible CSRF attack.")
-		log.Error().Str("state", state).Msg("Invalid or missing state parameter")
+		log.Error().Err(err).Str("state", state).Bool("hasCookie", binding != "").Msg("Invalid or missing state parameter")
 		return nil, fmt.Errorf("invalid or missing state parameter")
 	}
-	log.Info().Str("code", code).Msg("Received authorization code")
+	log.Info().Msg("Received authorization code")
 
-	tokenResponse, err := exchangeCodeForToken(code)
+	tokenResponse, err := exchangeCodeForToken(code, oauthState.CodeVerifier)
 	if err != nil {
 		log.Err(err).Msg("Error exchanging code for token")
 		return nil, err
@@ -113,33 +158,37 @@ func DiscordOAuthCallback(c *gin.Context, a *Api) (*Player, error) {
 	}
 	log.Info().Any("discordUser", discordUser).Msg("successfully grad discord user information")
 
-	sessionId, err := GenerateRandomState()
+	err = checkOAuthGuildMembership(tokenResponse)
 	if err != nil {
-		log.Err(err).Msg("failed to generate random state")
+		log.Err(err).Str("discordID", discordUser.ID).Msg("rejected discord login from outside the guild")
+		a.forbidden(c, guildMembershipMessage(err))
 		return nil, err
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(state), bcrypt.DefaultCost)
+	// NOTE: a player who is already signed in gets the discord account linked to them
+	session, err := a.findSessionFromCookie(c)
 	if err != nil {
-		log.Err(err).Msg("failed to hash fake user password for discord oauth workflow")
+		session = nil
+	}
+	player, err := a.resolveOAuthPlayer(c.Request.Context(), discordUser, session)
+	if err != nil {
+		c.String(http.StatusInternalServerError, "Failed to set up your player, please try again.")
+		log.Err(err).Str("discordID", discordUser.ID).Msg("failed to create or link player from discord oauth workflow")
 		return nil, err
 	}
-	player := &Player{
-		Name:             discordUser.Username,
-		Password:         string(hashedPassword),
-		DiscordID:        discordUser.ID,
-		VerificationCode: uuid.NewString(),
-		OAuthToken:       tokenResponse.AccessToken,
-		SessionId:        sessionId,
-	}
-	_, err = a.db.NewInsert().
-		Model(player).
-		On("CONFLICT (discord_id) DO UPDATE").
-		Set("oauth_token = EXCLUDED.oauth_token").
-		Set("session_id = EXCLUDED.session_id").
-		Exec(a.ctx)
+
+	// NOTE: the avatar is only shown on the profile, failing to keep it up to date shouldn't stop the login
+	if player.DiscordAvatar != discordUser.Avatar {
+		player.DiscordAvatar = discordUser.Avatar
+		_, err = a.db.NewUpdate().Model(player).Column("discord_avatar").WherePK().Exec(c.Request.Context())
+		if err != nil {
+			log.Err(err).Int("playerID", player.ID).Msg("failed to save discord avatar")
+		}
+	}
+
+	err = a.saveDiscordCredential(a.ctx, player.ID, tokenResponse)
 	if err != nil {
-		log.Err(err).Msg("failed to create or update user from discord oauth workflow")
+		log.Err(err).Int("playerID", player.ID).Msg("failed to store discord oauth credential")
 		return nil, err
 	}
 	log.Info().Any("player", player).Msg("successfully completed the oauth2 discord login and create/update the user information")
@@ -148,7 +197,7 @@ func DiscordOAuthCallback(c *gin.Context, a *Api) (*Player, error) {
 }
 
 // exchangeCodeForToken makes a POST request to Discord's token endpoint.
-func exchangeCodeForToken(code string) (*TokenResponse, error) {
+func exchangeCodeForToken(code string, codeVerifier string) (*TokenResponse, error) {
 	// Prepare the request body as application/x-www-form-urlencoded
 	data := url.Values{}
 	data.Add("client_id", Config.DiscordConfig.ClientID)
@@ -156,6 +205,7 @@ func exchangeCodeForToken(code string) (*TokenResponse, error) {
 	data.Add("grant_type", "authorization_code")
 	data.Add("code", code)
 	data.Add("redirect_uri", Config.DiscordConfig.RedirectURI)
+	data.Add("code_verifier", codeVerifier)
 
 	req, err := http.NewRequest(http.MethodPost, Config.DiscordConfig.TokenURL, bytes.NewBufferString(data.Encode()))
 	if err != nil {
@@ -213,3 +263,25 @@ func fetchDiscordUserInfo(accessToken, tokenType string) (*DiscordUser, error) {
 
 	return &discordUser, nil
 }
+
+// oauthStateSweeper deletes states for logins that were abandoned part way through.
+func (a *Api) oauthStateSweeper() {
+	ticker := time.NewTicker(oauthSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-ticker.C:
+			res, err := a.db.NewDelete().Model((*OAuthState)(nil)).Where("expires_date <= ?", time.Now()).Exec(a.ctx)
+			if err != nil {
+				log.Err(err).Msg("failed to sweep expired oauth states")
+				continue
+			}
+			if n, _ := res.RowsAffected(); n > 0 {
+				log.Info().Int64("states", n).Msg("swept expired oauth states")
+			}
+		}
+	}
+}
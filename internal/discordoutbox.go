@@ -0,0 +1,280 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"github.com/uptrace/bun"
+)
+
+const (
+	discordOutboxMaxAttempts  = 8
+	discordOutboxBaseBackoff  = 15 * time.Second
+	discordOutboxPollInterval = 5 * time.Second
+	discordOutboxBatchSize    = 50
+	// how long a claimed batch belongs to the server sending it, after that another server picks up what's left
+	// in case this one went down mid batch
+	discordOutboxLease = 10 * time.Minute
+	adminOutboxLimit   = 50
+)
+
+// discordOutboxBackoff returns how long to wait before the next attempt, doubling each time.
+func discordOutboxBackoff(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+	return discordOutboxBaseBackoff * time.Duration(1<<(attempts-1))
+}
+
+// queueDiscordMessage adds the message to the outbox. Pass the transaction making the change the message is
+// about, that way it's only sent if the change commits and can't be lost if we crash right after.
+func queueDiscordMessage(ctx context.Context, db bun.IDB, msg *DiscordOutboxMessage) error {
+	msg.Status = DiscordOutboxStatusPending
+	msg.NextAttemptDate = time.Now()
+	_, err := db.NewInsert().Model(msg).Exec(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to queue discord message: %w", err)
+	}
+	return nil
+}
+
+// kickDiscordOutbox wakes up the worker without waiting for the next poll.
+func (a *Api) kickDiscordOutbox() {
+	select {
+	case a.discordOutbox <- struct{}{}:
+	default:
+	}
+}
+
+func (a *Api) discordOutboxWorker() {
+	log.Info().Msg("Sending discord messages..")
+	ticker := time.NewTicker(discordOutboxPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-ticker.C:
+		case <-a.discordOutbox:
+		}
+		a.sendPendingDiscordMessages()
+	}
+}
+
+// sendPendingDiscordMessages sends what's due oldest first, so messages about a playdate arrive in order.
+func (a *Api) sendPendingDiscordMessages() {
+	messages, err := a.claimDiscordMessages(a.ctx)
+	if err != nil {
+		log.Err(err).Msg("failed to claim pending discord messages")
+		return
+	}
+
+	for i, msg := range messages {
+		if limited := a.sendDiscordOutboxMessage(msg); limited {
+			// NOTE: the rest would most likely hit the same limit, they go out once it's lifted
+			a.releaseDiscordMessages(messages[i+1:], msg.NextAttemptDate)
+			return
+		}
+	}
+}
+
+// claimDiscordMessages takes the batch that's due by leasing it, pushing its next attempt past the time it takes
+// to send. Other servers skip rows being claimed and won't see the leased ones as due, so nothing is sent twice.
+func (a *Api) claimDiscordMessages(ctx context.Context) ([]*DiscordOutboxMessage, error) {
+	messages := []*DiscordOutboxMessage{}
+	err := a.db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		err := tx.NewSelect().
+			Model(&messages).
+			Where("status = ?", DiscordOutboxStatusPending).
+			Where("next_attempt_date <= ?", time.Now()).
+			Order("next_attempt_date asc", "id asc").
+			Limit(discordOutboxBatchSize).
+			For("UPDATE SKIP LOCKED").
+			Scan(ctx)
+		if err != nil || len(messages) == 0 {
+			return err
+		}
+		ids := make([]int, 0, len(messages))
+		for _, msg := range messages {
+			ids = append(ids, msg.ID)
+		}
+		_, err = tx.NewUpdate().
+			Model((*DiscordOutboxMessage)(nil)).
+			Set("next_attempt_date = ?", time.Now().Add(discordOutboxLease)).
+			Where("id IN (?)", bun.In(ids)).
+			Exec(ctx)
+		return err
+	})
+	return messages, err
+}
+
+// releaseDiscordMessages hands back claimed messages that weren't attempted, due again at the given time.
+func (a *Api) releaseDiscordMessages(messages []*DiscordOutboxMessage, due time.Time) {
+	if len(messages) == 0 {
+		return
+	}
+	ids := make([]int, 0, len(messages))
+	for _, msg := range messages {
+		ids = append(ids, msg.ID)
+	}
+	_, err := a.db.NewUpdate().
+		Model((*DiscordOutboxMessage)(nil)).
+		Set("next_attempt_date = ?", due).
+		Where("id IN (?)", bun.In(ids)).
+		Exec(a.ctx)
+	if err != nil {
+		log.Err(err).Ints("outboxIDs", ids).Msg("failed to release claimed discord messages, they go out once the lease is up")
+	}
+}
+
+// sendDiscordOutboxMessage makes a single attempt at sending the message and records the outcome, scheduling
+// another attempt with exponential backoff until discordOutboxMaxAttempts is reached. Reports whether discord
+// rate limited us.
+func (a *Api) sendDiscordOutboxMessage(msg *DiscordOutboxMessage) bool {
+	msg.Attempts++
+	messageID, err := a.postDiscordMessage(msg)
+
+	var rateLimit *discordgo.RateLimitError
+	var restErr *discordgo.RESTError
+	limited := false
+	switch {
+	case err == nil:
+		msg.Status = DiscordOutboxStatusSent
+		msg.MessageID = messageID
+		msg.SentDate = time.Now()
+		msg.LastError = ""
+		log.Info().Int("outboxID", msg.ID).Any("kind", msg.Kind).Msg("sent discord message")
+	case errors.As(err, &rateLimit):
+		// NOTE: being rate limited isn't the message's fault, so it doesn't use up an attempt
+		limited = true
+		msg.Attempts--
+		msg.LastError = err.Error()
+		msg.NextAttemptDate = time.Now().Add(rateLimit.RetryAfter)
+		log.Warn().Err(err).Int("outboxID", msg.ID).Time("nextAttempt", msg.NextAttemptDate).Msg("discord rate limited us, waiting it out")
+	case errors.As(err, &restErr) && permanentDiscordError(restErr), msg.Attempts >= discordOutboxMaxAttempts:
+		msg.Status = DiscordOutboxStatusDead
+		msg.LastError = err.Error()
+		log.Err(err).Int("outboxID", msg.ID).Int("attempts", msg.Attempts).Msg("giving up on discord message")
+		a.recordFailure(FailureSourceNotifier, fmt.Sprintf("gave up on discord message %d to %s %s after %d attempts", msg.ID, msg.Kind, msg.Target, msg.Attempts), err)
+	default:
+		msg.LastError = err.Error()
+		msg.NextAttemptDate = time.Now().Add(discordOutboxBackoff(msg.Attempts))
+		log.Warn().Err(err).Int("outboxID", msg.ID).Int("attempts", msg.Attempts).Time("nextAttempt", msg.NextAttemptDate).Msg("discord message failed, retrying later")
+	}
+
+	_, err = a.db.NewUpdate().
+		Model(msg).
+		Column("status", "attempts", "next_attempt_date", "last_error", "message_id", "sent_date").
+		WherePK().
+		Exec(a.ctx)
+	if err != nil {
+		log.Err(err).Int("outboxID", msg.ID).Msg("failed to update discord outbox message")
+	}
+	return limited
+}
+
+// permanentDiscordError reports whether discord refused the message in a way trying again won't fix, i.e. a
+// player who doesn't accept DMs or a channel that's gone.
+func permanentDiscordError(err *discordgo.RESTError) bool {
+	if err.Response == nil {
+		return false
+	}
+	switch err.Response.StatusCode {
+	case http.StatusBadRequest, http.StatusForbidden, http.StatusNotFound:
+		return true
+	default:
+		return false
+	}
+}
+
+// postDiscordMessage sends the message, returning discord's ID for it.
+func (a *Api) postDiscordMessage(msg *DiscordOutboxMessage) (string, error) {
+	// NOTE: discordgo already waits on the rate limit buckets from discord's headers, this only stops it from
+	// sleeping through a 429 so the worker can reschedule instead
+	noRetry := discordgo.WithRetryOnRatelimit(false)
+	channelID := msg.Target
+	if msg.Kind == DiscordMessageDirect {
+		channel, err := a.dg.UserChannelCreate(msg.Target, noRetry)
+		if err != nil {
+			return "", fmt.Errorf("failed to create private channel: %w", err)
+		}
+		channelID = channel.ID
+	}
+	sent, err := a.dg.ChannelMessageSend(channelID, msg.Content, noRetry)
+	if err != nil {
+		return "", err
+	}
+	if msg.AddReactions {
+		log.Info().Int("playdateID", msg.PlayDateID).Msg("Adding Reactions to playdate")
+		for _, reaction := range attendanceReactions {
+			if err := a.dg.MessageReactionAdd(channelID, sent.ID, reaction); err != nil {
+				log.Err(err).Str("reaction", reaction).Int("playdateID", msg.PlayDateID).Msg("failed to add attendance reaction")
+			}
+		}
+	}
+	return sent.ID, nil
+}
+
+// adminOutboxState lists the discord messages that aren't getting through, dead ones and ones still being retried.
+func (a *Api) adminOutboxState(c *gin.Context) gin.H {
+	state := gin.H{"Errors": map[string]string{}}
+
+	messages := []*DiscordOutboxMessage{}
+	err := a.db.NewSelect().
+		Model(&messages).
+		WhereOr("status = ?", DiscordOutboxStatusDead).
+		WhereOr("status = ? AND attempts > 0", DiscordOutboxStatusPending).
+		Order("created_date desc").
+		Limit(adminOutboxLimit).
+		Scan(c.Request.Context())
+	if err != nil {
+		log.Err(err).Msg("failed to query for stuck discord messages")
+		state["ServerError"] = "Failed to retrieve stuck discord messages due to a server error. Please try again later."
+	}
+	state["Messages"] = messages
+	return state
+}
+
+func (a *Api) getAdminOutboxTemplate(c *gin.Context) {
+	c.HTML(http.StatusOK, "partials/admin-outbox.html", a.adminOutboxState(c))
+}
+
+// adminRetryDiscordMessage sends a stuck message again right away.
+func (a *Api) adminRetryDiscordMessage(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		log.Err(err).Str("outboxID", c.Param("id")).Msg("failed to parse given discord outbox id")
+		c.Redirect(http.StatusFound, "/admin")
+		return
+	}
+
+	// NOTE: a manual retry starts the retry schedule over again
+	_, err = a.db.NewUpdate().
+		Model((*DiscordOutboxMessage)(nil)).
+		Set("status = ?", DiscordOutboxStatusPending).
+		Set("attempts = 0").
+		Set("next_attempt_date = ?", time.Now()).
+		Where("id = ?", id).
+		Where("status != ?", DiscordOutboxStatusSent).
+		Exec(c.Request.Context())
+	if err != nil {
+		log.Err(err).Int("outboxID", id).Msg("failed to reset discord outbox message")
+	} else {
+		log.Info().Int("outboxID", id).Msg("manually retrying discord message")
+		a.kickDiscordOutbox()
+	}
+
+	state := a.adminOutboxState(c)
+	if err != nil {
+		state["ServerError"] = err.Error()
+	}
+	c.HTML(http.StatusOK, "partials/admin-outbox.html", state)
+}
@@ -0,0 +1,220 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"github.com/uptrace/bun"
+)
+
+// refresh tokens a little early so a request never goes out with a token that expires mid flight
+const discordTokenExpiryLeeway = time.Minute
+
+var ErrNoDiscordCredential = errors.New("player has not connected their discord account")
+
+// DiscordTokenSource hands out a valid access token for a player, transparently refreshing it before it expires.
+type DiscordTokenSource struct {
+	db       *bun.DB
+	playerID int
+}
+
+func (a *Api) discordTokenSource(playerID int) *DiscordTokenSource {
+	return &DiscordTokenSource{db: a.db, playerID: playerID}
+}
+
+// Token returns the decrypted access token and its type (i.e. Bearer).
+func (s *DiscordTokenSource) Token(ctx context.Context) (string, string, error) {
+	var accessToken, tokenType string
+	// NOTE: the row is locked while refreshing since discord rotates refresh tokens, two refreshes racing
+	// each other would leave us holding a dead refresh token
+	err := s.db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		credential := &PlayerOAuthCredential{}
+		err := tx.NewSelect().Model(credential).Where("player_id = ?", s.playerID).For("UPDATE").Scan(ctx)
+		if errors.Is(err, sql.ErrNoRows) {
+			return ErrNoDiscordCredential
+		}
+		if err != nil {
+			return err
+		}
+
+		if time.Now().Add(discordTokenExpiryLeeway).Before(credential.ExpiresDate) {
+			accessToken, err = decryptSecret(credential.AccessToken)
+			tokenType = credential.TokenType
+			return err
+		}
+
+		log.Info().Int("playerID", s.playerID).Msg("refreshing discord access token")
+		refreshToken, err := decryptSecret(credential.RefreshToken)
+		if err != nil {
+			return err
+		}
+		tokenResponse, err := refreshDiscordToken(refreshToken)
+		if err != nil {
+			return err
+		}
+		if err := updateDiscordCredential(credential, tokenResponse); err != nil {
+			return err
+		}
+		_, err = tx.NewUpdate().Model(credential).WherePK().Exec(ctx)
+		accessToken, tokenType = tokenResponse.AccessToken, tokenResponse.TokenType
+		return err
+	})
+	if err != nil {
+		return "", "", err
+	}
+	return accessToken, tokenType, nil
+}
+
+// updateDiscordCredential encrypts a fresh token response onto the credential.
+func updateDiscordCredential(credential *PlayerOAuthCredential, tokenResponse *TokenResponse) error {
+	accessToken, err := encryptSecret(tokenResponse.AccessToken)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt access token: %w", err)
+	}
+	refreshToken, err := encryptSecret(tokenResponse.RefreshToken)
+	if err != nil {
+		return fmt.Errorf("failed to encrypt refresh token: %w", err)
+	}
+	credential.AccessToken = accessToken
+	credential.RefreshToken = refreshToken
+	credential.TokenType = tokenResponse.TokenType
+	credential.Scopes = tokenResponse.Scope
+	credential.ExpiresDate = time.Now().Add(time.Duration(tokenResponse.ExpiresIn) * time.Second)
+	credential.UpdatedDate = time.Now()
+	return nil
+}
+
+// saveDiscordCredential stores the tokens from a completed oauth login, replacing any the player already had.
+func (a *Api) saveDiscordCredential(ctx context.Context, playerID int, tokenResponse *TokenResponse) error {
+	credential := &PlayerOAuthCredential{PlayerID: playerID}
+	if err := updateDiscordCredential(credential, tokenResponse); err != nil {
+		return err
+	}
+	_, err := a.db.NewInsert().
+		Model(credential).
+		On("CONFLICT (player_id) DO UPDATE").
+		Set("access_token = EXCLUDED.access_token").
+		Set("refresh_token = EXCLUDED.refresh_token").
+		Set("token_type = EXCLUDED.token_type").
+		Set("scopes = EXCLUDED.scopes").
+		Set("expires_date = EXCLUDED.expires_date").
+		Set("updated_date = EXCLUDED.updated_date").
+		Exec(ctx)
+	return err
+}
+
+// refreshDiscordToken trades a refresh token for a new set of tokens.
+func refreshDiscordToken(refreshToken string) (*TokenResponse, error) {
+	data := url.Values{}
+	data.Add("client_id", Config.DiscordConfig.ClientID)
+	data.Add("client_secret", Config.DiscordConfig.ClientSecret)
+	data.Add("grant_type", "refresh_token")
+	data.Add("refresh_token", refreshToken)
+
+	resp, err := postDiscordForm(Config.DiscordConfig.TokenURL, data)
+	if err != nil {
+		return nil, fmt.Errorf("failed to send refresh request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return nil, fmt.Errorf("token refresh failed with status %d: %s", resp.StatusCode, string(bodyBytes))
+	}
+
+	var tokenResp TokenResponse
+	if err := json.NewDecoder(resp.Body).Decode(&tokenResp); err != nil {
+		return nil, fmt.Errorf("failed to decode refresh response: %w", err)
+	}
+	return &tokenResp, nil
+}
+
+// revokeDiscordToken tells discord to invalidate a token, see https://discord.com/developers/docs/topics/oauth2#authorization-code-grant-token-revocation-example
+func revokeDiscordToken(token string, tokenTypeHint string) error {
+	data := url.Values{}
+	data.Add("client_id", Config.DiscordConfig.ClientID)
+	data.Add("client_secret", Config.DiscordConfig.ClientSecret)
+	data.Add("token", token)
+	data.Add("token_type_hint", tokenTypeHint)
+
+	resp, err := postDiscordForm(Config.DiscordConfig.RevokeURL, data)
+	if err != nil {
+		return fmt.Errorf("failed to send revoke request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("token revocation failed with status %d: %s", resp.StatusCode, string(bodyBytes))
+	}
+	return nil
+}
+
+func postDiscordForm(endpoint string, data url.Values) (*http.Response, error) {
+	req, err := http.NewRequest(http.MethodPost, endpoint, bytes.NewBufferString(data.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	return client.Do(req)
+}
+
+// revokeDiscordCredential revokes the player's tokens with discord and forgets them.
+func (a *Api) revokeDiscordCredential(ctx context.Context, playerID int) error {
+	credential := &PlayerOAuthCredential{}
+	err := a.db.NewSelect().Model(credential).Where("player_id = ?", playerID).Scan(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	// NOTE: a failed revocation is only logged, the tokens get deleted on our end regardless
+	if refreshToken, err := decryptSecret(credential.RefreshToken); err == nil {
+		if err := revokeDiscordToken(refreshToken, "refresh_token"); err != nil {
+			log.Err(err).Int("playerID", playerID).Msg("failed to revoke discord refresh token")
+		}
+	}
+	if accessToken, err := decryptSecret(credential.AccessToken); err == nil {
+		if err := revokeDiscordToken(accessToken, "access_token"); err != nil {
+			log.Err(err).Int("playerID", playerID).Msg("failed to revoke discord access token")
+		}
+	}
+
+	_, err = a.db.NewDelete().Model(credential).WherePK().Exec(ctx)
+	return err
+}
+
+func (a *Api) disconnectDiscord(c *gin.Context) {
+	session, err := a.findSessionFromCookie(c)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+
+	err = a.revokeDiscordCredential(c.Request.Context(), session.PlayerID)
+	if err != nil {
+		log.Err(err).Int("playerID", session.PlayerID).Msg("failed to disconnect discord")
+	} else {
+		log.Info().Int("playerID", session.PlayerID).Msg("disconnected discord")
+	}
+
+	state := a.profileState(c, session)
+	if err != nil {
+		state["ServerError"] = err.Error()
+	}
+	c.HTML(http.StatusOK, "partials/profile.html", state)
+}
@@ -0,0 +1,200 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"github.com/uptrace/bun"
+)
+
+const (
+	emailVerificationPurpose = "email-verification"
+	emailVerificationTTL     = 24 * time.Hour
+)
+
+// validEmail reports whether the input is a bare email address, without a display name.
+func validEmail(input string) bool {
+	address, err := mail.ParseAddress(input)
+	return err == nil && address.Name == "" && address.Address == input
+}
+
+// addEmail sends a verification link to the address the player typed in, it only becomes theirs once they
+// open it.
+func (a *Api) addEmail(c *gin.Context) {
+	session, err := a.findSessionFromCookie(c)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+	player := session.Player
+	email := strings.TrimSpace(c.PostForm("email"))
+
+	state := a.profileState(c, session)
+	errors := map[string]string{}
+	state["Errors"] = errors
+	state["EmailInput"] = email
+	if !emailEnabled() {
+		state["ServerError"] = ErrEmailDisabled.Error()
+		c.HTML(http.StatusOK, "partials/profile.html", state)
+		return
+	}
+	if !validEmail(email) {
+		errors["email"] = "email must look like you@example.com"
+	} else if strings.EqualFold(email, player.Email) {
+		errors["email"] = "that's already your email"
+	}
+	if len(errors) > 0 {
+		c.HTML(http.StatusOK, "partials/profile.html", state)
+		return
+	}
+
+	token, nonce, expires, err := newSignedToken(emailVerificationPurpose, emailVerificationTTL)
+	if err != nil {
+		log.Err(err).Int("playerID", player.ID).Msg("failed to create email verification token")
+		state["ServerError"] = "Not your fault, server is cooked. Try again?"
+		c.HTML(http.StatusOK, "partials/profile.html", state)
+		return
+	}
+	err = a.db.RunInTx(c.Request.Context(), nil, func(ctx context.Context, tx bun.Tx) error {
+		err := deleteExpired(ctx, tx, (*EmailVerification)(nil), player.ID)
+		if err != nil {
+			return err
+		}
+		verification := &EmailVerification{NonceHash: hashSessionToken(nonce), PlayerID: player.ID, Email: email, ExpiresDate: expires}
+		_, err = tx.NewInsert().Model(verification).Exec(ctx)
+		return err
+	})
+	if err != nil {
+		log.Err(err).Int("playerID", player.ID).Msg("failed to store email verification")
+		state["ServerError"] = "Not your fault, server is cooked. Try again?"
+		c.HTML(http.StatusOK, "partials/profile.html", state)
+		return
+	}
+
+	link := fmt.Sprintf("%s/me/email/verify?token=%s", Config.PublicURL, url.QueryEscape(token))
+	msg, err := a.renderEmail(email, emailContent{
+		Subject: "Verify your PlayDate email",
+		Heading: fmt.Sprintf("Is this you, %s?", player.Name),
+		Lines: []string{
+			fmt.Sprintf("Open this link within the next %s to get PlayDate emails at this address.", emailVerificationTTL),
+			"If you didn't add this address to PlayDate, you can ignore this email.",
+		},
+		Action: &emailLink{Label: "Verify Email", URL: link},
+	})
+	if err == nil {
+		err = sendEmail(msg)
+	}
+	if err != nil {
+		log.Err(err).Int("playerID", player.ID).Msg("failed to send email verification")
+		state["ServerError"] = "Failed to send the verification email, check the address and try again."
+		c.HTML(http.StatusOK, "partials/profile.html", state)
+		return
+	}
+	log.Info().Int("playerID", player.ID).Msg("sent email verification")
+
+	state["PendingEmail"] = email
+	state["EmailSent"] = true
+	c.HTML(http.StatusOK, "partials/profile.html", state)
+}
+
+// verifyEmail uses up the verification link and makes the address the player's email.
+func (a *Api) verifyEmail(c *gin.Context) {
+	state := gin.H{"Heading": "That link didn't work", "Alert": "warning", "Link": "/me"}
+	nonce, err := verifySignedToken(emailVerificationPurpose, c.Query("token"))
+	if err != nil {
+		state["Message"] = err.Error()
+		c.HTML(http.StatusForbidden, "pages/notice.html", state)
+		return
+	}
+
+	player := &Player{}
+	err = a.db.RunInTx(c.Request.Context(), nil, func(ctx context.Context, tx bun.Tx) error {
+		verification := &EmailVerification{}
+		_, err := tx.NewDelete().
+			Model(verification).
+			Where("nonce_hash = ?", hashSessionToken(nonce)).
+			Where("expires_date > ?", time.Now()).
+			Returning("*").
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+		if verification.PlayerID == 0 {
+			return ErrInvalidSignedToken
+		}
+
+		player.ID = verification.PlayerID
+		if err := tx.NewSelect().Model(player).WherePK().For("UPDATE").Scan(ctx); err != nil {
+			return err
+		}
+		before := player.auditSnapshot()
+		player.Email = verification.Email
+		player.EmailVerifiedDate = time.Now()
+		_, err = tx.NewUpdate().Model(player).Column("email", "email_verified_date").WherePK().Exec(ctx)
+		if err != nil {
+			return err
+		}
+		return recordAudit(ctx, tx, AuditActor{Player: player, Source: AuditSourceWeb}, before, player.auditSnapshot())
+	})
+	if isUniqueViolation(err, "player_email_key") {
+		state["Message"] = "That email already belongs to another player."
+		c.HTML(http.StatusConflict, "pages/notice.html", state)
+		return
+	}
+	if err != nil {
+		log.Err(err).Msg("failed to verify email")
+		state["Message"] = ErrInvalidSignedToken.Error()
+		c.HTML(http.StatusForbidden, "pages/notice.html", state)
+		return
+	}
+	log.Info().Int("playerID", player.ID).Msg("player verified their email")
+
+	state["Alert"] = "success"
+	state["Heading"] = "Email verified!"
+	state["Message"] = fmt.Sprintf("PlayDate emails will go to %s from now on, pick which ones from your profile.", player.Email)
+	c.HTML(http.StatusOK, "pages/notice.html", state)
+}
+
+// removeEmail forgets the player's email, along with any address still waiting on verification.
+func (a *Api) removeEmail(c *gin.Context) {
+	session, err := a.findSessionFromCookie(c)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+	player := session.Player
+
+	before := player.auditSnapshot()
+	updated := *player
+	updated.Email = ""
+	updated.EmailVerifiedDate = time.Time{}
+	err = a.db.RunInTx(c.Request.Context(), nil, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewDelete().Model((*EmailVerification)(nil)).Where("player_id = ?", player.ID).Exec(ctx)
+		if err != nil {
+			return err
+		}
+		_, err = tx.NewUpdate().Model(&updated).Column("email", "email_verified_date").WherePK().Exec(ctx)
+		if err != nil {
+			return err
+		}
+		return recordAudit(ctx, tx, AuditActor{Player: &updated, Source: AuditSourceWeb}, before, updated.auditSnapshot())
+	})
+	if err != nil {
+		log.Err(err).Int("playerID", player.ID).Msg("failed to remove email")
+		state := a.profileState(c, session)
+		state["ServerError"] = "Failed to remove your email, please try again."
+		c.HTML(http.StatusOK, "partials/profile.html", state)
+		return
+	}
+	log.Info().Int("playerID", player.ID).Msg("player removed their email")
+
+	*player = updated
+	c.HTML(http.StatusOK, "partials/profile.html", a.profileState(c, session))
+}
@@ -0,0 +1,281 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// emailLink is a button or link in an email.
+type emailLink struct {
+	Label string
+	URL   string
+}
+
+// emailContent is what an email says, rendered into both its HTML and plaintext bodies.
+type emailContent struct {
+	Subject string
+	Heading string
+	Lines   []string
+	Action  *emailLink
+	// signed RSVP links, for emails about a playdate the player can still answer
+	RSVP []emailLink
+}
+
+func (e emailContent) text() string {
+	var buf strings.Builder
+	buf.WriteString(e.Heading + "\n\n")
+	for _, line := range e.Lines {
+		buf.WriteString(line + "\n\n")
+	}
+	for _, link := range e.RSVP {
+		fmt.Fprintf(&buf, "%s: %s\n", link.Label, link.URL)
+	}
+	if len(e.RSVP) > 0 {
+		buf.WriteString("\n")
+	}
+	if e.Action != nil {
+		fmt.Fprintf(&buf, "%s: %s\n", e.Action.Label, e.Action.URL)
+	}
+	return buf.String()
+}
+
+// renderEmail turns the content into an email to the given address.
+func (a *Api) renderEmail(to string, content emailContent, attachments ...emailAttachment) (*emailMessage, error) {
+	html, err := a.renderTemplate("emails/message.html", content)
+	if err != nil {
+		return nil, err
+	}
+	return &emailMessage{To: to, Subject: content.Subject, Text: content.text(), HTML: html, Attachments: attachments}, nil
+}
+
+// rsvpPurpose ties an RSVP link to the player, playdate and answer it was made for, so it can't be changed into
+// a different one.
+func rsvpPurpose(playerID int, playdateID int, attending Attendance) string {
+	return fmt.Sprintf("rsvp:%d:%d:%s", playerID, playdateID, attending)
+}
+
+// rsvpLinks are signed links that answer the playdate for the player without signing in, they work until the playdate
+// starts.
+func rsvpLinks(player *Player, playdate *PlayDate) []emailLink {
+	ttl := time.Until(playdate.Date)
+	if ttl <= 0 {
+		return nil
+	}
+	links := []emailLink{}
+	for _, answer := range []struct {
+		label     string
+		attending Attendance
+	}{
+		{"👍 I'm in", AttendanceYes},
+		{"🤔 Maybe", AttendanceMaybe},
+		{"👎 Can't make it", AttendanceNo},
+	} {
+		token, _, _, err := newSignedToken(rsvpPurpose(player.ID, playdate.ID, answer.attending), ttl)
+		if err != nil {
+			log.Err(err).Int("playerID", player.ID).Int("playdateID", playdate.ID).Msg("failed to sign rsvp link")
+			return nil
+		}
+		links = append(links, emailLink{
+			Label: answer.label,
+			URL:   fmt.Sprintf("%s/rsvp/%d/%s?player=%d&token=%s", Config.PublicURL, playdate.ID, answer.attending, player.ID, url.QueryEscape(token)),
+		})
+	}
+	return links
+}
+
+// emailNotifier emails players with a verified address. New playdates go to everyone who asked for them, the
+// rest only to the players going.
+type emailNotifier struct {
+	a *Api
+}
+
+func newEmailNotifier(a *Api) (Notifier, error) {
+	if !emailEnabled() {
+		return nil, errors.New("SMTP_HOST isn't set")
+	}
+	return &emailNotifier{a: a}, nil
+}
+
+func (e *emailNotifier) Name() string {
+	return "email"
+}
+
+func (e *emailNotifier) Announce(ctx context.Context, n *Notification) error {
+	if n.Event != NotificationPlayDateCreated {
+		return nil
+	}
+	players := []*Player{}
+	err := e.a.db.NewSelect().
+		Model(&players).
+		Where("email_verified_date IS NOT NULL").
+		Where("notify_created").
+		Where("banned_date IS NULL").
+		Where("deleted_date IS NULL").
+		Scan(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to find players to email: %w", err)
+	}
+	errs := []error{}
+	for _, player := range players {
+		if n.Actor != nil && player.ID == n.Actor.ID {
+			continue
+		}
+		if err := e.send(player, n); err != nil {
+			errs = append(errs, fmt.Errorf("player %d: %w", player.ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func (e *emailNotifier) Send(ctx context.Context, player *Player, n *Notification) error {
+	switch n.Event {
+	case NotificationPlayDateReminder, NotificationPlayDateUpdated, NotificationPlayDateCancelled:
+		return e.send(player, n)
+	default:
+		return nil
+	}
+}
+
+func (e *emailNotifier) send(player *Player, n *Notification) error {
+	if player.Email == "" || player.EmailVerifiedDate.IsZero() {
+		return nil
+	}
+	playdate := n.PlayDate
+	display := player.TimeDisplay()
+	when := display.Format(playdate.Date) + " " + playdate.Date.In(display.Location).Format("MST")
+
+	content := emailContent{Action: &emailLink{Label: "Open PlayDate", URL: n.Link()}}
+	switch n.Event {
+	case NotificationPlayDateCreated:
+		content.Subject = fmt.Sprintf("New playdate: %s", playdate.Game)
+		content.Heading = fmt.Sprintf("%s on %s", playdate.Game, when)
+		content.Lines = []string{fmt.Sprintf("%s is getting a game of %s going on %s. Are you in?", playdate.Owner.Name, playdate.Game, when)}
+	case NotificationPlayDateReminder:
+		content.Subject = fmt.Sprintf("Reminder: %s starts soon", playdate.Game)
+		content.Heading = fmt.Sprintf("%s starts soon", playdate.Game)
+		content.Lines = []string{fmt.Sprintf("%s by %s starts on %s. Still coming?", playdate.Game, playdate.Owner.Name, when)}
+	case NotificationPlayDateUpdated:
+		content.Subject = fmt.Sprintf("Changed: %s", playdate.Game)
+		content.Heading = fmt.Sprintf("%s changed", playdate.Game)
+		if n.Previous != nil && n.Previous.OwnerId != playdate.OwnerId {
+			content.Lines = []string{fmt.Sprintf("%s on %s now belongs to %s.", playdate.Game, when, playdate.Owner.Name)}
+		} else {
+			content.Lines = []string{fmt.Sprintf("%s changed the playdate, it's now %s on %s. Still coming?", n.ActorName(), playdate.Game, when)}
+		}
+	case NotificationPlayDateCancelled:
+		content.Subject = fmt.Sprintf("Cancelled: %s", playdate.Game)
+		content.Heading = fmt.Sprintf("%s is cancelled", playdate.Game)
+		content.Lines = []string{fmt.Sprintf("%s cancelled %s on %s.", n.ActorName(), playdate.Game, when)}
+	default:
+		return nil
+	}
+	if playdate.Status == PlayDateStatusPending {
+		content.RSVP = rsvpLinks(player, playdate)
+	}
+	content.Lines = append(content.Lines, "You're getting this because of your notification settings on PlayDate, change them from your profile.")
+
+	msg, err := e.a.renderEmail(player.Email, content, emailAttachment{
+		Filename:    "playdate.ics",
+		ContentType: "text/calendar; charset=utf-8; method=PUBLISH",
+		Data:        playDateCalendar(playdate),
+	})
+	if err != nil {
+		return err
+	}
+	return sendEmail(msg)
+}
+
+// findRSVP checks a signed RSVP link and loads what it answers. When the link can't be used it returns nil along
+// with the status and notice explaining why.
+func (a *Api) findRSVP(c *gin.Context, playerParam string, token string) (*Player, *PlayDate, Attendance, int, gin.H) {
+	state := gin.H{"Heading": "That link didn't work", "Alert": "warning"}
+	playdateID, err := strconv.Atoi(c.Param("id"))
+	playerID, playerErr := strconv.Atoi(playerParam)
+	attending := Attendance(c.Param("attending"))
+	if err != nil || playerErr != nil || (attending != AttendanceYes && attending != AttendanceMaybe && attending != AttendanceNo) {
+		state["Message"] = ErrInvalidSignedToken.Error()
+		return nil, nil, attending, http.StatusNotFound, state
+	}
+	if _, err := verifySignedToken(rsvpPurpose(playerID, playdateID, attending), token); err != nil {
+		log.Warn().Int("playerID", playerID).Int("playdateID", playdateID).Msg("rejected rsvp with an invalid link")
+		state["Message"] = "The link is invalid or the playdate already started."
+		return nil, nil, attending, http.StatusForbidden, state
+	}
+
+	player := &Player{ID: playerID}
+	err = a.db.NewSelect().Model(player).WherePK().Scan(c.Request.Context())
+	if err != nil || player.Banned() || player.Deleted() {
+		log.Err(err).Int("playerID", playerID).Msg("rejected rsvp for a player who can't answer")
+		state["Message"] = "Your account can't answer playdates right now."
+		return nil, nil, attending, http.StatusForbidden, state
+	}
+	playdate := &PlayDate{ID: playdateID}
+	err = a.db.NewSelect().Model(playdate).Relation("Owner").WherePK().Scan(c.Request.Context())
+	if err != nil {
+		log.Err(err).Int("playdateID", playdateID).Msg("failed to find playdate to rsvp to")
+		state["Message"] = "That playdate doesn't exist anymore."
+		return nil, nil, attending, http.StatusNotFound, state
+	}
+	if playdate.Status != PlayDateStatusPending {
+		state["Message"] = "This playdate already happened or was cancelled, it can't be answered anymore."
+		return nil, nil, attending, http.StatusOK, state
+	}
+	return player, playdate, attending, http.StatusOK, nil
+}
+
+// confirmRSVPFromEmail shows what a signed RSVP link would answer. Mail scanners and link previews open every link
+// in an email, so only the button on this page saves the answer.
+func (a *Api) confirmRSVPFromEmail(c *gin.Context) {
+	player, playdate, attending, status, notice := a.findRSVP(c, c.Query("player"), c.Query("token"))
+	if notice != nil {
+		c.HTML(status, "pages/notice.html", notice)
+		return
+	}
+	c.HTML(http.StatusOK, "pages/rsvp.html", gin.H{
+		"Confirm":   true,
+		"PlayDate":  playdate,
+		"PlayerID":  player.ID,
+		"Attending": attending,
+		"Token":     c.Query("token"),
+		"When":      player.TimeDisplay().Format(playdate.Date),
+	})
+}
+
+// rsvpFromEmail answers a playdate for the player named in a signed RSVP link, no sign in needed.
+func (a *Api) rsvpFromEmail(c *gin.Context) {
+	player, playdate, attending, _, notice := a.findRSVP(c, c.PostForm("player"), c.PostForm("token"))
+	if notice != nil {
+		c.HTML(http.StatusOK, "partials/rsvp.html", notice)
+		return
+	}
+
+	state := gin.H{}
+	err := a.setAttendance(c.Request.Context(), AuditActor{Player: player, Source: AuditSourceEmail}, playdate, player, attending)
+	if err != nil {
+		log.Err(err).Int("playdateID", playdate.ID).Int("playerID", player.ID).Msg("failed to save rsvp")
+		state["Alert"] = "warning"
+		state["Heading"] = "Something went wrong"
+		state["Message"] = "Not your fault, server is cooked. Try again?"
+		c.HTML(http.StatusOK, "partials/rsvp.html", state)
+		return
+	}
+	log.Info().Int("playdateID", playdate.ID).Int("playerID", player.ID).Any("action", attending).Msg("player answered playdate from email")
+	a.notify(Notification{Event: NotificationAttendanceChanged, PlayDate: playdate, Actor: player, Attending: attending})
+	a.kickWebhookWorker()
+	a.publishPlayDate(playdate.ID, homeRowUpdated)
+
+	state["Alert"] = "success"
+	state["Heading"] = "Got it!"
+	state["Message"] = fmt.Sprintf("You said %s to %s on %s.", attending, playdate.Game, player.TimeDisplay().Format(playdate.Date))
+	state["Link"] = fmt.Sprintf("/playdate/%d", playdate.ID)
+	c.HTML(http.StatusOK, "partials/rsvp.html", state)
+}
@@ -0,0 +1,220 @@
+package internal
+
+import (
+	"context"
+	"encoding/base64"
+	"html"
+	"html/template"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/mail"
+	"net/textproto"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+// smtpCatcher is a mail server that accepts anything and hands each message it receives to the test.
+type smtpCatcher struct {
+	listener net.Listener
+	messages chan []byte
+}
+
+func newSMTPCatcher(t *testing.T) *smtpCatcher {
+	t.Helper()
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("failed to listen: %v", err)
+	}
+	s := &smtpCatcher{listener: listener, messages: make(chan []byte, 1)}
+	t.Cleanup(func() { listener.Close() })
+	go s.serve()
+	return s
+}
+
+func (s *smtpCatcher) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *smtpCatcher) handle(conn net.Conn) {
+	defer conn.Close()
+	tp := textproto.NewConn(conn)
+	tp.PrintfLine("220 localhost ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		switch command := strings.ToUpper(strings.Fields(line + " ")[0]); command {
+		case "EHLO", "HELO", "MAIL", "RCPT", "RSET", "NOOP":
+			tp.PrintfLine("250 OK")
+		case "DATA":
+			tp.PrintfLine("354 go ahead")
+			data, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			s.messages <- data
+			tp.PrintfLine("250 queued")
+		case "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+		default:
+			tp.PrintfLine("502 %s not implemented", command)
+		}
+	}
+}
+
+func (s *smtpCatcher) port() string {
+	return strconv.Itoa(s.listener.Addr().(*net.TCPAddr).Port)
+}
+
+// emailParts splits a sent message into its plaintext and HTML bodies and its attachments by filename.
+func emailParts(t *testing.T, raw []byte) (string, string, map[string][]byte) {
+	t.Helper()
+	msg, err := mail.ReadMessage(strings.NewReader(string(raw)))
+	if err != nil {
+		t.Fatalf("failed to parse message: %v", err)
+	}
+	mediaType, params, err := mime.ParseMediaType(msg.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/mixed" {
+		t.Fatalf("expected multipart/mixed, got %q (%v)", mediaType, err)
+	}
+
+	var text, body string
+	attachments := map[string][]byte{}
+	mixed := multipart.NewReader(msg.Body, params["boundary"])
+	for {
+		part, err := mixed.NextPart()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatalf("failed to read part: %v", err)
+		}
+		mediaType, params, _ := mime.ParseMediaType(part.Header.Get("Content-Type"))
+		if mediaType == "multipart/alternative" {
+			alternative := multipart.NewReader(part, params["boundary"])
+			for {
+				inner, err := alternative.NextPart()
+				if err == io.EOF {
+					break
+				}
+				if err != nil {
+					t.Fatalf("failed to read alternative part: %v", err)
+				}
+				// NOTE: the multipart reader already undoes the quoted-printable encoding
+				content, _ := io.ReadAll(inner)
+				innerType, _, _ := mime.ParseMediaType(inner.Header.Get("Content-Type"))
+				switch innerType {
+				case "text/plain":
+					text = string(content)
+				case "text/html":
+					body = string(content)
+				}
+			}
+			continue
+		}
+		encoded, _ := io.ReadAll(part)
+		data, err := base64.StdEncoding.DecodeString(strings.ReplaceAll(string(encoded), "\r\n", ""))
+		if err != nil {
+			t.Fatalf("attachment %q isn't base64: %v", part.FileName(), err)
+		}
+		attachments[part.FileName()] = data
+	}
+	return text, body, attachments
+}
+
+func TestEmailNotifierSendsReminder(t *testing.T) {
+	catcher := newSMTPCatcher(t)
+	previous := Config.SMTPConfig
+	Config.SMTPConfig = &SMTPConfig{Host: "127.0.0.1", Port: catcher.port(), From: "PlayDate <playdate@localhost>", TLS: "none"}
+	previousKey := Config.SigningKey
+	Config.SigningKey = make([]byte, 32)
+	t.Cleanup(func() { Config.SMTPConfig, Config.SigningKey = previous, previousKey })
+
+	api := &Api{templates: template.Must(template.New("").Funcs(templateFuncs).ParseGlob("../templates/**/*.html"))}
+	notifier, err := newEmailNotifier(api)
+	if err != nil {
+		t.Fatalf("failed to create notifier: %v", err)
+	}
+
+	owner := &Player{ID: 1, Name: "owner"}
+	player := &Player{ID: 7, Name: "player", Email: "player@example.com", EmailVerifiedDate: time.Now(), Timezone: "America/New_York"}
+	playdate := &PlayDate{
+		ID:          42,
+		Game:        "Deep Rock, Galactic",
+		Date:        time.Now().Add(2 * time.Hour),
+		Status:      PlayDateStatusPending,
+		OwnerId:     owner.ID,
+		Owner:       owner,
+		CreatedDate: time.Now().Add(-time.Hour),
+	}
+	err = notifier.Send(context.Background(), player, &Notification{Event: NotificationPlayDateReminder, PlayDate: playdate})
+	if err != nil {
+		t.Fatalf("failed to send: %v", err)
+	}
+
+	var raw []byte
+	select {
+	case raw = <-catcher.messages:
+	case <-time.After(5 * time.Second):
+		t.Fatal("mail server never received the message")
+	}
+	text, body, attachments := emailParts(t, raw)
+
+	if !strings.Contains(text, "Deep Rock, Galactic starts soon") {
+		t.Errorf("plaintext body is missing the heading:\n%s", text)
+	}
+	if !strings.Contains(body, "<html") || !strings.Contains(body, "Deep Rock, Galactic starts soon") {
+		t.Errorf("html body is missing the heading:\n%s", body)
+	}
+
+	calendar, ok := attachments["playdate.ics"]
+	if !ok {
+		t.Fatalf("expected a playdate.ics attachment, got %v", attachments)
+	}
+	for _, want := range []string{"BEGIN:VCALENDAR", "UID:playdate-42@", `SUMMARY:PlayDate: Deep Rock\, Galactic`, "STATUS:CONFIRMED"} {
+		if !strings.Contains(string(calendar), want) {
+			t.Errorf("calendar is missing %q:\n%s", want, calendar)
+		}
+	}
+
+	links := regexp.MustCompile(`\S+/rsvp/(\d+)/(\w+)\?player=(\d+)&token=(\S+)`).FindAllStringSubmatch(text, -1)
+	if len(links) != 3 {
+		t.Fatalf("expected three rsvp links in the plaintext body, got %d:\n%s", len(links), text)
+	}
+	unescaped := html.UnescapeString(body)
+	for _, link := range links {
+		if !strings.Contains(unescaped, link[0]) {
+			t.Errorf("html body is missing rsvp link %s", link[0])
+		}
+		playdateID, _ := strconv.Atoi(link[1])
+		playerID, _ := strconv.Atoi(link[3])
+		token, err := url.QueryUnescape(link[4])
+		if err != nil {
+			t.Fatalf("rsvp token isn't query escaped: %v", err)
+		}
+		if _, err := verifySignedToken(rsvpPurpose(playerID, playdateID, Attendance(link[2])), token); err != nil {
+			t.Errorf("rsvp link %s doesn't verify: %v", link[0], err)
+		}
+		if playdateID != playdate.ID || playerID != player.ID {
+			t.Errorf("rsvp link %s is for the wrong player or playdate", link[0])
+		}
+		// NOTE: the token must only answer what the link says
+		if _, err := verifySignedToken(rsvpPurpose(playerID+1, playdateID, Attendance(link[2])), token); err == nil {
+			t.Errorf("rsvp link %s verified for another player", link[0])
+		}
+	}
+}
@@ -5,32 +5,42 @@ import (
 	"encoding/json"
 	"errors"
 	"fmt"
+	"html/template"
 	"io"
 	"net/http"
-	"regexp"
 	"strconv"
 	"strings"
-	"text/template"
 	"time"
 
 	"github.com/bwmarrin/discordgo"
 	"github.com/gin-contrib/logger"
 	"github.com/gin-gonic/gin"
-	"github.com/google/uuid"
+	"github.com/go-webauthn/webauthn/webauthn"
 	"github.com/rs/zerolog"
 	"github.com/rs/zerolog/log"
 	"github.com/uptrace/bun"
-	"golang.org/x/crypto/bcrypt"
 )
 
 var (
 	// NOTE: This is just a const for the entire server to provide easy access to convert timestamps into EST.
-	// This would be better on the client as their browser could convert the timestamp to their local timezone.
+	// Players see their own timezone from their profile, discord shows each reader their own.
 	easternLocation, _ = time.LoadLocation("America/New_York")
+
+	templateFuncs = template.FuncMap{
+		"formatTime":   FormatTime,
+		"relativeTime": RelativeTime,
+	}
 )
 
 func StartAPI(db *bun.DB, dg *discordgo.Session) {
-	api := Api{db: db, dg: dg, ctx: context.Background()}
+	api := Api{db: db, dg: dg, ctx: context.Background(), webhooks: make(chan struct{}, 1), discordOutbox: make(chan struct{}, 1), events: newSSEBroker(), logins: newLoginGuard()}
+
+	webAuthn, err := newWebAuthn()
+	if err != nil {
+		log.Panic().Err(err).Msg("failed to configure webauthn")
+	}
+	api.webauthn = webAuthn
+	api.notifications = newNotificationDispatcher(&api)
 
 	router := gin.New()        // NOTE: Not using Default to avoid the wrong logger being used?
 	router.Use(gin.Recovery()) // handle panics (aka unhandled exceptions)
@@ -43,26 +53,65 @@ func StartAPI(db *bun.DB, dg *discordgo.Session) {
 		logger.WithClientErrorLevel(zerolog.WarnLevel),  // Level for 4xx errors
 		logger.WithServerErrorLevel(zerolog.ErrorLevel), // Level for 5xx errors
 	))
+	router.Use(api.CSRFMiddleware())
 
 	// custom template functions
-	router.SetFuncMap(template.FuncMap{
-		"formatTime":   FormatTime,
-		"relativeTime": RelativeTime,
-	})
+	router.SetFuncMap(templateFuncs)
 
 	// Template Endpoints
 	router.LoadHTMLGlob(fmt.Sprintf("%s/**/*.html", Config.TemplateDirectory))
+	// NOTE: a second copy of the templates for rendering fragments outside of a request (i.e. server sent events)
+	api.templates = template.Must(template.New("").Funcs(templateFuncs).ParseGlob(fmt.Sprintf("%s/**/*.html", Config.TemplateDirectory)))
 	router.StaticFile("custom-colors.css", fmt.Sprintf("%s/custom-colors.css", Config.TemplateDirectory))
+	router.StaticFile("passkeys.js", fmt.Sprintf("%s/passkeys.js", Config.TemplateDirectory))
+	router.StaticFile("push.js", fmt.Sprintf("%s/push.js", Config.TemplateDirectory))
+	router.StaticFile("sw.js", fmt.Sprintf("%s/sw.js", Config.TemplateDirectory))
+	router.StaticFile("sse.js", fmt.Sprintf("%s/sse.js", Config.TemplateDirectory))
 
 	// NOTE: Login/Registration Routes
 	router.GET("/", api.index)
 	router.POST("/login", api.userLogin)
 	router.DELETE("/logout", api.userLogout)
 	router.POST("/register", api.registerUserTemplate)
-	router.POST("/verify", api.verifyPlayer)
 	// Navigate around?
 	router.GET("/register", api.goToRegisterUser)
 	router.GET("/login", api.goToLogin)
+	// NOTE: Passwordless Login Routes
+	router.GET("/login/link", api.goToLoginLink)
+	router.POST("/login/link", api.requestLoginLink)
+	router.GET("/login/link/open", api.openLoginLink)
+	router.POST("/login/code", api.submitLoginCode)
+	router.POST("/login/passkey/begin", api.beginPasskeyLogin)
+	router.POST("/login/passkey/finish", api.finishPasskeyLogin)
+	router.POST("/login/totp", api.submitTOTPLogin)
+	// NOTE: Password Reset Routes
+	router.GET("/forgot", api.goToForgotPassword)
+	router.POST("/forgot", api.requestPasswordReset)
+	router.GET("/reset", api.getPasswordResetTemplate)
+	router.POST("/reset", api.resetPassword)
+
+	// NOTE: Profile Routes
+	router.GET("/me", api.getProfileTemplate)
+	router.DELETE("/me/sessions/:id", api.revokeSession)
+	router.DELETE("/me/discord", api.disconnectDiscord)
+	router.POST("/me/settings", api.updateSettings)
+	router.POST("/me/email", api.addEmail)
+	router.GET("/me/email/verify", api.verifyEmail)
+	router.DELETE("/me/email", api.removeEmail)
+	router.POST("/me/push", api.subscribePush)
+	router.POST("/me/push/test", api.testPush)
+	router.DELETE("/me/push/:id", api.unsubscribePush)
+	router.GET("/me/export", api.exportMyData)
+	router.POST("/me/delete", api.deleteMyAccount)
+	router.POST("/me/password", api.setPassword)
+	router.POST("/me/merge", api.confirmAccountMerge)
+	router.DELETE("/me/merge", api.cancelAccountMerge)
+	router.POST("/me/passkeys/begin", api.beginPasskeyRegistration)
+	router.POST("/me/passkeys/finish", api.finishPasskeyRegistration)
+	router.DELETE("/me/passkeys/:id", api.deletePasskey)
+	router.POST("/me/totp", api.beginTOTPEnrolment)
+	router.POST("/me/totp/confirm", api.confirmTOTPEnrolment)
+	router.POST("/me/totp/disable", api.disableTOTP)
 
 	// NOTE: Discord OAuth Routes
 	router.GET("/discord/login", api.handleOAuthLogin)
@@ -75,17 +124,55 @@ func StartAPI(db *bun.DB, dg *discordgo.Session) {
 	router.GET("/playdate", api.showPlayDateForm)
 	router.POST("/playdate", api.createPlayDateTemplate)
 	router.GET("/playdate/:id", api.getPlayDateTemplate)
+	router.POST("/playdate/:id", api.updatePlayDate)
+	router.GET("/playdate/:id/edit", api.getEditPlayDateTemplate)
+	router.POST("/playdate/:id/cancel", api.cancelPlayDateTemplate)
+	router.DELETE("/playdate/:id/players", api.removePlayDateAttendee)
 	router.POST("/playdate/:id/yes", api.setPlayDateAttendence)
 	router.POST("/playdate/:id/maybe", api.setPlayDateAttendence)
 	router.POST("/playdate/:id/no", api.setPlayDateAttendence)
+	router.GET("/playdate/:id/events", api.streamPlayDateEvents)
+	router.GET("/rsvp/:id/:attending", api.confirmRSVPFromEmail)
+	router.POST("/rsvp/:id/:attending", api.rsvpFromEmail)
+	router.GET("/events", api.streamHomeEvents)
+
+	// NOTE: Admin Routes
+	admin := router.Group("/admin", api.requirePermission(PermissionManagePlayers))
+	admin.GET("", api.getAdminTemplate)
+	admin.GET("/players", api.getAdminPlayersTemplate)
+	admin.POST("/players/:id/logout", api.adminLogoutPlayer)
+	admin.POST("/players/:id/ban", api.adminBanPlayer)
+	admin.DELETE("/players/:id/ban", api.adminUnbanPlayer)
+	admin.POST("/players/:id/name", api.adminRenamePlayer)
+	admin.GET("/players/:id/export", api.adminExportPlayer)
+	admin.POST("/players/:id/delete", api.adminDeletePlayer)
+	admin.GET("/playdates", api.getAdminPlayDatesTemplate)
+	admin.POST("/playdates/cancel", api.adminCancelPlayDates)
+	admin.POST("/playdates/delete", api.adminDeletePlayDates)
+	admin.GET("/playdates/:id/history", api.getPlayDateHistoryTemplate)
+	admin.GET("/failures", api.getAdminFailuresTemplate)
+	admin.GET("/outbox", api.getAdminOutboxTemplate)
+	admin.POST("/outbox/:id/retry", api.adminRetryDiscordMessage)
+	webhooks := admin.Group("/webhooks", api.requirePermission(PermissionManageSettings))
+	webhooks.GET("", api.getWebhooksTemplate)
+	webhooks.POST("", api.createWebhookTemplate)
+	webhooks.DELETE("/:id", api.deleteWebhook)
+	webhooks.POST("/deliveries/:id/redeliver", api.redeliverWebhook)
 
 	// Start discord handlers
 	dg.AddHandler(func(s *discordgo.Session, r *discordgo.MessageReactionAdd) {
 		api.setPlayDateAttendenceFromDisc(r.MessageReaction)
 	})
+	dg.AddHandler(func(s *discordgo.Session, i *discordgo.InteractionCreate) {
+		api.handleCommand(s, i)
+	})
 	api.sendPatchNotes()
 
-	go api.watchDog()
+	go api.runScheduler()
+	go api.webhookWorker()
+	go api.discordOutboxWorker()
+	go api.sessionSweeper()
+	go api.oauthStateSweeper()
 	router.Run("0.0.0.0:8080")
 }
 
@@ -98,6 +185,23 @@ type Api struct {
 	db  *bun.DB
 	dg  *discordgo.Session
 	ctx context.Context
+	// wakes up the webhook worker when new deliveries are queued
+	webhooks chan struct{}
+	// wakes up the discord outbox worker when new messages are queued
+	discordOutbox chan struct{}
+	// upcoming playdate starts and reminders, see runScheduler
+	schedule *scheduler
+	// brute force protection for anything that checks a password or code
+	logins *loginGuard
+	// live updates pushed to browsers over server sent events
+	events    *sseBroker
+	templates *template.Template
+	// passkey ceremonies
+	webauthn *webauthn.WebAuthn
+	// where playdate notifications get sent, see notify
+	notifications *notificationDispatcher
+	// signs web pushes, nil unless the webpush notifier is configured
+	vapid *vapidKeys
 }
 
 type GitHubRelease struct {
@@ -108,22 +212,8 @@ type GitHubRelease struct {
 	PublishedAt time.Time `json:"published_at"`
 }
 
-func (a *Api) watchDog() {
-	log.Info().Msg("Watching for PlayDates..")
-	ticker := time.NewTicker(time.Minute / 2)
-
-	go func() {
-		for {
-			select {
-			case <-ticker.C:
-				a.fetchPoppedDates()
-			}
-		}
-	}()
-}
-
 func (a *Api) index(c *gin.Context) {
-	cookie, _ := c.Cookie("playdate")
+	cookie, _ := c.Cookie(sessionCookieName)
 	log.Debug().Str("Cookie", cookie).Str("HX-Request", c.Request.Header.Get("HX-Request")).Msg("rendering index")
 
 	state := gin.H{"Errors": map[string]string{}}
@@ -161,22 +251,17 @@ func (a *Api) index(c *gin.Context) {
 		Model(&pastPlaydates).
 		Relation("Owner").
 		Relation("Players").
-		Where("play_date.status = ?", PlayDateStatusDone).
+		Where("play_date.status IN (?)", bun.In([]PlayDateStatus{PlayDateStatusDone, PlayDateStatusCancelled})).
 		Order("play_date.created_date desc").
 		Scan(a.ctx)
 	if err != nil {
 		log.Error().Err(err).Msg("failed to query for past playdates")
 		state["ServerError"] = "Failed to retrieve past playdates due to a server error. Please try again later."
 	}
-	playdates := append(upcomingPlaydates, pastPlaydates...)
-
-	// NOTE: manually convert timestamp to eastern
-	for _, p := range playdates {
-		p.Date = p.Date.In(easternLocation)
-	}
-
-	state["PlayDates"] = playdates
+	state["UpcomingPlayDates"] = playDateRows(upcomingPlaydates, player.TimeDisplay())
+	state["PastPlayDates"] = playDateRows(pastPlaydates, player.TimeDisplay())
 	state["Player"] = player
+	state["IsAdmin"] = isAdmin(player)
 
 	c.HTML(http.StatusOK, "pages/home.html", state)
 }
@@ -196,24 +281,9 @@ func (a *Api) createPlayDateTemplate(c *gin.Context) {
 	inputDatetime := c.PostForm("date")
 
 	formData := gin.H{"Game": inputGame, "Date": inputDatetime}
-	errors := map[string]string{}
-	if inputGame == "" {
-		errors["game"] = "game is required"
-	}
-	if inputDatetime == "" {
-		errors["date"] = "date is required"
-	}
-	// NOTE: that this date is not random but instead hardcoded into the standard
-	// libary to code layouts against.
-	expectedTimeLayout := "2006-01-02T15:04"
-	parsedDatetime, err := time.ParseInLocation(expectedTimeLayout, inputDatetime, easternLocation)
-	now := time.Now().In(easternLocation)
-	if err != nil {
-		formData["Date"] = ""
-		errors["date"] = "invalid format for date/time, please use layout 2025-01-01T12:00"
-	} else if parsedDatetime.Before(now) {
+	parsedDatetime, errors := parsePlayDateForm(inputGame, inputDatetime, player.TimeDisplay().Location)
+	if _, invalid := errors["date"]; invalid {
 		formData["Date"] = ""
-		errors["date"] = fmt.Sprintf("can not make a playdate in the past, %v is before %v", parsedDatetime, now)
 	}
 	formData["Errors"] = errors
 	if len(errors) > 0 {
@@ -223,7 +293,22 @@ func (a *Api) createPlayDateTemplate(c *gin.Context) {
 	log.Debug().Str("datetime", parsedDatetime.String()).Msg("*** Checking time prior to db")
 
 	playdate := PlayDate{Game: inputGame, Date: parsedDatetime, OwnerId: player.ID}
-	_, err = a.db.NewInsert().Model(&playdate).Exec(a.ctx)
+	// share the new playdate to the masses!
+	notification := Notification{Event: NotificationPlayDateCreated, PlayDate: &playdate, Actor: player}
+	err = a.db.RunInTx(c.Request.Context(), nil, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewInsert().Model(&playdate).Returning("*").Exec(ctx)
+		if err != nil {
+			return err
+		}
+		if err := recordAudit(ctx, tx, AuditActor{Player: player, Source: AuditSourceWeb}, auditSnapshot{}, playdate.auditSnapshot()); err != nil {
+			return err
+		}
+		playdate.Owner = player
+		if err := emitWebhookEvent(ctx, tx, WebhookEventPlayDateCreated, newWebhookPlayDate(&playdate)); err != nil {
+			return err
+		}
+		return a.queueNotification(ctx, tx, &notification)
+	})
 	if err != nil {
 		log.Err(err).Any("playdate", playdate).Msg("failed to insert new playdate")
 		formData["ServerError"] = err
@@ -231,59 +316,29 @@ func (a *Api) createPlayDateTemplate(c *gin.Context) {
 		return
 	}
 
-	// send notification to configure channel to share the new playdate to the masses!
-	msg := fmt.Sprintf("Playdate %s at %s by %s! Check it out here: https://playdate.colinthatcher.dev/playdate/%d", playdate.Game, FormatTime(&playdate.Date), player.Name, playdate.ID)
-	dgMsg, err := a.dg.ChannelMessageSend(Config.DiscordConfig.ChannelID, msg)
-	if err != nil {
-		log.Err(err).Any("playdate", playdate).Msg("failed to send message for new playdate to discord")
-	}
-	InitAttendanceReactions(a, dgMsg)
+	a.notify(notification)
+	a.kickWebhookWorker()
+	a.publishPlayDate(playdate.ID, homeRowCreated)
 
 	// redirect the user back to the index router (i.e. the homepage)
 	c.Header("HX-Location", "/")
 }
 
 func (a *Api) getPlayDateTemplate(c *gin.Context) {
-	_, err := a.findPlayerFromCookie(c)
+	player, err := a.findPlayerFromCookie(c)
 	if err != nil {
 		c.Redirect(http.StatusFound, "/")
 		return
 	}
 
-	state := gin.H{}
-	errors := map[string]string{}
-	id, err := strconv.Atoi(c.Param("id"))
+	// redirect the user to the home page if they request a playdate that doesn't exist
+	playdate, err := a.findPlayDateFromParam(c)
 	if err != nil {
-		// redirect the user to the home page if they request with an improper id
-		log.Err(err).Str("playdateID", c.Param("id")).Msg("failed to parse given playdate id")
 		c.Redirect(http.StatusFound, "/")
 		return
 	}
 
-	log.Info().Int("id", id).Msg("Querying for players related to playdate")
-	playdate := &PlayDate{ID: id}
-	err = a.db.NewSelect().Model(playdate).Relation("Owner").WherePK().Scan(c.Request.Context())
-	if err != nil {
-		// if the given id doesn't exist just return the called to the home page
-		log.Err(err).Int("playdateID", id).Msg("failed to find playdate")
-		c.Redirect(http.StatusFound, "/")
-		return
-	}
-	playdatePlayers := []*PlayDateToPlayer{}
-	err = a.db.NewSelect().Model(&playdatePlayers).Relation("Player").Where("playdate_id = ?", id).Scan(c.Request.Context())
-	if err != nil {
-		// report error back to user, but just render the page like normal
-		log.Err(err).Any("playdate", playdate).Msg("failed to find related players to playdate")
-		errors["PlayDatePlayers"] = err.Error()
-	}
-
-	log.Debug().Interface("playdatePlayers", playdatePlayers).Msg("Playdate players details")
-	// NOTE: Manually parse timestamp into eastern time
-	playdate.Date = playdate.Date.In(easternLocation)
-	playdate.CreatedDate = playdate.CreatedDate.In(easternLocation)
-	state["Errors"] = errors
-	state["PlayDate"] = playdate
-	state["PlayDatePlayers"] = playdatePlayers
+	state := a.playDateState(c.Request.Context(), player, playdate)
 	log.Debug().Interface("playdate", playdate).Msg("Playdate details")
 	if c.Request.Header.Get("HX-Request") == "" {
 		c.HTML(http.StatusOK, "pages/playdate.html", state)
@@ -324,13 +379,16 @@ func (a *Api) setPlayDateAttendence(c *gin.Context) {
 	log.Info().Int("playdateID", playdate.ID).Int("playerID", player.ID).Any("action", attendance).Msg("attempting to set playdate attendance")
 	errors := map[string]string{}
 	rel := &PlayDateToPlayer{PlayDateID: playdate.ID, PlayerID: player.ID, Attending: attendance}
-	_, err = a.db.NewInsert().Model(rel).On("CONFLICT (playdate_id, player_id) DO UPDATE").Set("attending = EXCLUDED.attending").Exec(a.ctx)
+	err = a.setAttendance(c.Request.Context(), AuditActor{Player: player, Source: AuditSourceWeb}, playdate, player, attendance)
 	if err != nil {
 		// send error back to user within the players-table.html
 		log.Error().Err(err).Interface("relation", rel).Msg("failed to insert playdate to player relation")
 		errors["PlayDatePlayers"] = err.Error()
 	} else {
 		log.Info().Interface("relation", rel).Msg("successfully inserted playdate to player relation")
+		a.notify(Notification{Event: NotificationAttendanceChanged, PlayDate: playdate, Actor: player, Attending: attendance})
+		a.kickWebhookWorker()
+		a.publishPlayDate(playdate.ID, homeRowUpdated)
 	}
 
 	playdatePlayers := []*PlayDateToPlayer{}
@@ -360,6 +418,7 @@ func (a *Api) setPlayDateAttendenceFromDisc(r *discordgo.MessageReaction) {
 	msg, err := a.dg.ChannelMessage(Config.DiscordConfig.ChannelID, r.MessageID)
 	if err != nil {
 		log.Err(err).Msg("failed to get reaction message")
+		a.recordFailure(FailureSourceBot, "failed to get the message a reaction was added to", err)
 		return
 	}
 	if msg.Author.ID != "1252426978313633812" {
@@ -402,13 +461,25 @@ func (a *Api) setPlayDateAttendenceFromDisc(r *discordgo.MessageReaction) {
 		}
 		return
 	}
+	if player.Banned() {
+		log.Warn().Int("playerID", player.ID).Msg("ignoring reaction from banned player")
+		err = a.dg.MessageReactionRemove(Config.DiscordConfig.ChannelID, msg.ID, r.Emoji.APIName(), discId)
+		if err != nil {
+			log.Err(err).Msg("Failed to remove reaction on banned player")
+		}
+		return
+	}
 	rel := &PlayDateToPlayer{PlayDateID: playdate.ID, PlayerID: player.ID, Attending: attendance}
-	_, err = a.db.NewInsert().Model(rel).On("CONFLICT (playdate_id, player_id) DO UPDATE").Set("attending = EXCLUDED.attending").Exec(a.ctx)
+	err = a.setAttendance(a.ctx, AuditActor{Player: player, Source: AuditSourceDiscord}, playdate, player, attendance)
 	if err != nil {
 		// send error back to user within the players-table.html
 		log.Error().Err(err).Interface("relation", rel).Msg("failed to insert playdate to player relation")
+		a.recordFailure(FailureSourceBot, fmt.Sprintf("failed to save %s's reaction to playdate %d", player.Name, playdate.ID), err)
 	} else {
 		log.Info().Interface("relation", rel).Msg("successfully inserted playdate to player relation")
+		a.notify(Notification{Event: NotificationAttendanceChanged, PlayDate: playdate, Actor: player, Attending: attendance})
+		a.kickWebhookWorker()
+		a.publishPlayDate(playdate.ID, homeRowUpdated)
 	}
 
 	playdatePlayers := []*PlayDateToPlayer{}
@@ -445,31 +516,21 @@ func (a *Api) registerUserTemplate(c *gin.Context) {
 
 	formData := gin.H{"Name": name, "DiscID": discID, "Password": pass}
 	errors := map[string]string{}
-	r, _ := regexp.Compile("[^a-zA-Z0-9]")
-	if name == "" {
-		errors["name"] = "name is required"
-	} else if r.MatchString(name) {
-		errors["password"] = "name must be alphanumeric"
-	}
-	if discID == "" {
-		errors["discID"] = "discID is required"
-	}
-	if pass == "" {
-		errors["password"] = "password is required"
-	} else if r.MatchString(pass) {
-		errors["password"] = "password must be alphanumeric"
-	}
-
-	player := Player{Name: name}
-	duplicate, err := a.db.NewSelect().Model(&player).Where("name = ?", player.Name).Exists(a.ctx)
+	problem, err := a.validatePlayerName(a.ctx, name, 0)
 	if err != nil {
 		log.Err(err).Msg("Failed to check DB for existing username")
 		formData["ServerError"] = "Not your fault, server is cooked. Try again?"
 		c.HTML(http.StatusOK, "partials/register.html", formData)
 		return
 	}
-	if duplicate {
-		errors["name"] = "name is taken"
+	if problem != "" {
+		errors["name"] = problem
+	}
+	if discID == "" {
+		errors["discID"] = "discID is required"
+	}
+	if problem := validatePassword(pass, name); problem != "" {
+		errors["password"] = problem
 	}
 	if len(errors) > 0 {
 		formData["Errors"] = errors
@@ -478,110 +539,52 @@ func (a *Api) registerUserTemplate(c *gin.Context) {
 		return
 	}
 
-	bytes, err := bcrypt.GenerateFromPassword([]byte(c.PostForm("password")), bcrypt.DefaultCost)
+	err = a.checkGuildMembership(discID)
 	if err != nil {
-		log.Err(err).Msg("failed to hash password")
-		formData["ServerError"] = err.Error()
+		log.Err(err).Str("discordID", discID).Msg("rejected registration from outside the guild")
+		formData["ServerError"] = guildMembershipMessage(err)
 		c.HTML(http.StatusOK, "partials/register.html", formData)
 		return
 	}
-	sessionId, err := GenerateRandomState()
+
+	hashedPassword, err := hashPassword(pass)
 	if err != nil {
-		log.Err(err).Msg("failed to generate session id")
+		log.Err(err).Msg("failed to hash password")
 		formData["ServerError"] = err.Error()
 		c.HTML(http.StatusOK, "partials/register.html", formData)
 		return
 	}
-
-	player = Player{Name: name, DiscordID: discID, Password: string(bytes), SessionId: sessionId}
+	player := Player{Name: name, DiscordID: discID, Password: hashedPassword, PasswordSet: true}
+	// NOTE: registering again with a discord id we already know just sends that player a new login link
 	err = a.db.NewSelect().Model(&player).Where("discord_id = ?", player.DiscordID).Scan(a.ctx)
 	if err != nil {
-		player.VerificationCode = uuid.NewString()
-		_, err := a.db.NewInsert().Model(&player).Exec(a.ctx)
+		err := a.db.RunInTx(c.Request.Context(), nil, func(ctx context.Context, tx bun.Tx) error {
+			_, err := tx.NewInsert().Model(&player).Exec(ctx)
+			if err != nil {
+				return err
+			}
+			return recordAudit(ctx, tx, AuditActor{Player: &player, Source: AuditSourceWeb}, auditSnapshot{}, player.auditSnapshot())
+		})
 		if err != nil {
 			log.Err(err).Msg("failed to create new player")
 			formData["ServerError"] = err.Error()
 			c.HTML(http.StatusOK, "partials/register.html", formData)
 			return
 		}
-	} else {
-		// update the player's verification code to enable them to re-login
-		player.VerificationCode = uuid.NewString()
-		_, err = a.db.NewUpdate().Model(&player).Where("discord_id = ?", player.DiscordID).Exec(a.ctx)
-		if err != nil {
-			log.Err(err).Msg("failed to update player with new verification code")
-			formData["ServerError"] = err.Error()
-			c.HTML(http.StatusOK, "partials/register.html", formData)
-			return
-		}
 	}
 
-	channel, err := a.dg.UserChannelCreate(discID)
+	err = a.sendLoginLink(c, &player)
 	if err != nil {
-		log.Err(err).Any("player", player).Msg("failed to create private channel to send verification code")
+		log.Err(err).Int("playerID", player.ID).Msg("failed to send login link to new player")
 		formData["ServerError"] = "Invalid Discord ID"
 		c.HTML(http.StatusOK, "partials/register.html", formData)
 		return
 	}
-	_, err = a.dg.ChannelMessageSend(
-		channel.ID,
-		fmt.Sprintf("Here is your verification code from the PlayDate application!\n`%s`\nUse this to complete your signup/login.", player.VerificationCode),
-	)
-	if err != nil {
-		log.Err(err).Any("player", player).Msg("failed to send verification code to user directly")
-		formData["ServerError"] = err.Error()
-		c.HTML(http.StatusOK, "partials/register.html", formData)
-		return
-	}
 
-	formData["Verifying"] = true
-	c.HTML(http.StatusOK, "partials/register.html", formData)
+	c.HTML(http.StatusOK, "partials/login-link.html", gin.H{"Name": player.Name, "Sent": true})
 }
 
-func (a *Api) verifyPlayer(c *gin.Context) {
-	name := c.PostForm("name")
-	discID := c.PostForm("discID")
-	verificationCode := c.PostForm("verificationCode")
-
-	formData := gin.H{"Name": name, "DiscID": discID, "Verifying": true, "VerificationCode": verificationCode}
-	errors := map[string]string{}
-	if name == "" {
-		errors["name"] = "name is required"
-	}
-	if discID == "" {
-		errors["discID"] = "discID is required"
-	}
-	if verificationCode == "" {
-		errors["verificationCode"] = "verificationCode is required"
-	}
-	if len(errors) > 0 {
-		formData["Errors"] = errors
-		log.Debug().Any("errors", errors).Msg("form data didn't meet validation")
-		c.HTML(http.StatusOK, "partials/register.html", formData)
-		return
-	}
-
-	player := Player{Name: name, DiscordID: discID}
-	err := a.db.NewSelect().Model(&player).Where("discord_id = ?", player.DiscordID).Scan(a.ctx)
-	if err != nil {
-		log.Err(err).Any("player", player).Msg("failed to find player")
-		formData["ServerError"] = err.Error()
-		c.HTML(http.StatusOK, "partials/register.html", formData)
-		return
-	}
-
-	// check if the verifcation codes match, otherwise reroute back to registration
-	if player.VerificationCode != verificationCode {
-		formData["VerificationCode"] = "" // required to show error message
-		errors["verificationCode"] = "invalid verification code provided"
-		formData["Errors"] = errors
-		log.Debug().Any("player", player).Any("errors", errors).Msg("provided verification code didn't match our records")
-		c.HTML(http.StatusOK, "partials/register.html", formData)
-		return
-	}
-
-	a.createPlayDateCookie(c, player.SessionId)
-}
+var errPlayDateAlreadyStarted = errors.New("playdate was already started")
 
 func (a *Api) fetchPoppedDates() {
 	log.Info().Msg("Any PlayDates??")
@@ -592,57 +595,110 @@ func (a *Api) fetchPoppedDates() {
 	err := a.db.NewSelect().
 		Model(&playdates).
 		Relation("Owner").
-		Relation("Attendances").
-		Relation("Attendances.Player"). // NOTE: this will prefetch the nested attendance relationship's player relationship :fire:
-		Where("date <= ?", now.Format("2006-01-02T15:04")).
+		Where("date <= ?", now).
 		Where("status = ?", PlayDateStatusPending).
 		Scan(a.ctx)
 	if err != nil {
 		log.Error().Err(err).Msg("Watch is Kill")
 		state["ServerError"] = "Watch Dead"
+		a.recordFailure(FailureSourceWatchdog, "failed to query for playdates that are starting", err)
 	}
 
 	log.Info().Any("playdates", playdates).Msg("Found the following playdates")
 	for _, playdate := range playdates {
-		atAttendingPlayers := ""
-		for _, attendance := range playdate.Attendances {
-			if attendance.Attending == AttendanceNo {
-				continue
-			}
-			atAttendingPlayers = atAttendingPlayers + fmt.Sprintf("<@%s>", attendance.Player.DiscordID)
-		}
-		msg := fmt.Sprintf("Playdate %s created by <@%s> is happening now! Make sure to join :video_game:!\n%s", playdate.Game, playdate.Owner.DiscordID, atAttendingPlayers)
-		_, err = a.dg.ChannelMessageSend(Config.DiscordConfig.ChannelID, msg)
-		if err != nil {
-			log.Err(err).Any("playdate", playdate).Msg("failed to send message for playdate")
-		}
 		// mark a playdate as done if its "popped"
+		before := playdate.auditSnapshot()
 		playdate.Status = PlayDateStatusDone
-		_, err = a.db.NewUpdate().Model(playdate).WherePK().Exec(a.ctx)
+		notification := Notification{Event: NotificationPlayDateStarted, PlayDate: playdate}
+		err = a.db.RunInTx(a.ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+			// NOTE: every server's scheduler fires at the same moment, only the one that gets to it first announces it
+			res, err := tx.NewUpdate().Model(playdate).WherePK().Where("status = ?", PlayDateStatusPending).Exec(ctx)
+			if err != nil {
+				return err
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				return errPlayDateAlreadyStarted
+			}
+			if err := recordAudit(ctx, tx, AuditActor{Source: AuditSourceWatchdog}, before, playdate.auditSnapshot()); err != nil {
+				return err
+			}
+			// NOTE: it's only done once the announcement is queued, so it can't be lost
+			if err := emitWebhookEvent(ctx, tx, WebhookEventPlayDateStarted, newWebhookPlayDate(playdate)); err != nil {
+				return err
+			}
+			return a.queueNotification(ctx, tx, &notification)
+		})
+		if errors.Is(err, errPlayDateAlreadyStarted) {
+			continue
+		}
 		if err != nil {
 			log.Err(err).Any("playdate", playdate).Msg("failed to update playdate status")
+			a.recordFailure(FailureSourceWatchdog, fmt.Sprintf("failed to mark playdate %d as done", playdate.ID), err)
+			// NOTE: the scheduler tries it again in a bit, announcing it now would announce it twice
+			continue
 		}
-		log.Info().Any("playdate", playdate).Str("notification", msg).Msg("sent notification for playdate starting")
+		log.Info().Any("playdate", playdate).Msg("sending notification for playdate starting")
+		a.notify(notification)
+		a.kickWebhookWorker()
+		a.publishPlayDate(playdate.ID, homeRowEnded)
 	}
 }
 
-func (a *Api) findPlayerFromCookie(c *gin.Context) (*Player, error) {
-	cookie, err := c.Cookie("playdate")
+// sendReminders reminds everyone about the playdates starting within Config.ReminderLead. Each playdate is marked
+// as reminded in the same statement that finds it, so a reminder never goes out twice.
+func (a *Api) sendReminders() {
+	if Config.ReminderLead <= 0 {
+		return
+	}
+
+	now := time.Now()
+	notifications := []Notification{}
+	err := a.db.RunInTx(a.ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		playdates := []*PlayDate{}
+		err := tx.NewUpdate().
+			Model((*PlayDate)(nil)).
+			Set("reminded_date = ?", now).
+			Where("status = ?", PlayDateStatusPending).
+			Where("reminded_date IS NULL").
+			Where("date > ?", now).
+			Where("date <= ?", now.Add(Config.ReminderLead)).
+			Returning("*").
+			Scan(ctx, &playdates)
+		if err != nil {
+			return err
+		}
+		for _, playdate := range playdates {
+			notification := Notification{Event: NotificationPlayDateReminder, PlayDate: playdate}
+			if err := a.queueNotification(ctx, tx, &notification); err != nil {
+				return err
+			}
+			notifications = append(notifications, notification)
+		}
+		return nil
+	})
 	if err != nil {
-		msg := "failed to parse user's cookie"
-		log.Err(err).Msg(msg)
-		return nil, errors.New(msg)
+		log.Err(err).Msg("failed to find playdates to remind players about")
+		a.recordFailure(FailureSourceWatchdog, "failed to queue reminders for playdates that are starting soon", err)
+		return
 	}
+	for _, notification := range notifications {
+		log.Info().Int("playdateID", notification.PlayDate.ID).Msg("sending reminder for playdate starting soon")
+		a.notify(notification)
+	}
+}
 
-	player := &Player{SessionId: cookie}
-	err = a.db.NewSelect().Model(player).Where("session_id = ?", player.SessionId).Scan(c.Request.Context())
+func (a *Api) findPlayerFromCookie(c *gin.Context) (*Player, error) {
+	session, err := a.findSessionFromCookie(c)
 	if err != nil {
+		return nil, err
+	}
+	if session.Player == nil {
 		// if the given player id doesn't exist just return the called to the home page
 		msg := "failed to find the player from their cookie"
-		log.Err(err).Str("cookie", cookie).Any("player", player).Msg(msg)
+		log.Error().Int("sessionID", session.ID).Msg(msg)
 		return nil, errors.New(msg)
 	}
-	return player, nil
+	return session.Player, nil
 }
 
 func (a *Api) goToRegisterUser(c *gin.Context) {
@@ -676,46 +732,52 @@ func (a *Api) userLogin(c *gin.Context) {
 		return
 	}
 
+	ip := c.ClientIP()
+	account := "name:" + strings.ToLower(name)
+	if err := a.logins.Check(ip, account); err != nil {
+		formData["ServerError"] = err.Error()
+		c.HTML(http.StatusOK, "partials/login.html", formData)
+		return
+	}
+
 	player := &Player{Name: name}
 	err := a.db.NewSelect().Model(player).Where("name = ?", player.Name).Scan(a.ctx)
 	if err != nil {
 		log.Err(err).Any("player", player).Msg("failed to find player")
+		a.logins.Fail(ip, account)
 		formData["ServerError"] = "User doesn't exist"
 		c.HTML(http.StatusOK, "partials/login.html", formData)
 		return
 	}
 
-	err = bcrypt.CompareHashAndPassword([]byte(player.Password), []byte(pass))
+	err = comparePassword(player.Password, pass)
 	if err != nil {
-		log.Err(err).Any("player", player).Msg("Invalid Password")
+		log.Err(err).Int("playerID", player.ID).Msg("Invalid Password")
+		if a.logins.Fail(ip, account) {
+			a.warnPlayerOfLockout(player, ip)
+		}
 		formData["ServerError"] = "Invalid Password"
 		c.HTML(http.StatusOK, "partials/login.html", formData)
 		return
 	}
+	a.logins.Succeed(account)
+	a.upgradePasswordHash(player, pass)
 
-	newSessionId, err := GenerateRandomState()
+	err = a.createSession(c, player, false)
 	if err != nil {
-		log.Err(err).Msg("failed to generate session id")
+		log.Err(err).Int("playerID", player.ID).Msg("failed to sign in player")
 		formData["ServerError"] = err.Error()
-		c.HTML(http.StatusOK, "partials/register.html", formData)
-		return
-	}
-	player.SessionId = newSessionId
-	_, err = a.db.NewUpdate().Model(player).WherePK().Exec(a.ctx)
-	if err != nil {
-		log.Err(err).Msg("failed to update users session id")
-		formData["ServerError"] = err.Error()
-		c.HTML(http.StatusOK, "partials/register.html", formData)
-		return
+		if isGuildMembershipError(err) {
+			formData["ServerError"] = guildMembershipMessage(err)
+		}
+		c.HTML(http.StatusOK, "partials/login.html", formData)
 	}
-
-	a.createPlayDateCookie(c, newSessionId)
 }
 
-// TODO: This isn't working
 func (a *Api) userLogout(c *gin.Context) {
-	// TODO: delete existing session id
-	c.SetCookie("playdate", "", -1, "/", "", false, true)
+	a.deleteSessionFromCookie(c)
+	setCookie(c, sessionCookieName, "", -1, true)
+	setCookie(c, csrfCookieName, "", -1, false)
 	if c.Request.Header.Get("HX-Request") != "" {
 		c.Header("HX-Location", "/")
 	} else {
@@ -725,7 +787,7 @@ func (a *Api) userLogout(c *gin.Context) {
 
 // create cookie and redirect to index
 func (a *Api) createPlayDateCookie(c *gin.Context, sessionId string) {
-	c.SetCookie("playdate", string(sessionId), 2000000, "/", "", false, true)
+	setCookie(c, sessionCookieName, sessionId, int(sessionTTL.Seconds()), true)
 	if c.Request.Header.Get("HX-Request") != "" {
 		c.Header("HX-Location", "/")
 	} else {
@@ -734,7 +796,7 @@ func (a *Api) createPlayDateCookie(c *gin.Context, sessionId string) {
 }
 
 func (a *Api) handleOAuthLogin(c *gin.Context) {
-	authURL, err := DiscordOAuthLogin(a)
+	authURL, err := DiscordOAuthLogin(c, a)
 	if err != nil {
 		log.Err(err).Msg("failed to oauth login")
 		return
@@ -753,7 +815,24 @@ func (a *Api) handleOAuthCallback(c *gin.Context) {
 		return
 	}
 
-	a.createPlayDateCookie(c, player.SessionId)
+	// NOTE: already signed in means the player came from their profile to connect discord
+	if session, err := a.findSessionFromCookie(c); err == nil {
+		if session.PlayerID != player.ID {
+			a.requestAccountMerge(c, session, player)
+			return
+		}
+		c.Redirect(http.StatusFound, "/me")
+		return
+	}
+
+	err = a.createSession(c, player, false)
+	if errors.Is(err, ErrPlayerBanned) {
+		a.forbidden(c, "This account has been banned.")
+	} else if isGuildMembershipError(err) {
+		a.forbidden(c, guildMembershipMessage(err))
+	} else if err != nil {
+		c.String(http.StatusInternalServerError, "Failed to start your session, please try again.")
+	}
 }
 
 func (a *Api) healthCheck(c *gin.Context) {
@@ -835,6 +914,7 @@ func (a *Api) sendPatchNotes() {
 	_, err := a.dg.ChannelMessageSendEmbed(Config.DiscordConfig.ChannelID, embed)
 	if err != nil {
 		log.Err(err).Msg("Failed to send patch notes embed")
+		a.recordFailure(FailureSourceBot, "failed to send patch notes", err)
 	}
 }
 
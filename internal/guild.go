@@ -0,0 +1,224 @@
+package internal
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	discordGuildsScope       = "guilds"
+	discordGuildMembersScope = "guilds.members.read"
+)
+
+var (
+	ErrNotGuildMember      = errors.New("not a member of the configured discord server")
+	ErrMissingGuildRole    = errors.New("missing the role required by the configured discord server")
+	ErrGuildMemberUnproven = errors.New("discord didn't grant the scopes needed to check server membership")
+)
+
+// guildMembershipMessage turns a membership error into something friendly enough to show to the player.
+func guildMembershipMessage(err error) string {
+	switch {
+	case errors.Is(err, ErrMissingGuildRole):
+		return "You're in our Discord server, but you don't have the role needed to use PlayDate yet. Ask an admin to give it to you!"
+	case errors.Is(err, ErrGuildMemberUnproven):
+		return "We couldn't check that you're in our Discord server. Please allow PlayDate to see your servers when signing in with Discord."
+	default:
+		return "PlayDate is only for members of our Discord server. Join the server first, then try again!"
+	}
+}
+
+// isGuildMembershipError reports whether err means the player isn't allowed in by the guild, rather than that the
+// lookup failed.
+func isGuildMembershipError(err error) bool {
+	return errors.Is(err, ErrNotGuildMember) || errors.Is(err, ErrMissingGuildRole) || errors.Is(err, ErrGuildMemberUnproven)
+}
+
+// oauthScopes adds the scopes needed for the membership check to the configured ones.
+func oauthScopes() string {
+	scopes := strings.Fields(Config.DiscordConfig.Scopes)
+	if Config.DiscordConfig.RequireGuildMember && !slices.Contains(scopes, discordGuildMembersScope) {
+		scopes = append(scopes, discordGuildMembersScope)
+	}
+	return strings.Join(scopes, " ")
+}
+
+// checkGuildRoles makes sure the member has the required role, if one is configured.
+func checkGuildRoles(roles []string) error {
+	if Config.DiscordConfig.RequiredRoleID == "" || slices.Contains(roles, Config.DiscordConfig.RequiredRoleID) {
+		return nil
+	}
+	return ErrMissingGuildRole
+}
+
+// checkOAuthGuildMembership uses the player's own token to check they're in the configured guild. With the
+// guilds.members.read scope we also get their roles, with only the guilds scope we can just check membership.
+func checkOAuthGuildMembership(tokenResponse *TokenResponse) error {
+	if !Config.DiscordConfig.RequireGuildMember {
+		return nil
+	}
+
+	granted := strings.Fields(tokenResponse.Scope)
+	switch {
+	case slices.Contains(granted, discordGuildMembersScope):
+		member, err := fetchOAuthGuildMember(tokenResponse)
+		if err != nil {
+			return err
+		}
+		return checkGuildRoles(member.Roles)
+	case slices.Contains(granted, discordGuildsScope):
+		if Config.DiscordConfig.RequiredRoleID != "" {
+			// the guild list doesn't include roles
+			return ErrGuildMemberUnproven
+		}
+		var guilds []discordgo.UserGuild
+		if _, err := getDiscordUserResource(Config.DiscordConfig.UserGuildsAPIURL, tokenResponse, &guilds); err != nil {
+			return err
+		}
+		for _, guild := range guilds {
+			if guild.ID == Config.DiscordConfig.GuildID {
+				return nil
+			}
+		}
+		return ErrNotGuildMember
+	default:
+		return ErrGuildMemberUnproven
+	}
+}
+
+// fetchOAuthGuildMember looks the user up in the configured guild with their own token, this needs the
+// guilds.members.read scope.
+func fetchOAuthGuildMember(tokenResponse *TokenResponse) (*discordgo.Member, error) {
+	url := fmt.Sprintf("%s/%s/member", Config.DiscordConfig.UserGuildsAPIURL, Config.DiscordConfig.GuildID)
+	var member discordgo.Member
+	found, err := getDiscordUserResource(url, tokenResponse, &member)
+	if err != nil {
+		return nil, err
+	}
+	if !found {
+		return nil, ErrNotGuildMember
+	}
+	return &member, nil
+}
+
+// getDiscordUserResource GETs a discord endpoint as the user, returning false when it doesn't exist.
+func getDiscordUserResource(url string, tokenResponse *TokenResponse, dest any) (bool, error) {
+	req, err := http.NewRequest(http.MethodGet, url, nil)
+	if err != nil {
+		return false, fmt.Errorf("failed to create discord request: %w", err)
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("%s %s", tokenResponse.TokenType, tokenResponse.AccessToken))
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false, fmt.Errorf("failed to send discord request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == http.StatusNotFound {
+		return false, nil
+	}
+	if resp.StatusCode != http.StatusOK {
+		bodyBytes, _ := io.ReadAll(resp.Body)
+		return false, fmt.Errorf("discord request failed with status %d: %s", resp.StatusCode, string(bodyBytes))
+	}
+	if err := json.NewDecoder(resp.Body).Decode(dest); err != nil {
+		return false, fmt.Errorf("failed to decode discord response: %w", err)
+	}
+	return true, nil
+}
+
+// checkGuildMembership looks the discord user up through the bot, used for players registering with a password.
+func (a *Api) checkGuildMembership(discordID string) error {
+	if !Config.DiscordConfig.RequireGuildMember {
+		return nil
+	}
+
+	member, err := a.fetchGuildMember(discordID)
+	if err != nil {
+		log.Err(err).Str("discordID", discordID).Msg("failed to look up guild member")
+		return err
+	}
+	return checkGuildRoles(member.Roles)
+}
+
+// syncGuildMember looks the player up in the guild as they sign in. They have to still be in it when
+// DISCORD_REQUIRE_GUILD_MEMBER is on, and their role follows their guild roles when those are configured.
+func (a *Api) syncGuildMember(ctx context.Context, player *Player) error {
+	_, mapped := roleFromGuildRoles(nil)
+	required := Config.DiscordConfig.RequireGuildMember
+	if !required && (!mapped || !player.DiscordVerified()) {
+		return nil
+	}
+	member, err := a.lookupGuildMember(ctx, player)
+	if errors.Is(err, ErrNotGuildMember) && !required {
+		log.Info().Int("playerID", player.ID).Msg("player is no longer in the guild, keeping their role")
+		return nil
+	}
+	if err != nil && !required {
+		log.Err(err).Int("playerID", player.ID).Msg("failed to look up guild member to sync role")
+		return nil
+	}
+	if err != nil {
+		log.Err(err).Int("playerID", player.ID).Msg("refused sign in from outside the guild")
+		return err
+	}
+	if required {
+		if err := checkGuildRoles(member.Roles); err != nil {
+			log.Err(err).Int("playerID", player.ID).Msg("refused sign in without the required guild role")
+			return err
+		}
+	}
+	a.syncGuildRole(ctx, player, member.Roles)
+	return nil
+}
+
+// lookupGuildMember tries the player's own discord token first, the bot is the fallback for players without one or
+// without the scope.
+func (a *Api) lookupGuildMember(ctx context.Context, player *Player) (*discordgo.Member, error) {
+	member, err := a.fetchPlayerGuildMember(ctx, player.ID)
+	if err == nil || errors.Is(err, ErrNotGuildMember) {
+		return member, err
+	}
+	if !errors.Is(err, ErrNoDiscordCredential) {
+		log.Debug().Err(err).Int("playerID", player.ID).Msg("couldn't look up guild member with the player's token, asking the bot")
+	}
+	return a.fetchGuildMember(player.DiscordID)
+}
+
+// fetchPlayerGuildMember looks the player up with the discord token they signed in with, refreshing it when needed.
+// Unlike the bot this sees members the gateway hasn't told us about, but only when the player granted
+// guilds.members.read.
+func (a *Api) fetchPlayerGuildMember(ctx context.Context, playerID int) (*discordgo.Member, error) {
+	accessToken, tokenType, err := a.discordTokenSource(playerID).Token(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return fetchOAuthGuildMember(&TokenResponse{AccessToken: accessToken, TokenType: tokenType})
+}
+
+// fetchGuildMember looks the discord user up through the bot, returning ErrNotGuildMember when they aren't in the guild.
+func (a *Api) fetchGuildMember(discordID string) (*discordgo.Member, error) {
+	// NOTE: the gateway state cache is only populated for members we've seen, so fall back to the api
+	member, err := a.dg.State.Member(Config.DiscordConfig.GuildID, discordID)
+	if err != nil {
+		member, err = a.dg.GuildMember(Config.DiscordConfig.GuildID, discordID)
+	}
+	var restErr *discordgo.RESTError
+	if errors.As(err, &restErr) && restErr.Message != nil &&
+		(restErr.Message.Code == discordgo.ErrCodeUnknownMember || restErr.Message.Code == discordgo.ErrCodeUnknownUser) {
+		return nil, ErrNotGuildMember
+	}
+	return member, err
+}
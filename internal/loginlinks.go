@@ -0,0 +1,242 @@
+package internal
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"github.com/uptrace/bun"
+)
+
+const (
+	loginLinkPurpose = "login-link"
+	loginLinkTTL     = 10 * time.Minute
+	// ties a login link to the browser that asked for it, so clicking the link there signs in straight away
+	loginLinkCookieName = "playdate_login"
+	// wrong codes allowed before the link is thrown away and the player has to ask for a new one
+	loginCodeMaxAttempts = 5
+)
+
+// sendLoginLink DMs the player a signed, single use link that signs this browser in.
+func (a *Api) sendLoginLink(c *gin.Context, player *Player) error {
+	token, nonce, expires, err := newSignedToken(loginLinkPurpose, loginLinkTTL)
+	if err != nil {
+		return err
+	}
+	binding, err := GenerateRandomState()
+	if err != nil {
+		return err
+	}
+
+	err = a.db.RunInTx(c.Request.Context(), nil, func(ctx context.Context, tx bun.Tx) error {
+		err := deleteExpired(ctx, tx, (*LoginLink)(nil), player.ID)
+		if err != nil {
+			return err
+		}
+		link := &LoginLink{
+			NonceHash:   hashSessionToken(nonce),
+			PlayerID:    player.ID,
+			BindingHash: hashSessionToken(binding),
+			ExpiresDate: expires,
+		}
+		_, err = tx.NewInsert().Model(link).Exec(ctx)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store login link: %w", err)
+	}
+
+	err = a.sendDirectMessage(
+		player,
+		fmt.Sprintf(
+			"Here is your link to sign in to PlayDate! It works once within the next %s:\n%s/login/link/open?token=%s\nIf you didn't try to sign in, you can ignore this message.",
+			loginLinkTTL, Config.PublicURL, url.QueryEscape(token),
+		),
+	)
+	if err != nil {
+		return fmt.Errorf("failed to send login link: %w", err)
+	}
+
+	setCookie(c, loginLinkCookieName, binding, int(loginLinkTTL.Seconds()), true)
+	log.Info().Int("playerID", player.ID).Msg("sent login link")
+	return nil
+}
+
+func (a *Api) goToLoginLink(c *gin.Context) {
+	c.HTML(http.StatusOK, "partials/login-link.html", gin.H{})
+}
+
+func (a *Api) requestLoginLink(c *gin.Context) {
+	name := c.PostForm("name")
+
+	formData := gin.H{"Name": name}
+	if name == "" {
+		formData["Errors"] = map[string]string{"name": "name is required"}
+		c.HTML(http.StatusOK, "partials/login-link.html", formData)
+		return
+	}
+
+	player, err := a.directMessageRecipient(c, "link", name)
+	if err != nil {
+		formData["ServerError"] = err.Error()
+		c.HTML(http.StatusOK, "partials/login-link.html", formData)
+		return
+	}
+	formData["Sent"] = true
+	if player == nil {
+		c.HTML(http.StatusOK, "partials/login-link.html", formData)
+		return
+	}
+
+	err = a.sendLoginLink(c, player)
+	if err != nil {
+		log.Err(err).Int("playerID", player.ID).Msg("failed to send login link")
+		formData["ServerError"] = "Failed to send you a link over Discord, try again?"
+	}
+	c.HTML(http.StatusOK, "partials/login-link.html", formData)
+}
+
+// openLoginLink signs in the browser that asked for the link. Any other browser gets a short code to type
+// into the one that asked instead, so a link opened on a phone can still sign in a desktop.
+func (a *Api) openLoginLink(c *gin.Context) {
+	state := gin.H{}
+	nonce, err := verifySignedToken(loginLinkPurpose, c.Query("token"))
+	if err != nil {
+		state["Invalid"] = true
+		c.HTML(http.StatusOK, "pages/login-code.html", state)
+		return
+	}
+
+	link := &LoginLink{}
+	err = a.db.NewSelect().
+		Model(link).
+		Relation("Player").
+		Where("nonce_hash = ?", hashSessionToken(nonce)).
+		Where("login_link.expires_date > ?", time.Now()).
+		Scan(c.Request.Context())
+	if err != nil {
+		log.Err(err).Msg("failed to find login link")
+		state["Invalid"] = true
+		c.HTML(http.StatusOK, "pages/login-code.html", state)
+		return
+	}
+
+	binding, _ := c.Cookie(loginLinkCookieName)
+	if binding != "" && subtle.ConstantTimeCompare([]byte(link.BindingHash), []byte(hashSessionToken(binding))) == 1 {
+		a.completeLoginLink(c, link)
+		return
+	}
+
+	code, err := newLoginCode()
+	if err != nil {
+		log.Err(err).Msg("failed to generate login code")
+		c.String(http.StatusInternalServerError, "Failed to sign you in, please try again.")
+		return
+	}
+	link.CodeHash = hashSessionToken(code)
+	link.Attempts = 0
+	_, err = a.db.NewUpdate().Model(link).Column("code_hash", "attempts").WherePK().Exec(c.Request.Context())
+	if err != nil {
+		log.Err(err).Int("loginLinkID", link.ID).Msg("failed to store login code")
+		c.String(http.StatusInternalServerError, "Failed to sign you in, please try again.")
+		return
+	}
+
+	log.Info().Int("playerID", link.PlayerID).Msg("login link opened in another browser, handing out a code")
+	state["Code"] = code
+	c.HTML(http.StatusOK, "pages/login-code.html", state)
+}
+
+// submitLoginCode signs in the browser that asked for the link with the code shown where the link was opened.
+func (a *Api) submitLoginCode(c *gin.Context) {
+	code := strings.TrimSpace(c.PostForm("code"))
+	formData := gin.H{"Sent": true}
+
+	binding, _ := c.Cookie(loginLinkCookieName)
+	link := &LoginLink{}
+	err := a.db.NewSelect().
+		Model(link).
+		Relation("Player").
+		Where("binding_hash = ?", hashSessionToken(binding)).
+		Where("code_hash IS NOT NULL").
+		Where("login_link.expires_date > ?", time.Now()).
+		Scan(c.Request.Context())
+	if binding == "" || err != nil {
+		log.Err(err).Msg("failed to find login link waiting on a code")
+		formData["Errors"] = map[string]string{"code": "open the link from your DMs first, it will show you the code"}
+		c.HTML(http.StatusOK, "partials/login-link.html", formData)
+		return
+	}
+
+	ip := c.ClientIP()
+	account := "discord:" + link.Player.DiscordID
+	if err := a.logins.Check(ip, account); err != nil {
+		formData["ServerError"] = err.Error()
+		c.HTML(http.StatusOK, "partials/login-link.html", formData)
+		return
+	}
+
+	if subtle.ConstantTimeCompare([]byte(link.CodeHash), []byte(hashSessionToken(code))) != 1 {
+		if a.logins.Fail(ip, account) {
+			a.warnPlayerOfLockout(link.Player, ip)
+		}
+		link.Attempts++
+		if link.Attempts >= loginCodeMaxAttempts {
+			_, err = a.db.NewDelete().Model(link).WherePK().Exec(c.Request.Context())
+			formData = gin.H{"ServerError": "Too many wrong codes, ask for a new link."}
+		} else {
+			_, err = a.db.NewUpdate().Model(link).Column("attempts").WherePK().Exec(c.Request.Context())
+			formData["Errors"] = map[string]string{"code": "invalid code provided"}
+		}
+		if err != nil {
+			log.Err(err).Int("loginLinkID", link.ID).Msg("failed to record wrong login code")
+		}
+		c.HTML(http.StatusOK, "partials/login-link.html", formData)
+		return
+	}
+	a.logins.Succeed(account)
+	a.completeLoginLink(c, link)
+}
+
+// completeLoginLink uses up the link and starts the session.
+func (a *Api) completeLoginLink(c *gin.Context, link *LoginLink) {
+	err := consumeSingleUse(c.Request.Context(), a.db, link)
+	if err != nil {
+		log.Err(err).Int("loginLinkID", link.ID).Msg("failed to use up login link")
+		c.HTML(http.StatusOK, "pages/login-code.html", gin.H{"Invalid": true})
+		return
+	}
+	setCookie(c, loginLinkCookieName, "", -1, true)
+
+	log.Info().Int("playerID", link.PlayerID).Msg("signed in with login link")
+	// NOTE: the link only ever went to the player's discord DMs
+	err = a.verifyDiscordAccount(c.Request.Context(), link.Player)
+	if err == nil {
+		err = a.createSession(c, link.Player, false)
+	}
+	if errors.Is(err, ErrPlayerBanned) {
+		a.forbidden(c, "This account has been banned.")
+	} else if isGuildMembershipError(err) {
+		a.forbidden(c, guildMembershipMessage(err))
+	} else if err != nil {
+		c.String(http.StatusInternalServerError, "Failed to start your session, please try again.")
+	}
+}
+
+// newLoginCode returns a six digit code, short enough to read off a phone and type in elsewhere.
+func newLoginCode() (string, error) {
+	n, err := rand.Int(rand.Reader, big.NewInt(1_000_000))
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%06d", n.Int64()), nil
+}
@@ -0,0 +1,146 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+// matrixMessage is an m.room.message event, with an HTML body for clients that render it and a plaintext one
+// for those that don't.
+type matrixMessage struct {
+	MsgType       string         `json:"msgtype"`
+	Body          string         `json:"body"`
+	Format        string         `json:"format"`
+	FormattedBody string         `json:"formatted_body"`
+	Mentions      matrixMentions `json:"m.mentions"`
+}
+
+// matrixMentions is who the message pings, see https://spec.matrix.org/v1.10/client-server-api/#user-and-room-mentions
+type matrixMentions struct {
+	Room bool `json:"room,omitempty"`
+}
+
+// matrixNotifier posts announcements to the room mapped to the guild, through the client-server API as the
+// user the access token belongs to. Players have no matrix account on file, so there's no one to Send to.
+type matrixNotifier struct {
+	homeserverURL string
+	accessToken   string
+	roomID        string
+}
+
+func newMatrixNotifier(a *Api) (Notifier, error) {
+	config := Config.MatrixConfig
+	if config.HomeserverURL == "" || config.AccessToken == "" {
+		return nil, errors.New("MATRIX_HOMESERVER_URL and MATRIX_ACCESS_TOKEN have to be set")
+	}
+	parsed, err := url.ParseRequestURI(config.HomeserverURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, errors.New("MATRIX_HOMESERVER_URL has to be an absolute http(s) url")
+	}
+	roomID := guildChannel(config.Rooms)
+	if roomID == "" {
+		return nil, fmt.Errorf("MATRIX_ROOMS has no room for guild %s", Config.DiscordConfig.GuildID)
+	}
+	return &matrixNotifier{homeserverURL: config.HomeserverURL, accessToken: config.AccessToken, roomID: roomID}, nil
+}
+
+func (m *matrixNotifier) Name() string {
+	return "matrix"
+}
+
+// attendeeNames lists who's going to the playdate, for the platforms we can't mention players on.
+func attendeeNames(n *Notification) []string {
+	names := []string{}
+	for _, attendance := range n.Attendees {
+		names = append(names, attendance.Player.Name)
+	}
+	return names
+}
+
+func (m *matrixNotifier) Announce(ctx context.Context, n *Notification) error {
+	playdate := n.PlayDate
+	game := "<strong>" + html.EscapeString(playdate.Game) + "</strong>"
+	when := html.EscapeString(channelTime(playdate.Date))
+	link := fmt.Sprintf(`<a href="%s">Check it out here</a>`, html.EscapeString(n.Link()))
+	owner := html.EscapeString(playdate.Owner.Name)
+	actor := html.EscapeString(n.ActorName())
+
+	msg := matrixMessage{MsgType: "m.notice", Format: "org.matrix.custom.html"}
+	switch n.Event {
+	case NotificationPlayDateCreated:
+		msg.FormattedBody = fmt.Sprintf("New playdate %s on %s by %s! %s", game, when, owner, link)
+	case NotificationPlayDateReminder:
+		msg.FormattedBody = fmt.Sprintf("Playdate %s by %s starts on %s! %s", game, owner, when, link)
+	case NotificationPlayDateStarted:
+		// NOTE: a ping for the whole room stands in for mentioning attendees, notices never notify anyone
+		msg.MsgType = "m.text"
+		msg.Mentions.Room = true
+		msg.FormattedBody = fmt.Sprintf("@room Playdate %s by %s is happening now! Make sure to join 🎮", game, owner)
+	case NotificationPlayDateUpdated:
+		if n.Previous != nil && n.Previous.OwnerId != playdate.OwnerId {
+			msg.FormattedBody = fmt.Sprintf("Playdate %s on %s now belongs to %s. %s", game, when, owner, link)
+		} else {
+			msg.FormattedBody = fmt.Sprintf("Playdate %s is now on %s, changed by %s. %s", game, when, actor, link)
+		}
+	case NotificationPlayDateCancelled:
+		msg.FormattedBody = fmt.Sprintf("Playdate %s on %s was cancelled by %s.", game, when, actor)
+	case NotificationAttendanceChanged:
+		msg.FormattedBody = fmt.Sprintf("%s said %s to playdate %s on %s. %s", actor, n.Attending, game, when, link)
+	default:
+		return nil
+	}
+	if names := attendeeNames(n); len(names) > 0 && (n.Event == NotificationPlayDateReminder || n.Event == NotificationPlayDateStarted) {
+		msg.FormattedBody += "<br>Going: " + html.EscapeString(strings.Join(names, ", "))
+	}
+	msg.Body = matrixPlaintext(msg.FormattedBody, n.Link())
+	return m.send(ctx, msg, fmt.Sprintf("playdate-%d-%s-%d", playdate.ID, n.Event, time.Now().UnixNano()))
+}
+
+func (m *matrixNotifier) Send(ctx context.Context, player *Player, n *Notification) error {
+	return nil
+}
+
+// matrixPlaintext turns the formatted body into the plaintext fallback, links end up as bare URLs.
+func matrixPlaintext(formatted string, link string) string {
+	replacer := strings.NewReplacer(
+		"<strong>", "", "</strong>", "",
+		"<br>", "\n",
+		fmt.Sprintf(`<a href="%s">Check it out here</a>`, html.EscapeString(link)), "Check it out here: "+link,
+	)
+	return html.UnescapeString(replacer.Replace(formatted))
+}
+
+// send puts the message in the room. The transaction ID makes the homeserver drop the message if it already
+// got it, should the request be retried.
+func (m *matrixNotifier) send(ctx context.Context, msg matrixMessage, txnID string) error {
+	body, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	endpoint := fmt.Sprintf("%s/_matrix/client/v3/rooms/%s/send/m.room.message/%s", m.homeserverURL, url.PathEscape(m.roomID), url.PathEscape(txnID))
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", "Bearer "+m.accessToken)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := chatClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		answer, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("matrix answered %s: %s", resp.Status, answer)
+	}
+	return nil
+}
@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"encoding/json"
 	"time"
 
 	"github.com/uptrace/bun"
@@ -16,10 +17,30 @@ func InitializeManyToManyRelationships(db *bun.DB) {
 type PlayDateStatus string
 
 const (
-	PlayDateStatusPending PlayDateStatus = "pending"
-	PlayDateStatusDone    PlayDateStatus = "done"
+	PlayDateStatusPending   PlayDateStatus = "pending"
+	PlayDateStatusDone      PlayDateStatus = "done"
+	PlayDateStatusCancelled PlayDateStatus = "cancelled"
 )
 
+// Role is what a player is allowed to do, see rolePermissions.
+type Role string
+
+const (
+	RoleMember    Role = "member"
+	RoleModerator Role = "moderator"
+	RoleAdmin     Role = "admin"
+)
+
+// RoleFrom parses a role from a form or command option, anything unknown is a plain member.
+func RoleFrom(s string) Role {
+	switch Role(s) {
+	case RoleModerator, RoleAdmin:
+		return Role(s)
+	default:
+		return RoleMember
+	}
+}
+
 type Attendance string
 
 const (
@@ -48,6 +69,8 @@ type PlayDate struct {
 	Date        time.Time      `bun:"date,nullzero" json:"date"`
 	Status      PlayDateStatus `bun:"status,notnull,default:'pending',type:playdate_status"`
 	OwnerId     int            `bun:"owner_id,notnull"`
+	// when the reminder before it starts went out, cleared when the date changes
+	RemindedDate time.Time `bun:"reminded_date,nullzero" json:"-"`
 
 	// just relationship fields for bun to utilize
 	Players     []*Player           `bun:"m2m:playdate_player,join:PlayDate=Player"`
@@ -58,20 +81,62 @@ type PlayDate struct {
 type Player struct {
 	bun.BaseModel `bun:"table:player"`
 
-	ID               int       `bun:",pk,autoincrement" json:"id"`
-	CreatedDate      time.Time `bun:"created_date,nullzero,default:CURRENT_TIMESTAMP" json:"created_date"`
-	Name             string    `bun:"name,notnull,unique" json:"name"`
-	Password         string    `bun:"password,notnull"`
-	DiscordID        string    `bun:"discord_id,notnull,unique" json:"discord_id"`
-	VerificationCode string    `bun:"verification_code,notnull" json:"verification_code"`
-	SessionId        string    `bun:"session_id,notnull"`
-	OAuthToken       string    `bun:"oauth_token"`
+	ID          int       `bun:",pk,autoincrement" json:"id"`
+	CreatedDate time.Time `bun:"created_date,nullzero,default:CURRENT_TIMESTAMP" json:"created_date"`
+	Name        string    `bun:"name,notnull,unique" json:"name"`
+	Password    string    `bun:"password,notnull"`
+	// NOTE: false for players created through discord, until they pick a password of their own
+	PasswordSet bool   `bun:"password_set,notnull" json:"-"`
+	DiscordID   string `bun:"discord_id,notnull,unique" json:"discord_id"`
+	// set once the player proved DiscordID is theirs, see verifyDiscordAccount
+	DiscordVerifiedDate time.Time `bun:"discord_verified_date,nullzero" json:"-"`
+	Role                Role      `bun:"role,notnull,default:'member',type:player_role" json:"role"`
+	// random user handle given to passkeys, created the first time the player registers one
+	WebAuthnHandle []byte `bun:"webauthn_handle,nullzero" json:"-"`
+	// AES-GCM encrypted authenticator secret, only asked for at sign in once TOTPEnabled is confirmed
+	TOTPSecret   string `bun:"totp_secret,nullzero" json:"-"`
+	TOTPEnabled  bool   `bun:"totp_enabled,notnull" json:"-"`
+	TOTPLastStep int64  `bun:"totp_last_step,notnull" json:"-"`
+	// set while an admin has banned the player, they can't sign in or use the bot until it's cleared
+	BannedDate    time.Time `bun:"banned_date,nullzero" json:"-"`
+	LastLoginDate time.Time `bun:"last_login_date,nullzero" json:"-"`
+	// set once the player deleted their account, everything identifying them is gone by then
+	DeletedDate time.Time `bun:"deleted_date,nullzero" json:"-"`
+	// avatar hash from the player's last discord login, empty means discord's default avatar
+	DiscordAvatar string `bun:"discord_avatar,nullzero" json:"-"`
+	// IANA timezone and clock the site shows times in for the player
+	Timezone string `bun:"timezone,notnull,default:'America/New_York'" json:"-"`
+	Clock24h bool   `bun:"clock_24h,notnull" json:"-"`
+	// remind the player when a playdate they're going to is about to start, and when it does
+	NotifyStarting bool `bun:"notify_starting,notnull,default:true" json:"-"`
+	// tell the player when a playdate they're going to is moved or cancelled
+	NotifyChanges bool `bun:"notify_changes,notnull" json:"-"`
+	// email the player about every new playdate, the guild channel already hears about them on discord
+	NotifyCreated bool `bun:"notify_created,notnull" json:"-"`
+	// only set once verified, see EmailVerification
+	Email             string    `bun:"email,nullzero" json:"-"`
+	EmailVerifiedDate time.Time `bun:"email_verified_date,nullzero" json:"-"`
 
 	// just relationship fields for bun to utilize
 	Attendances []*PlayDateToPlayer `bun:"rel:has-many,join:id=player_id"`
 	PlayDates   []*PlayDate         `bun:"m2m:playdate_player,join:Player=PlayDate"`
 }
 
+// Banned reports whether an admin has banned the player.
+func (p *Player) Banned() bool {
+	return !p.BannedDate.IsZero()
+}
+
+// DiscordVerified reports whether the player proved they own their discord account.
+func (p *Player) DiscordVerified() bool {
+	return !p.DiscordVerifiedDate.IsZero()
+}
+
+// Deleted reports whether the player deleted their account.
+func (p *Player) Deleted() bool {
+	return !p.DeletedDate.IsZero()
+}
+
 type PlayDateToPlayer struct {
 	bun.BaseModel `bun:"table:playdate_player"`
 
@@ -83,3 +148,332 @@ type PlayDateToPlayer struct {
 	PlayDate *PlayDate `bun:"rel:belongs-to,join:playdate_id=id"`
 	Player   *Player   `bun:"rel:belongs-to,join:player_id=id"`
 }
+
+type WebhookDeliveryStatus string
+
+const (
+	WebhookDeliveryStatusPending   WebhookDeliveryStatus = "pending"
+	WebhookDeliveryStatusDelivered WebhookDeliveryStatus = "delivered"
+	WebhookDeliveryStatusFailed    WebhookDeliveryStatus = "failed"
+)
+
+type WebhookEndpoint struct {
+	bun.BaseModel `bun:"table:webhook_endpoint"`
+
+	ID          int       `bun:",pk,autoincrement" json:"id"`
+	CreatedDate time.Time `bun:"created_date,nullzero,default:CURRENT_TIMESTAMP" json:"created_date"`
+	URL         string    `bun:"url,notnull" json:"url"`
+	Secret      string    `bun:"secret,notnull" json:"-"`
+	Events      []string  `bun:"events,array" json:"events"`
+	Active      bool      `bun:"active,notnull,default:true" json:"active"`
+}
+
+// Subscribed reports whether the endpoint wants to receive the given event. An
+// endpoint without any configured events receives everything.
+func (w *WebhookEndpoint) Subscribed(event WebhookEvent) bool {
+	if len(w.Events) == 0 {
+		return true
+	}
+	for _, e := range w.Events {
+		if e == string(event) {
+			return true
+		}
+	}
+	return false
+}
+
+type WebhookDelivery struct {
+	bun.BaseModel `bun:"table:webhook_delivery"`
+
+	ID              int                   `bun:",pk,autoincrement" json:"id"`
+	UUID            string                `bun:"uuid,notnull,unique" json:"uuid"`
+	EndpointID      int                   `bun:"endpoint_id,notnull" json:"endpoint_id"`
+	Event           WebhookEvent          `bun:"event,notnull" json:"event"`
+	Payload         json.RawMessage       `bun:"payload,type:jsonb,notnull" json:"payload"`
+	Status          WebhookDeliveryStatus `bun:"status,notnull,default:'pending',type:webhook_delivery_status" json:"status"`
+	Attempts        int                   `bun:"attempts,notnull" json:"attempts"`
+	NextAttemptDate time.Time             `bun:"next_attempt_date,nullzero,default:CURRENT_TIMESTAMP" json:"next_attempt_date"`
+	LastStatusCode  int                   `bun:"last_status_code,nullzero" json:"last_status_code"`
+	LastError       string                `bun:"last_error,nullzero" json:"last_error"`
+	CreatedDate     time.Time             `bun:"created_date,nullzero,default:CURRENT_TIMESTAMP" json:"created_date"`
+	DeliveredDate   time.Time             `bun:"delivered_date,nullzero" json:"delivered_date"`
+
+	// just relationship fields for bun to utilize
+	Endpoint *WebhookEndpoint `bun:"rel:belongs-to,join:endpoint_id=id"`
+}
+
+type DiscordOutboxStatus string
+
+const (
+	DiscordOutboxStatusPending DiscordOutboxStatus = "pending"
+	DiscordOutboxStatusSent    DiscordOutboxStatus = "sent"
+	// gave up after discordOutboxMaxAttempts, or discord said it will never work. Only an admin retries these
+	DiscordOutboxStatusDead DiscordOutboxStatus = "dead"
+)
+
+type DiscordMessageKind string
+
+const (
+	// a message to a channel, the target is its channel ID
+	DiscordMessageChannel DiscordMessageKind = "channel"
+	// a DM, the target is the player's discord ID
+	DiscordMessageDirect DiscordMessageKind = "direct"
+)
+
+// DiscordOutboxMessage is a discord message waiting to be sent by the outbox worker, see discordoutbox.go.
+type DiscordOutboxMessage struct {
+	bun.BaseModel `bun:"table:discord_outbox"`
+
+	ID      int                `bun:",pk,autoincrement" json:"id"`
+	Kind    DiscordMessageKind `bun:"kind,notnull" json:"kind"`
+	Target  string             `bun:"target,notnull" json:"target"`
+	Content string             `bun:"content,notnull" json:"content"`
+	// add the attendance reactions once it's sent, so players can answer the playdate from discord
+	AddReactions    bool                `bun:"add_reactions,notnull" json:"add_reactions"`
+	PlayDateID      int                 `bun:"playdate_id,nullzero" json:"playdate_id"`
+	Status          DiscordOutboxStatus `bun:"status,notnull,default:'pending',type:discord_outbox_status" json:"status"`
+	Attempts        int                 `bun:"attempts,notnull" json:"attempts"`
+	NextAttemptDate time.Time           `bun:"next_attempt_date,nullzero,default:CURRENT_TIMESTAMP" json:"next_attempt_date"`
+	LastError       string              `bun:"last_error,nullzero" json:"last_error"`
+	MessageID       string              `bun:"message_id,nullzero" json:"message_id"`
+	CreatedDate     time.Time           `bun:"created_date,nullzero,default:CURRENT_TIMESTAMP" json:"created_date"`
+	SentDate        time.Time           `bun:"sent_date,nullzero" json:"sent_date"`
+}
+
+type Session struct {
+	bun.BaseModel `bun:"table:session"`
+
+	ID           int       `bun:",pk,autoincrement" json:"id"`
+	IDHash       string    `bun:"id_hash,notnull,unique" json:"-"`
+	PlayerID     int       `bun:"player_id,notnull" json:"player_id"`
+	CreatedDate  time.Time `bun:"created_date,nullzero,default:CURRENT_TIMESTAMP" json:"created_date"`
+	LastSeenDate time.Time `bun:"last_seen_date,nullzero,default:CURRENT_TIMESTAMP" json:"last_seen_date"`
+	UserAgent    string    `bun:"user_agent" json:"user_agent"`
+	IP           string    `bun:"ip" json:"ip"`
+	ExpiresDate  time.Time `bun:"expires_date,notnull" json:"expires_date"`
+	CSRFToken    string    `bun:"csrf_token,notnull" json:"-"`
+	// an account merge waiting on the player's confirmation, see requestAccountMerge
+	MergePlayerID    int       `bun:"merge_player_id,nullzero" json:"-"`
+	MergeExpiresDate time.Time `bun:"merge_expires_date,nullzero" json:"-"`
+	// when the session got past two-factor authentication or was started with a passkey
+	SecondFactorDate time.Time `bun:"second_factor_date,nullzero" json:"second_factor_date"`
+
+	// just relationship fields for bun to utilize
+	Player *Player `bun:"rel:belongs-to,join:player_id=id"`
+}
+
+// OAuthState is a pending Discord authorization, only usable by the browser holding the matching pre-auth cookie.
+type OAuthState struct {
+	bun.BaseModel `bun:"table:oauth_state"`
+
+	State        string    `bun:"state,pk"`
+	BindingHash  string    `bun:"binding_hash,notnull"`
+	CodeVerifier string    `bun:"code_verifier,notnull"`
+	CreatedDate  time.Time `bun:"created_date,nullzero,default:CURRENT_TIMESTAMP"`
+	ExpiresDate  time.Time `bun:"expires_date,notnull"`
+}
+
+// PlayerOAuthCredential holds the player's Discord tokens. Both tokens are AES-GCM encrypted, use
+// a DiscordTokenSource rather than reading them directly.
+type PlayerOAuthCredential struct {
+	bun.BaseModel `bun:"table:player_oauth_credential"`
+
+	ID           int       `bun:",pk,autoincrement"`
+	PlayerID     int       `bun:"player_id,notnull,unique"`
+	AccessToken  string    `bun:"access_token,notnull"`
+	RefreshToken string    `bun:"refresh_token,notnull"`
+	TokenType    string    `bun:"token_type,notnull"`
+	Scopes       string    `bun:"scopes,notnull"`
+	ExpiresDate  time.Time `bun:"expires_date,notnull"`
+	CreatedDate  time.Time `bun:"created_date,nullzero,default:CURRENT_TIMESTAMP"`
+	UpdatedDate  time.Time `bun:"updated_date,nullzero,default:CURRENT_TIMESTAMP"`
+}
+
+// VAPIDKey is the key pair web pushes are signed with, browsers tie every subscription to its public key. The
+// private key is AES-GCM encrypted.
+type VAPIDKey struct {
+	bun.BaseModel `bun:"table:vapid_key"`
+
+	ID          int       `bun:",pk"`
+	PublicKey   string    `bun:"public_key,notnull"`
+	PrivateKey  string    `bun:"private_key,notnull"`
+	CreatedDate time.Time `bun:"created_date,nullzero,default:CURRENT_TIMESTAMP"`
+}
+
+// PushSubscription is one of the player's browsers that asked for web push notifications.
+type PushSubscription struct {
+	bun.BaseModel `bun:"table:push_subscription"`
+
+	ID       int    `bun:",pk,autoincrement" json:"id"`
+	PlayerID int    `bun:"player_id,notnull" json:"player_id"`
+	Endpoint string `bun:"endpoint,notnull,unique" json:"endpoint"`
+	// the browser's public key and auth secret that payloads are encrypted for
+	P256DH       string    `bun:"p256dh,notnull" json:"-"`
+	Auth         string    `bun:"auth,notnull" json:"-"`
+	UserAgent    string    `bun:"user_agent" json:"user_agent"`
+	CreatedDate  time.Time `bun:"created_date,nullzero,default:CURRENT_TIMESTAMP" json:"created_date"`
+	LastUsedDate time.Time `bun:"last_used_date,nullzero" json:"last_used_date"`
+}
+
+// EmailVerification is an email address a player added that's waiting on them to open the link sent to it. Only
+// the hash of the link's nonce is stored.
+type EmailVerification struct {
+	bun.BaseModel `bun:"table:email_verification"`
+
+	ID          int       `bun:",pk,autoincrement"`
+	NonceHash   string    `bun:"nonce_hash,notnull,unique"`
+	PlayerID    int       `bun:"player_id,notnull"`
+	Email       string    `bun:"email,notnull"`
+	CreatedDate time.Time `bun:"created_date,nullzero,default:CURRENT_TIMESTAMP"`
+	ExpiresDate time.Time `bun:"expires_date,notnull"`
+
+	// just relationship fields for bun to utilize
+	Player *Player `bun:"rel:belongs-to,join:player_id=id"`
+}
+
+// PasswordReset is a pending "forgot password" link. Only the hash of the link's nonce is stored.
+type PasswordReset struct {
+	bun.BaseModel `bun:"table:password_reset"`
+
+	ID          int       `bun:",pk,autoincrement"`
+	NonceHash   string    `bun:"nonce_hash,notnull,unique"`
+	PlayerID    int       `bun:"player_id,notnull"`
+	CreatedDate time.Time `bun:"created_date,nullzero,default:CURRENT_TIMESTAMP"`
+	ExpiresDate time.Time `bun:"expires_date,notnull"`
+
+	// just relationship fields for bun to utilize
+	Player *Player `bun:"rel:belongs-to,join:player_id=id"`
+}
+
+// LoginLink is a pending passwordless sign in sent to the player over Discord. The browser that asked for it
+// holds the binding cookie, any other browser opening the link gets a code to type into that one instead.
+type LoginLink struct {
+	bun.BaseModel `bun:"table:login_link"`
+
+	ID          int       `bun:",pk,autoincrement"`
+	NonceHash   string    `bun:"nonce_hash,notnull,unique"`
+	PlayerID    int       `bun:"player_id,notnull"`
+	BindingHash string    `bun:"binding_hash,notnull"`
+	CodeHash    string    `bun:"code_hash,nullzero"`
+	Attempts    int       `bun:"attempts,notnull"`
+	CreatedDate time.Time `bun:"created_date,nullzero,default:CURRENT_TIMESTAMP"`
+	ExpiresDate time.Time `bun:"expires_date,notnull"`
+
+	// just relationship fields for bun to utilize
+	Player *Player `bun:"rel:belongs-to,join:player_id=id"`
+}
+
+// WebAuthnCredential is a passkey the player registered from their profile.
+type WebAuthnCredential struct {
+	bun.BaseModel `bun:"table:webauthn_credential"`
+
+	ID           int    `bun:",pk,autoincrement"`
+	PlayerID     int    `bun:"player_id,notnull"`
+	Name         string `bun:"name,notnull"`
+	CredentialID []byte `bun:"credential_id,notnull,unique"`
+	// the player's webauthn handle when the passkey was made, merged players' passkeys keep their old one
+	UserHandle      []byte    `bun:"user_handle,notnull"`
+	PublicKey       []byte    `bun:"public_key,notnull"`
+	AttestationType string    `bun:"attestation_type,notnull"`
+	Transports      []string  `bun:"transports,array"`
+	Flags           int       `bun:"flags,notnull"`
+	AAGUID          []byte    `bun:"aaguid"`
+	SignCount       int64     `bun:"sign_count,notnull"`
+	CreatedDate     time.Time `bun:"created_date,nullzero,default:CURRENT_TIMESTAMP"`
+	LastUsedDate    time.Time `bun:"last_used_date,nullzero"`
+
+	// just relationship fields for bun to utilize
+	Player *Player `bun:"rel:belongs-to,join:player_id=id"`
+}
+
+// WebAuthnCeremony holds the challenge for a passkey registration or sign in that is in progress, keyed by the
+// browser's ceremony cookie.
+type WebAuthnCeremony struct {
+	bun.BaseModel `bun:"table:webauthn_ceremony"`
+
+	BindingHash string          `bun:"binding_hash,pk"`
+	PlayerID    int             `bun:"player_id,nullzero"`
+	Data        json.RawMessage `bun:"data,type:jsonb,notnull"`
+	CreatedDate time.Time       `bun:"created_date,nullzero,default:CURRENT_TIMESTAMP"`
+	ExpiresDate time.Time       `bun:"expires_date,notnull"`
+}
+
+// TOTPRecoveryCode is a single use code that stands in for the authenticator app, only its hash is stored.
+type TOTPRecoveryCode struct {
+	bun.BaseModel `bun:"table:totp_recovery_code"`
+
+	ID          int       `bun:",pk,autoincrement"`
+	PlayerID    int       `bun:"player_id,notnull"`
+	CodeHash    string    `bun:"code_hash,notnull,unique"`
+	CreatedDate time.Time `bun:"created_date,nullzero,default:CURRENT_TIMESTAMP"`
+}
+
+// TOTPChallenge is a password sign in waiting on the player's authenticator code, held by the browser's
+// challenge cookie. No session exists until it's answered.
+type TOTPChallenge struct {
+	bun.BaseModel `bun:"table:totp_challenge"`
+
+	ID          int       `bun:",pk,autoincrement"`
+	BindingHash string    `bun:"binding_hash,notnull,unique"`
+	PlayerID    int       `bun:"player_id,notnull"`
+	Attempts    int       `bun:"attempts,notnull"`
+	CreatedDate time.Time `bun:"created_date,nullzero,default:CURRENT_TIMESTAMP"`
+	ExpiresDate time.Time `bun:"expires_date,notnull"`
+
+	// just relationship fields for bun to utilize
+	Player *Player `bun:"rel:belongs-to,join:player_id=id"`
+}
+
+type FailureSource string
+
+const (
+	FailureSourceBot      FailureSource = "bot"
+	FailureSourceWatchdog FailureSource = "watchdog"
+	FailureSourceNotifier FailureSource = "notifier"
+)
+
+// Failure is an error from the bot or watchdog kept around for the admin dashboard, see recordFailure.
+type Failure struct {
+	bun.BaseModel `bun:"table:failure"`
+
+	ID          int           `bun:",pk,autoincrement"`
+	CreatedDate time.Time     `bun:"created_date,nullzero,default:CURRENT_TIMESTAMP"`
+	Source      FailureSource `bun:"source,notnull"`
+	Message     string        `bun:"message,notnull"`
+	Error       string        `bun:"error,notnull"`
+}
+
+type AuditSource string
+
+const (
+	AuditSourceWeb      AuditSource = "web"
+	AuditSourceDiscord  AuditSource = "discord"
+	AuditSourceAPI      AuditSource = "api"
+	AuditSourceWatchdog AuditSource = "watchdog"
+	AuditSourceEmail    AuditSource = "email"
+)
+
+type AuditAction string
+
+const (
+	AuditActionCreate AuditAction = "create"
+	AuditActionUpdate AuditAction = "update"
+	AuditActionDelete AuditAction = "delete"
+)
+
+// AuditEvent is one change to a playdate, player or attendance, see recordAudit. The table is append-only.
+type AuditEvent struct {
+	bun.BaseModel `bun:"table:audit_event"`
+
+	ID          int64           `bun:",pk,autoincrement" json:"id"`
+	CreatedDate time.Time       `bun:"created_date,nullzero,default:CURRENT_TIMESTAMP" json:"created_date"`
+	ActorID     int             `bun:"actor_id,nullzero" json:"actor_id,omitempty"`
+	ActorName   string          `bun:"actor_name,notnull" json:"actor_name"`
+	Source      AuditSource     `bun:"source,notnull" json:"source"`
+	Action      AuditAction     `bun:"action,notnull" json:"action"`
+	TargetType  string          `bun:"target_type,notnull" json:"target_type"`
+	TargetID    string          `bun:"target_id,notnull" json:"target_id"`
+	PlayDateID  int             `bun:"playdate_id,nullzero" json:"playdate_id,omitempty"`
+	Before      json.RawMessage `bun:"before,type:jsonb,nullzero" json:"before,omitempty"`
+	After       json.RawMessage `bun:"after,type:jsonb,nullzero" json:"after,omitempty"`
+}
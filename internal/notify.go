@@ -0,0 +1,261 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/uptrace/bun"
+)
+
+// chatClient posts announcements to matrix and slack.
+var chatClient = &http.Client{Timeout: 10 * time.Second}
+
+type NotificationEvent string
+
+const (
+	NotificationPlayDateCreated   NotificationEvent = "playdate.created"
+	NotificationPlayDateReminder  NotificationEvent = "playdate.reminder"
+	NotificationPlayDateStarted   NotificationEvent = "playdate.started"
+	NotificationPlayDateUpdated   NotificationEvent = "playdate.updated"
+	NotificationPlayDateCancelled NotificationEvent = "playdate.cancelled"
+	NotificationAttendanceChanged NotificationEvent = "attendance.changed"
+)
+
+// Notification is something that happened to a playdate that players might want to hear about.
+type Notification struct {
+	Event    NotificationEvent
+	PlayDate *PlayDate
+	// how the playdate was before it was updated, only set for playdate.updated
+	Previous *PlayDate
+	// who made it happen, nil when it was the watchdog
+	Actor *Player
+	// what the actor changed their attendance to, only set for attendance.changed
+	Attending Attendance
+	// everyone going to the playdate or maybe going, loaded by the dispatcher
+	Attendees []*PlayDateToPlayer
+	// whether the event was announced to the guild, notifiers that mention attendees in their announcement can
+	// skip sending it to them again
+	Announced bool
+	// the queued notifiers already ran in the transaction that made the change, see queueNotification
+	queued bool
+}
+
+// Link is where the playdate can be found on the site.
+func (n *Notification) Link() string {
+	return fmt.Sprintf("%s/playdate/%d", Config.PublicURL, n.PlayDate.ID)
+}
+
+// ActorName is who to credit for the event in a message.
+func (n *Notification) ActorName() string {
+	if n.Actor == nil {
+		return "PlayDate"
+	}
+	return n.Actor.Name
+}
+
+// guildChannel picks where a chat notifier announces for the configured discord guild, falling back to the
+// entry without a guild. A server only serves that one guild, so the notifiers look it up once when they start.
+func guildChannel(channels map[string]string) string {
+	if channel, ok := channels[Config.DiscordConfig.GuildID]; ok {
+		return channel
+	}
+	return channels["*"]
+}
+
+// channelTime formats a time for a whole channel, nobody in particular is reading so it's in the site's timezone.
+func channelTime(t time.Time) string {
+	display := (*Player)(nil).TimeDisplay()
+	return display.Format(t) + " " + t.In(display.Location).Format("MST")
+}
+
+// Notifier is a transport notifications go out over. Notifiers return nil for events they have nothing to say
+// about, or for players they have no way of reaching.
+type Notifier interface {
+	Name() string
+	// Announce tells the whole guild about the event.
+	Announce(ctx context.Context, n *Notification) error
+	// Send tells one player about the event.
+	Send(ctx context.Context, player *Player, n *Notification) error
+}
+
+// queuedNotifier is a notifier that only writes its messages to the database for a worker to send, so it can run
+// inside the transaction making the change, see queueNotification.
+type queuedNotifier interface {
+	Notifier
+	// WithTx is the notifier writing its messages in the transaction.
+	WithTx(tx bun.IDB) Notifier
+	// Committed wakes up whatever sends the messages, once the transaction they were written in commits.
+	Committed()
+}
+
+// notifierFactories builds the notifiers Config.Notifiers can pick from by name, a new transport only needs
+// adding here.
+var notifierFactories = map[string]func(a *Api) (Notifier, error){
+	"discord": newDiscordNotifier,
+	"email":   newEmailNotifier,
+	"webpush": newWebPushNotifier,
+	"matrix":  newMatrixNotifier,
+	"slack":   newSlackNotifier,
+}
+
+// notificationDispatcher fans every notification out to each configured notifier, once for the guild when it's
+// one of Config.NotifyGuildEvents and once for every attendee who asked to hear about it.
+type notificationDispatcher struct {
+	notifiers   []Notifier
+	guildEvents map[NotificationEvent]bool
+}
+
+func newNotificationDispatcher(a *Api) *notificationDispatcher {
+	d := &notificationDispatcher{guildEvents: map[NotificationEvent]bool{}}
+	for _, name := range Config.Notifiers {
+		factory, ok := notifierFactories[name]
+		if !ok {
+			log.Error().Str("notifier", name).Msg("unknown notifier, skipping it")
+			continue
+		}
+		notifier, err := factory(a)
+		// NOTE: skipping a notifier that can't read its own keys would quietly drop everything it should send
+		if errors.Is(err, ErrTokenEncryptionKey) {
+			log.Panic().Err(err).Str("notifier", name).Msg("refusing to start with a TOKEN_ENCRYPTION_KEY that can't read the notifier's secrets, put back the old key or take it out of NOTIFIERS")
+		}
+		if err != nil {
+			log.Err(err).Str("notifier", name).Msg("failed to set up notifier, skipping it")
+			continue
+		}
+		d.notifiers = append(d.notifiers, notifier)
+	}
+	for _, event := range Config.NotifyGuildEvents {
+		d.guildEvents[NotificationEvent(event)] = true
+	}
+	log.Info().Strs("notifiers", Config.Notifiers).Strs("guildEvents", Config.NotifyGuildEvents).Msg("configured notifications")
+	return d
+}
+
+// wantsNotification reports whether the player asked to be told about the event from their profile.
+func (p *Player) wantsNotification(event NotificationEvent) bool {
+	if p.Banned() || p.Deleted() {
+		return false
+	}
+	switch event {
+	case NotificationPlayDateReminder, NotificationPlayDateStarted:
+		return p.NotifyStarting
+	case NotificationPlayDateUpdated, NotificationPlayDateCancelled:
+		return p.NotifyChanges
+	default:
+		return false
+	}
+}
+
+// notify sends the notification in the background, since most notifiers need a call or two per player. The
+// playdate is copied so the caller is free to keep using theirs.
+func (a *Api) notify(n Notification) {
+	playdate := *n.PlayDate
+	n.PlayDate = &playdate
+	go a.dispatchNotification(&n)
+}
+
+// queueNotification runs the queued notifiers inside the transaction making the change, failing it when they
+// can't write their messages. That way the change and the messages about it are saved together or not at all.
+// Pass the notification to notify once the transaction commits, for the rest of the notifiers.
+func (a *Api) queueNotification(ctx context.Context, tx bun.Tx, n *Notification) error {
+	if err := findNotificationOwner(ctx, tx, n); err != nil {
+		return fmt.Errorf("failed to find owner of playdate to notify about: %w", err)
+	}
+	if err := findNotificationAttendees(ctx, tx, n); err != nil {
+		return fmt.Errorf("failed to find attendees to notify: %w", err)
+	}
+	notifiers := []Notifier{}
+	for _, notifier := range a.notifications.notifiers {
+		if queued, ok := notifier.(queuedNotifier); ok {
+			notifiers = append(notifiers, queued.WithTx(tx))
+		}
+	}
+	errs := []error{}
+	a.fanOutNotification(ctx, n, notifiers, func(notifier Notifier, player *Player, err error) {
+		errs = append(errs, fmt.Errorf("%s: %w", notifier.Name(), err))
+	})
+	n.queued = true
+	return errors.Join(errs...)
+}
+
+func findNotificationOwner(ctx context.Context, db bun.IDB, n *Notification) error {
+	if n.PlayDate.Owner != nil {
+		return nil
+	}
+	owner := &Player{ID: n.PlayDate.OwnerId}
+	if err := db.NewSelect().Model(owner).WherePK().Scan(ctx); err != nil {
+		return err
+	}
+	n.PlayDate.Owner = owner
+	return nil
+}
+
+func findNotificationAttendees(ctx context.Context, db bun.IDB, n *Notification) error {
+	n.Attendees = nil
+	return db.NewSelect().
+		Model(&n.Attendees).
+		Relation("Player").
+		Where("playdate_id = ?", n.PlayDate.ID).
+		Where("attending != ?", AttendanceNo).
+		Order("player.name asc").
+		Scan(ctx)
+}
+
+func (a *Api) dispatchNotification(n *Notification) {
+	ctx := a.ctx
+	if err := findNotificationOwner(ctx, a.db, n); err != nil {
+		log.Err(err).Int("playdateID", n.PlayDate.ID).Msg("failed to find owner of playdate to notify about")
+		a.recordFailure(FailureSourceNotifier, fmt.Sprintf("failed to find the owner of playdate %d for %s", n.PlayDate.ID, n.Event), err)
+		return
+	}
+	if err := findNotificationAttendees(ctx, a.db, n); err != nil {
+		// NOTE: the guild still hears about it, only the attendees miss out
+		log.Err(err).Int("playdateID", n.PlayDate.ID).Msg("failed to find attendees to notify")
+		a.recordFailure(FailureSourceNotifier, fmt.Sprintf("failed to find who to tell about %s for playdate %d", n.Event, n.PlayDate.ID), err)
+	}
+
+	notifiers := []Notifier{}
+	for _, notifier := range a.notifications.notifiers {
+		if queued, ok := notifier.(queuedNotifier); ok && n.queued {
+			queued.Committed()
+			continue
+		}
+		notifiers = append(notifiers, notifier)
+	}
+	a.fanOutNotification(ctx, n, notifiers, func(notifier Notifier, player *Player, err error) {
+		if player == nil {
+			log.Err(err).Str("notifier", notifier.Name()).Any("event", n.Event).Int("playdateID", n.PlayDate.ID).Msg("failed to announce notification")
+			a.recordFailure(FailureSourceNotifier, fmt.Sprintf("%s failed to announce %s for playdate %d", notifier.Name(), n.Event, n.PlayDate.ID), err)
+			return
+		}
+		log.Err(err).Str("notifier", notifier.Name()).Any("event", n.Event).Int("playdateID", n.PlayDate.ID).Int("playerID", player.ID).Msg("failed to send notification")
+		a.recordFailure(FailureSourceNotifier, fmt.Sprintf("%s failed to send %s for playdate %d to player %d", notifier.Name(), n.Event, n.PlayDate.ID, player.ID), err)
+	})
+}
+
+// fanOutNotification announces the notification with each notifier when it's a guild event, and sends it to every
+// attendee who asked for it besides whoever made it happen. Failures go to report, with a nil player for
+// announcements.
+func (a *Api) fanOutNotification(ctx context.Context, n *Notification, notifiers []Notifier, report func(notifier Notifier, player *Player, err error)) {
+	n.Announced = a.notifications.guildEvents[n.Event]
+	for _, notifier := range notifiers {
+		if n.Announced {
+			if err := notifier.Announce(ctx, n); err != nil {
+				report(notifier, nil, err)
+			}
+		}
+		for _, attendance := range n.Attendees {
+			player := attendance.Player
+			if (n.Actor != nil && player.ID == n.Actor.ID) || !player.wantsNotification(n.Event) {
+				continue
+			}
+			if err := notifier.Send(ctx, player, n); err != nil {
+				report(notifier, player, err)
+			}
+		}
+	}
+}
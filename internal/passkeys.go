@@ -0,0 +1,459 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/webauthn"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// ties an in progress passkey ceremony to the browser that started it
+	webauthnCookieName  = "playdate_webauthn"
+	webauthnCeremonyTTL = 5 * time.Minute
+	passkeyNameMaxLen   = 64
+)
+
+var (
+	ErrNoWebAuthnCeremony = errors.New("no passkey ceremony in progress for this browser")
+	ErrPasskeyCloned      = errors.New("passkey signature counter went backwards, it may have been cloned")
+)
+
+// newWebAuthn configures the relying party from the public url, passkeys only work on the host they were made for.
+func newWebAuthn() (*webauthn.WebAuthn, error) {
+	publicURL, err := url.Parse(Config.PublicURL)
+	if err != nil {
+		return nil, fmt.Errorf("invalid public url: %w", err)
+	}
+	return webauthn.New(&webauthn.Config{
+		RPID:          publicURL.Hostname(),
+		RPDisplayName: "PlayDate",
+		RPOrigins:     []string{Config.PublicURL},
+		AuthenticatorSelection: protocol.AuthenticatorSelection{
+			ResidentKey:      protocol.ResidentKeyRequirementRequired,
+			UserVerification: protocol.VerificationPreferred,
+		},
+	})
+}
+
+// passkeyUser adapts a player and their passkeys to what the webauthn library expects.
+type passkeyUser struct {
+	player      *Player
+	credentials []*WebAuthnCredential
+	// the user handle a sign in presented, only differs from the player's for passkeys merged from another player
+	handle []byte
+}
+
+func (u *passkeyUser) WebAuthnID() []byte {
+	if len(u.handle) > 0 {
+		return u.handle
+	}
+	return u.player.WebAuthnHandle
+}
+
+func (u *passkeyUser) WebAuthnName() string {
+	return u.player.Name
+}
+
+func (u *passkeyUser) WebAuthnDisplayName() string {
+	return u.player.Name
+}
+
+func (u *passkeyUser) WebAuthnCredentials() []webauthn.Credential {
+	credentials := make([]webauthn.Credential, 0, len(u.credentials))
+	for _, c := range u.credentials {
+		credentials = append(credentials, c.Credential())
+	}
+	return credentials
+}
+
+// Credential converts the stored passkey back into the library's representation.
+func (c *WebAuthnCredential) Credential() webauthn.Credential {
+	transports := make([]protocol.AuthenticatorTransport, 0, len(c.Transports))
+	for _, t := range c.Transports {
+		transports = append(transports, protocol.AuthenticatorTransport(t))
+	}
+	return webauthn.Credential{
+		ID:              c.CredentialID,
+		PublicKey:       c.PublicKey,
+		AttestationType: c.AttestationType,
+		Transport:       transports,
+		Flags:           webauthn.NewCredentialFlags(protocol.AuthenticatorFlags(c.Flags)),
+		Authenticator: webauthn.Authenticator{
+			AAGUID:    c.AAGUID,
+			SignCount: uint32(c.SignCount),
+		},
+	}
+}
+
+func newWebAuthnCredential(player *Player, name string, credential *webauthn.Credential) *WebAuthnCredential {
+	transports := make([]string, 0, len(credential.Transport))
+	for _, t := range credential.Transport {
+		transports = append(transports, string(t))
+	}
+	return &WebAuthnCredential{
+		PlayerID:        player.ID,
+		Name:            name,
+		CredentialID:    credential.ID,
+		UserHandle:      player.WebAuthnHandle,
+		PublicKey:       credential.PublicKey,
+		AttestationType: credential.AttestationType,
+		Transports:      transports,
+		Flags:           int(credential.Flags.ProtocolValue()),
+		AAGUID:          credential.Authenticator.AAGUID,
+		SignCount:       int64(credential.Authenticator.SignCount),
+	}
+}
+
+// loadPasskeyUser loads the player's passkeys, giving the player a user handle first if they don't have one yet.
+func (a *Api) loadPasskeyUser(ctx context.Context, player *Player) (*passkeyUser, error) {
+	if len(player.WebAuthnHandle) == 0 {
+		handle := make([]byte, 32)
+		if _, err := rand.Read(handle); err != nil {
+			return nil, err
+		}
+		player.WebAuthnHandle = handle
+		_, err := a.db.NewUpdate().Model(player).Column("webauthn_handle").WherePK().Exec(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("failed to store webauthn handle: %w", err)
+		}
+	}
+
+	credentials := []*WebAuthnCredential{}
+	err := a.db.NewSelect().Model(&credentials).Where("player_id = ?", player.ID).Order("created_date asc").Scan(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load passkeys: %w", err)
+	}
+	return &passkeyUser{player: player, credentials: credentials}, nil
+}
+
+// saveWebAuthnCeremony remembers the challenge for the browser holding the binding, replacing any earlier one.
+func (a *Api) saveWebAuthnCeremony(ctx context.Context, binding string, playerID int, session *webauthn.SessionData) error {
+	data, err := json.Marshal(session)
+	if err != nil {
+		return err
+	}
+	ceremony := &WebAuthnCeremony{
+		BindingHash: hashSessionToken(binding),
+		PlayerID:    playerID,
+		Data:        data,
+		ExpiresDate: time.Now().Add(webauthnCeremonyTTL),
+	}
+	err = deleteExpired(ctx, a.db, (*WebAuthnCeremony)(nil), 0)
+	if err != nil {
+		return err
+	}
+	_, err = a.db.NewInsert().
+		Model(ceremony).
+		On("CONFLICT (binding_hash) DO UPDATE").
+		Set("player_id = EXCLUDED.player_id").
+		Set("data = EXCLUDED.data").
+		Set("expires_date = EXCLUDED.expires_date").
+		Exec(ctx)
+	return err
+}
+
+// consumeWebAuthnCeremony takes the browser's ceremony so a challenge can only ever be answered once.
+func (a *Api) consumeWebAuthnCeremony(ctx context.Context, binding string) (*WebAuthnCeremony, *webauthn.SessionData, error) {
+	if binding == "" {
+		return nil, nil, ErrNoWebAuthnCeremony
+	}
+	ceremony := &WebAuthnCeremony{}
+	_, err := a.db.NewDelete().
+		Model(ceremony).
+		Where("binding_hash = ?", hashSessionToken(binding)).
+		Where("expires_date > ?", time.Now()).
+		Returning("*").
+		Exec(ctx)
+	if err != nil {
+		return nil, nil, err
+	}
+	if ceremony.BindingHash == "" {
+		return nil, nil, ErrNoWebAuthnCeremony
+	}
+	session := &webauthn.SessionData{}
+	if err := json.Unmarshal(ceremony.Data, session); err != nil {
+		return nil, nil, err
+	}
+	return ceremony, session, nil
+}
+
+// startPasskeyRegistration starts adding a passkey for the player, returning the options for navigator.credentials.create.
+func (a *Api) startPasskeyRegistration(ctx context.Context, player *Player, binding string) (*protocol.CredentialCreation, error) {
+	user, err := a.loadPasskeyUser(ctx, player)
+	if err != nil {
+		return nil, err
+	}
+	exclusions := []protocol.CredentialDescriptor{}
+	for _, credential := range user.WebAuthnCredentials() {
+		exclusions = append(exclusions, credential.Descriptor())
+	}
+	creation, session, err := a.webauthn.BeginRegistration(user, webauthn.WithExclusions(exclusions))
+	if err != nil {
+		return nil, err
+	}
+	if err := a.saveWebAuthnCeremony(ctx, binding, player.ID, session); err != nil {
+		return nil, err
+	}
+	return creation, nil
+}
+
+// completePasskeyRegistration verifies the authenticator's attestation and stores the new passkey.
+func (a *Api) completePasskeyRegistration(ctx context.Context, player *Player, binding string, name string, body io.Reader) (*WebAuthnCredential, error) {
+	ceremony, session, err := a.consumeWebAuthnCeremony(ctx, binding)
+	if err != nil {
+		return nil, err
+	}
+	if ceremony.PlayerID != player.ID {
+		return nil, ErrNoWebAuthnCeremony
+	}
+	parsed, err := protocol.ParseCredentialCreationResponseBody(body)
+	if err != nil {
+		return nil, err
+	}
+	user, err := a.loadPasskeyUser(ctx, player)
+	if err != nil {
+		return nil, err
+	}
+	credential, err := a.webauthn.CreateCredential(user, *session, parsed)
+	if err != nil {
+		return nil, err
+	}
+
+	passkey := newWebAuthnCredential(player, name, credential)
+	_, err = a.db.NewInsert().Model(passkey).Exec(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to store passkey: %w", err)
+	}
+	return passkey, nil
+}
+
+// startPasskeyLogin starts a sign in with any passkey, the authenticator tells us whose it is.
+func (a *Api) startPasskeyLogin(ctx context.Context, binding string) (*protocol.CredentialAssertion, error) {
+	assertion, session, err := a.webauthn.BeginDiscoverableLogin()
+	if err != nil {
+		return nil, err
+	}
+	if err := a.saveWebAuthnCeremony(ctx, binding, 0, session); err != nil {
+		return nil, err
+	}
+	return assertion, nil
+}
+
+// completePasskeyLogin verifies the assertion and returns the player it belongs to.
+func (a *Api) completePasskeyLogin(ctx context.Context, binding string, body io.Reader) (*Player, error) {
+	_, session, err := a.consumeWebAuthnCeremony(ctx, binding)
+	if err != nil {
+		return nil, err
+	}
+	parsed, err := protocol.ParseCredentialRequestResponseBody(body)
+	if err != nil {
+		return nil, err
+	}
+
+	owner, passkey, err := a.verifyPasskeyLogin(*session, parsed, func(userHandle []byte) (*passkeyUser, error) {
+		credentials := []*WebAuthnCredential{}
+		err := a.db.NewSelect().Model(&credentials).Relation("Player").Where("user_handle = ?", userHandle).Scan(ctx)
+		if err != nil {
+			return nil, err
+		}
+		if len(credentials) == 0 {
+			return nil, sql.ErrNoRows
+		}
+		return &passkeyUser{player: credentials[0].Player, credentials: credentials, handle: userHandle}, nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	_, err = a.db.NewUpdate().Model(passkey).Column("sign_count", "flags", "last_used_date").WherePK().Exec(ctx)
+	if err != nil {
+		return nil, fmt.Errorf("failed to update passkey: %w", err)
+	}
+	return owner.player, nil
+}
+
+// verifyPasskeyLogin checks the assertion against the ceremony's challenge and returns whose passkey signed it,
+// with the passkey updated to what has to be stored. A signature counter that didn't move forward means the passkey
+// may have been cloned, so the sign in is refused.
+func (a *Api) verifyPasskeyLogin(session webauthn.SessionData, parsed *protocol.ParsedCredentialAssertionData, findUser func(userHandle []byte) (*passkeyUser, error)) (*passkeyUser, *WebAuthnCredential, error) {
+	var owner *passkeyUser
+	handler := func(rawID, userHandle []byte) (webauthn.User, error) {
+		user, err := findUser(userHandle)
+		owner = user
+		return user, err
+	}
+	_, credential, err := a.webauthn.ValidatePasskeyLogin(handler, session, parsed)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	var passkey *WebAuthnCredential
+	for _, c := range owner.credentials {
+		if bytes.Equal(c.CredentialID, credential.ID) {
+			passkey = c
+		}
+	}
+	if passkey == nil {
+		return nil, nil, sql.ErrNoRows
+	}
+	if credential.Authenticator.CloneWarning {
+		log.Warn().Int("playerID", owner.player.ID).Int("passkeyID", passkey.ID).Int64("storedSignCount", passkey.SignCount).Uint32("signCount", credential.Authenticator.SignCount).Msg("rejected passkey with a signature counter that went backwards")
+		return nil, nil, ErrPasskeyCloned
+	}
+
+	passkey.SignCount = int64(credential.Authenticator.SignCount)
+	passkey.Flags = int(credential.Flags.ProtocolValue())
+	passkey.LastUsedDate = time.Now()
+	return owner, passkey, nil
+}
+
+// webauthnBinding returns the browser's ceremony cookie, handing out a new one when starting a ceremony.
+func webauthnBinding(c *gin.Context, start bool) (string, error) {
+	if !start {
+		binding, _ := c.Cookie(webauthnCookieName)
+		setCookie(c, webauthnCookieName, "", -1, true)
+		return binding, nil
+	}
+	binding, err := GenerateRandomState()
+	if err != nil {
+		return "", err
+	}
+	setCookie(c, webauthnCookieName, binding, int(webauthnCeremonyTTL.Seconds()), true)
+	return binding, nil
+}
+
+func (a *Api) beginPasskeyRegistration(c *gin.Context) {
+	session, err := a.findSessionFromCookie(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "sign in first"})
+		return
+	}
+	binding, err := webauthnBinding(c, true)
+	if err != nil {
+		log.Err(err).Msg("failed to generate webauthn binding")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start passkey registration"})
+		return
+	}
+	creation, err := a.startPasskeyRegistration(c.Request.Context(), session.Player, binding)
+	if err != nil {
+		log.Err(err).Int("playerID", session.PlayerID).Msg("failed to begin passkey registration")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start passkey registration"})
+		return
+	}
+	c.JSON(http.StatusOK, creation)
+}
+
+func (a *Api) finishPasskeyRegistration(c *gin.Context) {
+	session, err := a.findSessionFromCookie(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "sign in first"})
+		return
+	}
+	name := strings.TrimSpace(c.Query("name"))
+	if name == "" {
+		name = "Passkey"
+	}
+	if len(name) > passkeyNameMaxLen {
+		name = name[:passkeyNameMaxLen]
+	}
+
+	binding, _ := webauthnBinding(c, false)
+	passkey, err := a.completePasskeyRegistration(c.Request.Context(), session.Player, binding, name, c.Request.Body)
+	if err != nil {
+		log.Err(err).Int("playerID", session.PlayerID).Msg("failed to finish passkey registration")
+		c.JSON(http.StatusBadRequest, gin.H{"error": "failed to register passkey, please try again"})
+		return
+	}
+	log.Info().Int("playerID", session.PlayerID).Int("passkeyID", passkey.ID).Msg("registered passkey")
+	c.JSON(http.StatusOK, gin.H{"id": passkey.ID})
+}
+
+func (a *Api) deletePasskey(c *gin.Context) {
+	session, err := a.findSessionFromCookie(c)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		log.Err(err).Str("passkeyID", c.Param("id")).Msg("failed to parse given passkey id")
+		c.Redirect(http.StatusFound, "/me")
+		return
+	}
+
+	// NOTE: scoped to the current player so nobody can delete someone else's passkey
+	_, err = a.db.NewDelete().
+		Model((*WebAuthnCredential)(nil)).
+		Where("id = ?", id).
+		Where("player_id = ?", session.PlayerID).
+		Exec(c.Request.Context())
+	if err != nil {
+		log.Err(err).Int("passkeyID", id).Msg("failed to delete passkey")
+	} else {
+		log.Info().Int("passkeyID", id).Int("playerID", session.PlayerID).Msg("deleted passkey")
+	}
+
+	state := a.profileState(c, session)
+	if err != nil {
+		state["ServerError"] = err.Error()
+	}
+	c.HTML(http.StatusOK, "partials/profile.html", state)
+}
+
+func (a *Api) beginPasskeyLogin(c *gin.Context) {
+	binding, err := webauthnBinding(c, true)
+	if err != nil {
+		log.Err(err).Msg("failed to generate webauthn binding")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start passkey sign in"})
+		return
+	}
+	assertion, err := a.startPasskeyLogin(c.Request.Context(), binding)
+	if err != nil {
+		log.Err(err).Msg("failed to begin passkey login")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start passkey sign in"})
+		return
+	}
+	c.JSON(http.StatusOK, assertion)
+}
+
+func (a *Api) finishPasskeyLogin(c *gin.Context) {
+	ip := c.ClientIP()
+	if ok, _ := a.logins.ips.Allowed(ip); !ok {
+		c.JSON(http.StatusTooManyRequests, gin.H{"error": "too many failed attempts, try again later"})
+		return
+	}
+
+	binding, _ := webauthnBinding(c, false)
+	player, err := a.completePasskeyLogin(c.Request.Context(), binding, c.Request.Body)
+	if err != nil {
+		log.Err(err).Str("ip", ip).Msg("failed passkey login")
+		a.logins.ips.Fail(ip)
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "that passkey didn't work, try another way to sign in"})
+		return
+	}
+
+	log.Info().Int("playerID", player.ID).Msg("signed in with passkey")
+	// NOTE: passkeys verify the player on the device, they are a second factor on their own
+	err = a.createSession(c, player, true)
+	if errors.Is(err, ErrPlayerBanned) {
+		c.JSON(http.StatusForbidden, gin.H{"error": err.Error()})
+	} else if isGuildMembershipError(err) {
+		c.JSON(http.StatusForbidden, gin.H{"error": guildMembershipMessage(err)})
+	} else if err != nil {
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to start your session, please try again"})
+	}
+}
@@ -0,0 +1,258 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"testing"
+
+	"github.com/go-webauthn/webauthn/protocol"
+	"github.com/go-webauthn/webauthn/protocol/webauthncbor"
+	"github.com/go-webauthn/webauthn/protocol/webauthncose"
+	"github.com/go-webauthn/webauthn/webauthn"
+)
+
+const (
+	// user present and user verified
+	softAuthenticatorFlags = 0x05
+	// attested credential data included, only set when creating the passkey
+	softAuthenticatorAttested = 0x40
+)
+
+// softAuthenticator is a passkey living in memory, it answers ceremonies the way a browser and authenticator would.
+type softAuthenticator struct {
+	key          *ecdsa.PrivateKey
+	credentialID []byte
+	userHandle   []byte
+	signCount    uint32
+}
+
+func newSoftAuthenticator(t *testing.T) *softAuthenticator {
+	t.Helper()
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	credentialID := make([]byte, 16)
+	rand.Read(credentialID)
+	return &softAuthenticator{key: key, credentialID: credentialID}
+}
+
+func softEncode(data []byte) string {
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+func (s *softAuthenticator) clientData(t *testing.T, ceremony string, challenge protocol.URLEncodedBase64) []byte {
+	t.Helper()
+	data, err := json.Marshal(map[string]string{
+		"type":      ceremony,
+		"challenge": softEncode(challenge),
+		"origin":    Config.PublicURL,
+	})
+	if err != nil {
+		t.Fatalf("failed to encode client data: %v", err)
+	}
+	return data
+}
+
+func (s *softAuthenticator) authData(rpID string, flags byte) []byte {
+	rpIDHash := sha256.Sum256([]byte(rpID))
+	data := append(rpIDHash[:], flags)
+	return binary.BigEndian.AppendUint32(data, s.signCount)
+}
+
+// create answers navigator.credentials.create with a "none" attestation.
+func (s *softAuthenticator) create(t *testing.T, creation *protocol.CredentialCreation) []byte {
+	t.Helper()
+	s.userHandle = creation.Response.User.ID.(protocol.URLEncodedBase64)
+	publicKey, err := webauthncbor.Marshal(webauthncose.EC2PublicKeyData{
+		PublicKeyData: webauthncose.PublicKeyData{
+			KeyType:   int64(webauthncose.EllipticKey),
+			Algorithm: int64(webauthncose.AlgES256),
+		},
+		Curve:  1,
+		XCoord: s.key.X.FillBytes(make([]byte, 32)),
+		YCoord: s.key.Y.FillBytes(make([]byte, 32)),
+	})
+	if err != nil {
+		t.Fatalf("failed to encode public key: %v", err)
+	}
+
+	authData := s.authData(creation.Response.RelyingParty.ID, softAuthenticatorFlags|softAuthenticatorAttested)
+	authData = append(authData, make([]byte, 16)...)
+	authData = binary.BigEndian.AppendUint16(authData, uint16(len(s.credentialID)))
+	authData = append(authData, s.credentialID...)
+	authData = append(authData, publicKey...)
+	attestation, err := webauthncbor.Marshal(map[string]any{
+		"fmt":      "none",
+		"attStmt":  map[string]any{},
+		"authData": authData,
+	})
+	if err != nil {
+		t.Fatalf("failed to encode attestation: %v", err)
+	}
+
+	return s.respond(t, map[string]any{
+		"clientDataJSON":    softEncode(s.clientData(t, "webauthn.create", creation.Response.Challenge)),
+		"attestationObject": softEncode(attestation),
+		"transports":        []string{"internal"},
+	})
+}
+
+// get answers navigator.credentials.get, signing with the current counter.
+func (s *softAuthenticator) get(t *testing.T, assertion *protocol.CredentialAssertion) []byte {
+	t.Helper()
+	clientData := s.clientData(t, "webauthn.get", assertion.Response.Challenge)
+	authData := s.authData(assertion.Response.RelyingPartyID, softAuthenticatorFlags)
+	clientDataHash := sha256.Sum256(clientData)
+	digest := sha256.Sum256(append(bytes.Clone(authData), clientDataHash[:]...))
+	signature, err := ecdsa.SignASN1(rand.Reader, s.key, digest[:])
+	if err != nil {
+		t.Fatalf("failed to sign assertion: %v", err)
+	}
+
+	return s.respond(t, map[string]any{
+		"clientDataJSON":    softEncode(clientData),
+		"authenticatorData": softEncode(authData),
+		"signature":         softEncode(signature),
+		"userHandle":        softEncode(s.userHandle),
+	})
+}
+
+func (s *softAuthenticator) respond(t *testing.T, response map[string]any) []byte {
+	t.Helper()
+	body, err := json.Marshal(map[string]any{
+		"id":       softEncode(s.credentialID),
+		"rawId":    softEncode(s.credentialID),
+		"type":     "public-key",
+		"response": response,
+	})
+	if err != nil {
+		t.Fatalf("failed to encode response: %v", err)
+	}
+	return body
+}
+
+// registerSoftPasskey runs a registration ceremony and returns the player with the passkey as it would be stored.
+func registerSoftPasskey(t *testing.T, a *Api, authenticator *softAuthenticator) *passkeyUser {
+	t.Helper()
+	user := &passkeyUser{player: &Player{ID: 7, Name: "player", WebAuthnHandle: []byte("0123456789abcdef0123456789abcdef")}}
+	creation, session, err := a.webauthn.BeginRegistration(user)
+	if err != nil {
+		t.Fatalf("failed to begin registration: %v", err)
+	}
+	parsed, err := protocol.ParseCredentialCreationResponseBody(bytes.NewReader(authenticator.create(t, creation)))
+	if err != nil {
+		t.Fatalf("failed to parse registration: %v", err)
+	}
+	credential, err := a.webauthn.CreateCredential(user, *session, parsed)
+	if err != nil {
+		t.Fatalf("failed to register passkey: %v", err)
+	}
+	passkey := newWebAuthnCredential(user.player, "Passkey", credential)
+	passkey.ID = 1
+	user.credentials = append(user.credentials, passkey)
+	return user
+}
+
+// softLogin answers the ceremony with the given response body and verifies it like completePasskeyLogin.
+func softLogin(t *testing.T, a *Api, user *passkeyUser, session *webauthn.SessionData, body []byte) (*WebAuthnCredential, error) {
+	t.Helper()
+	parsed, err := protocol.ParseCredentialRequestResponseBody(bytes.NewReader(body))
+	if err != nil {
+		t.Fatalf("failed to parse assertion: %v", err)
+	}
+	owner, passkey, err := a.verifyPasskeyLogin(*session, parsed, func(userHandle []byte) (*passkeyUser, error) {
+		if !bytes.Equal(userHandle, user.player.WebAuthnHandle) {
+			return nil, errors.New("unknown user handle")
+		}
+		return user, nil
+	})
+	if err == nil && owner.player.ID != user.player.ID {
+		t.Fatalf("passkey signed in player %d instead of %d", owner.player.ID, user.player.ID)
+	}
+	return passkey, err
+}
+
+func newPasskeyTestApi(t *testing.T) *Api {
+	t.Helper()
+	webauthn, err := newWebAuthn()
+	if err != nil {
+		t.Fatalf("failed to configure webauthn: %v", err)
+	}
+	return &Api{webauthn: webauthn}
+}
+
+func TestPasskeyRegistrationThenLogin(t *testing.T) {
+	a := newPasskeyTestApi(t)
+	authenticator := newSoftAuthenticator(t)
+	user := registerSoftPasskey(t, a, authenticator)
+
+	for count := uint32(1); count <= 2; count++ {
+		assertion, session, err := a.webauthn.BeginDiscoverableLogin()
+		if err != nil {
+			t.Fatalf("failed to begin login: %v", err)
+		}
+		authenticator.signCount = count
+		passkey, err := softLogin(t, a, user, session, authenticator.get(t, assertion))
+		if err != nil {
+			t.Fatalf("login %d failed: %v", count, err)
+		}
+		if passkey.SignCount != int64(count) || passkey.LastUsedDate.IsZero() {
+			t.Errorf("login %d stored sign count %d, last used %v", count, passkey.SignCount, passkey.LastUsedDate)
+		}
+	}
+}
+
+func TestPasskeyLoginRejectsCounterGoingBackwards(t *testing.T) {
+	a := newPasskeyTestApi(t)
+	authenticator := newSoftAuthenticator(t)
+	user := registerSoftPasskey(t, a, authenticator)
+	user.credentials[0].SignCount = 5
+
+	assertion, session, err := a.webauthn.BeginDiscoverableLogin()
+	if err != nil {
+		t.Fatalf("failed to begin login: %v", err)
+	}
+	authenticator.signCount = 3
+	_, err = softLogin(t, a, user, session, authenticator.get(t, assertion))
+	if !errors.Is(err, ErrPasskeyCloned) {
+		t.Fatalf("expected ErrPasskeyCloned, got %v", err)
+	}
+}
+
+func TestPasskeyLoginRejectsReplayedCeremony(t *testing.T) {
+	a := newPasskeyTestApi(t)
+	authenticator := newSoftAuthenticator(t)
+	user := registerSoftPasskey(t, a, authenticator)
+
+	assertion, session, err := a.webauthn.BeginDiscoverableLogin()
+	if err != nil {
+		t.Fatalf("failed to begin login: %v", err)
+	}
+	authenticator.signCount = 1
+	captured := authenticator.get(t, assertion)
+	if _, err := softLogin(t, a, user, session, captured); err != nil {
+		t.Fatalf("first login failed: %v", err)
+	}
+
+	// the same answer again, as if the challenge could be answered twice
+	if _, err := softLogin(t, a, user, session, captured); !errors.Is(err, ErrPasskeyCloned) {
+		t.Errorf("expected replay into the same ceremony to be refused as cloned, got %v", err)
+	}
+
+	// the captured answer for a new sign in, its challenge doesn't match
+	_, next, err := a.webauthn.BeginDiscoverableLogin()
+	if err != nil {
+		t.Fatalf("failed to begin login: %v", err)
+	}
+	if _, err := softLogin(t, a, user, next, captured); err == nil {
+		t.Error("expected replay into a new ceremony to be refused")
+	}
+}
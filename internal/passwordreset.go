@@ -0,0 +1,179 @@
+package internal
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"github.com/uptrace/bun"
+)
+
+const (
+	passwordResetPurpose     = "password-reset"
+	passwordResetTTL         = 30 * time.Minute
+	passwordResetSentMessage = "If that player exists, we've sent them a link over Discord to reset their password."
+)
+
+func (a *Api) goToForgotPassword(c *gin.Context) {
+	c.HTML(http.StatusOK, "partials/forgot.html", gin.H{})
+}
+
+// requestPasswordReset DMs the player a signed, single use link to pick a new password.
+func (a *Api) requestPasswordReset(c *gin.Context) {
+	name := c.PostForm("name")
+
+	formData := gin.H{"Name": name}
+	if name == "" {
+		formData["Errors"] = map[string]string{"name": "name is required"}
+		c.HTML(http.StatusOK, "partials/forgot.html", formData)
+		return
+	}
+
+	player, err := a.directMessageRecipient(c, "reset", name)
+	if err != nil {
+		formData["ServerError"] = err.Error()
+		c.HTML(http.StatusOK, "partials/forgot.html", formData)
+		return
+	}
+	formData["Sent"] = passwordResetSentMessage
+	if player == nil {
+		c.HTML(http.StatusOK, "partials/forgot.html", formData)
+		return
+	}
+
+	link, err := a.createPasswordReset(c.Request.Context(), player)
+	if err != nil {
+		log.Err(err).Int("playerID", player.ID).Msg("failed to create password reset")
+		formData["ServerError"] = "Not your fault, server is cooked. Try again?"
+		c.HTML(http.StatusOK, "partials/forgot.html", formData)
+		return
+	}
+
+	err = a.sendDirectMessage(
+		player,
+		fmt.Sprintf("Someone asked to reset your PlayDate password. Use this link within the next %s to pick a new one:\n%s\nIf this wasn't you, you can ignore this message.", passwordResetTTL, link),
+	)
+	if err != nil {
+		log.Err(err).Int("playerID", player.ID).Msg("failed to send password reset to user directly")
+	} else {
+		log.Info().Int("playerID", player.ID).Msg("sent password reset link")
+	}
+	c.HTML(http.StatusOK, "partials/forgot.html", formData)
+}
+
+// createPasswordReset stores a new reset for the player, replacing any older ones, and returns the link to it.
+func (a *Api) createPasswordReset(ctx context.Context, player *Player) (string, error) {
+	token, nonce, expires, err := newSignedToken(passwordResetPurpose, passwordResetTTL)
+	if err != nil {
+		return "", err
+	}
+
+	err = a.db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		err := deleteExpired(ctx, tx, (*PasswordReset)(nil), player.ID)
+		if err != nil {
+			return err
+		}
+		reset := &PasswordReset{NonceHash: hashSessionToken(nonce), PlayerID: player.ID, ExpiresDate: expires}
+		_, err = tx.NewInsert().Model(reset).Exec(ctx)
+		return err
+	})
+	if err != nil {
+		return "", err
+	}
+	return fmt.Sprintf("%s/reset?token=%s", Config.PublicURL, url.QueryEscape(token)), nil
+}
+
+func (a *Api) getPasswordResetTemplate(c *gin.Context) {
+	token := c.Query("token")
+	state := gin.H{"Token": token}
+	if _, err := verifySignedToken(passwordResetPurpose, token); err != nil {
+		state["Invalid"] = true
+	}
+	c.HTML(http.StatusOK, "pages/reset.html", state)
+}
+
+// resetPassword uses up the reset link, sets the new password and signs the player out everywhere.
+func (a *Api) resetPassword(c *gin.Context) {
+	token := c.PostForm("token")
+	pass := c.PostForm("password")
+
+	formData := gin.H{"Token": token}
+	nonce, err := verifySignedToken(passwordResetPurpose, token)
+	if err != nil {
+		formData["Invalid"] = true
+		c.HTML(http.StatusOK, "partials/reset.html", formData)
+		return
+	}
+	if problem := validatePassword(pass, ""); problem != "" {
+		formData["Errors"] = map[string]string{"password": problem}
+		c.HTML(http.StatusOK, "partials/reset.html", formData)
+		return
+	}
+	hashedPassword, err := hashPassword(pass)
+	if err != nil {
+		log.Err(err).Msg("failed to hash password")
+		formData["ServerError"] = err.Error()
+		c.HTML(http.StatusOK, "partials/reset.html", formData)
+		return
+	}
+
+	player := &Player{}
+	err = a.db.RunInTx(c.Request.Context(), nil, func(ctx context.Context, tx bun.Tx) error {
+		// consume the reset so the link can only ever be used once
+		reset := &PasswordReset{}
+		_, err := tx.NewDelete().
+			Model(reset).
+			Where("nonce_hash = ?", hashSessionToken(nonce)).
+			Where("expires_date > ?", time.Now()).
+			Returning("*").
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+		if reset.PlayerID == 0 {
+			return ErrInvalidSignedToken
+		}
+
+		player.ID = reset.PlayerID
+		err = tx.NewSelect().Model(player).WherePK().For("UPDATE").Scan(ctx)
+		if err != nil {
+			return err
+		}
+		before := player.auditSnapshot()
+		player.Password = hashedPassword
+		player.PasswordSet = true
+		// NOTE: the reset link only ever went to the player's discord DMs
+		if !player.DiscordVerified() {
+			player.DiscordVerifiedDate = time.Now()
+		}
+		_, err = tx.NewUpdate().Model(player).Column("password", "password_set", "discord_verified_date").WherePK().Exec(ctx)
+		if err != nil {
+			return err
+		}
+		err = recordAudit(ctx, tx, AuditActor{Player: player, Source: AuditSourceWeb}, before, player.auditSnapshot())
+		if err != nil {
+			return err
+		}
+		// NOTE: whoever knew the old password may still be signed in, kick every session out
+		_, err = tx.NewDelete().Model((*Session)(nil)).Where("player_id = ?", player.ID).Exec(ctx)
+		return err
+	})
+	if err != nil {
+		log.Err(err).Msg("failed to reset password")
+		formData["Invalid"] = true
+		c.HTML(http.StatusOK, "partials/reset.html", formData)
+		return
+	}
+	a.logins.Succeed("name:" + strings.ToLower(player.Name))
+	log.Info().Int("playerID", player.ID).Msg("player reset their password")
+
+	// the browser may still hold a cookie for a session that no longer exists
+	setCookie(c, sessionCookieName, "", -1, true)
+	formData["Done"] = true
+	c.HTML(http.StatusOK, "partials/reset.html", formData)
+}
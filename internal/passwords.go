@@ -0,0 +1,194 @@
+package internal
+
+import (
+	"bufio"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	_ "embed"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/rs/zerolog/log"
+	"github.com/uptrace/bun"
+	"golang.org/x/crypto/argon2"
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/text/unicode/norm"
+)
+
+const (
+	hashAlgorithmArgon2id = "argon2id"
+	hashAlgorithmBcrypt   = "bcrypt"
+	// long enough for any passphrase, short enough that hashing it can't be used to tie up the server
+	passwordMaxLength = 256
+	// bcrypt only looks at this many bytes, anything after it would be silently ignored
+	bcryptMaxBytes   = 72
+	argon2SaltLength = 16
+	argon2KeyLength  = 32
+)
+
+var ErrPasswordMismatch = errors.New("password does not match")
+
+//go:embed common-passwords.txt
+var commonPasswordsFile string
+
+// commonPasswords is the bundled list of passwords too popular to allow, lowercased.
+var commonPasswords = loadCommonPasswords(commonPasswordsFile)
+
+func loadCommonPasswords(list string) map[string]bool {
+	passwords := map[string]bool{}
+	scanner := bufio.NewScanner(strings.NewReader(list))
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			passwords[line] = true
+		}
+	}
+	return passwords
+}
+
+// normalizePassword puts the password in NFKC form, so the same passphrase typed on two keyboards that encode an
+// accented letter differently still matches.
+func normalizePassword(pass string) []byte {
+	return []byte(norm.NFKC.String(pass))
+}
+
+// validatePassword returns a user facing problem with the password, or an empty string when it's acceptable.
+// Anything goes as long as it's long enough and not on the common passwords list, spaces and emoji included.
+func validatePassword(pass string, name string) string {
+	cfg := Config.PasswordConfig
+	length := utf8.RuneCountInString(pass)
+	switch {
+	case pass == "":
+		return "password is required"
+	case length < cfg.MinLength:
+		return fmt.Sprintf("password must be at least %d characters", cfg.MinLength)
+	case length > passwordMaxLength:
+		return fmt.Sprintf("password can't be longer than %d characters", passwordMaxLength)
+	case cfg.HashAlgorithm == hashAlgorithmBcrypt && len(normalizePassword(pass)) > bcryptMaxBytes:
+		return "password is too long"
+	case commonPasswords[strings.ToLower(pass)]:
+		return "password is too common, try a few random words instead"
+	case utf8.RuneCountInString(name) >= 3 && strings.Contains(strings.ToLower(pass), strings.ToLower(name)):
+		return "password can't contain your name"
+	}
+	return ""
+}
+
+// hashPassword hashes the password with the configured algorithm. argon2id hashes use the PHC string format,
+// i.e. $argon2id$v=19$m=19456,t=2,p=1$<salt>$<hash>.
+func hashPassword(pass string) (string, error) {
+	cfg := Config.PasswordConfig
+	if cfg.HashAlgorithm == hashAlgorithmBcrypt {
+		hash, err := bcrypt.GenerateFromPassword(normalizePassword(pass), cfg.BcryptCost)
+		return string(hash), err
+	}
+
+	salt := make([]byte, argon2SaltLength)
+	if _, err := rand.Read(salt); err != nil {
+		return "", err
+	}
+	key := argon2.IDKey(normalizePassword(pass), salt, cfg.Argon2Iterations, cfg.Argon2Memory, cfg.Argon2Parallelism, argon2KeyLength)
+	return fmt.Sprintf(
+		"$argon2id$v=%d$m=%d,t=%d,p=%d$%s$%s",
+		argon2.Version, cfg.Argon2Memory, cfg.Argon2Iterations, cfg.Argon2Parallelism,
+		base64.RawStdEncoding.EncodeToString(salt), base64.RawStdEncoding.EncodeToString(key),
+	), nil
+}
+
+// comparePassword checks the password against a hash made by hashPassword, whichever algorithm it was made with.
+func comparePassword(hash string, pass string) error {
+	if !strings.HasPrefix(hash, "$argon2id$") {
+		err := bcrypt.CompareHashAndPassword([]byte(hash), normalizePassword(pass))
+		if errors.Is(err, bcrypt.ErrMismatchedHashAndPassword) {
+			return ErrPasswordMismatch
+		}
+		return err
+	}
+
+	params, salt, key, err := parseArgon2Hash(hash)
+	if err != nil {
+		return err
+	}
+	actual := argon2.IDKey(normalizePassword(pass), salt, params.iterations, params.memory, params.parallelism, uint32(len(key)))
+	if subtle.ConstantTimeCompare(actual, key) != 1 {
+		return ErrPasswordMismatch
+	}
+	return nil
+}
+
+// passwordNeedsRehash reports whether the hash was made with another algorithm or weaker parameters than are
+// configured now, so it can be replaced while the player's password is at hand.
+func passwordNeedsRehash(hash string) bool {
+	cfg := Config.PasswordConfig
+	if cfg.HashAlgorithm == hashAlgorithmBcrypt {
+		cost, err := bcrypt.Cost([]byte(hash))
+		return err != nil || cost < cfg.BcryptCost
+	}
+
+	params, _, _, err := parseArgon2Hash(hash)
+	if err != nil {
+		return true
+	}
+	return params.memory < cfg.Argon2Memory || params.iterations < cfg.Argon2Iterations || params.parallelism < cfg.Argon2Parallelism
+}
+
+type argon2Params struct {
+	memory      uint32
+	iterations  uint32
+	parallelism uint8
+}
+
+func parseArgon2Hash(hash string) (argon2Params, []byte, []byte, error) {
+	params := argon2Params{}
+	parts := strings.Split(hash, "$")
+	if len(parts) != 6 || parts[1] != hashAlgorithmArgon2id {
+		return params, nil, nil, errors.New("not an argon2id hash")
+	}
+	var version int
+	if _, err := fmt.Sscanf(parts[2], "v=%d", &version); err != nil || version != argon2.Version {
+		return params, nil, nil, fmt.Errorf("unsupported argon2 version %q", parts[2])
+	}
+	if _, err := fmt.Sscanf(parts[3], "m=%d,t=%d,p=%d", &params.memory, &params.iterations, &params.parallelism); err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2 parameters: %w", err)
+	}
+	salt, err := base64.RawStdEncoding.DecodeString(parts[4])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2 salt: %w", err)
+	}
+	key, err := base64.RawStdEncoding.DecodeString(parts[5])
+	if err != nil {
+		return params, nil, nil, fmt.Errorf("invalid argon2 hash: %w", err)
+	}
+	return params, salt, key, nil
+}
+
+// upgradePasswordHash rehashes the player's password with the current settings when their stored hash is weaker.
+// It's only possible right after they've signed in, the one time the plain password is at hand.
+func (a *Api) upgradePasswordHash(player *Player, pass string) {
+	if !passwordNeedsRehash(player.Password) {
+		return
+	}
+	hashedPassword, err := hashPassword(pass)
+	if err != nil {
+		log.Err(err).Int("playerID", player.ID).Msg("failed to rehash password")
+		return
+	}
+	before := player.auditSnapshot()
+	player.Password = hashedPassword
+	err = a.db.RunInTx(a.ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewUpdate().Model(player).Column("password").WherePK().Exec(ctx)
+		if err != nil {
+			return err
+		}
+		return recordAudit(ctx, tx, AuditActor{Player: player, Source: AuditSourceWeb}, before, player.auditSnapshot())
+	})
+	if err != nil {
+		log.Err(err).Int("playerID", player.ID).Msg("failed to store upgraded password hash")
+		return
+	}
+	log.Info().Int("playerID", player.ID).Str("algorithm", Config.PasswordConfig.HashAlgorithm).Msg("upgraded password hash")
+}
@@ -0,0 +1,92 @@
+package internal
+
+import (
+	"testing"
+)
+
+func withPasswordConfig(t *testing.T, cfg PasswordConfig) {
+	previous := Config.PasswordConfig
+	Config.PasswordConfig = &cfg
+	t.Cleanup(func() { Config.PasswordConfig = previous })
+}
+
+func TestParseArgon2Hash(t *testing.T) {
+	withPasswordConfig(t, PasswordConfig{HashAlgorithm: hashAlgorithmArgon2id, Argon2Memory: 64, Argon2Iterations: 1, Argon2Parallelism: 1})
+	hash, err := hashPassword("correct horse battery staple")
+	if err != nil {
+		t.Fatal(err)
+	}
+	params, salt, key, err := parseArgon2Hash(hash)
+	if err != nil {
+		t.Fatalf("failed to parse our own hash %q: %v", hash, err)
+	}
+	if params != (argon2Params{memory: 64, iterations: 1, parallelism: 1}) {
+		t.Errorf("expected the configured parameters, got %+v", params)
+	}
+	if len(salt) != argon2SaltLength || len(key) != argon2KeyLength {
+		t.Errorf("expected a %d byte salt and %d byte key, got %d and %d", argon2SaltLength, argon2KeyLength, len(salt), len(key))
+	}
+
+	invalid := map[string]string{
+		"bcrypt":         "$2a$10$N9qo8uLOickgx2ZMRZoMyeIjZAgcfl7p92ldGxad68LJZdL17lhWy",
+		"argon2i":        "$argon2i$v=19$m=64,t=1,p=1$c2FsdHNhbHQ$a2V5",
+		"old version":    "$argon2id$v=16$m=64,t=1,p=1$c2FsdHNhbHQ$a2V5",
+		"bad parameters": "$argon2id$v=19$m=lots$c2FsdHNhbHQ$a2V5",
+		"bad salt":       "$argon2id$v=19$m=64,t=1,p=1$not base64!$a2V5",
+		"missing key":    "$argon2id$v=19$m=64,t=1,p=1$c2FsdHNhbHQ",
+		"not a hash":     "hunter2",
+		"empty":          "",
+	}
+	for name, hash := range invalid {
+		t.Run(name, func(t *testing.T) {
+			if _, _, _, err := parseArgon2Hash(hash); err == nil {
+				t.Errorf("expected %q to be rejected", hash)
+			}
+		})
+	}
+}
+
+func TestPasswordNeedsRehash(t *testing.T) {
+	argon2 := PasswordConfig{HashAlgorithm: hashAlgorithmArgon2id, Argon2Memory: 64, Argon2Iterations: 1, Argon2Parallelism: 1}
+	stronger := argon2
+	stronger.Argon2Iterations = 2
+	bcrypt := PasswordConfig{HashAlgorithm: hashAlgorithmBcrypt, BcryptCost: 4}
+	costlier := bcrypt
+	costlier.BcryptCost = 5
+
+	hashWith := func(cfg PasswordConfig) string {
+		withPasswordConfig(t, cfg)
+		hash, err := hashPassword("correct horse battery staple")
+		if err != nil {
+			t.Fatal(err)
+		}
+		return hash
+	}
+	argon2Hash := hashWith(argon2)
+	bcryptHash := hashWith(bcrypt)
+
+	tests := []struct {
+		name string
+		hash string
+		cfg  PasswordConfig
+		want bool
+	}{
+		{"argon2id with the same settings", argon2Hash, argon2, false},
+		{"argon2id with stronger settings", argon2Hash, stronger, true},
+		{"argon2id with weaker settings", hashWith(stronger), argon2, false},
+		{"bcrypt switched to argon2id", bcryptHash, argon2, true},
+		{"argon2id switched to bcrypt", argon2Hash, bcrypt, true},
+		{"bcrypt with the same cost", bcryptHash, bcrypt, false},
+		{"bcrypt with a higher cost", bcryptHash, costlier, true},
+		{"garbage under argon2id", "hunter2", argon2, true},
+		{"garbage under bcrypt", "hunter2", bcrypt, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			withPasswordConfig(t, tt.cfg)
+			if got := passwordNeedsRehash(tt.hash); got != tt.want {
+				t.Errorf("expected %v, got %v", tt.want, got)
+			}
+		})
+	}
+}
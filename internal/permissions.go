@@ -0,0 +1,218 @@
+package internal
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"github.com/uptrace/bun"
+)
+
+type Permission string
+
+const (
+	// edit or cancel any playdate and remove anyone from one, owners can already edit and cancel their own
+	PermissionManagePlayDates Permission = "playdates.manage"
+	// change other players' roles and accounts
+	PermissionManagePlayers Permission = "players.manage"
+	// site wide settings and integrations, i.e. webhooks
+	PermissionManageSettings Permission = "settings.manage"
+)
+
+// rolePermissions is what each role is allowed on top of what every signed in player can do.
+var rolePermissions = map[Role][]Permission{
+	RoleMember:    {},
+	RoleModerator: {PermissionManagePlayDates},
+	RoleAdmin:     {PermissionManagePlayDates, PermissionManagePlayers, PermissionManageSettings},
+}
+
+var (
+	ErrForbidden            = errors.New("player is missing the permission")
+	ErrTOTPRequired         = errors.New("admin has not enabled two-factor authentication")
+	ErrSecondFactorRequired = errors.New("session has not passed two-factor authentication")
+)
+
+// permissionMessage turns an authorization error into something friendly enough to show to the player.
+func permissionMessage(err error) string {
+	switch {
+	case errors.Is(err, ErrTOTPRequired):
+		return "Turn on two-factor authentication from your profile before using admin features."
+	case errors.Is(err, ErrSecondFactorRequired):
+		return "Sign out and back in with your two-factor code before using admin features."
+	case errors.Is(err, ErrUnknownDiscordPlayer):
+		return "You don't have a PlayDate account yet, sign in to the site with Discord first."
+	default:
+		return "You don't have permission to do that."
+	}
+}
+
+// playerRole is the player's stored role, except anyone listed in ADMIN_DISCORD_IDS is always an admin so there's
+// a way to hand out the first roles. That only counts once the player proved the discord account is theirs.
+func playerRole(player *Player) Role {
+	if player.DiscordVerified() && slices.Contains(Config.AdminDiscordIDs, player.DiscordID) {
+		return RoleAdmin
+	}
+	return RoleFrom(string(player.Role))
+}
+
+// isAdmin checks whether the player has the admin role.
+func isAdmin(player *Player) bool {
+	return playerRole(player) == RoleAdmin
+}
+
+func can(player *Player, permission Permission) bool {
+	return player != nil && slices.Contains(rolePermissions[playerRole(player)], permission)
+}
+
+// authorize returns a user facing error when the player isn't allowed the permission. Requests from the site pass
+// their session, which has to have passed a second factor for admin permissions. Bot commands pass nil.
+func authorize(player *Player, session *Session, permission Permission) error {
+	if !can(player, permission) {
+		return ErrForbidden
+	}
+	// NOTE: only admins can be required to use two-factor, so permissions moderators have are never held back
+	if slices.Contains(rolePermissions[RoleModerator], permission) {
+		return nil
+	}
+	if requiresTOTP(player) {
+		return ErrTOTPRequired
+	}
+	if session != nil && sessionRequiresTOTP(session) {
+		return ErrSecondFactorRequired
+	}
+	return nil
+}
+
+// canManagePlayDate reports whether the player may edit or cancel the playdate.
+func canManagePlayDate(player *Player, playdate *PlayDate) bool {
+	return player != nil && (playdate.OwnerId == player.ID || can(player, PermissionManagePlayDates))
+}
+
+// roleFromGuildRoles maps a guild member's discord roles to a player role. It reports false when no guild roles
+// are configured, in which case roles are only managed from the site.
+func roleFromGuildRoles(roles []string) (Role, bool) {
+	cfg := Config.DiscordConfig
+	if cfg.AdminRoleID == "" && cfg.ModeratorRoleID == "" {
+		return RoleMember, false
+	}
+	switch {
+	case cfg.AdminRoleID != "" && slices.Contains(roles, cfg.AdminRoleID):
+		return RoleAdmin, true
+	case cfg.ModeratorRoleID != "" && slices.Contains(roles, cfg.ModeratorRoleID):
+		return RoleModerator, true
+	default:
+		return RoleMember, true
+	}
+}
+
+// syncGuildRole updates the player's role to match their guild roles, when guild roles are configured. Players who
+// haven't proved their discord account is theirs keep the role they have.
+func (a *Api) syncGuildRole(ctx context.Context, player *Player, roles []string) {
+	if !player.DiscordVerified() {
+		return
+	}
+	role, mapped := roleFromGuildRoles(roles)
+	if !mapped || role == player.Role {
+		return
+	}
+	log.Info().Int("playerID", player.ID).Str("from", string(player.Role)).Str("to", string(role)).Msg("updating player role from guild roles")
+	before := player.auditSnapshot()
+	player.Role = role
+	err := a.db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewUpdate().Model(player).Column("role").WherePK().Exec(ctx)
+		if err != nil {
+			return err
+		}
+		return recordAudit(ctx, tx, AuditActor{Source: AuditSourceDiscord}, before, player.auditSnapshot())
+	})
+	if err != nil {
+		log.Err(err).Int("playerID", player.ID).Msg("failed to update player role from guild roles")
+	}
+}
+
+// requirePermission is middleware only letting through signed in players with the permission.
+func (a *Api) requirePermission(permission Permission) gin.HandlerFunc {
+	return func(c *gin.Context) {
+		session, err := a.findSessionFromCookie(c)
+		if err != nil {
+			c.Redirect(http.StatusFound, "/")
+			c.Abort()
+			return
+		}
+		if err := authorize(session.Player, session, permission); err != nil {
+			log.Warn().Int("playerID", session.PlayerID).Str("permission", string(permission)).Str("path", c.Request.URL.Path).Msg("player is missing permission")
+			a.forbidden(c, permissionMessage(err))
+			return
+		}
+		c.Next()
+	}
+}
+
+// forbidden renders the 403 page, swapping out the whole page when asked for by htmx.
+func (a *Api) forbidden(c *gin.Context, message string) {
+	if c.Request.Header.Get("HX-Request") != "" {
+		c.Header("HX-Retarget", "body")
+		c.Header("HX-Reswap", "outerHTML")
+	}
+	c.HTML(http.StatusForbidden, "pages/forbidden.html", gin.H{"Message": message})
+	c.Abort()
+}
+
+// authorizeInteraction checks the permission for a bot command, answering with a reply only the caller can see
+// when they don't have it.
+func authorizeInteraction(s *discordgo.Session, i *discordgo.InteractionCreate, player *Player, permission Permission) bool {
+	err := authorize(player, nil, permission)
+	if player == nil {
+		err = ErrUnknownDiscordPlayer
+	}
+	if err != nil {
+		log.Warn().Str("discordID", interactionUser(i).ID).Str("permission", string(permission)).Msg("discord user is missing permission")
+		respondEphemeral(s, i, permissionMessage(err))
+		return false
+	}
+	return true
+}
+
+// roleCommand lets admins change a player's role from discord.
+func roleCommand(a *Api, s *discordgo.Session, i *discordgo.InteractionCreate, botContext *BotContext) {
+	if !authorizeInteraction(s, i, botContext.player, PermissionManagePlayers) {
+		return
+	}
+	options := i.ApplicationCommandData().Options
+	user := options[0].UserValue(nil)
+	role := RoleFrom(options[1].StringValue())
+
+	target := &Player{}
+	err := a.db.NewSelect().Model(target).Where("discord_id = ?", user.ID).Scan(a.ctx)
+	if err != nil {
+		log.Err(err).Str("discordID", user.ID).Msg("failed to find player to change role")
+		respondEphemeral(s, i, fmt.Sprintf("<@%s> doesn't have a PlayDate account.", user.ID))
+		return
+	}
+	before := target.auditSnapshot()
+	target.Role = role
+	err = a.db.RunInTx(a.ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewUpdate().Model(target).Column("role").WherePK().Exec(ctx)
+		if err != nil {
+			return err
+		}
+		return recordAudit(ctx, tx, AuditActor{Player: botContext.player, Source: AuditSourceDiscord}, before, target.auditSnapshot())
+	})
+	if err != nil {
+		log.Err(err).Int("playerID", target.ID).Msg("failed to change player role")
+		respondEphemeral(s, i, "Failed to change their role, please try again.")
+		return
+	}
+	log.Info().Int("playerID", target.ID).Int("actorID", botContext.player.ID).Str("role", string(role)).Msg("changed player role")
+
+	msg := fmt.Sprintf("<@%s> is now a %s.", user.ID, role)
+	if _, mapped := roleFromGuildRoles(nil); mapped {
+		msg += " Roles follow the server's roles, so this only lasts until they next sign in."
+	}
+	respondEphemeral(s, i, msg)
+}
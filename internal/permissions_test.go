@@ -0,0 +1,36 @@
+package internal
+
+import (
+	"errors"
+	"testing"
+	"time"
+)
+
+func TestAuthorizeRequiresSecondFactorForAdminPermissions(t *testing.T) {
+	previous := Config.RequireAdminTOTP
+	Config.RequireAdminTOTP = true
+	t.Cleanup(func() { Config.RequireAdminTOTP = previous })
+
+	admin := &Player{ID: 1, Role: RoleAdmin, TOTPEnabled: true}
+	tests := []struct {
+		name       string
+		player     *Player
+		session    *Session
+		permission Permission
+		want       error
+	}{
+		{"passed two-factor", admin, &Session{Player: admin, SecondFactorDate: time.Now()}, PermissionManagePlayers, nil},
+		{"skipped two-factor", admin, &Session{Player: admin}, PermissionManagePlayers, ErrSecondFactorRequired},
+		{"moderator permission without two-factor", admin, &Session{Player: admin}, PermissionManagePlayDates, nil},
+		{"bot command", admin, nil, PermissionManagePlayers, nil},
+		{"two-factor never enabled", &Player{ID: 2, Role: RoleAdmin}, nil, PermissionManagePlayers, ErrTOTPRequired},
+		{"member", &Player{ID: 3, Role: RoleMember}, nil, PermissionManagePlayers, ErrForbidden},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := authorize(tt.player, tt.session, tt.permission); !errors.Is(err, tt.want) {
+				t.Errorf("expected %v, got %v", tt.want, err)
+			}
+		})
+	}
+}
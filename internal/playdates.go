@@ -0,0 +1,382 @@
+package internal
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"github.com/uptrace/bun"
+)
+
+// NOTE: that this date is not random but instead hardcoded into the standard
+// libary to code layouts against.
+const playDateTimeLayout = "2006-01-02T15:04"
+
+var ErrPlayDateNotPending = errors.New("playdate already happened or was cancelled")
+
+// playDateRow is a playdate in a table, with its times shown the way the viewer wants them.
+type playDateRow struct {
+	*PlayDate
+	Display TimeDisplay
+}
+
+func playDateRows(playdates []*PlayDate, display TimeDisplay) []playDateRow {
+	rows := make([]playDateRow, 0, len(playdates))
+	for _, p := range playdates {
+		rows = append(rows, playDateRow{PlayDate: p, Display: display})
+	}
+	return rows
+}
+
+// parsePlayDateForm validates the game and date submitted for a playdate, errors are keyed by form field. The date
+// is read in the given timezone, the one of the player filling in the form.
+func parsePlayDateForm(inputGame string, inputDatetime string, loc *time.Location) (time.Time, map[string]string) {
+	errors := map[string]string{}
+	if inputGame == "" {
+		errors["game"] = "game is required"
+	}
+	if inputDatetime == "" {
+		errors["date"] = "date is required"
+	}
+	parsedDatetime, err := time.ParseInLocation(playDateTimeLayout, inputDatetime, loc)
+	now := time.Now().In(loc)
+	if err != nil {
+		errors["date"] = "invalid format for date/time, please use layout 2025-01-01T12:00"
+	} else if parsedDatetime.Before(now) {
+		errors["date"] = fmt.Sprintf("can not make a playdate in the past, %v is before %v", parsedDatetime, now)
+	}
+	return parsedDatetime, errors
+}
+
+// findPlayDateFromParam loads the playdate named by the :id route parameter along with its owner.
+func (a *Api) findPlayDateFromParam(c *gin.Context) (*PlayDate, error) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		log.Err(err).Str("playdateID", c.Param("id")).Msg("failed to parse given playdate id")
+		return nil, err
+	}
+	playdate := &PlayDate{ID: id}
+	err = a.db.NewSelect().Model(playdate).Relation("Owner").WherePK().Scan(c.Request.Context())
+	if err != nil {
+		log.Err(err).Int("playdateID", id).Msg("failed to find playdate")
+		return nil, err
+	}
+	return playdate, nil
+}
+
+// playDateState is everything partials/playdate.html needs, including what the viewer may do with the playdate.
+func (a *Api) playDateState(ctx context.Context, player *Player, playdate *PlayDate) gin.H {
+	errors := map[string]string{}
+	playdatePlayers := []*PlayDateToPlayer{}
+	err := a.db.NewSelect().Model(&playdatePlayers).Relation("Player").Where("playdate_id = ?", playdate.ID).Scan(ctx)
+	if err != nil {
+		// report error back to user, but just render the page like normal
+		log.Err(err).Any("playdate", playdate).Msg("failed to find related players to playdate")
+		errors["PlayDatePlayers"] = err.Error()
+	}
+
+	display := player.TimeDisplay()
+	playdate.Date = playdate.Date.In(display.Location)
+	playdate.CreatedDate = playdate.CreatedDate.In(display.Location)
+	pending := playdate.Status == PlayDateStatusPending
+	return gin.H{
+		"Errors":             errors,
+		"Display":            display,
+		"PlayDate":           playdate,
+		"PlayDatePlayers":    playdatePlayers,
+		"CanManage":          pending && canManagePlayDate(player, playdate),
+		"CanRemoveAttendees": pending && can(player, PermissionManagePlayDates),
+	}
+}
+
+func (a *Api) getEditPlayDateTemplate(c *gin.Context) {
+	player, err := a.findPlayerFromCookie(c)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+	playdate, err := a.findPlayDateFromParam(c)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+	if !canManagePlayDate(player, playdate) {
+		a.forbidden(c, permissionMessage(ErrForbidden))
+		return
+	}
+
+	c.HTML(http.StatusOK, "partials/playdate-edit.html", gin.H{
+		"PlayDate": playdate,
+		"Game":     playdate.Game,
+		"Date":     playdate.Date.In(player.TimeDisplay().Location).Format(playDateTimeLayout),
+	})
+}
+
+// updatePlayDate changes a pending playdate's game or date, for its owner or a moderator.
+func (a *Api) updatePlayDate(c *gin.Context) {
+	player, err := a.findPlayerFromCookie(c)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+	playdate, err := a.findPlayDateFromParam(c)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+	if !canManagePlayDate(player, playdate) {
+		a.forbidden(c, permissionMessage(ErrForbidden))
+		return
+	}
+
+	inputGame := c.PostForm("game")
+	inputDatetime := c.PostForm("date")
+	formData := gin.H{"PlayDate": playdate, "Game": inputGame, "Date": inputDatetime}
+	parsedDatetime, errors := parsePlayDateForm(inputGame, inputDatetime, player.TimeDisplay().Location)
+	if playdate.Status != PlayDateStatusPending {
+		formData["ServerError"] = "This playdate already happened or was cancelled, it can't be changed anymore."
+	}
+	if len(errors) > 0 || formData["ServerError"] != nil {
+		formData["Errors"] = errors
+		c.HTML(http.StatusOK, "partials/playdate-edit.html", formData)
+		return
+	}
+
+	before, previous := playdate.auditSnapshot(), *playdate
+	playdate.Game = inputGame
+	playdate.Date = parsedDatetime
+	// NOTE: the reminder goes out again for the new date
+	playdate.RemindedDate = time.Time{}
+	err = a.db.RunInTx(c.Request.Context(), nil, func(ctx context.Context, tx bun.Tx) error {
+		res, err := tx.NewUpdate().
+			Model(playdate).
+			Column("game", "date", "reminded_date").
+			WherePK().
+			Where("status = ?", PlayDateStatusPending).
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return ErrPlayDateNotPending
+		}
+		if err := recordAudit(ctx, tx, AuditActor{Player: player, Source: AuditSourceWeb}, before, playdate.auditSnapshot()); err != nil {
+			return err
+		}
+		return emitWebhookEvent(ctx, tx, WebhookEventPlayDateUpdated, newWebhookPlayDate(playdate))
+	})
+	if err != nil {
+		log.Err(err).Int("playdateID", playdate.ID).Msg("failed to update playdate")
+		formData["ServerError"] = err.Error()
+		c.HTML(http.StatusOK, "partials/playdate-edit.html", formData)
+		return
+	}
+	log.Info().Int("playdateID", playdate.ID).Int("playerID", player.ID).Msg("updated playdate")
+
+	a.notify(Notification{Event: NotificationPlayDateUpdated, PlayDate: playdate, Previous: &previous, Actor: player})
+	a.kickWebhookWorker()
+	a.publishPlayDate(playdate.ID, homeRowUpdated)
+
+	c.Header("HX-Location", fmt.Sprintf("/playdate/%d", playdate.ID))
+}
+
+// cancelPlayDate calls off a pending playdate and lets everyone know.
+func (a *Api) cancelPlayDate(ctx context.Context, playdate *PlayDate, actor AuditActor) error {
+	before, status := playdate.auditSnapshot(), playdate.Status
+	err := a.db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		res, err := tx.NewUpdate().
+			Model(playdate).
+			Set("status = ?", PlayDateStatusCancelled).
+			WherePK().
+			Where("status = ?", PlayDateStatusPending).
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return ErrPlayDateNotPending
+		}
+		playdate.Status = PlayDateStatusCancelled
+		if err := recordAudit(ctx, tx, actor, before, playdate.auditSnapshot()); err != nil {
+			return err
+		}
+		return emitWebhookEvent(ctx, tx, WebhookEventPlayDateCancelled, newWebhookPlayDate(playdate))
+	})
+	if err != nil {
+		playdate.Status = status
+		return err
+	}
+	log.Info().Int("playdateID", playdate.ID).Int("playerID", actor.Player.ID).Msg("cancelled playdate")
+	a.announceCancelledPlayDate(playdate, actor.Player)
+	return nil
+}
+
+// announceCancelledPlayDate lets everyone know the playdate was called off, once the cancellation is saved.
+func (a *Api) announceCancelledPlayDate(playdate *PlayDate, actor *Player) {
+	a.notify(Notification{Event: NotificationPlayDateCancelled, PlayDate: playdate, Actor: actor})
+	a.kickWebhookWorker()
+	a.publishPlayDate(playdate.ID, homeRowEnded)
+}
+
+// sendDirectMessage DMs the player through the bot. It's for messages only discord can be trusted with, like
+// sign in links, playdate notifications go through notify.
+func (a *Api) sendDirectMessage(player *Player, msg string) error {
+	return sendDiscordDirectMessage(a.dg, player.DiscordID, msg)
+}
+
+func (a *Api) cancelPlayDateTemplate(c *gin.Context) {
+	player, err := a.findPlayerFromCookie(c)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+	playdate, err := a.findPlayDateFromParam(c)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+	if !canManagePlayDate(player, playdate) {
+		a.forbidden(c, permissionMessage(ErrForbidden))
+		return
+	}
+
+	err = a.cancelPlayDate(c.Request.Context(), playdate, AuditActor{Player: player, Source: AuditSourceWeb})
+	state := a.playDateState(c.Request.Context(), player, playdate)
+	if err != nil {
+		log.Err(err).Int("playdateID", playdate.ID).Msg("failed to cancel playdate")
+		state["ServerError"] = err.Error()
+	}
+	c.HTML(http.StatusOK, "partials/playdate.html", state)
+}
+
+// removePlayDateAttendee takes a player off a playdate, for moderators cleaning up after someone.
+func (a *Api) removePlayDateAttendee(c *gin.Context) {
+	session, err := a.findSessionFromCookie(c)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+	player := session.Player
+	if err := authorize(player, session, PermissionManagePlayDates); err != nil {
+		a.forbidden(c, permissionMessage(err))
+		return
+	}
+	playdate, err := a.findPlayDateFromParam(c)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+
+	state := gin.H{}
+	attendee := &Player{}
+	err = a.db.NewSelect().Model(attendee).Where("id = ?", c.Query("playerID")).Scan(c.Request.Context())
+	if err == nil {
+		err = a.db.RunInTx(c.Request.Context(), nil, func(ctx context.Context, tx bun.Tx) error {
+			rel := &PlayDateToPlayer{Player: attendee}
+			_, err := tx.NewDelete().
+				Model(rel).
+				Where("playdate_id = ?", playdate.ID).
+				Where("player_id = ?", attendee.ID).
+				Returning("*").
+				Exec(ctx)
+			if err != nil || rel.PlayDateID == 0 {
+				return err
+			}
+			if err := recordAudit(ctx, tx, AuditActor{Player: player, Source: AuditSourceWeb}, rel.auditSnapshot(), auditSnapshot{}); err != nil {
+				return err
+			}
+			return emitWebhookEvent(ctx, tx, WebhookEventAttendanceChanged, newWebhookAttendance(playdate, attendee, AttendanceNo))
+		})
+	}
+	if err != nil {
+		log.Err(err).Int("playdateID", playdate.ID).Str("attendeeID", c.Query("playerID")).Msg("failed to remove player from playdate")
+		state["ServerError"] = "Failed to remove that player, please try again."
+	} else {
+		log.Info().Int("playdateID", playdate.ID).Int("attendeeID", attendee.ID).Int("playerID", player.ID).Msg("removed player from playdate")
+		a.kickWebhookWorker()
+		a.publishPlayDate(playdate.ID, homeRowUpdated)
+	}
+
+	for k, v := range a.playDateState(c.Request.Context(), player, playdate) {
+		state[k] = v
+	}
+	c.HTML(http.StatusOK, "partials/playdate.html", state)
+}
+
+// setAttendance saves the player's answer for the playdate along with its audit event.
+func (a *Api) setAttendance(ctx context.Context, actor AuditActor, playdate *PlayDate, player *Player, attendance Attendance) error {
+	return a.db.RunInTx(ctx, nil, func(ctx context.Context, tx bun.Tx) error {
+		before := auditSnapshot{}
+		existing := &PlayDateToPlayer{Player: player}
+		err := tx.NewSelect().
+			Model(existing).
+			Where("playdate_id = ?", playdate.ID).
+			Where("player_id = ?", player.ID).
+			For("UPDATE").
+			Scan(ctx)
+		if err == nil {
+			before = existing.auditSnapshot()
+		} else if !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+
+		rel := &PlayDateToPlayer{PlayDateID: playdate.ID, PlayerID: player.ID, Attending: attendance, Player: player}
+		_, err = tx.NewInsert().Model(rel).On("CONFLICT (playdate_id, player_id) DO UPDATE").Set("attending = EXCLUDED.attending").Exec(ctx)
+		if err != nil {
+			return err
+		}
+		if err := recordAudit(ctx, tx, actor, before, rel.auditSnapshot()); err != nil {
+			return err
+		}
+		return emitWebhookEvent(ctx, tx, WebhookEventAttendanceChanged, newWebhookAttendance(playdate, player, attendance))
+	})
+}
+
+// playdateCommand handles /playdate and its subcommands.
+func playdateCommand(a *Api, s *discordgo.Session, i *discordgo.InteractionCreate, botContext *BotContext) {
+	subcommand := i.ApplicationCommandData().Options[0]
+	switch subcommand.Name {
+	case "cancel":
+		cancelPlayDateCommand(a, s, i, botContext, int(subcommand.Options[0].IntValue()))
+	case "history":
+		playDateHistoryCommand(a, s, i, botContext, int(subcommand.Options[0].IntValue()))
+	}
+}
+
+func cancelPlayDateCommand(a *Api, s *discordgo.Session, i *discordgo.InteractionCreate, botContext *BotContext, id int) {
+	if botContext.player == nil {
+		respondEphemeral(s, i, permissionMessage(ErrUnknownDiscordPlayer))
+		return
+	}
+	playdate := &PlayDate{ID: id}
+	err := a.db.NewSelect().Model(playdate).Relation("Owner").WherePK().Scan(a.ctx)
+	if err != nil {
+		log.Err(err).Int("playdateID", id).Msg("failed to find playdate to cancel")
+		respondEphemeral(s, i, fmt.Sprintf("There's no playdate %d.", id))
+		return
+	}
+	if !canManagePlayDate(botContext.player, playdate) {
+		log.Warn().Int("playdateID", id).Int("playerID", botContext.player.ID).Msg("player can't cancel playdate")
+		respondEphemeral(s, i, permissionMessage(ErrForbidden))
+		return
+	}
+
+	err = a.cancelPlayDate(a.ctx, playdate, AuditActor{Player: botContext.player, Source: AuditSourceDiscord})
+	if errors.Is(err, ErrPlayDateNotPending) {
+		respondEphemeral(s, i, "That playdate already happened or was cancelled.")
+		return
+	}
+	if err != nil {
+		log.Err(err).Int("playdateID", id).Msg("failed to cancel playdate")
+		respondEphemeral(s, i, "Failed to cancel the playdate, please try again.")
+		return
+	}
+	respondEphemeral(s, i, fmt.Sprintf("Cancelled %s.", playdate.Game))
+}
@@ -0,0 +1,141 @@
+package internal
+
+import (
+	"context"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"github.com/uptrace/bun"
+)
+
+// commonTimezones are suggested on the profile, any other IANA name can still be typed in.
+var commonTimezones = []string{
+	"America/New_York",
+	"America/Chicago",
+	"America/Denver",
+	"America/Phoenix",
+	"America/Los_Angeles",
+	"America/Anchorage",
+	"Pacific/Honolulu",
+	"America/Toronto",
+	"America/Sao_Paulo",
+	"Europe/London",
+	"Europe/Berlin",
+	"Europe/Helsinki",
+	"Asia/Kolkata",
+	"Asia/Tokyo",
+	"Australia/Sydney",
+	"UTC",
+}
+
+// AvatarURL is the player's discord avatar, or discord's default one until they sign in with discord.
+func (p *Player) AvatarURL() string {
+	// NOTE: discord dropped discriminators, "0" picks the default avatar from the user id like discord does now
+	user := discordgo.User{ID: p.DiscordID, Avatar: p.DiscordAvatar, Discriminator: "0"}
+	return user.AvatarURL("128")
+}
+
+// TimeDisplay is how times should be shown to the player, a nil player gets eastern time like before players
+// could pick their own.
+func (p *Player) TimeDisplay() TimeDisplay {
+	if p == nil {
+		return TimeDisplay{Location: easternLocation}
+	}
+	return TimeDisplay{Location: loadLocation(p.Timezone), Clock24h: p.Clock24h}
+}
+
+// validTimezone reports whether name is an IANA timezone, "Local" is left out since it's the server's.
+func validTimezone(name string) bool {
+	if name == "" || name == "Local" {
+		return false
+	}
+	_, err := time.LoadLocation(name)
+	return err == nil
+}
+
+// playerSettings fills in the profile's settings form.
+func playerSettings(p *Player) gin.H {
+	return gin.H{
+		"Name":           p.Name,
+		"Timezone":       p.Timezone,
+		"Clock24h":       p.Clock24h,
+		"NotifyStarting": p.NotifyStarting,
+		"NotifyChanges":  p.NotifyChanges,
+		"NotifyCreated":  p.NotifyCreated,
+	}
+}
+
+// updateSettings saves the name, time display and notifications a player picked on their profile. The name is
+// checked the same way as on registration.
+func (a *Api) updateSettings(c *gin.Context) {
+	session, err := a.findSessionFromCookie(c)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+	player := session.Player
+
+	updated := *player
+	updated.Name = strings.TrimSpace(c.PostForm("name"))
+	updated.Timezone = strings.TrimSpace(c.PostForm("timezone"))
+	updated.Clock24h = c.PostForm("clock") == "24h"
+	updated.NotifyStarting = c.PostForm("notifyStarting") == "on"
+	updated.NotifyChanges = c.PostForm("notifyChanges") == "on"
+	updated.NotifyCreated = c.PostForm("notifyCreated") == "on"
+
+	state := a.profileState(c, session)
+	state["Settings"] = playerSettings(&updated)
+	errors := map[string]string{}
+	state["Errors"] = errors
+
+	problem, err := a.validatePlayerName(c.Request.Context(), updated.Name, player.ID)
+	if err != nil {
+		log.Err(err).Int("playerID", player.ID).Msg("failed to check for an existing player name")
+		state["ServerError"] = "Not your fault, server is cooked. Try again?"
+		c.HTML(http.StatusOK, "partials/profile.html", state)
+		return
+	}
+	if problem != "" {
+		errors["name"] = problem
+	}
+	if !validTimezone(updated.Timezone) {
+		errors["timezone"] = "timezone must be an IANA name, i.e. America/New_York"
+	}
+	if len(errors) > 0 {
+		c.HTML(http.StatusOK, "partials/profile.html", state)
+		return
+	}
+
+	before := player.auditSnapshot()
+	err = a.db.RunInTx(c.Request.Context(), nil, func(ctx context.Context, tx bun.Tx) error {
+		_, err := tx.NewUpdate().
+			Model(&updated).
+			Column("name", "timezone", "clock_24h", "notify_starting", "notify_changes", "notify_created").
+			WherePK().
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+		return recordAudit(ctx, tx, AuditActor{Player: &updated, Source: AuditSourceWeb}, before, updated.auditSnapshot())
+	})
+	if isUniqueViolation(err, "player_name_key") {
+		errors["name"] = "name is taken"
+		c.HTML(http.StatusOK, "partials/profile.html", state)
+		return
+	}
+	if err != nil {
+		log.Err(err).Int("playerID", player.ID).Msg("failed to save player settings")
+		state["ServerError"] = "Failed to save your settings, please try again."
+		c.HTML(http.StatusOK, "partials/profile.html", state)
+		return
+	}
+	log.Info().Int("playerID", player.ID).Msg("player updated their settings")
+
+	*player = updated
+	state["SettingsUpdated"] = true
+	c.HTML(http.StatusOK, "partials/profile.html", state)
+}
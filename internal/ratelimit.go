@@ -0,0 +1,184 @@
+package internal
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+// attemptLimiter counts failures per key (i.e. an ip or an account) over a sliding window and locks the key
+// out for a while once it has failed too many times. It only lives in memory, a restart forgives everyone.
+type attemptLimiter struct {
+	mu          sync.Mutex
+	maxFailures int
+	window      time.Duration
+	lockout     time.Duration
+	failures    map[string][]time.Time
+	lockedUntil map[string]time.Time
+	lastSweep   time.Time
+}
+
+func newAttemptLimiter(maxFailures int, window time.Duration, lockout time.Duration) *attemptLimiter {
+	return &attemptLimiter{
+		maxFailures: maxFailures,
+		window:      window,
+		lockout:     lockout,
+		failures:    map[string][]time.Time{},
+		lockedUntil: map[string]time.Time{},
+	}
+}
+
+// Allowed reports if the key may attempt again, and if not, how long until it can.
+func (l *attemptLimiter) Allowed(key string) (bool, time.Duration) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	until, locked := l.lockedUntil[key]
+	if !locked {
+		return true, 0
+	}
+	if remaining := time.Until(until); remaining > 0 {
+		return false, remaining
+	}
+	delete(l.lockedUntil, key)
+	return true, 0
+}
+
+// Fail records a failed attempt and returns true when this failure is the one that locked the key out.
+func (l *attemptLimiter) Fail(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	l.sweep(now)
+
+	recent := pruneAttempts(l.failures[key], now.Add(-l.window))
+	recent = append(recent, now)
+	l.failures[key] = recent
+	if len(recent) < l.maxFailures {
+		return false
+	}
+	if until, locked := l.lockedUntil[key]; locked && until.After(now) {
+		return false
+	}
+	l.lockedUntil[key] = now.Add(l.lockout)
+	delete(l.failures, key)
+	return true
+}
+
+// Reset forgets every failure for the key, i.e. after a successful login.
+func (l *attemptLimiter) Reset(key string) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	delete(l.failures, key)
+	delete(l.lockedUntil, key)
+}
+
+// sweep drops keys that have gone quiet so the maps don't grow forever. The caller must hold the lock.
+func (l *attemptLimiter) sweep(now time.Time) {
+	if now.Sub(l.lastSweep) < l.window {
+		return
+	}
+	l.lastSweep = now
+	for key, attempts := range l.failures {
+		if recent := pruneAttempts(attempts, now.Add(-l.window)); len(recent) == 0 {
+			delete(l.failures, key)
+		} else {
+			l.failures[key] = recent
+		}
+	}
+	for key, until := range l.lockedUntil {
+		if until.Before(now) {
+			delete(l.lockedUntil, key)
+		}
+	}
+}
+
+func pruneAttempts(attempts []time.Time, cutoff time.Time) []time.Time {
+	i := 0
+	for i < len(attempts) && attempts[i].Before(cutoff) {
+		i++
+	}
+	return attempts[i:]
+}
+
+// loginGuard bundles the per ip and per account limiters used by every endpoint that checks a secret.
+type loginGuard struct {
+	ips      *attemptLimiter
+	accounts *attemptLimiter
+}
+
+func newLoginGuard() *loginGuard {
+	return &loginGuard{
+		ips:      newAttemptLimiter(Config.LoginIPMaxFailures, Config.LoginFailureWindow, Config.LoginLockout),
+		accounts: newAttemptLimiter(Config.LoginAccountMaxFailures, Config.LoginFailureWindow, Config.LoginLockout),
+	}
+}
+
+// Check returns a user facing error when either the ip or the account is currently locked out.
+func (g *loginGuard) Check(ip string, account string) error {
+	if ok, wait := g.ips.Allowed(ip); !ok {
+		log.Warn().Str("ip", ip).Dur("retryAfter", wait).Msg("rejected attempt from locked out ip")
+		return fmt.Errorf("Too many failed attempts, try again in %s", wait.Round(time.Second))
+	}
+	if ok, wait := g.accounts.Allowed(account); !ok {
+		log.Warn().Str("account", account).Dur("retryAfter", wait).Msg("rejected attempt for locked out account")
+		return fmt.Errorf("Too many failed attempts, try again in %s", wait.Round(time.Second))
+	}
+	return nil
+}
+
+// Fail records a failure against both the ip and the account, returning true when the account just got locked.
+func (g *loginGuard) Fail(ip string, account string) bool {
+	if g.ips.Fail(ip) {
+		log.Warn().Str("ip", ip).Msg("locked out ip after too many failed attempts")
+	}
+	locked := g.accounts.Fail(account)
+	if locked {
+		log.Warn().Str("account", account).Msg("locked out account after too many failed attempts")
+	}
+	return locked
+}
+
+func (g *loginGuard) Succeed(account string) {
+	g.accounts.Reset(account)
+}
+
+// warnPlayerOfLockout lets the player know through Discord that someone is guessing at their account.
+func (a *Api) warnPlayerOfLockout(player *Player, ip string) {
+	err := a.sendDirectMessage(
+		player,
+		fmt.Sprintf(
+			"Heads up! Someone failed to sign in to your PlayDate account %d times (last attempt from `%s`), so it has been locked for %s.\nIf this wasn't you, consider changing your password.",
+			Config.LoginAccountMaxFailures, ip, Config.LoginLockout,
+		),
+	)
+	if err != nil {
+		log.Err(err).Int("playerID", player.ID).Msg("failed to warn player about lockout")
+	}
+}
+
+// directMessageRecipient finds the player a form asked to DM something to. Every request counts against the limiter,
+// so the bot can't be used to flood someone's DMs, and the returned error is the limiter's. An unknown name isn't an
+// error, the player is just nil: callers respond the same either way, so the form can't be used to find out who has
+// an account.
+func (a *Api) directMessageRecipient(c *gin.Context, purpose string, name string) (*Player, error) {
+	ip := c.ClientIP()
+	account := purpose + ":" + strings.ToLower(name)
+	if err := a.logins.Check(ip, account); err != nil {
+		return nil, err
+	}
+	a.logins.Fail(ip, account)
+
+	player := &Player{}
+	err := a.db.NewSelect().Model(player).Where("name = ?", name).Scan(c.Request.Context())
+	if err != nil {
+		log.Err(err).Str("name", name).Str("purpose", purpose).Msg("direct message requested for unknown player")
+		return nil, nil
+	}
+	return player, nil
+}
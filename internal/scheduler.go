@@ -0,0 +1,249 @@
+package internal
+
+import (
+	"container/heap"
+	"database/sql"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/rs/zerolog/log"
+	"github.com/uptrace/bun/driver/pgdriver"
+)
+
+const (
+	// postgres channel the playdate_changed trigger notifies with the id of the playdate that changed
+	playDateChangedChannel = "playdate_changed"
+	// how long to wait before trying an event again when it didn't go through
+	schedulerRetryDelay = 30 * time.Second
+)
+
+type scheduledEventKind string
+
+const (
+	scheduledPlayDateReminder scheduledEventKind = "reminder"
+	scheduledPlayDateStart    scheduledEventKind = "start"
+)
+
+// scheduledEvent is something to do for a playdate once it's time.
+type scheduledEvent struct {
+	At         time.Time
+	Kind       scheduledEventKind
+	PlayDateID int
+	// where the event is in the heap, kept up to date by it
+	index int
+}
+
+// scheduleHeap orders events soonest first, see container/heap.
+type scheduleHeap []*scheduledEvent
+
+func (h scheduleHeap) Len() int           { return len(h) }
+func (h scheduleHeap) Less(i, j int) bool { return h[i].At.Before(h[j].At) }
+func (h scheduleHeap) Swap(i, j int) {
+	h[i], h[j] = h[j], h[i]
+	h[i].index = i
+	h[j].index = j
+}
+
+func (h *scheduleHeap) Push(x any) {
+	event := x.(*scheduledEvent)
+	event.index = len(*h)
+	*h = append(*h, event)
+}
+
+func (h *scheduleHeap) Pop() any {
+	old := *h
+	event := old[len(old)-1]
+	old[len(old)-1] = nil
+	*h = old[:len(old)-1]
+	return event
+}
+
+// scheduler keeps every upcoming playdate event in a timer heap, so runScheduler sleeps until exactly when the
+// next one is due instead of polling for them. It's only touched from runScheduler, so it has no locking.
+type scheduler struct {
+	events     scheduleHeap
+	byPlayDate map[int][]*scheduledEvent
+}
+
+func newScheduler() *scheduler {
+	return &scheduler{byPlayDate: map[int][]*scheduledEvent{}}
+}
+
+// schedule replaces the playdate's events with the ones it still has coming up, none once it isn't pending.
+// Nothing is scheduled before notBefore, which keeps an event that keeps failing from being retried in a loop.
+func (s *scheduler) schedule(playdate *PlayDate, notBefore time.Time) {
+	s.unschedule(playdate.ID)
+	if playdate.Status != PlayDateStatusPending {
+		return
+	}
+
+	events := []*scheduledEvent{{At: playdate.Date, Kind: scheduledPlayDateStart, PlayDateID: playdate.ID}}
+	// NOTE: a playdate that's already started has nothing left to remind anyone about
+	if Config.ReminderLead > 0 && playdate.RemindedDate.IsZero() && playdate.Date.After(time.Now()) {
+		events = append(events, &scheduledEvent{At: playdate.Date.Add(-Config.ReminderLead), Kind: scheduledPlayDateReminder, PlayDateID: playdate.ID})
+	}
+	for _, event := range events {
+		if event.At.Before(notBefore) {
+			event.At = notBefore
+		}
+		heap.Push(&s.events, event)
+	}
+	s.byPlayDate[playdate.ID] = events
+}
+
+func (s *scheduler) unschedule(playdateID int) {
+	for _, event := range s.byPlayDate[playdateID] {
+		if event.index >= 0 {
+			heap.Remove(&s.events, event.index)
+		}
+	}
+	delete(s.byPlayDate, playdateID)
+}
+
+// reset replaces every event with the ones for the given playdates.
+func (s *scheduler) reset(playdates []*PlayDate) {
+	s.events = scheduleHeap{}
+	s.byPlayDate = map[int][]*scheduledEvent{}
+	for _, playdate := range playdates {
+		s.schedule(playdate, time.Time{})
+	}
+}
+
+// due takes every event that's due off the schedule, along with how long until the next one. The wait is
+// negative when nothing is scheduled at all.
+func (s *scheduler) due(now time.Time) ([]*scheduledEvent, time.Duration) {
+	events := []*scheduledEvent{}
+	for len(s.events) > 0 && !s.events[0].At.After(now) {
+		event := heap.Pop(&s.events).(*scheduledEvent)
+		event.index = -1
+		events = append(events, event)
+	}
+	for _, event := range events {
+		remaining := s.byPlayDate[event.PlayDateID][:0]
+		for _, scheduled := range s.byPlayDate[event.PlayDateID] {
+			if scheduled != event {
+				remaining = append(remaining, scheduled)
+			}
+		}
+		if len(remaining) == 0 {
+			delete(s.byPlayDate, event.PlayDateID)
+		} else {
+			s.byPlayDate[event.PlayDateID] = remaining
+		}
+	}
+	if len(s.events) == 0 {
+		return events, -1
+	}
+	return events, s.events[0].At.Sub(now)
+}
+
+// runScheduler sends reminders and starts playdates right when they're due. Postgres notifies us whenever a
+// playdate is created or its schedule changes, from this server or any other, and every
+// Config.SchedulerSweepInterval everything is reloaded in case a notification was lost on a reconnect.
+func (a *Api) runScheduler() {
+	log.Info().Msg("Watching for PlayDates..")
+	listener := pgdriver.NewListener(a.db)
+	defer listener.Close()
+	if err := listener.Listen(a.ctx, playDateChangedChannel); err != nil {
+		// NOTE: the sweep still picks up every change, just later
+		log.Err(err).Msg("failed to listen for playdate changes")
+		a.recordFailure(FailureSourceWatchdog, "failed to listen for playdate changes, they're only picked up by the sweep", err)
+	}
+	changes := listener.Channel()
+
+	interval := Config.SchedulerSweepInterval
+	if interval <= 0 {
+		log.Warn().Dur("interval", interval).Msg("SCHEDULER_SWEEP_INTERVAL has to be positive, sweeping every 15 minutes")
+		interval = 15 * time.Minute
+	}
+	sweep := time.NewTicker(interval)
+	defer sweep.Stop()
+	a.reconcileSchedule()
+
+	for {
+		events, wait := a.schedule.due(time.Now())
+		a.runScheduledEvents(events)
+		if wait < 0 {
+			// NOTE: nothing is scheduled, the next change or sweep is what wakes us up
+			wait = interval
+		}
+
+		timer := time.NewTimer(wait)
+		select {
+		case <-a.ctx.Done():
+			timer.Stop()
+			return
+		case <-timer.C:
+		case change, ok := <-changes:
+			if !ok {
+				changes = nil
+				break
+			}
+			a.reschedulePlayDate(change.Payload, time.Time{})
+		case <-sweep.C:
+			a.reconcileSchedule()
+		}
+		timer.Stop()
+	}
+}
+
+// runScheduledEvents sends the reminders and starts the playdates that are due. Both find everything that's due
+// by themselves and mark it as handled, so one call each covers every event.
+func (a *Api) runScheduledEvents(events []*scheduledEvent) {
+	if len(events) == 0 {
+		return
+	}
+	kinds := map[scheduledEventKind]bool{}
+	playdateIDs := map[int]bool{}
+	for _, event := range events {
+		kinds[event.Kind] = true
+		playdateIDs[event.PlayDateID] = true
+	}
+	if kinds[scheduledPlayDateReminder] {
+		a.sendReminders()
+	}
+	if kinds[scheduledPlayDateStart] {
+		a.fetchPoppedDates()
+	}
+	// NOTE: whatever didn't go through is still pending, it's tried again in a bit instead of right away
+	retry := time.Now().Add(schedulerRetryDelay)
+	for id := range playdateIDs {
+		a.reschedulePlayDate(strconv.Itoa(id), retry)
+	}
+}
+
+// reschedulePlayDate reloads the playdate and replaces its events, the id comes straight from the notification.
+func (a *Api) reschedulePlayDate(payload string, notBefore time.Time) {
+	id, err := strconv.Atoi(payload)
+	if err != nil {
+		log.Err(err).Str("payload", payload).Msg("failed to parse playdate change notification")
+		return
+	}
+	playdate := &PlayDate{ID: id}
+	err = a.db.NewSelect().Model(playdate).WherePK().Scan(a.ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		a.schedule.unschedule(id)
+		return
+	}
+	if err != nil {
+		// NOTE: its old events stay put, the sweep fixes them up if they changed
+		log.Err(err).Int("playdateID", id).Msg("failed to reload playdate to reschedule")
+		return
+	}
+	a.schedule.schedule(playdate, notBefore)
+	log.Debug().Int("playdateID", id).Msg("rescheduled playdate")
+}
+
+// reconcileSchedule reloads every pending playdate, the safety net for changes we never heard about.
+func (a *Api) reconcileSchedule() {
+	playdates := []*PlayDate{}
+	err := a.db.NewSelect().Model(&playdates).Where("status = ?", PlayDateStatusPending).Scan(a.ctx)
+	if err != nil {
+		log.Err(err).Msg("failed to load playdates to schedule")
+		a.recordFailure(FailureSourceWatchdog, "failed to load playdates to schedule", err)
+		return
+	}
+	a.schedule.reset(playdates)
+	log.Info().Int("playdates", len(playdates)).Int("events", len(a.schedule.events)).Msg("reconciled playdate schedule")
+}
@@ -0,0 +1,109 @@
+package internal
+
+import (
+	"testing"
+	"time"
+)
+
+func withReminderLead(t *testing.T, lead time.Duration) {
+	previous := Config.ReminderLead
+	Config.ReminderLead = lead
+	t.Cleanup(func() { Config.ReminderLead = previous })
+}
+
+func TestSchedulerDueInOrder(t *testing.T) {
+	withReminderLead(t, 0)
+	now := time.Now()
+	s := newScheduler()
+	for id, in := range []time.Duration{3 * time.Hour, time.Hour, 2 * time.Hour} {
+		s.schedule(&PlayDate{ID: id + 1, Date: now.Add(in), Status: PlayDateStatusPending}, time.Time{})
+	}
+	s.schedule(&PlayDate{ID: 4, Date: now.Add(time.Hour), Status: PlayDateStatusCancelled}, time.Time{})
+
+	events, wait := s.due(now)
+	if len(events) != 0 || wait != time.Hour {
+		t.Fatalf("expected nothing due for an hour, got %d events and %v", len(events), wait)
+	}
+	events, wait = s.due(now.Add(4 * time.Hour))
+	if wait >= 0 {
+		t.Errorf("expected nothing left scheduled, got a wait of %v", wait)
+	}
+	got := []int{}
+	for _, event := range events {
+		got = append(got, event.PlayDateID)
+	}
+	if len(got) != 3 || got[0] != 2 || got[1] != 3 || got[2] != 1 {
+		t.Errorf("expected playdates 2, 3 and 1 in that order, got %v", got)
+	}
+	if len(s.byPlayDate) != 0 {
+		t.Errorf("expected no playdates left, got %v", s.byPlayDate)
+	}
+}
+
+func TestSchedulerRescheduleReplacesPendingReminder(t *testing.T) {
+	withReminderLead(t, 30*time.Minute)
+	now := time.Now()
+	s := newScheduler()
+	playdate := &PlayDate{ID: 1, Date: now.Add(time.Hour), Status: PlayDateStatusPending}
+	s.schedule(playdate, time.Time{})
+	if len(s.events) != 2 {
+		t.Fatalf("expected a reminder and a start, got %d events", len(s.events))
+	}
+
+	playdate.Date = now.Add(2 * time.Hour)
+	s.schedule(playdate, time.Time{})
+	if len(s.events) != 2 || len(s.byPlayDate[1]) != 2 {
+		t.Fatalf("expected the old events to be replaced, got %d in the heap and %d for the playdate", len(s.events), len(s.byPlayDate[1]))
+	}
+	events, _ := s.due(now.Add(time.Hour))
+	if len(events) != 0 {
+		t.Errorf("expected the old reminder to be gone, got %d events", len(events))
+	}
+	events, _ = s.due(now.Add(90 * time.Minute))
+	if len(events) != 1 || events[0].Kind != scheduledPlayDateReminder {
+		t.Errorf("expected the moved reminder, got %v", events)
+	}
+}
+
+func TestSchedulerUnscheduleAfterPartialPop(t *testing.T) {
+	withReminderLead(t, 30*time.Minute)
+	now := time.Now()
+	s := newScheduler()
+	s.schedule(&PlayDate{ID: 1, Date: now.Add(time.Hour), Status: PlayDateStatusPending}, time.Time{})
+	s.schedule(&PlayDate{ID: 2, Date: now.Add(3 * time.Hour), Status: PlayDateStatusPending}, time.Time{})
+
+	events, _ := s.due(now.Add(45 * time.Minute))
+	if len(events) != 1 || events[0].PlayDateID != 1 || events[0].Kind != scheduledPlayDateReminder {
+		t.Fatalf("expected playdate 1's reminder, got %v", events)
+	}
+	s.unschedule(1)
+	if _, ok := s.byPlayDate[1]; ok {
+		t.Error("expected playdate 1 to be unscheduled")
+	}
+	if len(s.events) != 2 {
+		t.Fatalf("expected playdate 2's events to be left, got %d events", len(s.events))
+	}
+	for _, event := range s.events {
+		if event.PlayDateID != 2 {
+			t.Errorf("expected only playdate 2 left, got %d", event.PlayDateID)
+		}
+	}
+}
+
+func TestSchedulerClampsToNotBefore(t *testing.T) {
+	withReminderLead(t, 30*time.Minute)
+	now := time.Now()
+	retry := now.Add(schedulerRetryDelay)
+	s := newScheduler()
+	s.schedule(&PlayDate{ID: 1, Date: now.Add(-time.Minute), Status: PlayDateStatusPending}, retry)
+
+	if len(s.events) != 1 {
+		t.Fatalf("expected only a start for a playdate that already started, got %d events", len(s.events))
+	}
+	if event := s.events[0]; event.Kind != scheduledPlayDateStart || !event.At.Equal(retry) {
+		t.Errorf("expected the start to wait until %v, got %s at %v", retry, event.Kind, event.At)
+	}
+	if events, wait := s.due(now); len(events) != 0 || wait != schedulerRetryDelay {
+		t.Errorf("expected nothing due until the retry, got %d events and %v", len(events), wait)
+	}
+}
@@ -0,0 +1,102 @@
+package internal
+
+import (
+	"crypto/subtle"
+	"net/http"
+	"strings"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	csrfCookieName = "playdate_csrf"
+	csrfHeaderName = "X-CSRF-Token"
+	csrfFormField  = "csrf_token"
+)
+
+// secureCookies decides if cookies need the Secure flag. In "auto" mode we look at the request (or the
+// proxy in front of us) so local development over plain http keeps working.
+func secureCookies(c *gin.Context) bool {
+	switch strings.ToLower(Config.CookieSecure) {
+	case "true":
+		return true
+	case "false":
+		return false
+	default:
+		return c.Request.TLS != nil || strings.EqualFold(c.GetHeader("X-Forwarded-Proto"), "https")
+	}
+}
+
+// setCookie is the only place cookies should be written so they all get the same hardening.
+func setCookie(c *gin.Context, name string, value string, maxAge int, httpOnly bool) {
+	c.SetSameSite(http.SameSiteLaxMode)
+	c.SetCookie(name, value, maxAge, "/", "", secureCookies(c), httpOnly)
+}
+
+// csrfToken returns the token the current request is expected to echo back. Logged in players get the token
+// stored on their session, everyone else gets a random token in a cookie (i.e. the double submit pattern).
+func (a *Api) csrfToken(c *gin.Context) (string, error) {
+	if cookie, _ := c.Cookie(sessionCookieName); cookie == "" {
+		token, err := c.Cookie(csrfCookieName)
+		if err == nil && token != "" {
+			return token, nil
+		}
+		return GenerateRandomState()
+	}
+
+	session, err := a.findSessionFromCookie(c)
+	if err == nil {
+		if session.CSRFToken == "" {
+			// sessions created before csrf tokens existed get one lazily
+			session.CSRFToken, err = GenerateRandomState()
+			if err != nil {
+				return "", err
+			}
+			_, err = a.db.NewUpdate().Model(session).Column("csrf_token").WherePK().Exec(c.Request.Context())
+			if err != nil {
+				return "", err
+			}
+		}
+		return session.CSRFToken, nil
+	}
+
+	token, err := c.Cookie(csrfCookieName)
+	if err == nil && token != "" {
+		return token, nil
+	}
+	return GenerateRandomState()
+}
+
+// CSRFMiddleware hands every browser a token through a javascript readable cookie (head.html adds it to every
+// htmx request through hx-headers) and rejects any state changing request that doesn't send it back.
+func (a *Api) CSRFMiddleware() gin.HandlerFunc {
+	return func(c *gin.Context) {
+		expected, err := a.csrfToken(c)
+		if err != nil {
+			log.Err(err).Msg("failed to find csrf token")
+			c.AbortWithStatus(http.StatusInternalServerError)
+			return
+		}
+
+		switch c.Request.Method {
+		case http.MethodGet, http.MethodHead, http.MethodOptions:
+		default:
+			provided := c.GetHeader(csrfHeaderName)
+			if provided == "" {
+				provided = c.PostForm(csrfFormField)
+			}
+			if provided == "" || subtle.ConstantTimeCompare([]byte(provided), []byte(expected)) != 1 {
+				log.Warn().Str("path", c.Request.URL.Path).Str("method", c.Request.Method).Msg("rejected request with missing or invalid csrf token")
+				c.String(http.StatusForbidden, "Invalid or missing CSRF token, please refresh the page and try again.")
+				c.Abort()
+				return
+			}
+		}
+
+		if current, _ := c.Cookie(csrfCookieName); current != expected {
+			setCookie(c, csrfCookieName, expected, int(sessionTTL.Seconds()), false)
+		}
+		c.Next()
+	}
+}
@@ -81,23 +81,18 @@ func addGame(s *discordgo.Session, i *discordgo.InteractionCreate, botContext *B
 	})
 }
 
+// extractPlayerFromDiscord finds the player whose discord account used the command, nil when they haven't signed up.
 func extractPlayerFromDiscord(i *discordgo.InteractionCreate, db *bun.DB) *Player {
-	if strings.Compare(i.Member.User.ID, "") == 0 {
-		log.Panicf("Received empty string for discord user id. interaction=%+v", i)
+	user := interactionUser(i)
+	if user == nil || user.ID == "" {
+		log.Printf("Received empty discord user for interaction. interaction=%+v", i)
+		return nil
 	}
 
-	// get or create new reference to the player
 	var player Player
-	err := db.NewSelect().Model(&player).Scan(context.Background())
+	err := db.NewSelect().Model(&player).Where("discord_id = ?", user.ID).Scan(context.Background())
 	if err != nil {
-		player = Player{
-			Name: i.Member.User.ID,
-		}
-		_, err := db.NewInsert().Model(&player).Exec(context.Background())
-		if err != nil {
-			log.Fatal(err)
-			return nil
-		}
+		return nil
 	}
 	return &player
 }
@@ -106,7 +101,7 @@ func getUserId(s *discordgo.Session, i *discordgo.InteractionCreate, botContext
 	s.InteractionRespond(i.Interaction, &discordgo.InteractionResponse{
 		Type: discordgo.InteractionResponseChannelMessageWithSource,
 		Data: &discordgo.InteractionResponseData{
-			Content: fmt.Sprintf("Your Discord User ID is %s", botContext.player.Name),
+			Content: fmt.Sprintf("Your Discord User ID is %s", interactionUser(i).ID),
 		},
 	})
 }
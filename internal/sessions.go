@@ -0,0 +1,306 @@
+package internal
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	sessionCookieName = "playdate"
+	// how long a session lives without being used, every request pushes the expiry back out again
+	sessionTTL = 30 * 24 * time.Hour
+	// avoid writing to the session table on every single request
+	sessionRenewInterval = time.Minute
+	sessionSweepInterval = time.Hour
+	// the session found for the current request is cached on the gin context under this key
+	sessionContextKey = "session"
+)
+
+// hashSessionToken is what actually gets stored, so a leaked session table can't be used to log in.
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// createSession starts a new session for the player on this device and hands the browser the cookie. Players with
+// two-factor authentication turned on are asked for their code first, unless secondFactor says they already gave
+// one (or signed in with a passkey).
+func (a *Api) createSession(c *gin.Context, player *Player, secondFactor bool) error {
+	// NOTE: every way of signing in ends up here, so this is the one place a ban has to be checked
+	if player.Banned() {
+		log.Warn().Int("playerID", player.ID).Msg("refused to create session for banned player")
+		return ErrPlayerBanned
+	}
+	// NOTE: signing in is when guild membership is checked and guild roles are picked up, they hold for the rest of
+	// the session
+	if err := a.syncGuildMember(c.Request.Context(), player); err != nil {
+		return err
+	}
+	if player.TOTPEnabled && !secondFactor {
+		return a.startTOTPChallenge(c, player)
+	}
+	token, err := GenerateRandomState()
+	if err != nil {
+		log.Err(err).Msg("failed to generate session id")
+		return err
+	}
+	csrfToken, err := GenerateRandomState()
+	if err != nil {
+		log.Err(err).Msg("failed to generate csrf token")
+		return err
+	}
+
+	now := time.Now()
+	session := &Session{
+		IDHash:       hashSessionToken(token),
+		PlayerID:     player.ID,
+		LastSeenDate: now,
+		UserAgent:    c.Request.UserAgent(),
+		IP:           c.ClientIP(),
+		ExpiresDate:  now.Add(sessionTTL),
+		CSRFToken:    csrfToken,
+	}
+	if secondFactor {
+		session.SecondFactorDate = now
+	}
+	_, err = a.db.NewInsert().Model(session).Exec(c.Request.Context())
+	if err != nil {
+		log.Err(err).Int("playerID", player.ID).Msg("failed to create session")
+		return err
+	}
+	log.Info().Int("playerID", player.ID).Int("sessionID", session.ID).Msg("created new session")
+
+	player.LastLoginDate = now
+	_, err = a.db.NewUpdate().Model(player).Column("last_login_date").WherePK().Exec(c.Request.Context())
+	if err != nil {
+		log.Err(err).Int("playerID", player.ID).Msg("failed to update last login")
+	}
+
+	session.Player = player
+	c.Set(sessionContextKey, session)
+	setCookie(c, csrfCookieName, csrfToken, int(sessionTTL.Seconds()), false)
+	a.createPlayDateCookie(c, token)
+	return nil
+}
+
+// findSessionFromCookie looks up the session for the request's cookie and slides its expiry forward.
+func (a *Api) findSessionFromCookie(c *gin.Context) (*Session, error) {
+	if cached, ok := c.Get(sessionContextKey); ok {
+		return cached.(*Session), nil
+	}
+
+	cookie, err := c.Cookie(sessionCookieName)
+	if err != nil {
+		msg := "failed to parse user's cookie"
+		log.Err(err).Msg(msg)
+		return nil, errors.New(msg)
+	}
+
+	session := &Session{}
+	err = a.db.NewSelect().
+		Model(session).
+		Relation("Player").
+		Where("session.id_hash = ?", hashSessionToken(cookie)).
+		Where("session.expires_date > ?", time.Now()).
+		Where("player.banned_date IS NULL").
+		Scan(c.Request.Context())
+	if err != nil {
+		msg := "failed to find the session from their cookie"
+		log.Err(err).Msg(msg)
+		return nil, errors.New(msg)
+	}
+
+	now := time.Now()
+	if now.Sub(session.LastSeenDate) > sessionRenewInterval {
+		session.LastSeenDate = now
+		session.ExpiresDate = now.Add(sessionTTL)
+		session.UserAgent = c.Request.UserAgent()
+		session.IP = c.ClientIP()
+		_, err = a.db.NewUpdate().
+			Model(session).
+			Column("last_seen_date", "expires_date", "user_agent", "ip").
+			WherePK().
+			Exec(c.Request.Context())
+		if err != nil {
+			log.Err(err).Int("sessionID", session.ID).Msg("failed to renew session")
+		} else {
+			setCookie(c, sessionCookieName, cookie, int(sessionTTL.Seconds()), true)
+		}
+	}
+	c.Set(sessionContextKey, session)
+	return session, nil
+}
+
+// deleteSessionFromCookie removes the server side session for the request, if there is one.
+func (a *Api) deleteSessionFromCookie(c *gin.Context) {
+	cookie, err := c.Cookie(sessionCookieName)
+	if err != nil || cookie == "" {
+		return
+	}
+	_, err = a.db.NewDelete().
+		Model((*Session)(nil)).
+		Where("id_hash = ?", hashSessionToken(cookie)).
+		Exec(c.Request.Context())
+	if err != nil {
+		log.Err(err).Msg("failed to delete session")
+	}
+}
+
+func (a *Api) sessionSweeper() {
+	ticker := time.NewTicker(sessionSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-ticker.C:
+			res, err := a.db.NewDelete().Model((*Session)(nil)).Where("expires_date <= ?", time.Now()).Exec(a.ctx)
+			if err != nil {
+				log.Err(err).Msg("failed to sweep expired sessions")
+				continue
+			}
+			if n, _ := res.RowsAffected(); n > 0 {
+				log.Info().Int64("sessions", n).Msg("swept expired sessions")
+			}
+		}
+	}
+}
+
+func (a *Api) profileState(c *gin.Context, current *Session) gin.H {
+	state := gin.H{
+		"Errors":           map[string]string{},
+		"Player":           current.Player,
+		"CurrentSessionID": current.ID,
+		"Settings":         playerSettings(current.Player),
+		"Timezones":        commonTimezones,
+		"EmailEnabled":     emailEnabled(),
+	}
+
+	sessions := []*Session{}
+	err := a.db.NewSelect().
+		Model(&sessions).
+		Where("player_id = ?", current.PlayerID).
+		Where("expires_date > ?", time.Now()).
+		Order("last_seen_date desc").
+		Scan(c.Request.Context())
+	if err != nil {
+		log.Err(err).Int("playerID", current.PlayerID).Msg("failed to query for player sessions")
+		state["ServerError"] = "Failed to retrieve your sessions due to a server error. Please try again later."
+	}
+	state["Sessions"] = sessions
+
+	passkeys := []*WebAuthnCredential{}
+	err = a.db.NewSelect().
+		Model(&passkeys).
+		Where("player_id = ?", current.PlayerID).
+		Order("created_date asc").
+		Scan(c.Request.Context())
+	if err != nil {
+		log.Err(err).Int("playerID", current.PlayerID).Msg("failed to query for player passkeys")
+		state["ServerError"] = "Failed to retrieve your passkeys due to a server error. Please try again later."
+	}
+	state["Passkeys"] = passkeys
+
+	if current.Player.TOTPEnabled {
+		left, err := a.db.NewSelect().Model((*TOTPRecoveryCode)(nil)).Where("player_id = ?", current.PlayerID).Count(c.Request.Context())
+		if err != nil {
+			log.Err(err).Int("playerID", current.PlayerID).Msg("failed to count recovery codes")
+		}
+		state["RecoveryCodesLeft"] = left
+	}
+	state["TOTPRequired"] = requiresTOTP(current.Player)
+	state["SecondFactorRequired"] = !requiresTOTP(current.Player) && sessionRequiresTOTP(current)
+
+	credential := &PlayerOAuthCredential{}
+	err = a.db.NewSelect().Model(credential).Where("player_id = ?", current.PlayerID).Scan(c.Request.Context())
+	if err == nil {
+		state["DiscordCredential"] = credential
+	}
+
+	verification := &EmailVerification{}
+	err = a.db.NewSelect().
+		Model(verification).
+		Where("player_id = ?", current.PlayerID).
+		Where("expires_date > ?", time.Now()).
+		Scan(c.Request.Context())
+	if err == nil {
+		state["PendingEmail"] = verification.Email
+	}
+
+	if a.vapid != nil {
+		state["WebPushKey"] = a.vapid.public
+		subscriptions := []*PushSubscription{}
+		err = a.db.NewSelect().
+			Model(&subscriptions).
+			Where("player_id = ?", current.PlayerID).
+			Order("created_date asc").
+			Scan(c.Request.Context())
+		if err != nil {
+			log.Err(err).Int("playerID", current.PlayerID).Msg("failed to query for player push subscriptions")
+			state["ServerError"] = "Failed to retrieve your browser notifications due to a server error. Please try again later."
+		}
+		state["PushSubscriptions"] = subscriptions
+	}
+	return state
+}
+
+func (a *Api) getProfileTemplate(c *gin.Context) {
+	session, err := a.findSessionFromCookie(c)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+
+	state := a.profileState(c, session)
+	if c.Request.Header.Get("HX-Request") == "" {
+		c.HTML(http.StatusOK, "pages/profile.html", state)
+	} else {
+		c.HTML(http.StatusOK, "partials/profile.html", state)
+	}
+}
+
+func (a *Api) revokeSession(c *gin.Context) {
+	current, err := a.findSessionFromCookie(c)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		log.Err(err).Str("sessionID", c.Param("id")).Msg("failed to parse given session id")
+		c.Redirect(http.StatusFound, "/me")
+		return
+	}
+
+	// NOTE: scoped to the current player so nobody can revoke someone else's session
+	_, err = a.db.NewDelete().
+		Model((*Session)(nil)).
+		Where("id = ?", id).
+		Where("player_id = ?", current.PlayerID).
+		Exec(c.Request.Context())
+	if err != nil {
+		log.Err(err).Int("sessionID", id).Msg("failed to revoke session")
+	} else {
+		log.Info().Int("sessionID", id).Int("playerID", current.PlayerID).Msg("revoked session")
+	}
+
+	if id == current.ID {
+		a.userLogout(c)
+		return
+	}
+
+	state := a.profileState(c, current)
+	if err != nil {
+		state["ServerError"] = err.Error()
+	}
+	c.HTML(http.StatusOK, "partials/profile.html", state)
+}
@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// slackEscaper escapes the characters slack's mrkdwn treats as control characters.
+var slackEscaper = strings.NewReplacer("&", "&amp;", "<", "&lt;", ">", "&gt;")
+
+// slackNotifier posts announcements to the incoming webhook mapped to the guild. It only sticks to the text
+// field, which mattermost, rocket.chat and the rest of the slack-compatible webhooks understand too.
+type slackNotifier struct {
+	webhookURL string
+}
+
+func newSlackNotifier(a *Api) (Notifier, error) {
+	webhookURL := guildChannel(Config.SlackConfig.Webhooks)
+	if webhookURL == "" {
+		return nil, fmt.Errorf("SLACK_WEBHOOKS has no webhook for guild %s", Config.DiscordConfig.GuildID)
+	}
+	parsed, err := url.ParseRequestURI(webhookURL)
+	if err != nil || (parsed.Scheme != "http" && parsed.Scheme != "https") || parsed.Host == "" {
+		return nil, errors.New("SLACK_WEBHOOKS has to be absolute http(s) urls")
+	}
+	return &slackNotifier{webhookURL: webhookURL}, nil
+}
+
+func (s *slackNotifier) Name() string {
+	return "slack"
+}
+
+func (s *slackNotifier) Announce(ctx context.Context, n *Notification) error {
+	playdate := n.PlayDate
+	game := "*" + slackEscaper.Replace(playdate.Game) + "*"
+	when := channelTime(playdate.Date)
+	link := fmt.Sprintf("<%s|Check it out here>", n.Link())
+	owner := slackEscaper.Replace(playdate.Owner.Name)
+	actor := slackEscaper.Replace(n.ActorName())
+
+	var text string
+	switch n.Event {
+	case NotificationPlayDateCreated:
+		text = fmt.Sprintf(":calendar: New playdate %s on %s by %s! %s", game, when, owner, link)
+	case NotificationPlayDateReminder:
+		text = fmt.Sprintf(":alarm_clock: Playdate %s by %s starts on %s! %s", game, owner, when, link)
+	case NotificationPlayDateStarted:
+		// NOTE: pings whoever is around in the channel, slack user IDs aren't something we know
+		text = fmt.Sprintf("<!here> Playdate %s by %s is happening now! Make sure to join :video_game:", game, owner)
+	case NotificationPlayDateUpdated:
+		if n.Previous != nil && n.Previous.OwnerId != playdate.OwnerId {
+			text = fmt.Sprintf("Playdate %s on %s now belongs to %s. %s", game, when, owner, link)
+		} else {
+			text = fmt.Sprintf(":pencil2: Playdate %s is now on %s, changed by %s. %s", game, when, actor, link)
+		}
+	case NotificationPlayDateCancelled:
+		text = fmt.Sprintf(":x: Playdate %s on %s was cancelled by %s.", game, when, actor)
+	case NotificationAttendanceChanged:
+		text = fmt.Sprintf("%s said %s to playdate %s on %s. %s", actor, n.Attending, game, when, link)
+	default:
+		return nil
+	}
+	if names := attendeeNames(n); len(names) > 0 && (n.Event == NotificationPlayDateReminder || n.Event == NotificationPlayDateStarted) {
+		text += "\n>Going: " + slackEscaper.Replace(strings.Join(names, ", "))
+	}
+	return s.post(ctx, text)
+}
+
+func (s *slackNotifier) Send(ctx context.Context, player *Player, n *Notification) error {
+	return nil
+}
+
+func (s *slackNotifier) post(ctx context.Context, text string) error {
+	body, err := json.Marshal(map[string]string{"text": text})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.webhookURL, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := chatClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		// slack answers with what was wrong as plain text, i.e. invalid_payload or no_service
+		answer, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("slack answered %s: %s", resp.Status, answer)
+	}
+	return nil
+}
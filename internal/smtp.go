@@ -0,0 +1,268 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/tls"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	smtpTimeout = 30 * time.Second
+	// playdates don't have an end, calendars get this long of a block for them
+	calendarEventLength = 2 * time.Hour
+)
+
+var ErrEmailDisabled = errors.New("email isn't set up on this server")
+
+// emailEnabled reports whether there is a mail server to send through.
+func emailEnabled() bool {
+	return Config.SMTPConfig.Host != ""
+}
+
+// emailAttachment is a file sent along with an email, i.e. a calendar invite.
+type emailAttachment struct {
+	Filename    string
+	ContentType string
+	Data        []byte
+}
+
+// emailMessage is an email with both an HTML and a plaintext body, mail clients show whichever they prefer.
+type emailMessage struct {
+	To          string
+	Subject     string
+	Text        string
+	HTML        string
+	Attachments []emailAttachment
+}
+
+// bytes renders the message as MIME, ready for the SMTP DATA command.
+func (m *emailMessage) bytes() ([]byte, error) {
+	from, err := mail.ParseAddress(Config.SMTPConfig.From)
+	if err != nil {
+		return nil, fmt.Errorf("invalid SMTP_FROM: %w", err)
+	}
+	to, err := mail.ParseAddress(m.To)
+	if err != nil {
+		return nil, fmt.Errorf("invalid recipient: %w", err)
+	}
+
+	var buf bytes.Buffer
+	// NOTE: the subject can hold a game name, which is anything a player typed in. Newlines would start new headers.
+	subject := strings.NewReplacer("\r", " ", "\n", " ").Replace(m.Subject)
+	fmt.Fprintf(&buf, "From: %s\r\n", from.String())
+	fmt.Fprintf(&buf, "To: %s\r\n", to.String())
+	fmt.Fprintf(&buf, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", subject))
+	fmt.Fprintf(&buf, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&buf, "Message-ID: <%d.%s@%s>\r\n", time.Now().UnixNano(), strings.ReplaceAll(to.Address, "@", "."), emailDomain())
+	buf.WriteString("MIME-Version: 1.0\r\n")
+
+	mixed := multipart.NewWriter(&buf)
+	fmt.Fprintf(&buf, "Content-Type: multipart/mixed; boundary=%q\r\n\r\n", mixed.Boundary())
+
+	var alternativeBody bytes.Buffer
+	alternative := multipart.NewWriter(&alternativeBody)
+	for _, body := range []struct{ contentType, content string }{
+		{"text/plain; charset=utf-8", m.Text},
+		{"text/html; charset=utf-8", m.HTML},
+	} {
+		part, err := alternative.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {body.contentType},
+			"Content-Transfer-Encoding": {"quoted-printable"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		qp := quotedprintable.NewWriter(part)
+		if _, err := qp.Write([]byte(body.content)); err != nil {
+			return nil, err
+		}
+		if err := qp.Close(); err != nil {
+			return nil, err
+		}
+	}
+	if err := alternative.Close(); err != nil {
+		return nil, err
+	}
+	part, err := mixed.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {fmt.Sprintf("multipart/alternative; boundary=%q", alternative.Boundary())},
+	})
+	if err != nil {
+		return nil, err
+	}
+	if _, err := part.Write(alternativeBody.Bytes()); err != nil {
+		return nil, err
+	}
+
+	for _, attachment := range m.Attachments {
+		part, err := mixed.CreatePart(textproto.MIMEHeader{
+			"Content-Type":              {fmt.Sprintf("%s; name=%q", attachment.ContentType, attachment.Filename)},
+			"Content-Disposition":       {fmt.Sprintf("attachment; filename=%q", attachment.Filename)},
+			"Content-Transfer-Encoding": {"base64"},
+		})
+		if err != nil {
+			return nil, err
+		}
+		encoded := base64.StdEncoding.EncodeToString(attachment.Data)
+		// NOTE: base64 in email has to be wrapped at 76 characters
+		for len(encoded) > 76 {
+			part.Write([]byte(encoded[:76] + "\r\n"))
+			encoded = encoded[76:]
+		}
+		part.Write([]byte(encoded + "\r\n"))
+	}
+	if err := mixed.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// emailDomain is the site's host name, used to make ids that are unique to this server.
+func emailDomain() string {
+	u, err := url.Parse(Config.PublicURL)
+	if err != nil || u.Hostname() == "" {
+		return "localhost"
+	}
+	return u.Hostname()
+}
+
+// sendEmail delivers the message through the configured mail server.
+func sendEmail(m *emailMessage) error {
+	config := Config.SMTPConfig
+	if config.Host == "" {
+		return ErrEmailDisabled
+	}
+	body, err := m.bytes()
+	if err != nil {
+		return err
+	}
+	from, err := mail.ParseAddress(config.From)
+	if err != nil {
+		return fmt.Errorf("invalid SMTP_FROM: %w", err)
+	}
+	to, err := mail.ParseAddress(m.To)
+	if err != nil {
+		return fmt.Errorf("invalid recipient: %w", err)
+	}
+
+	addr := net.JoinHostPort(config.Host, config.Port)
+	dialer := &net.Dialer{Timeout: smtpTimeout}
+	tlsConfig := &tls.Config{ServerName: config.Host}
+	var conn net.Conn
+	if config.TLS == "tls" {
+		conn, err = tls.DialWithDialer(dialer, "tcp", addr, tlsConfig)
+	} else {
+		conn, err = dialer.Dial("tcp", addr)
+	}
+	if err != nil {
+		return fmt.Errorf("failed to connect to mail server: %w", err)
+	}
+	conn.SetDeadline(time.Now().Add(smtpTimeout))
+
+	client, err := smtp.NewClient(conn, config.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("failed to greet mail server: %w", err)
+	}
+	defer client.Close()
+	if err := client.Hello(emailDomain()); err != nil {
+		return err
+	}
+	if config.TLS == "starttls" {
+		if ok, _ := client.Extension("STARTTLS"); !ok {
+			return errors.New("mail server doesn't support STARTTLS, set SMTP_TLS to none if that's expected")
+		}
+		if err := client.StartTLS(tlsConfig); err != nil {
+			return fmt.Errorf("failed to start TLS with mail server: %w", err)
+		}
+	}
+	if config.Username != "" {
+		if err := client.Auth(smtp.PlainAuth("", config.Username, config.Password, config.Host)); err != nil {
+			return fmt.Errorf("failed to authenticate with mail server: %w", err)
+		}
+	}
+	if err := client.Mail(from.Address); err != nil {
+		return err
+	}
+	if err := client.Rcpt(to.Address); err != nil {
+		return err
+	}
+	w, err := client.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(body); err != nil {
+		return err
+	}
+	if err := w.Close(); err != nil {
+		return err
+	}
+	return client.Quit()
+}
+
+// playDateCalendar is an iCalendar file for the playdate, so it can be added to a calendar from an email. Every
+// version of the playdate shares a UID, so opening a newer one moves or cancels the event that's already there.
+func playDateCalendar(playdate *PlayDate) []byte {
+	const stamp = "20060102T150405Z"
+	status := "CONFIRMED"
+	if playdate.Status == PlayDateStatusCancelled {
+		status = "CANCELLED"
+	}
+	lines := []string{
+		"BEGIN:VCALENDAR",
+		"VERSION:2.0",
+		"PRODID:-//PlayDate//PlayDate//EN",
+		"METHOD:PUBLISH",
+		"BEGIN:VEVENT",
+		fmt.Sprintf("UID:playdate-%d@%s", playdate.ID, emailDomain()),
+		// NOTE: calendars only take a change when its sequence is higher, seconds since creation always grow
+		fmt.Sprintf("SEQUENCE:%d", int(time.Since(playdate.CreatedDate).Seconds())),
+		"DTSTAMP:" + time.Now().UTC().Format(stamp),
+		"DTSTART:" + playdate.Date.UTC().Format(stamp),
+		"DTEND:" + playdate.Date.Add(calendarEventLength).UTC().Format(stamp),
+		"SUMMARY:" + calendarText("PlayDate: "+playdate.Game),
+		fmt.Sprintf("URL:%s/playdate/%d", Config.PublicURL, playdate.ID),
+		"STATUS:" + status,
+		"END:VEVENT",
+		"END:VCALENDAR",
+	}
+	var buf bytes.Buffer
+	for _, line := range lines {
+		buf.WriteString(foldCalendarLine(line))
+	}
+	return buf.Bytes()
+}
+
+// calendarText escapes text the way iCalendar wants it.
+func calendarText(s string) string {
+	return strings.NewReplacer(`\`, `\\`, ";", `\;`, ",", `\,`, "\r", "", "\n", `\n`).Replace(s)
+}
+
+// foldCalendarLine wraps lines longer than iCalendar's 75 octets, continuation lines start with a space.
+func foldCalendarLine(line string) string {
+	var buf strings.Builder
+	limit := 75
+	for len(line) > limit {
+		cut := limit
+		// don't split a multibyte character
+		for cut > 0 && line[cut]&0xC0 == 0x80 {
+			cut--
+		}
+		buf.WriteString(line[:cut] + "\r\n ")
+		line = line[cut:]
+		limit = 74
+	}
+	buf.WriteString(line + "\r\n")
+	return buf.String()
+}
@@ -0,0 +1,252 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+)
+
+const (
+	// homeTopic is the topic the home page subscribes to, playdates use their id as a topic.
+	homeTopic = 0
+	// how many fragments a subscriber can fall behind before the oldest ones get dropped
+	sseSubscriberBuffer = 8
+	sseKeepAlive        = 30 * time.Second
+)
+
+type sseMessage struct {
+	Event string
+	Data  string
+}
+
+type sseSubscriber struct {
+	messages chan sseMessage
+	// how the subscriber wants times shown, for fragments rendered with PublishRendered
+	display TimeDisplay
+}
+
+// sseBroker fans out rendered fragments to every browser listening on a topic. Each subscriber gets its
+// own buffered channel so a slow connection can never block the publisher or any other subscriber.
+type sseBroker struct {
+	mu     sync.RWMutex
+	topics map[int]map[*sseSubscriber]struct{}
+}
+
+func newSSEBroker() *sseBroker {
+	return &sseBroker{topics: map[int]map[*sseSubscriber]struct{}{}}
+}
+
+func (b *sseBroker) Subscribe(topic int, display TimeDisplay) *sseSubscriber {
+	sub := &sseSubscriber{messages: make(chan sseMessage, sseSubscriberBuffer), display: display}
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.topics[topic] == nil {
+		b.topics[topic] = map[*sseSubscriber]struct{}{}
+	}
+	b.topics[topic][sub] = struct{}{}
+	return sub
+}
+
+func (b *sseBroker) Unsubscribe(topic int, sub *sseSubscriber) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	delete(b.topics[topic], sub)
+	if len(b.topics[topic]) == 0 {
+		delete(b.topics, topic)
+	}
+}
+
+func (b *sseBroker) HasSubscribers(topic int) bool {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	return len(b.topics[topic]) > 0
+}
+
+// Publish never blocks. When a subscriber's buffer is full the oldest fragment is dropped to make room. Most
+// fragments are full re-renders that supersede the ones before them, a dropped home row add or move only shows up
+// once the page is reloaded.
+func (b *sseBroker) Publish(topic int, msg sseMessage) {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	for sub := range b.topics[topic] {
+		sub.send(topic, msg)
+	}
+}
+
+// PublishRendered renders the fragment once for every time display among the topic's subscribers, so each of
+// them sees times in their own timezone and clock.
+func (b *sseBroker) PublishRendered(topic int, render func(TimeDisplay) (sseMessage, error)) error {
+	b.mu.RLock()
+	defer b.mu.RUnlock()
+	rendered := map[string]sseMessage{}
+	for sub := range b.topics[topic] {
+		key := sub.display.String()
+		msg, ok := rendered[key]
+		if !ok {
+			var err error
+			if msg, err = render(sub.display); err != nil {
+				return err
+			}
+			rendered[key] = msg
+		}
+		sub.send(topic, msg)
+	}
+	return nil
+}
+
+func (sub *sseSubscriber) send(topic int, msg sseMessage) {
+	select {
+	case sub.messages <- msg:
+		return
+	default:
+	}
+	select {
+	case <-sub.messages:
+	default:
+	}
+	select {
+	case sub.messages <- msg:
+	default:
+		log.Warn().Int("topic", topic).Str("event", msg.Event).Msg("dropped server sent event for slow subscriber")
+	}
+}
+
+func (a *Api) renderTemplate(name string, data any) (string, error) {
+	var buf bytes.Buffer
+	if err := a.templates.ExecuteTemplate(&buf, name, data); err != nil {
+		return "", err
+	}
+	return buf.String(), nil
+}
+
+// homeRowChange is what a change to a playdate does to its row on the home page.
+type homeRowChange int
+
+const (
+	homeRowUpdated homeRowChange = iota
+	// a new playdate, its row is added after the other upcoming ones
+	homeRowCreated
+	// the playdate started or was cancelled, its row moves to the top of the past ones
+	homeRowEnded
+)
+
+// publishPlayDate re-renders the players table for anyone viewing the playdate as well as the playdate's
+// row on the home page. It is a no-op when nobody is listening.
+func (a *Api) publishPlayDate(playdateID int, change homeRowChange) {
+	if !a.events.HasSubscribers(playdateID) && !a.events.HasSubscribers(homeTopic) {
+		return
+	}
+
+	playdate := &PlayDate{ID: playdateID}
+	err := a.db.NewSelect().Model(playdate).Relation("Owner").Relation("Players").WherePK().Scan(a.ctx)
+	if err != nil {
+		log.Err(err).Int("playdateID", playdateID).Msg("failed to find playdate to publish")
+		return
+	}
+
+	errors := map[string]string{}
+	playdatePlayers := []*PlayDateToPlayer{}
+	err = a.db.NewSelect().Model(&playdatePlayers).Relation("Player").Where("playdate_id = ?", playdateID).Scan(a.ctx)
+	if err != nil {
+		log.Err(err).Int("playdateID", playdateID).Msg("failed to find related players to publish")
+		errors["PlayDatePlayers"] = err.Error()
+	}
+
+	if a.events.HasSubscribers(playdateID) {
+		state := map[string]any{"Errors": errors, "PlayDate": playdate, "PlayDatePlayers": playdatePlayers}
+		html, err := a.renderTemplate("partials/players-table.html", state)
+		if err != nil {
+			log.Err(err).Int("playdateID", playdateID).Msg("failed to render players table")
+		} else {
+			a.events.Publish(playdateID, sseMessage{Event: "players-table", Data: html})
+		}
+	}
+
+	if a.events.HasSubscribers(homeTopic) {
+		err := a.events.PublishRendered(homeTopic, func(display TimeDisplay) (sseMessage, error) {
+			row := playDateRow{PlayDate: playdate, Display: display}
+			// NOTE: the home page listens with hx-swap="none" so everything here gets swapped out of band
+			switch change {
+			case homeRowCreated:
+				html, err := a.renderTemplate("partials/home-row.html", row)
+				html = `<tbody hx-swap-oob="delete:#playdates-empty"></tbody>` +
+					fmt.Sprintf(`<tbody hx-swap-oob="beforeend:#playdates-upcoming">%s</tbody>`, html)
+				return sseMessage{Event: "playdate", Data: html}, err
+			case homeRowEnded:
+				html, err := a.renderTemplate("partials/home-row.html", row)
+				html = fmt.Sprintf(`<tbody hx-swap-oob="delete:#playdate-row-%d"></tbody>`, playdateID) +
+					fmt.Sprintf(`<tbody hx-swap-oob="afterbegin:#playdates-past">%s</tbody>`, html)
+				return sseMessage{Event: "playdate", Data: html}, err
+			default:
+				html, err := a.renderTemplate("partials/playdate-row.html", row)
+				html = fmt.Sprintf(`<tr hx-swap-oob="innerHTML:#playdate-row-%d">%s</tr>`, playdateID, html)
+				return sseMessage{Event: "playdate", Data: html}, err
+			}
+		})
+		if err != nil {
+			log.Err(err).Int("playdateID", playdateID).Msg("failed to render playdate row")
+		}
+	}
+}
+
+func (a *Api) streamHomeEvents(c *gin.Context) {
+	player, err := a.findPlayerFromCookie(c)
+	if err != nil {
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+	a.streamEvents(c, homeTopic, player)
+}
+
+func (a *Api) streamPlayDateEvents(c *gin.Context) {
+	player, err := a.findPlayerFromCookie(c)
+	if err != nil {
+		c.Status(http.StatusUnauthorized)
+		return
+	}
+
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil || id == homeTopic {
+		log.Err(err).Str("playdateID", c.Param("id")).Msg("failed to parse given playdate id")
+		c.Status(http.StatusNotFound)
+		return
+	}
+	a.streamEvents(c, id, player)
+}
+
+// streamEvents holds the request open and writes every fragment published on the topic as a server sent event
+// which htmx's sse extension swaps into the page.
+func (a *Api) streamEvents(c *gin.Context, topic int, player *Player) {
+	sub := a.events.Subscribe(topic, player.TimeDisplay())
+	defer a.events.Unsubscribe(topic, sub)
+
+	c.Header("Content-Type", "text/event-stream")
+	c.Header("Cache-Control", "no-cache")
+	c.Header("Connection", "keep-alive")
+	c.Header("X-Accel-Buffering", "no") // stop reverse proxies from buffering the stream
+
+	keepAlive := time.NewTicker(sseKeepAlive)
+	defer keepAlive.Stop()
+
+	log.Debug().Int("topic", topic).Msg("opened server sent event stream")
+	c.Stream(func(w io.Writer) bool {
+		select {
+		case <-c.Request.Context().Done():
+			return false
+		case msg := <-sub.messages:
+			c.SSEvent(msg.Event, msg.Data)
+			return true
+		case <-keepAlive.C:
+			_, err := io.WriteString(w, ": keep-alive\n\n")
+			return err == nil
+		}
+	})
+	log.Debug().Int("topic", topic).Msg("closed server sent event stream")
+}
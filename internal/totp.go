@@ -0,0 +1,429 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base32"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"html/template"
+	"image/png"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/pquerna/otp"
+	"github.com/pquerna/otp/totp"
+	"github.com/rs/zerolog/log"
+	"github.com/uptrace/bun"
+)
+
+const (
+	totpIssuer = "PlayDate"
+	totpPeriod = 30
+	// ties the second sign in step to the browser that got the password right
+	totpCookieName   = "playdate_totp"
+	totpChallengeTTL = 5 * time.Minute
+	// wrong codes allowed before the player has to start over with their password
+	totpMaxAttempts   = 5
+	recoveryCodeCount = 10
+)
+
+var ErrInvalidTOTPCode = errors.New("invalid code provided")
+
+var totpOpts = totp.ValidateOpts{Period: totpPeriod, Digits: otp.DigitsSix, Algorithm: otp.AlgorithmSHA1}
+
+// requiresTOTP reports whether the player can't use admin pages until they enable two-factor authentication.
+func requiresTOTP(player *Player) bool {
+	return Config.RequireAdminTOTP && isAdmin(player) && !player.TOTPEnabled
+}
+
+// sessionRequiresTOTP reports whether the session can't use admin pages because it never passed a second factor.
+func sessionRequiresTOTP(session *Session) bool {
+	return Config.RequireAdminTOTP && isAdmin(session.Player) && session.SecondFactorDate.IsZero()
+}
+
+// verifyTOTPCode accepts a code from the player's authenticator, allowing one step of clock drift either way, and
+// records the step it was for so it can't be used again.
+func (a *Api) verifyTOTPCode(ctx context.Context, player *Player, code string) error {
+	secret, err := decryptSecret(player.TOTPSecret)
+	if err != nil {
+		return fmt.Errorf("failed to decrypt totp secret: %w", err)
+	}
+
+	now := time.Now().Unix() / totpPeriod
+	for step := now - 1; step <= now+1; step++ {
+		expected, err := totp.GenerateCodeCustom(secret, time.Unix(step*totpPeriod, 0), totpOpts)
+		if err != nil {
+			return err
+		}
+		if subtle.ConstantTimeCompare([]byte(expected), []byte(code)) != 1 {
+			continue
+		}
+		if step <= player.TOTPLastStep {
+			return ErrInvalidTOTPCode
+		}
+		// NOTE: the where makes sure two requests racing with the same code can't both get in
+		res, err := a.db.NewUpdate().
+			Model(player).
+			Set("totp_last_step = ?", step).
+			WherePK().
+			Where("totp_last_step < ?", step).
+			Exec(ctx)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return ErrInvalidTOTPCode
+		}
+		player.TOTPLastStep = step
+		return nil
+	}
+	return ErrInvalidTOTPCode
+}
+
+// useRecoveryCode deletes the matching recovery code, failing when the player doesn't have it.
+func (a *Api) useRecoveryCode(ctx context.Context, player *Player, code string) error {
+	code = strings.ToLower(strings.ReplaceAll(code, " ", ""))
+	res, err := a.db.NewDelete().
+		Model((*TOTPRecoveryCode)(nil)).
+		Where("player_id = ?", player.ID).
+		Where("code_hash = ?", hashSessionToken(code)).
+		Exec(ctx)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return ErrInvalidTOTPCode
+	}
+	log.Info().Int("playerID", player.ID).Msg("player used a two-factor recovery code")
+	return nil
+}
+
+// verifySecondFactor takes either an authenticator code or one of the player's recovery codes.
+func (a *Api) verifySecondFactor(ctx context.Context, player *Player, code string) error {
+	code = strings.TrimSpace(code)
+	if len(code) == int(otp.DigitsSix) {
+		return a.verifyTOTPCode(ctx, player, code)
+	}
+	return a.useRecoveryCode(ctx, player, code)
+}
+
+// newRecoveryCodes replaces the player's recovery codes, returning the new ones so they can be shown exactly once.
+func (a *Api) newRecoveryCodes(ctx context.Context, tx bun.Tx, player *Player) ([]string, error) {
+	_, err := tx.NewDelete().Model((*TOTPRecoveryCode)(nil)).Where("player_id = ?", player.ID).Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+
+	codes := make([]string, recoveryCodeCount)
+	rows := make([]*TOTPRecoveryCode, recoveryCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		// i.e. "k3j9-2mqp", easy enough to copy down by hand
+		code := strings.ToLower(base32.StdEncoding.EncodeToString(b))
+		codes[i] = code[:4] + "-" + code[4:]
+		rows[i] = &TOTPRecoveryCode{PlayerID: player.ID, CodeHash: hashSessionToken(codes[i])}
+	}
+	_, err = tx.NewInsert().Model(&rows).Exec(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return codes, nil
+}
+
+// startTOTPChallenge parks a sign in until the player gives their second factor. Sign ins that arrive as a full page
+// load, i.e. from discord or a login link, get the form as a page of its own.
+func (a *Api) startTOTPChallenge(c *gin.Context, player *Player) error {
+	binding, err := GenerateRandomState()
+	if err != nil {
+		return err
+	}
+
+	err = a.db.RunInTx(c.Request.Context(), nil, func(ctx context.Context, tx bun.Tx) error {
+		err := deleteExpired(ctx, tx, (*TOTPChallenge)(nil), 0)
+		if err != nil {
+			return err
+		}
+		challenge := &TOTPChallenge{
+			BindingHash: hashSessionToken(binding),
+			PlayerID:    player.ID,
+			ExpiresDate: time.Now().Add(totpChallengeTTL),
+		}
+		_, err = tx.NewInsert().Model(challenge).Exec(ctx)
+		return err
+	})
+	if err != nil {
+		return fmt.Errorf("failed to store totp challenge: %w", err)
+	}
+
+	setCookie(c, totpCookieName, binding, int(totpChallengeTTL.Seconds()), true)
+	log.Info().Int("playerID", player.ID).Msg("first factor accepted, waiting on two-factor code")
+	if c.Request.Header.Get("HX-Request") == "" {
+		c.HTML(http.StatusOK, "pages/login-totp.html", gin.H{})
+	} else {
+		c.HTML(http.StatusOK, "partials/login-totp.html", gin.H{})
+	}
+	return nil
+}
+
+// submitTOTPLogin is the second step of a password sign in, it only starts the session once the code checks out.
+func (a *Api) submitTOTPLogin(c *gin.Context) {
+	code := c.PostForm("code")
+	formData := gin.H{}
+
+	binding, _ := c.Cookie(totpCookieName)
+	challenge := &TOTPChallenge{}
+	err := a.db.NewSelect().
+		Model(challenge).
+		Relation("Player").
+		Where("binding_hash = ?", hashSessionToken(binding)).
+		Where("totp_challenge.expires_date > ?", time.Now()).
+		Scan(c.Request.Context())
+	if binding == "" || err != nil {
+		log.Err(err).Msg("failed to find totp challenge")
+		formData["ServerError"] = "Took too long, sign in with your password again."
+		c.HTML(http.StatusOK, "partials/login.html", formData)
+		return
+	}
+
+	ip := c.ClientIP()
+	account := "totp:" + strings.ToLower(challenge.Player.Name)
+	if err := a.logins.Check(ip, account); err != nil {
+		formData["ServerError"] = err.Error()
+		c.HTML(http.StatusOK, "partials/login-totp.html", formData)
+		return
+	}
+
+	err = a.verifySecondFactor(c.Request.Context(), challenge.Player, code)
+	if err != nil {
+		log.Err(err).Int("playerID", challenge.PlayerID).Msg("invalid two-factor code")
+		if a.logins.Fail(ip, account) {
+			a.warnPlayerOfLockout(challenge.Player, ip)
+		}
+		challenge.Attempts++
+		if challenge.Attempts >= totpMaxAttempts {
+			_, err = a.db.NewDelete().Model(challenge).WherePK().Exec(c.Request.Context())
+			setCookie(c, totpCookieName, "", -1, true)
+			formData["ServerError"] = "Too many wrong codes, sign in with your password again."
+			c.HTML(http.StatusOK, "partials/login.html", formData)
+		} else {
+			_, err = a.db.NewUpdate().Model(challenge).Column("attempts").WherePK().Exec(c.Request.Context())
+			formData["Errors"] = map[string]string{"code": ErrInvalidTOTPCode.Error()}
+			c.HTML(http.StatusOK, "partials/login-totp.html", formData)
+		}
+		if err != nil {
+			log.Err(err).Int("totpChallengeID", challenge.ID).Msg("failed to record wrong two-factor code")
+		}
+		return
+	}
+	a.logins.Succeed(account)
+
+	err = consumeSingleUse(c.Request.Context(), a.db, challenge)
+	if err != nil {
+		log.Err(err).Int("totpChallengeID", challenge.ID).Msg("failed to use up totp challenge")
+		formData["ServerError"] = "Took too long, sign in with your password again."
+		c.HTML(http.StatusOK, "partials/login.html", formData)
+		return
+	}
+	setCookie(c, totpCookieName, "", -1, true)
+
+	err = a.createSession(c, challenge.Player, true)
+	if err != nil {
+		formData["ServerError"] = err.Error()
+		c.HTML(http.StatusOK, "partials/login-totp.html", formData)
+	}
+}
+
+// beginTOTPEnrolment generates a new secret for the player and shows it as a QR code. It isn't asked for at sign
+// in until the player proves their authenticator has it with confirmTOTPEnrolment.
+func (a *Api) beginTOTPEnrolment(c *gin.Context) {
+	session, err := a.findSessionFromCookie(c)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+	player := session.Player
+	state := a.profileState(c, session)
+	if player.TOTPEnabled {
+		c.HTML(http.StatusOK, "partials/profile.html", state)
+		return
+	}
+
+	key, err := totp.Generate(totp.GenerateOpts{Issuer: totpIssuer, AccountName: player.Name})
+	if err != nil {
+		log.Err(err).Int("playerID", player.ID).Msg("failed to generate totp secret")
+		state["ServerError"] = "Not your fault, server is cooked. Try again?"
+		c.HTML(http.StatusOK, "partials/profile.html", state)
+		return
+	}
+	player.TOTPSecret, err = encryptSecret(key.Secret())
+	if err == nil {
+		_, err = a.db.NewUpdate().Model(player).Column("totp_secret").WherePK().Exec(c.Request.Context())
+	}
+	if err != nil {
+		log.Err(err).Int("playerID", player.ID).Msg("failed to store totp secret")
+		state["ServerError"] = "Not your fault, server is cooked. Try again?"
+		c.HTML(http.StatusOK, "partials/profile.html", state)
+		return
+	}
+
+	state["TOTPSetup"] = totpSetup(player, key)
+	c.HTML(http.StatusOK, "partials/profile.html", state)
+}
+
+// totpSetup is what the profile shows to add the key to an authenticator app, the otpauth:// uri both as text and
+// as a QR code.
+func totpSetup(player *Player, key *otp.Key) gin.H {
+	setup := gin.H{"URI": key.URL(), "Secret": key.Secret()}
+	var qr bytes.Buffer
+	img, err := key.Image(200, 200)
+	if err == nil {
+		err = png.Encode(&qr, img)
+	}
+	if err != nil {
+		log.Err(err).Int("playerID", player.ID).Msg("failed to draw totp qr code, the secret can still be typed in")
+	} else {
+		setup["QR"] = template.URL("data:image/png;base64," + base64.StdEncoding.EncodeToString(qr.Bytes()))
+	}
+	return setup
+}
+
+// pendingTOTPKey rebuilds the key of an enrolment that hasn't been confirmed yet.
+func pendingTOTPKey(player *Player) (*otp.Key, error) {
+	secret, err := decryptSecret(player.TOTPSecret)
+	if err != nil {
+		return nil, err
+	}
+	raw, err := base32.StdEncoding.WithPadding(base32.NoPadding).DecodeString(secret)
+	if err != nil {
+		return nil, err
+	}
+	return totp.Generate(totp.GenerateOpts{Issuer: totpIssuer, AccountName: player.Name, Secret: raw})
+}
+
+// confirmTOTPEnrolment turns two-factor authentication on once the player enters a code from their authenticator,
+// handing them their recovery codes.
+func (a *Api) confirmTOTPEnrolment(c *gin.Context) {
+	session, err := a.findSessionFromCookie(c)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+	player := session.Player
+	state := a.profileState(c, session)
+	if player.TOTPEnabled || player.TOTPSecret == "" {
+		c.HTML(http.StatusOK, "partials/profile.html", state)
+		return
+	}
+
+	err = a.verifyTOTPCode(c.Request.Context(), player, strings.TrimSpace(c.PostForm("code")))
+	if err != nil {
+		log.Err(err).Int("playerID", player.ID).Msg("failed to confirm totp enrolment")
+		state["Errors"] = map[string]string{"totpCode": "that code didn't match, wait for a fresh one and try again"}
+		if key, err := pendingTOTPKey(player); err == nil {
+			state["TOTPSetup"] = totpSetup(player, key)
+		}
+		c.HTML(http.StatusOK, "partials/profile.html", state)
+		return
+	}
+
+	var codes []string
+	err = a.db.RunInTx(c.Request.Context(), nil, func(ctx context.Context, tx bun.Tx) error {
+		before := player.auditSnapshot()
+		player.TOTPEnabled = true
+		_, err := tx.NewUpdate().Model(player).Column("totp_enabled").WherePK().Exec(ctx)
+		if err != nil {
+			return err
+		}
+		err = recordAudit(ctx, tx, AuditActor{Player: player, Source: AuditSourceWeb}, before, player.auditSnapshot())
+		if err != nil {
+			return err
+		}
+		codes, err = a.newRecoveryCodes(ctx, tx, player)
+		if err != nil {
+			return err
+		}
+		// NOTE: the code was just given on this session, it doesn't need to sign in again for the admin pages
+		session.SecondFactorDate = time.Now()
+		_, err = tx.NewUpdate().Model(session).Column("second_factor_date").WherePK().Exec(ctx)
+		return err
+	})
+	if err != nil {
+		log.Err(err).Int("playerID", player.ID).Msg("failed to enable totp")
+		player.TOTPEnabled = false
+		session.SecondFactorDate = time.Time{}
+		state["ServerError"] = "Not your fault, server is cooked. Try again?"
+		c.HTML(http.StatusOK, "partials/profile.html", state)
+		return
+	}
+	log.Info().Int("playerID", player.ID).Msg("player enabled two-factor authentication")
+
+	state = a.profileState(c, session)
+	state["RecoveryCodes"] = codes
+	c.HTML(http.StatusOK, "partials/profile.html", state)
+}
+
+// disableTOTP turns two-factor authentication off, which takes the player's password and a current code.
+func (a *Api) disableTOTP(c *gin.Context) {
+	session, err := a.findSessionFromCookie(c)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+	player := session.Player
+	state := a.profileState(c, session)
+	if !player.TOTPEnabled {
+		c.HTML(http.StatusOK, "partials/profile.html", state)
+		return
+	}
+	if Config.RequireAdminTOTP && isAdmin(player) {
+		state["ServerError"] = "Two-factor authentication is required for admins."
+		c.HTML(http.StatusOK, "partials/profile.html", state)
+		return
+	}
+
+	errors := map[string]string{}
+	state["Errors"] = errors
+	if player.PasswordSet && comparePassword(player.Password, c.PostForm("totpPassword")) != nil {
+		errors["totpPassword"] = "password is incorrect"
+	} else if err := a.verifySecondFactor(c.Request.Context(), player, c.PostForm("code")); err != nil {
+		log.Err(err).Int("playerID", player.ID).Msg("failed to verify code to disable totp")
+		errors["totpDisableCode"] = ErrInvalidTOTPCode.Error()
+	}
+	if len(errors) > 0 {
+		c.HTML(http.StatusOK, "partials/profile.html", state)
+		return
+	}
+
+	err = a.db.RunInTx(c.Request.Context(), nil, func(ctx context.Context, tx bun.Tx) error {
+		before := player.auditSnapshot()
+		player.TOTPEnabled = false
+		player.TOTPSecret = ""
+		_, err := tx.NewUpdate().Model(player).Column("totp_enabled", "totp_secret").WherePK().Exec(ctx)
+		if err != nil {
+			return err
+		}
+		err = recordAudit(ctx, tx, AuditActor{Player: player, Source: AuditSourceWeb}, before, player.auditSnapshot())
+		if err != nil {
+			return err
+		}
+		_, err = tx.NewDelete().Model((*TOTPRecoveryCode)(nil)).Where("player_id = ?", player.ID).Exec(ctx)
+		return err
+	})
+	if err != nil {
+		log.Err(err).Int("playerID", player.ID).Msg("failed to disable totp")
+		state["ServerError"] = "Not your fault, server is cooked. Try again?"
+		c.HTML(http.StatusOK, "partials/profile.html", state)
+		return
+	}
+	log.Info().Int("playerID", player.ID).Msg("player disabled two-factor authentication")
+	c.HTML(http.StatusOK, "partials/profile.html", state)
+}
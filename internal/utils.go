@@ -4,10 +4,17 @@ import (
 	"crypto/rand"
 	"encoding/base64"
 	"fmt"
+	"sync"
 	"time"
 )
 
-const timeFormat = "Jan 2 2006 at 03:04 PM"
+const (
+	timeFormat    = "Jan 2 2006 at 03:04 PM"
+	timeFormat24h = "Jan 2 2006 at 15:04"
+)
+
+// locations caches loaded timezones by name, time.LoadLocation reads the zoneinfo from disk every time.
+var locations sync.Map
 
 // FormatTime formats a time.Time object into a human-readable string format.
 func FormatTime(t *time.Time) string {
@@ -17,6 +24,38 @@ func FormatTime(t *time.Time) string {
 	return t.Format(timeFormat)
 }
 
+// loadLocation is time.LoadLocation with a cache, falling back to eastern time for names that don't load.
+func loadLocation(name string) *time.Location {
+	if loc, ok := locations.Load(name); ok {
+		return loc.(*time.Location)
+	}
+	loc, err := time.LoadLocation(name)
+	if err != nil || name == "" {
+		return easternLocation
+	}
+	locations.Store(name, loc)
+	return loc
+}
+
+// TimeDisplay is how a player wants to see times, in their own timezone on a 12 or 24 hour clock.
+type TimeDisplay struct {
+	Location *time.Location
+	Clock24h bool
+}
+
+// Format is FormatTime in the player's timezone and clock.
+func (d TimeDisplay) Format(t time.Time) string {
+	if d.Clock24h {
+		return t.In(d.Location).Format(timeFormat24h)
+	}
+	return t.In(d.Location).Format(timeFormat)
+}
+
+// String identifies the display, players with the same one can be sent the same rendered fragment.
+func (d TimeDisplay) String() string {
+	return fmt.Sprintf("%s/%t", d.Location, d.Clock24h)
+}
+
 // RelativeTime formats a given time.Time value into a human-readable string indicating
 // how long ago or how long from now it occurred. It breaks down the difference
 // into the largest appropriate unit (seconds, minutes, hours, days, months, years).
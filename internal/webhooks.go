@@ -0,0 +1,390 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/google/uuid"
+	"github.com/rs/zerolog/log"
+	"github.com/uptrace/bun"
+)
+
+type WebhookEvent string
+
+const (
+	WebhookEventPlayDateCreated   WebhookEvent = "playdate.created"
+	WebhookEventPlayDateUpdated   WebhookEvent = "playdate.updated"
+	WebhookEventPlayDateCancelled WebhookEvent = "playdate.cancelled"
+	WebhookEventPlayDateStarted   WebhookEvent = "playdate.started"
+	WebhookEventAttendanceChanged WebhookEvent = "attendance.changed"
+)
+
+// WebhookEvents is every event an endpoint can subscribe to, mostly used to render the admin form.
+var WebhookEvents = []WebhookEvent{
+	WebhookEventPlayDateCreated,
+	WebhookEventPlayDateUpdated,
+	WebhookEventPlayDateCancelled,
+	WebhookEventPlayDateStarted,
+	WebhookEventAttendanceChanged,
+}
+
+const (
+	webhookMaxAttempts  = 8
+	webhookBaseBackoff  = 30 * time.Second
+	webhookPollInterval = 10 * time.Second
+	webhookBatchSize    = 50
+
+	webhookSignatureHeader = "X-PlayDate-Signature"
+	webhookTimestampHeader = "X-PlayDate-Timestamp"
+	webhookEventHeader     = "X-PlayDate-Event"
+	webhookDeliveryHeader  = "X-PlayDate-Delivery"
+)
+
+// WebhookPayload is the JSON body POSTed to every webhook endpoint.
+type WebhookPayload struct {
+	ID        string       `json:"id"`
+	Event     WebhookEvent `json:"event"`
+	CreatedAt time.Time    `json:"created_at"`
+	Data      any          `json:"data"`
+}
+
+// NOTE: these mirror the models but only expose what is safe to send to a third party (i.e. no passwords or sessions)
+type webhookPlayer struct {
+	ID        int    `json:"id"`
+	Name      string `json:"name"`
+	DiscordID string `json:"discord_id"`
+}
+
+type webhookPlayDate struct {
+	ID     int            `json:"id"`
+	Game   string         `json:"game"`
+	Date   time.Time      `json:"date"`
+	Status PlayDateStatus `json:"status"`
+	Owner  *webhookPlayer `json:"owner,omitempty"`
+}
+
+type webhookAttendance struct {
+	PlayDate  webhookPlayDate `json:"playdate"`
+	Player    webhookPlayer   `json:"player"`
+	Attending Attendance      `json:"attending"`
+}
+
+func newWebhookPlayer(p *Player) *webhookPlayer {
+	if p == nil {
+		return nil
+	}
+	return &webhookPlayer{ID: p.ID, Name: p.Name, DiscordID: p.DiscordID}
+}
+
+func newWebhookPlayDate(p *PlayDate) webhookPlayDate {
+	return webhookPlayDate{ID: p.ID, Game: p.Game, Date: p.Date, Status: p.Status, Owner: newWebhookPlayer(p.Owner)}
+}
+
+func newWebhookAttendance(playdate *PlayDate, player *Player, attending Attendance) webhookAttendance {
+	return webhookAttendance{PlayDate: newWebhookPlayDate(playdate), Player: *newWebhookPlayer(player), Attending: attending}
+}
+
+// SignWebhookPayload computes the hex encoded HMAC-SHA256 of "<timestamp>.<body>" using the endpoint's secret.
+// Receivers should recompute this and compare it against the X-PlayDate-Signature header (minus the "sha256=" prefix).
+func SignWebhookPayload(secret string, timestamp int64, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(strconv.FormatInt(timestamp, 10)))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// webhookBackoff returns how long to wait before the next attempt, doubling each time.
+func webhookBackoff(attempts int) time.Duration {
+	if attempts < 1 {
+		attempts = 1
+	}
+	return webhookBaseBackoff * time.Duration(1<<(attempts-1))
+}
+
+// emitWebhookEvent queues a delivery of the event for every active endpoint subscribed to it. Pass the transaction
+// making the change the event is about, like queueDiscordMessage, and kickWebhookWorker once it commits.
+func emitWebhookEvent(ctx context.Context, db bun.IDB, event WebhookEvent, data any) error {
+	endpoints := []*WebhookEndpoint{}
+	err := db.NewSelect().Model(&endpoints).Where("active = ?", true).Scan(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to find webhook endpoints: %w", err)
+	}
+
+	for _, endpoint := range endpoints {
+		if !endpoint.Subscribed(event) {
+			continue
+		}
+		payload := WebhookPayload{ID: uuid.NewString(), Event: event, CreatedAt: time.Now().UTC(), Data: data}
+		body, err := json.Marshal(payload)
+		if err != nil {
+			return fmt.Errorf("failed to marshal webhook payload: %w", err)
+		}
+		delivery := &WebhookDelivery{UUID: payload.ID, EndpointID: endpoint.ID, Event: event, Payload: body, NextAttemptDate: time.Now()}
+		_, err = db.NewInsert().Model(delivery).Exec(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to queue webhook delivery for endpoint %d: %w", endpoint.ID, err)
+		}
+	}
+	return nil
+}
+
+// kickWebhookWorker wakes up the worker without waiting for the next poll.
+func (a *Api) kickWebhookWorker() {
+	select {
+	case a.webhooks <- struct{}{}:
+	default:
+	}
+}
+
+func (a *Api) webhookWorker() {
+	log.Info().Msg("Delivering webhooks..")
+	ticker := time.NewTicker(webhookPollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-a.ctx.Done():
+			return
+		case <-ticker.C:
+		case <-a.webhooks:
+		}
+		a.deliverPendingWebhooks()
+	}
+}
+
+func (a *Api) deliverPendingWebhooks() {
+	deliveries := []*WebhookDelivery{}
+	err := a.db.NewSelect().
+		Model(&deliveries).
+		Relation("Endpoint").
+		Where("webhook_delivery.status = ?", WebhookDeliveryStatusPending).
+		Where("webhook_delivery.next_attempt_date <= ?", time.Now()).
+		Order("webhook_delivery.next_attempt_date asc").
+		Limit(webhookBatchSize).
+		Scan(a.ctx)
+	if err != nil {
+		log.Err(err).Msg("failed to query for pending webhook deliveries")
+		return
+	}
+
+	for _, delivery := range deliveries {
+		a.deliverWebhook(delivery)
+	}
+}
+
+// deliverWebhook makes a single attempt at delivering the payload and records the outcome, scheduling
+// another attempt with exponential backoff until webhookMaxAttempts is reached.
+func (a *Api) deliverWebhook(delivery *WebhookDelivery) {
+	delivery.Attempts++
+	statusCode, err := postWebhook(delivery.Endpoint, delivery)
+	delivery.LastStatusCode = statusCode
+
+	switch {
+	case err == nil:
+		delivery.Status = WebhookDeliveryStatusDelivered
+		delivery.DeliveredDate = time.Now()
+		delivery.LastError = ""
+		log.Info().Str("delivery", delivery.UUID).Any("event", delivery.Event).Msg("delivered webhook")
+	case delivery.Attempts >= webhookMaxAttempts:
+		delivery.Status = WebhookDeliveryStatusFailed
+		delivery.LastError = err.Error()
+		log.Err(err).Str("delivery", delivery.UUID).Int("attempts", delivery.Attempts).Msg("giving up on webhook delivery")
+	default:
+		delivery.LastError = err.Error()
+		delivery.NextAttemptDate = time.Now().Add(webhookBackoff(delivery.Attempts))
+		log.Warn().Err(err).Str("delivery", delivery.UUID).Int("attempts", delivery.Attempts).Time("nextAttempt", delivery.NextAttemptDate).Msg("webhook delivery failed, retrying later")
+	}
+
+	_, err = a.db.NewUpdate().
+		Model(delivery).
+		Column("status", "attempts", "next_attempt_date", "last_status_code", "last_error", "delivered_date").
+		WherePK().
+		Exec(a.ctx)
+	if err != nil {
+		log.Err(err).Str("delivery", delivery.UUID).Msg("failed to update webhook delivery")
+	}
+}
+
+func postWebhook(endpoint *WebhookEndpoint, delivery *WebhookDelivery) (int, error) {
+	if endpoint == nil {
+		return 0, fmt.Errorf("webhook endpoint %d no longer exists", delivery.EndpointID)
+	}
+
+	timestamp := time.Now().Unix()
+	req, err := http.NewRequest(http.MethodPost, endpoint.URL, bytes.NewReader(delivery.Payload))
+	if err != nil {
+		return 0, fmt.Errorf("failed to create webhook request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("User-Agent", "PlayDate-Webhooks/1.0")
+	req.Header.Set(webhookEventHeader, string(delivery.Event))
+	req.Header.Set(webhookDeliveryHeader, delivery.UUID)
+	req.Header.Set(webhookTimestampHeader, strconv.FormatInt(timestamp, 10))
+	req.Header.Set(webhookSignatureHeader, "sha256="+SignWebhookPayload(endpoint.Secret, timestamp, delivery.Payload))
+
+	client := &http.Client{Timeout: 10 * time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return 0, fmt.Errorf("failed to send webhook request: %w", err)
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		bodyBytes, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return resp.StatusCode, fmt.Errorf("webhook endpoint responded with status %d: %s", resp.StatusCode, string(bodyBytes))
+	}
+	return resp.StatusCode, nil
+}
+
+func (a *Api) webhooksState(c *gin.Context) gin.H {
+	state := gin.H{"Errors": map[string]string{}, "Events": WebhookEvents}
+
+	endpoints := []*WebhookEndpoint{}
+	err := a.db.NewSelect().Model(&endpoints).Order("id asc").Scan(c.Request.Context())
+	if err != nil {
+		log.Err(err).Msg("failed to query for webhook endpoints")
+		state["ServerError"] = "Failed to retrieve webhook endpoints due to a server error. Please try again later."
+	}
+
+	deliveries := []*WebhookDelivery{}
+	err = a.db.NewSelect().
+		Model(&deliveries).
+		Relation("Endpoint").
+		Order("webhook_delivery.created_date desc").
+		Limit(100).
+		Scan(c.Request.Context())
+	if err != nil {
+		log.Err(err).Msg("failed to query for webhook deliveries")
+		state["ServerError"] = "Failed to retrieve webhook deliveries due to a server error. Please try again later."
+	}
+
+	state["Endpoints"] = endpoints
+	state["Deliveries"] = deliveries
+	return state
+}
+
+func (a *Api) getWebhooksTemplate(c *gin.Context) {
+	state := a.webhooksState(c)
+	if c.Request.Header.Get("HX-Request") == "" {
+		c.HTML(http.StatusOK, "pages/webhooks.html", state)
+	} else {
+		c.HTML(http.StatusOK, "partials/webhooks.html", state)
+	}
+}
+
+func (a *Api) createWebhookTemplate(c *gin.Context) {
+	inputURL := c.PostForm("url")
+	inputEvents := c.PostFormArray("events")
+	// NOTE: no boxes ticked means every event, the column can't hold a null for that
+	if inputEvents == nil {
+		inputEvents = []string{}
+	}
+
+	errors := map[string]string{}
+	parsedURL, err := url.ParseRequestURI(inputURL)
+	if inputURL == "" {
+		errors["url"] = "url is required"
+	} else if err != nil || (parsedURL.Scheme != "http" && parsedURL.Scheme != "https") || parsedURL.Host == "" {
+		errors["url"] = "url must be an absolute http(s) url"
+	}
+	for _, e := range inputEvents {
+		known := false
+		for _, event := range WebhookEvents {
+			known = known || e == string(event)
+		}
+		if !known {
+			errors["events"] = fmt.Sprintf("unknown event %q", e)
+		}
+	}
+	if len(errors) > 0 {
+		state := a.webhooksState(c)
+		state["Errors"] = errors
+		state["URL"] = inputURL
+		c.HTML(http.StatusOK, "partials/webhooks.html", state)
+		return
+	}
+
+	secret, err := GenerateRandomState()
+	if err != nil {
+		log.Err(err).Msg("failed to generate webhook secret")
+		state := a.webhooksState(c)
+		state["ServerError"] = err.Error()
+		c.HTML(http.StatusOK, "partials/webhooks.html", state)
+		return
+	}
+
+	endpoint := &WebhookEndpoint{URL: inputURL, Secret: secret, Events: inputEvents, Active: true}
+	_, err = a.db.NewInsert().Model(endpoint).Exec(c.Request.Context())
+	if err != nil {
+		log.Err(err).Any("endpoint", endpoint).Msg("failed to insert webhook endpoint")
+		state := a.webhooksState(c)
+		state["ServerError"] = err.Error()
+		c.HTML(http.StatusOK, "partials/webhooks.html", state)
+		return
+	}
+	log.Info().Int("endpointID", endpoint.ID).Str("url", endpoint.URL).Msg("registered new webhook endpoint")
+
+	state := a.webhooksState(c)
+	state["NewSecret"] = secret
+	c.HTML(http.StatusOK, "partials/webhooks.html", state)
+}
+
+func (a *Api) deleteWebhook(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		log.Err(err).Str("endpointID", c.Param("id")).Msg("failed to parse given webhook endpoint id")
+		c.Redirect(http.StatusFound, "/admin/webhooks")
+		return
+	}
+
+	_, err = a.db.NewDelete().Model((*WebhookEndpoint)(nil)).Where("id = ?", id).Exec(c.Request.Context())
+	state := a.webhooksState(c)
+	if err != nil {
+		log.Err(err).Int("endpointID", id).Msg("failed to delete webhook endpoint")
+		state["ServerError"] = err.Error()
+	}
+	c.HTML(http.StatusOK, "partials/webhooks.html", state)
+}
+
+func (a *Api) redeliverWebhook(c *gin.Context) {
+	id, err := strconv.Atoi(c.Param("id"))
+	if err != nil {
+		log.Err(err).Str("deliveryID", c.Param("id")).Msg("failed to parse given webhook delivery id")
+		c.Redirect(http.StatusFound, "/admin/webhooks")
+		return
+	}
+
+	// NOTE: a manual redelivery starts the retry schedule over again
+	delivery := &WebhookDelivery{ID: id}
+	_, err = a.db.NewUpdate().
+		Model(delivery).
+		Set("status = ?", WebhookDeliveryStatusPending).
+		Set("attempts = 0").
+		Set("next_attempt_date = ?", time.Now()).
+		WherePK().
+		Exec(c.Request.Context())
+	if err != nil {
+		log.Err(err).Int("deliveryID", id).Msg("failed to reset webhook delivery")
+	} else {
+		log.Info().Int("deliveryID", id).Msg("manually redelivering webhook")
+		a.kickWebhookWorker()
+	}
+
+	state := a.webhooksState(c)
+	if err != nil {
+		state["ServerError"] = err.Error()
+	}
+	c.HTML(http.StatusOK, "partials/webhooks.html", state)
+}
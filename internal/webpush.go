@@ -0,0 +1,453 @@
+package internal
+
+import (
+	"bytes"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/x509"
+	"database/sql"
+	"encoding/base64"
+	"encoding/binary"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"github.com/gin-gonic/gin"
+	"github.com/rs/zerolog/log"
+	"github.com/uptrace/bun"
+	"golang.org/x/crypto/hkdf"
+)
+
+const (
+	// how long a push service holds on to a push for a device that's offline
+	webPushTTL = 30 * time.Minute
+	// how long the VAPID token on a push is good for, push services reject anything over a day
+	webPushTokenTTL = 12 * time.Hour
+	// encrypted pushes are sent as a single record of at most this many bytes
+	webPushRecordSize = 4096
+	webPushMaxPayload = webPushRecordSize - 16 - 1 // minus the GCM tag and padding delimiter
+)
+
+var (
+	ErrInvalidPushSubscription = errors.New("push subscription is invalid")
+	webPushClient              = &http.Client{Timeout: 15 * time.Second}
+)
+
+// vapidKeys is the server's VAPID key pair, see loadVAPIDKeys.
+type vapidKeys struct {
+	private *ecdsa.PrivateKey
+	// the uncompressed public key as base64url, browsers get it as the applicationServerKey to subscribe with
+	public string
+}
+
+// loadVAPIDKeys reads the VAPID key pair from the database, generating it the first time the server starts.
+// NOTE: every subscription is tied to the public key, a new key pair means every player has to subscribe again
+func loadVAPIDKeys(ctx context.Context, db *bun.DB) (*vapidKeys, error) {
+	key := &VAPIDKey{ID: 1}
+	err := db.NewSelect().Model(key).WherePK().Scan(ctx)
+	if errors.Is(err, sql.ErrNoRows) {
+		if key, err = generateVAPIDKey(); err != nil {
+			return nil, err
+		}
+		// another instance starting at the same time may have won, whichever key made it in is the one to use
+		if _, err := db.NewInsert().Model(key).On("CONFLICT (id) DO NOTHING").Exec(ctx); err != nil {
+			return nil, fmt.Errorf("failed to store VAPID key: %w", err)
+		}
+		log.Info().Msg("generated VAPID key for web push")
+		err = db.NewSelect().Model(key).WherePK().Scan(ctx)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("failed to find VAPID key: %w", err)
+	}
+
+	der, err := decryptSecret(key.PrivateKey)
+	if err != nil {
+		return nil, fmt.Errorf("failed to decrypt VAPID key: %w: %w", ErrTokenEncryptionKey, err)
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey([]byte(der))
+	if err != nil {
+		return nil, err
+	}
+	private, ok := parsed.(*ecdsa.PrivateKey)
+	if !ok {
+		return nil, errors.New("VAPID key isn't an ECDSA key")
+	}
+	return &vapidKeys{private: private, public: key.PublicKey}, nil
+}
+
+func generateVAPIDKey() (*VAPIDKey, error) {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(private)
+	if err != nil {
+		return nil, err
+	}
+	encrypted, err := encryptSecret(string(der))
+	if err != nil {
+		return nil, err
+	}
+	public, err := private.PublicKey.ECDH()
+	if err != nil {
+		return nil, err
+	}
+	return &VAPIDKey{ID: 1, PublicKey: base64.RawURLEncoding.EncodeToString(public.Bytes()), PrivateKey: encrypted}, nil
+}
+
+// authorization is the VAPID header proving the push came from this server, see RFC 8292.
+func (k *vapidKeys) authorization(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`))
+	claims, err := json.Marshal(map[string]any{
+		"aud": u.Scheme + "://" + u.Host,
+		"exp": time.Now().Add(webPushTokenTTL).Unix(),
+		"sub": webPushSubject(),
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(claims)
+	digest := sha256.Sum256([]byte(unsigned))
+	r, s, err := ecdsa.Sign(rand.Reader, k.private, digest[:])
+	if err != nil {
+		return "", err
+	}
+	// NOTE: JWTs want the raw r and s, not the ASN.1 ecdsa.SignASN1 would give
+	signature := make([]byte, 64)
+	r.FillBytes(signature[:32])
+	s.FillBytes(signature[32:])
+	return fmt.Sprintf("vapid t=%s.%s, k=%s", unsigned, base64.RawURLEncoding.EncodeToString(signature), k.public), nil
+}
+
+// webPushSubject is who push services can reach about this server's pushes, a mailto: or https: URL.
+func webPushSubject() string {
+	if Config.VAPIDSubject != "" {
+		return Config.VAPIDSubject
+	}
+	return "mailto:playdate@" + emailDomain()
+}
+
+// encryptWebPush encrypts the payload for the subscription's browser as a single aes128gcm record, see RFC 8291.
+func encryptWebPush(subscription *PushSubscription, payload []byte) ([]byte, error) {
+	if len(payload) > webPushMaxPayload {
+		return nil, fmt.Errorf("push payload is %d bytes, at most %d fit", len(payload), webPushMaxPayload)
+	}
+	uaPublicBytes, err := base64.RawURLEncoding.DecodeString(subscription.P256DH)
+	if err != nil {
+		return nil, ErrInvalidPushSubscription
+	}
+	uaPublic, err := ecdh.P256().NewPublicKey(uaPublicBytes)
+	if err != nil {
+		return nil, ErrInvalidPushSubscription
+	}
+	authSecret, err := base64.RawURLEncoding.DecodeString(subscription.Auth)
+	if err != nil {
+		return nil, ErrInvalidPushSubscription
+	}
+
+	// a new key pair and salt for every push, so no two pushes share a content encryption key
+	asPrivate, err := ecdh.P256().GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+	return encryptWebPushRecord(uaPublic, authSecret, asPrivate, salt, payload)
+}
+
+// encryptWebPushRecord does the encryption for encryptWebPush with the given key pair and salt.
+func encryptWebPushRecord(uaPublic *ecdh.PublicKey, authSecret []byte, asPrivate *ecdh.PrivateKey, salt []byte, payload []byte) ([]byte, error) {
+	sharedSecret, err := asPrivate.ECDH(uaPublic)
+	if err != nil {
+		return nil, err
+	}
+	uaPublicBytes := uaPublic.Bytes()
+	asPublic := asPrivate.PublicKey().Bytes()
+
+	keyInfo := append([]byte("WebPush: info\x00"), uaPublicBytes...)
+	keyInfo = append(keyInfo, asPublic...)
+	ikm := make([]byte, 32)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, sharedSecret, authSecret, keyInfo), ikm); err != nil {
+		return nil, err
+	}
+	contentKey := make([]byte, 16)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: aes128gcm\x00")), contentKey); err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, 12)
+	if _, err := io.ReadFull(hkdf.New(sha256.New, ikm, salt, []byte("Content-Encoding: nonce\x00")), nonce); err != nil {
+		return nil, err
+	}
+
+	block, err := aes.NewCipher(contentKey)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	// the header is the salt, record size and the key the browser needs to derive the same secret
+	body := bytes.NewBuffer(salt)
+	binary.Write(body, binary.BigEndian, uint32(webPushRecordSize))
+	body.WriteByte(byte(len(asPublic)))
+	body.Write(asPublic)
+	// NOTE: 0x02 marks the last (and only) record
+	body.Write(gcm.Seal(nil, nonce, append(payload, 0x02), nil))
+	return body.Bytes(), nil
+}
+
+// webPushMessage is what the service worker in sw.js turns into a notification.
+type webPushMessage struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+	URL   string `json:"url"`
+	// a notification replaces any earlier one with the same tag, so a playdate only ever shows its latest
+	Tag string `json:"tag"`
+}
+
+// sendWebPush pushes the message to one browser. Subscriptions the push service says are gone get deleted.
+func (a *Api) sendWebPush(ctx context.Context, subscription *PushSubscription, msg webPushMessage, urgency string) error {
+	if a.vapid == nil {
+		return errors.New("web push isn't set up")
+	}
+	payload, err := json.Marshal(msg)
+	if err != nil {
+		return err
+	}
+	body, err := encryptWebPush(subscription, payload)
+	if err != nil {
+		return err
+	}
+	authorization, err := a.vapid.authorization(subscription.Endpoint)
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, subscription.Endpoint, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Authorization", authorization)
+	req.Header.Set("Content-Encoding", "aes128gcm")
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("TTL", strconv.Itoa(int(webPushTTL.Seconds())))
+	req.Header.Set("Urgency", urgency)
+	resp, err := webPushClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	answer, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+
+	switch {
+	case resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusGone:
+		// the player unsubscribed or the browser dropped the subscription, it won't ever work again
+		_, err := a.db.NewDelete().Model(subscription).WherePK().Exec(ctx)
+		if err != nil {
+			return fmt.Errorf("failed to prune expired push subscription: %w", err)
+		}
+		log.Info().Int("subscriptionID", subscription.ID).Int("playerID", subscription.PlayerID).Msg("pruned expired push subscription")
+		return nil
+	case resp.StatusCode >= 300:
+		return fmt.Errorf("push service answered %s: %s", resp.Status, answer)
+	}
+
+	subscription.LastUsedDate = time.Now()
+	_, err = a.db.NewUpdate().Model(subscription).Column("last_used_date").WherePK().Exec(ctx)
+	if err != nil {
+		log.Err(err).Int("subscriptionID", subscription.ID).Msg("failed to update push subscription last used date")
+	}
+	return nil
+}
+
+// pushToPlayer sends the message to every browser the player subscribed.
+func (a *Api) pushToPlayer(ctx context.Context, player *Player, msg webPushMessage, urgency string) error {
+	subscriptions := []*PushSubscription{}
+	err := a.db.NewSelect().Model(&subscriptions).Where("player_id = ?", player.ID).Scan(ctx)
+	if err != nil {
+		return fmt.Errorf("failed to find push subscriptions: %w", err)
+	}
+	errs := []error{}
+	for _, subscription := range subscriptions {
+		if err := a.sendWebPush(ctx, subscription, msg, urgency); err != nil {
+			errs = append(errs, fmt.Errorf("subscription %d: %w", subscription.ID, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// webPushNotifier gives players who live in the browser the same heads-up the discord channel gets when a
+// playdate is about to start and when it does.
+type webPushNotifier struct {
+	a *Api
+}
+
+func newWebPushNotifier(a *Api) (Notifier, error) {
+	keys, err := loadVAPIDKeys(a.ctx, a.db)
+	if err != nil {
+		return nil, err
+	}
+	a.vapid = keys
+	return &webPushNotifier{a: a}, nil
+}
+
+func (w *webPushNotifier) Name() string {
+	return "webpush"
+}
+
+// Announce does nothing, pushes only go to the players who subscribed.
+func (w *webPushNotifier) Announce(ctx context.Context, n *Notification) error {
+	return nil
+}
+
+func (w *webPushNotifier) Send(ctx context.Context, player *Player, n *Notification) error {
+	msg := webPushMessage{Title: n.PlayDate.Game, URL: n.Link(), Tag: fmt.Sprintf("playdate-%d", n.PlayDate.ID)}
+	urgency := "normal"
+	switch n.Event {
+	case NotificationPlayDateReminder:
+		msg.Body = fmt.Sprintf("Starts %s, see you there!", player.TimeDisplay().Format(n.PlayDate.Date))
+	case NotificationPlayDateStarted:
+		msg.Body = "Happening now! Make sure to join 🎮"
+		urgency = "high"
+	default:
+		return nil
+	}
+	return w.a.pushToPlayer(ctx, player, msg, urgency)
+}
+
+// pushSubscriptionRequest is PushSubscription.toJSON() from the browser.
+type pushSubscriptionRequest struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256DH string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+// validate checks the subscription is something we can push to, keys have to be what RFC 8291 expects.
+func (r *pushSubscriptionRequest) validate() error {
+	endpoint, err := url.Parse(r.Endpoint)
+	// NOTE: every browser's push service is https, anything else is someone pointing the server somewhere else
+	if err != nil || endpoint.Scheme != "https" || endpoint.Host == "" {
+		return ErrInvalidPushSubscription
+	}
+	key, err := base64.RawURLEncoding.DecodeString(r.Keys.P256DH)
+	if err != nil {
+		return ErrInvalidPushSubscription
+	}
+	if _, err := ecdh.P256().NewPublicKey(key); err != nil {
+		return ErrInvalidPushSubscription
+	}
+	auth, err := base64.RawURLEncoding.DecodeString(r.Keys.Auth)
+	if err != nil || len(auth) != 16 {
+		return ErrInvalidPushSubscription
+	}
+	return nil
+}
+
+// subscribePush saves the browser's push subscription for the signed in player. Subscribing a browser again
+// moves it over to whoever is signed in now.
+func (a *Api) subscribePush(c *gin.Context) {
+	session, err := a.findSessionFromCookie(c)
+	if err != nil {
+		c.JSON(http.StatusUnauthorized, gin.H{"error": "sign in first"})
+		return
+	}
+	if a.vapid == nil {
+		c.JSON(http.StatusNotFound, gin.H{"error": "push notifications aren't set up on this server"})
+		return
+	}
+	request := &pushSubscriptionRequest{}
+	if err := c.ShouldBindJSON(request); err != nil || request.validate() != nil {
+		c.JSON(http.StatusBadRequest, gin.H{"error": ErrInvalidPushSubscription.Error()})
+		return
+	}
+
+	subscription := &PushSubscription{
+		PlayerID:  session.PlayerID,
+		Endpoint:  request.Endpoint,
+		P256DH:    request.Keys.P256DH,
+		Auth:      request.Keys.Auth,
+		UserAgent: c.Request.UserAgent(),
+	}
+	_, err = a.db.NewInsert().
+		Model(subscription).
+		On("CONFLICT (endpoint) DO UPDATE").
+		Set("player_id = EXCLUDED.player_id").
+		Set("p256dh = EXCLUDED.p256dh").
+		Set("auth = EXCLUDED.auth").
+		Set("user_agent = EXCLUDED.user_agent").
+		Returning("id").
+		Exec(c.Request.Context())
+	if err != nil {
+		log.Err(err).Int("playerID", session.PlayerID).Msg("failed to save push subscription")
+		c.JSON(http.StatusInternalServerError, gin.H{"error": "failed to turn on push notifications, please try again"})
+		return
+	}
+	log.Info().Int("playerID", session.PlayerID).Int("subscriptionID", subscription.ID).Msg("player subscribed to push notifications")
+	c.JSON(http.StatusOK, gin.H{"id": subscription.ID})
+}
+
+// unsubscribePush forgets one of the signed in player's browsers.
+func (a *Api) unsubscribePush(c *gin.Context) {
+	session, err := a.findSessionFromCookie(c)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+	state := a.profileState(c, session)
+	_, err = a.db.NewDelete().
+		Model((*PushSubscription)(nil)).
+		Where("id = ?", c.Param("id")).
+		Where("player_id = ?", session.PlayerID).
+		Exec(c.Request.Context())
+	if err != nil {
+		log.Err(err).Int("playerID", session.PlayerID).Str("subscriptionID", c.Param("id")).Msg("failed to delete push subscription")
+		state["ServerError"] = "Failed to turn off push notifications for that browser, please try again."
+		c.HTML(http.StatusOK, "partials/profile.html", state)
+		return
+	}
+	c.HTML(http.StatusOK, "partials/profile.html", a.profileState(c, session))
+}
+
+// testPush sends a push to every one of the signed in player's browsers, so they can check it works.
+func (a *Api) testPush(c *gin.Context) {
+	session, err := a.findSessionFromCookie(c)
+	if err != nil {
+		c.Redirect(http.StatusFound, "/")
+		return
+	}
+	err = a.pushToPlayer(c.Request.Context(), session.Player, webPushMessage{
+		Title: "PlayDate",
+		Body:  "Push notifications work! You'll get these when a playdate you're going to is about to start.",
+		URL:   Config.PublicURL + "/me",
+		Tag:   "test",
+	}, "normal")
+	// NOTE: read the state after pushing, so browsers that were pruned along the way disappear
+	state := a.profileState(c, session)
+	if err != nil {
+		log.Err(err).Int("playerID", session.PlayerID).Msg("failed to send test push")
+		state["ServerError"] = "Some of your browsers didn't get the test notification, try turning them on again."
+	} else {
+		state["PushTested"] = true
+	}
+	c.HTML(http.StatusOK, "partials/profile.html", state)
+}
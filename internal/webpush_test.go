@@ -0,0 +1,106 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/ecdh"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"math/big"
+	"strings"
+	"testing"
+	"time"
+)
+
+func decodeWebPushVector(t *testing.T, value string) []byte {
+	t.Helper()
+	decoded, err := base64.RawURLEncoding.DecodeString(value)
+	if err != nil {
+		t.Fatalf("bad test vector %q: %v", value, err)
+	}
+	return decoded
+}
+
+// TestEncryptWebPushKnownAnswer runs the example from RFC 8291 Appendix A.
+func TestEncryptWebPushKnownAnswer(t *testing.T) {
+	asPrivate, err := ecdh.P256().NewPrivateKey(decodeWebPushVector(t, "yfWPiYE-n46HLnH0KqZOF1fJJU3MYrct3AELtAQ-oRw"))
+	if err != nil {
+		t.Fatalf("bad application server key: %v", err)
+	}
+	uaPublic, err := ecdh.P256().NewPublicKey(decodeWebPushVector(t, "BCVxsr7N_eNgVRqvHtD0zTZsEc6-VV-JvLexhqUzORcxaOzi6-AYWXvTBHm4bjyPjs7Vd8pZGH6SRpkNtoIAiw4"))
+	if err != nil {
+		t.Fatalf("bad user agent key: %v", err)
+	}
+	authSecret := decodeWebPushVector(t, "BTBZMqHH6r4Tts7J_aSIgg")
+	salt := decodeWebPushVector(t, "DGv6ra1nlYgDCS1FRnbzlw")
+
+	body, err := encryptWebPushRecord(uaPublic, authSecret, asPrivate, salt, []byte("When I grow up, I want to be a watermelon"))
+	if err != nil {
+		t.Fatalf("failed to encrypt: %v", err)
+	}
+	want := decodeWebPushVector(t, "DGv6ra1nlYgDCS1FRnbzlwAAEABBBP4z9KsN6nGRTbVYI_c7VJSPQTBtkgcy27mlmlMoZIIgDll6e3vCYLocInmYWAmS6TlzAC8wEqKK6PBru3jl7A_yl95bQpu6cVPTpK4Mqgkf1CXztLVBSt2Ks3oZwbuwXPXLWyouBWLVWGNWQexSgSxsj_Qulcy4a-fN")
+	if !bytes.Equal(body, want) {
+		t.Errorf("encrypted push doesn't match RFC 8291\n got: %s\nwant: %s", base64.RawURLEncoding.EncodeToString(body), base64.RawURLEncoding.EncodeToString(want))
+	}
+}
+
+func TestVAPIDAuthorizationVerifies(t *testing.T) {
+	private, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("failed to generate key: %v", err)
+	}
+	public, err := private.PublicKey.ECDH()
+	if err != nil {
+		t.Fatalf("failed to convert key: %v", err)
+	}
+	keys := &vapidKeys{private: private, public: base64.RawURLEncoding.EncodeToString(public.Bytes())}
+
+	authorization, err := keys.authorization("https://push.example.net/send/abc?x=1")
+	if err != nil {
+		t.Fatalf("failed to sign: %v", err)
+	}
+	token, key, ok := strings.Cut(strings.TrimPrefix(authorization, "vapid t="), ", k=")
+	if !ok || !strings.HasPrefix(authorization, "vapid t=") {
+		t.Fatalf("unexpected authorization header %q", authorization)
+	}
+
+	// the push service only has the k parameter to check the signature with
+	raw := decodeWebPushVector(t, key)
+	if len(raw) != 65 || raw[0] != 0x04 {
+		t.Fatalf("k isn't an uncompressed P-256 point: %x", raw)
+	}
+	pub := &ecdsa.PublicKey{Curve: elliptic.P256(), X: new(big.Int).SetBytes(raw[1:33]), Y: new(big.Int).SetBytes(raw[33:])}
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		t.Fatalf("expected a three part JWT, got %q", token)
+	}
+	signature := decodeWebPushVector(t, parts[2])
+	if len(signature) != 64 {
+		t.Fatalf("expected a 64 byte ES256 signature, got %d bytes", len(signature))
+	}
+	digest := sha256.Sum256([]byte(parts[0] + "." + parts[1]))
+	if !ecdsa.Verify(pub, digest[:], new(big.Int).SetBytes(signature[:32]), new(big.Int).SetBytes(signature[32:])) {
+		t.Error("VAPID signature doesn't verify against k")
+	}
+
+	var header, claims map[string]any
+	if err := json.Unmarshal(decodeWebPushVector(t, parts[0]), &header); err != nil || header["alg"] != "ES256" {
+		t.Errorf("unexpected JWT header %v (%v)", header, err)
+	}
+	if err := json.Unmarshal(decodeWebPushVector(t, parts[1]), &claims); err != nil {
+		t.Fatalf("failed to decode claims: %v", err)
+	}
+	if claims["aud"] != "https://push.example.net" {
+		t.Errorf("expected the push service origin as aud, got %v", claims["aud"])
+	}
+	exp, _ := claims["exp"].(float64)
+	if until := time.Until(time.Unix(int64(exp), 0)); until <= 0 || until > 24*time.Hour {
+		t.Errorf("exp is %v away, push services want it within a day", until)
+	}
+	if sub, _ := claims["sub"].(string); !strings.HasPrefix(sub, "mailto:") && !strings.HasPrefix(sub, "https:") {
+		t.Errorf("sub has to be a mailto: or https: URL, got %q", sub)
+	}
+}
@@ -0,0 +1,34 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TYPE webhook_delivery_status AS ENUM ('pending', 'delivered', 'failed');
+CREATE TABLE IF NOT EXISTS webhook_endpoint (
+    id SERIAL PRIMARY KEY,
+    url TEXT NOT NULL,
+    secret VARCHAR(128) NOT NULL,
+    events TEXT[] NOT NULL DEFAULT '{}',
+    active BOOLEAN NOT NULL DEFAULT TRUE,
+    created_date TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE TABLE IF NOT EXISTS webhook_delivery (
+    id SERIAL PRIMARY KEY,
+    uuid VARCHAR(64) NOT NULL UNIQUE,
+    endpoint_id INT NOT NULL REFERENCES webhook_endpoint(id) ON DELETE CASCADE,
+    event TEXT NOT NULL,
+    payload JSONB NOT NULL,
+    status webhook_delivery_status DEFAULT 'pending' NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_date TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_status_code INT,
+    last_error TEXT,
+    created_date TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    delivered_date TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS webhook_delivery_pending_idx ON webhook_delivery (next_attempt_date) WHERE status = 'pending';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS webhook_delivery;
+DROP TABLE IF EXISTS webhook_endpoint;
+DROP TYPE IF EXISTS webhook_delivery_status CASCADE;
+-- +goose StatementEnd
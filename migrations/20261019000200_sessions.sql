@@ -0,0 +1,26 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS session (
+    id SERIAL PRIMARY KEY,
+    id_hash VARCHAR(128) NOT NULL UNIQUE,
+    player_id INT NOT NULL REFERENCES player(id) ON DELETE CASCADE,
+    created_date TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_seen_date TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    user_agent TEXT,
+    ip TEXT,
+    expires_date TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS session_player_id_idx ON session (player_id);
+-- carry over everyone's current login so nobody gets signed out by the migration
+INSERT INTO session (id_hash, player_id, expires_date)
+    SELECT encode(sha256(convert_to(session_id, 'UTF8')), 'hex'), id, CURRENT_TIMESTAMP + INTERVAL '30 days'
+    FROM player
+    WHERE session_id IS NOT NULL AND session_id <> '';
+ALTER TABLE player DROP COLUMN session_id;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE player ADD COLUMN session_id VARCHAR(128);
+DROP TABLE IF EXISTS session;
+-- +goose StatementEnd
@@ -0,0 +1,9 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE session ADD COLUMN csrf_token VARCHAR(128) NOT NULL DEFAULT '';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE session DROP COLUMN csrf_token;
+-- +goose StatementEnd
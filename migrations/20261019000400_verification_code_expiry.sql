@@ -0,0 +1,10 @@
+-- +goose Up
+-- +goose StatementBegin
+-- NOTE: existing codes are left without an expiry which makes them unusable
+ALTER TABLE player ADD COLUMN verification_code_expires_at TIMESTAMP;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE player DROP COLUMN verification_code_expires_at;
+-- +goose StatementEnd
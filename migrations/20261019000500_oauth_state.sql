@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS oauth_state (
+    state VARCHAR(128) PRIMARY KEY,
+    binding_hash VARCHAR(128) NOT NULL,
+    code_verifier VARCHAR(128) NOT NULL,
+    created_date TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_date TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS oauth_state_expires_date_idx ON oauth_state (expires_date);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS oauth_state;
+-- +goose StatementEnd
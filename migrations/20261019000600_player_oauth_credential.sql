@@ -0,0 +1,22 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS player_oauth_credential (
+    id SERIAL PRIMARY KEY,
+    player_id INT NOT NULL UNIQUE REFERENCES player(id) ON DELETE CASCADE,
+    access_token TEXT NOT NULL,
+    refresh_token TEXT NOT NULL,
+    token_type VARCHAR(32) NOT NULL,
+    scopes TEXT NOT NULL DEFAULT '',
+    expires_date TIMESTAMP NOT NULL,
+    created_date TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    updated_date TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+-- NOTE: the old plaintext tokens can't be encrypted from sql, players pick up new ones on their next discord login
+ALTER TABLE player DROP COLUMN oauth_token;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE player ADD COLUMN oauth_token VARCHAR(128);
+DROP TABLE IF EXISTS player_oauth_credential;
+-- +goose StatementEnd
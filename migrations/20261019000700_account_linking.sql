@@ -0,0 +1,14 @@
+-- +goose Up
+-- +goose StatementBegin
+-- NOTE: players created through discord get a random password nobody knows until they set their own
+ALTER TABLE player ADD COLUMN password_set BOOLEAN NOT NULL DEFAULT TRUE;
+ALTER TABLE session ADD COLUMN merge_player_id INT REFERENCES player(id) ON DELETE SET NULL;
+ALTER TABLE session ADD COLUMN merge_expires_date TIMESTAMP;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE session DROP COLUMN merge_expires_date;
+ALTER TABLE session DROP COLUMN merge_player_id;
+ALTER TABLE player DROP COLUMN password_set;
+-- +goose StatementEnd
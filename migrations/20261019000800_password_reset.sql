@@ -0,0 +1,16 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS password_reset (
+    id SERIAL PRIMARY KEY,
+    nonce_hash VARCHAR(128) NOT NULL UNIQUE,
+    player_id INT NOT NULL REFERENCES player(id) ON DELETE CASCADE,
+    created_date TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_date TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS password_reset_player_id_idx ON password_reset (player_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS password_reset;
+-- +goose StatementEnd
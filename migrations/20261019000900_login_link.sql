@@ -0,0 +1,25 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TABLE IF NOT EXISTS login_link (
+    id SERIAL PRIMARY KEY,
+    nonce_hash VARCHAR(128) NOT NULL UNIQUE,
+    player_id INT NOT NULL REFERENCES player(id) ON DELETE CASCADE,
+    binding_hash VARCHAR(128) NOT NULL,
+    code_hash VARCHAR(128),
+    attempts INT NOT NULL DEFAULT 0,
+    created_date TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_date TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS login_link_player_id_idx ON login_link (player_id);
+CREATE INDEX IF NOT EXISTS login_link_binding_hash_idx ON login_link (binding_hash);
+-- NOTE: login links replace the verification codes players used to copy out of their DMs
+ALTER TABLE player DROP COLUMN verification_code;
+ALTER TABLE player DROP COLUMN verification_code_expires_at;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE player ADD COLUMN verification_code_expires_at TIMESTAMP;
+ALTER TABLE player ADD COLUMN verification_code VARCHAR(128) NOT NULL DEFAULT '';
+DROP TABLE IF EXISTS login_link;
+-- +goose StatementEnd
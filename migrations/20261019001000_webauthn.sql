@@ -0,0 +1,33 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE player ADD COLUMN webauthn_handle BYTEA UNIQUE;
+CREATE TABLE IF NOT EXISTS webauthn_credential (
+    id SERIAL PRIMARY KEY,
+    player_id INT NOT NULL REFERENCES player(id) ON DELETE CASCADE,
+    name TEXT NOT NULL,
+    credential_id BYTEA NOT NULL UNIQUE,
+    public_key BYTEA NOT NULL,
+    attestation_type TEXT NOT NULL DEFAULT '',
+    transports TEXT[],
+    flags INT NOT NULL DEFAULT 0,
+    aaguid BYTEA,
+    sign_count BIGINT NOT NULL DEFAULT 0,
+    created_date TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_used_date TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS webauthn_credential_player_id_idx ON webauthn_credential (player_id);
+CREATE TABLE IF NOT EXISTS webauthn_ceremony (
+    binding_hash VARCHAR(128) PRIMARY KEY,
+    player_id INT REFERENCES player(id) ON DELETE CASCADE,
+    data JSONB NOT NULL,
+    created_date TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_date TIMESTAMP NOT NULL
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS webauthn_ceremony;
+DROP TABLE IF EXISTS webauthn_credential;
+ALTER TABLE player DROP COLUMN webauthn_handle;
+-- +goose StatementEnd
@@ -0,0 +1,31 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE player ADD COLUMN totp_secret TEXT;
+ALTER TABLE player ADD COLUMN totp_enabled BOOLEAN NOT NULL DEFAULT FALSE;
+-- NOTE: the last time step a code was accepted for, so the same code can't be used twice
+ALTER TABLE player ADD COLUMN totp_last_step BIGINT NOT NULL DEFAULT 0;
+CREATE TABLE IF NOT EXISTS totp_recovery_code (
+    id SERIAL PRIMARY KEY,
+    player_id INT NOT NULL REFERENCES player(id) ON DELETE CASCADE,
+    code_hash VARCHAR(128) NOT NULL UNIQUE,
+    created_date TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS totp_recovery_code_player_id_idx ON totp_recovery_code (player_id);
+CREATE TABLE IF NOT EXISTS totp_challenge (
+    id SERIAL PRIMARY KEY,
+    binding_hash VARCHAR(128) NOT NULL UNIQUE,
+    player_id INT NOT NULL REFERENCES player(id) ON DELETE CASCADE,
+    attempts INT NOT NULL DEFAULT 0,
+    created_date TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_date TIMESTAMP NOT NULL
+);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS totp_challenge;
+DROP TABLE IF EXISTS totp_recovery_code;
+ALTER TABLE player DROP COLUMN totp_last_step;
+ALTER TABLE player DROP COLUMN totp_enabled;
+ALTER TABLE player DROP COLUMN totp_secret;
+-- +goose StatementEnd
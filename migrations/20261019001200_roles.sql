@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+CREATE TYPE player_role AS ENUM ('member', 'moderator', 'admin');
+ALTER TABLE player ADD COLUMN role player_role NOT NULL DEFAULT 'member';
+-- NOTE: moderators and owners can call a playdate off instead of waiting for it to pop
+ALTER TYPE playdate_status ADD VALUE IF NOT EXISTS 'cancelled';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+-- NOTE: postgres can't drop a value from an enum, so cancelled playdates are marked done instead
+UPDATE playdate SET status = 'done' WHERE status = 'cancelled';
+ALTER TABLE player DROP COLUMN role;
+DROP TYPE IF EXISTS player_role;
+-- +goose StatementEnd
@@ -0,0 +1,21 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE player ADD COLUMN banned_date TIMESTAMP;
+ALTER TABLE player ADD COLUMN last_login_date TIMESTAMP;
+-- NOTE: errors from the bot and watchdog kept for the admin dashboard, they'd otherwise only be in the logs
+CREATE TABLE IF NOT EXISTS failure (
+    id SERIAL PRIMARY KEY,
+    created_date TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    source TEXT NOT NULL,
+    message TEXT NOT NULL,
+    error TEXT NOT NULL
+);
+CREATE INDEX IF NOT EXISTS failure_created_date_idx ON failure (created_date);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS failure;
+ALTER TABLE player DROP COLUMN last_login_date;
+ALTER TABLE player DROP COLUMN banned_date;
+-- +goose StatementEnd
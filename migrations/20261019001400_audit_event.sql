@@ -0,0 +1,34 @@
+-- +goose Up
+-- +goose StatementBegin
+-- NOTE: actor_id isn't a foreign key, events have to outlive the players in them and can never be updated
+CREATE TABLE IF NOT EXISTS audit_event (
+    id BIGSERIAL PRIMARY KEY,
+    created_date TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    actor_id INT,
+    actor_name TEXT NOT NULL,
+    source TEXT NOT NULL,
+    action TEXT NOT NULL,
+    target_type TEXT NOT NULL,
+    target_id TEXT NOT NULL,
+    playdate_id INT,
+    before JSONB,
+    after JSONB
+);
+CREATE INDEX IF NOT EXISTS audit_event_playdate_id_idx ON audit_event (playdate_id, created_date);
+CREATE INDEX IF NOT EXISTS audit_event_target_idx ON audit_event (target_type, target_id, created_date);
+
+CREATE OR REPLACE FUNCTION audit_event_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_event is append-only';
+END;
+$$ LANGUAGE plpgsql;
+CREATE TRIGGER audit_event_append_only
+    BEFORE UPDATE OR DELETE ON audit_event
+    FOR EACH ROW EXECUTE FUNCTION audit_event_append_only();
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS audit_event;
+DROP FUNCTION IF EXISTS audit_event_append_only;
+-- +goose StatementEnd
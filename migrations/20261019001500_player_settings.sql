@@ -0,0 +1,18 @@
+-- +goose Up
+-- +goose StatementBegin
+ALTER TABLE player ADD COLUMN discord_avatar TEXT;
+-- NOTE: everyone saw eastern time before players could pick their own timezone
+ALTER TABLE player ADD COLUMN timezone TEXT NOT NULL DEFAULT 'America/New_York';
+ALTER TABLE player ADD COLUMN clock_24h BOOLEAN NOT NULL DEFAULT FALSE;
+ALTER TABLE player ADD COLUMN notify_starting BOOLEAN NOT NULL DEFAULT TRUE;
+ALTER TABLE player ADD COLUMN notify_changes BOOLEAN NOT NULL DEFAULT FALSE;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE player DROP COLUMN notify_changes;
+ALTER TABLE player DROP COLUMN notify_starting;
+ALTER TABLE player DROP COLUMN clock_24h;
+ALTER TABLE player DROP COLUMN timezone;
+ALTER TABLE player DROP COLUMN discord_avatar;
+-- +goose StatementEnd
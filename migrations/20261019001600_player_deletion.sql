@@ -0,0 +1,10 @@
+-- +goose Up
+-- +goose StatementBegin
+-- NOTE: deleted players are kept as an anonymous row so the playdates they went to still add up
+ALTER TABLE player ADD COLUMN deleted_date TIMESTAMP;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE player DROP COLUMN deleted_date;
+-- +goose StatementEnd
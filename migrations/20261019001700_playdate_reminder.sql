@@ -0,0 +1,10 @@
+-- +goose Up
+-- +goose StatementBegin
+-- NOTE: set once the reminder before a playdate went out so the watchdog only sends it once
+ALTER TABLE playdate ADD COLUMN reminded_date TIMESTAMP;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE playdate DROP COLUMN reminded_date;
+-- +goose StatementEnd
@@ -0,0 +1,27 @@
+-- +goose Up
+-- +goose StatementBegin
+-- NOTE: email is only set once the player proved it's theirs, addresses waiting on that live in email_verification
+ALTER TABLE player ADD COLUMN email TEXT;
+ALTER TABLE player ADD COLUMN email_verified_date TIMESTAMP;
+ALTER TABLE player ADD COLUMN notify_created BOOLEAN NOT NULL DEFAULT FALSE;
+CREATE UNIQUE INDEX IF NOT EXISTS player_email_key ON player (lower(email));
+
+CREATE TABLE IF NOT EXISTS email_verification (
+    id SERIAL PRIMARY KEY,
+    nonce_hash VARCHAR(128) NOT NULL UNIQUE,
+    player_id INT NOT NULL REFERENCES player(id) ON DELETE CASCADE,
+    email TEXT NOT NULL,
+    created_date TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    expires_date TIMESTAMP NOT NULL
+);
+CREATE INDEX IF NOT EXISTS email_verification_player_id_idx ON email_verification (player_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS email_verification;
+DROP INDEX IF EXISTS player_email_key;
+ALTER TABLE player DROP COLUMN notify_created;
+ALTER TABLE player DROP COLUMN email_verified_date;
+ALTER TABLE player DROP COLUMN email;
+-- +goose StatementEnd
@@ -0,0 +1,28 @@
+-- +goose Up
+-- +goose StatementBegin
+-- NOTE: the one VAPID key pair the server signs pushes with, generated the first time it starts
+CREATE TABLE IF NOT EXISTS vapid_key (
+    id INT PRIMARY KEY DEFAULT 1 CHECK (id = 1),
+    public_key TEXT NOT NULL,
+    private_key TEXT NOT NULL,
+    created_date TIMESTAMP DEFAULT CURRENT_TIMESTAMP
+);
+
+CREATE TABLE IF NOT EXISTS push_subscription (
+    id SERIAL PRIMARY KEY,
+    player_id INT NOT NULL REFERENCES player(id) ON DELETE CASCADE,
+    endpoint TEXT NOT NULL UNIQUE,
+    p256dh TEXT NOT NULL,
+    auth TEXT NOT NULL,
+    user_agent TEXT,
+    created_date TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_used_date TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS push_subscription_player_id_idx ON push_subscription (player_id);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS push_subscription;
+DROP TABLE IF EXISTS vapid_key;
+-- +goose StatementEnd
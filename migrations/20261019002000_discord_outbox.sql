@@ -0,0 +1,27 @@
+-- +goose Up
+-- +goose StatementBegin
+-- NOTE: discord messages are queued here in the same transaction as the change they're about, a worker sends them
+CREATE TYPE discord_outbox_status AS ENUM ('pending', 'sent', 'dead');
+CREATE TABLE IF NOT EXISTS discord_outbox (
+    id SERIAL PRIMARY KEY,
+    kind TEXT NOT NULL,
+    target TEXT NOT NULL,
+    content TEXT NOT NULL,
+    add_reactions BOOLEAN NOT NULL DEFAULT FALSE,
+    playdate_id INT REFERENCES playdate(id) ON DELETE SET NULL,
+    status discord_outbox_status DEFAULT 'pending' NOT NULL,
+    attempts INT NOT NULL DEFAULT 0,
+    next_attempt_date TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    last_error TEXT,
+    message_id TEXT,
+    created_date TIMESTAMP DEFAULT CURRENT_TIMESTAMP,
+    sent_date TIMESTAMP
+);
+CREATE INDEX IF NOT EXISTS discord_outbox_pending_idx ON discord_outbox (next_attempt_date) WHERE status = 'pending';
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TABLE IF EXISTS discord_outbox;
+DROP TYPE IF EXISTS discord_outbox_status CASCADE;
+-- +goose StatementEnd
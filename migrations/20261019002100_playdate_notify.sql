@@ -0,0 +1,27 @@
+-- +goose Up
+-- +goose StatementBegin
+-- NOTE: wakes up the scheduler in every running server when a playdate's schedule changes, the payload is its id.
+-- postgres holds notifications until the transaction commits, so rolled back changes never wake anyone
+CREATE OR REPLACE FUNCTION notify_playdate_changed() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'DELETE' THEN
+        PERFORM pg_notify('playdate_changed', OLD.id::text);
+    ELSIF TG_OP = 'INSERT'
+        OR NEW.date IS DISTINCT FROM OLD.date
+        OR NEW.status IS DISTINCT FROM OLD.status
+        OR NEW.reminded_date IS DISTINCT FROM OLD.reminded_date THEN
+        PERFORM pg_notify('playdate_changed', NEW.id::text);
+    END IF;
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+CREATE TRIGGER playdate_changed AFTER INSERT OR UPDATE OR DELETE ON playdate
+    FOR EACH ROW EXECUTE FUNCTION notify_playdate_changed();
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+DROP TRIGGER IF EXISTS playdate_changed ON playdate;
+DROP FUNCTION IF EXISTS notify_playdate_changed();
+-- +goose StatementEnd
@@ -0,0 +1,13 @@
+-- +goose Up
+-- +goose StatementBegin
+-- NOTE: anyone can type a discord id at registration, roles only follow it once the player proved the account is
+-- theirs by signing in with discord or through a link sent to it. Players holding discord tokens already did.
+ALTER TABLE player ADD COLUMN discord_verified_date TIMESTAMP;
+UPDATE player SET discord_verified_date = CURRENT_TIMESTAMP
+    WHERE id IN (SELECT player_id FROM player_oauth_credential);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE player DROP COLUMN discord_verified_date;
+-- +goose StatementEnd
@@ -0,0 +1,15 @@
+-- +goose Up
+-- +goose StatementBegin
+-- NOTE: authenticators keep the user handle a passkey was made under, so it has to stay with the passkey when a
+-- merge moves it to a player with a handle of their own
+ALTER TABLE webauthn_credential ADD COLUMN user_handle BYTEA;
+UPDATE webauthn_credential SET user_handle = player.webauthn_handle
+    FROM player WHERE player.id = webauthn_credential.player_id;
+ALTER TABLE webauthn_credential ALTER COLUMN user_handle SET NOT NULL;
+CREATE INDEX IF NOT EXISTS webauthn_credential_user_handle_idx ON webauthn_credential (user_handle);
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE webauthn_credential DROP COLUMN user_handle;
+-- +goose StatementEnd
@@ -0,0 +1,11 @@
+-- +goose Up
+-- +goose StatementBegin
+-- NOTE: sessions from before this can't tell whether they passed a second factor, admins sign in again to use the
+-- admin pages when REQUIRE_ADMIN_TOTP is on
+ALTER TABLE session ADD COLUMN second_factor_date TIMESTAMP;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+ALTER TABLE session DROP COLUMN second_factor_date;
+-- +goose StatementEnd
@@ -0,0 +1,25 @@
+-- +goose Up
+-- +goose StatementBegin
+-- NOTE: deleting an account scrubs the player's name, discord id and email out of their events, see
+-- scrubAuditEvents. That's the only update let through, and only for a transaction that asked for it.
+CREATE OR REPLACE FUNCTION audit_event_append_only() RETURNS trigger AS $$
+BEGIN
+    IF TG_OP = 'UPDATE' AND current_setting('playdate.audit_scrub', true) = 'on'
+        AND (NEW.id, NEW.created_date, NEW.actor_id, NEW.source, NEW.action, NEW.target_type, NEW.target_id, NEW.playdate_id)
+            IS NOT DISTINCT FROM
+            (OLD.id, OLD.created_date, OLD.actor_id, OLD.source, OLD.action, OLD.target_type, OLD.target_id, OLD.playdate_id) THEN
+        RETURN NEW;
+    END IF;
+    RAISE EXCEPTION 'audit_event is append-only';
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
+
+-- +goose Down
+-- +goose StatementBegin
+CREATE OR REPLACE FUNCTION audit_event_append_only() RETURNS trigger AS $$
+BEGIN
+    RAISE EXCEPTION 'audit_event is append-only';
+END;
+$$ LANGUAGE plpgsql;
+-- +goose StatementEnd
@@ -0,0 +1,20 @@
+-- +goose Up
+-- +goose StatementBegin
+-- NOTE: account linking marked every existing player as having set their password, including the ones the old
+-- discord sign in created with a password nobody knows. Players holding discord tokens can sign in with discord, so
+-- they set one without being asked for the current one unless the audit log shows them choosing it. Players who
+-- haven't signed in with discord since lose the unknown password the first time they do, see verifyDiscordAccount.
+UPDATE player SET password_set = FALSE
+    WHERE password_set
+    AND id IN (SELECT player_id FROM player_oauth_credential)
+    AND NOT EXISTS (
+        SELECT 1 FROM audit_event
+            WHERE target_type = 'player'
+            AND target_id = player.id::text
+            AND after->>'password_set' = 'true'
+            AND (before IS NULL OR before->>'password_fingerprint' IS DISTINCT FROM after->>'password_fingerprint')
+    );
+-- +goose StatementEnd
+
+-- +goose Down
+-- NOTE: which players this changed isn't recorded, they keep being able to set a password without the current one
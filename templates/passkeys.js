@@ -0,0 +1,115 @@
+// Passkey registration and sign in, the server does all of the verifying. WebAuthn hands out ArrayBuffers
+// while the server speaks base64url JSON, so most of this is converting between the two.
+(function () {
+  function toBuffer(value) {
+    const base64 = value.replace(/-/g, "+").replace(/_/g, "/");
+    const padded = base64 + "=".repeat((4 - (base64.length % 4)) % 4);
+    return Uint8Array.from(atob(padded), (c) => c.charCodeAt(0)).buffer;
+  }
+
+  function toBase64URL(buffer) {
+    const bytes = String.fromCharCode(...new Uint8Array(buffer));
+    return btoa(bytes).replace(/\+/g, "-").replace(/\//g, "_").replace(/=+$/, "");
+  }
+
+  function postJSON(url, body) {
+    return fetch(url, {
+      method: "POST",
+      credentials: "same-origin",
+      headers: {
+        "Content-Type": "application/json",
+        "X-CSRF-Token": playdateCsrfToken(),
+        // NOTE: makes the server answer a successful sign in with HX-Location instead of a redirect
+        "HX-Request": "true",
+      },
+      body: body ? JSON.stringify(body) : undefined,
+    });
+  }
+
+  async function errorFrom(response) {
+    try {
+      return (await response.json()).error;
+    } catch {
+      return "Something went wrong, please try again.";
+    }
+  }
+
+  function showError(elementId, message) {
+    const element = document.getElementById(elementId);
+    if (element) {
+      element.textContent = message;
+      element.classList.remove("d-none");
+    }
+  }
+
+  window.playdateRegisterPasskey = async function (nameInputId, errorId) {
+    const begin = await postJSON("/me/passkeys/begin");
+    if (!begin.ok) {
+      return showError(errorId, await errorFrom(begin));
+    }
+    const options = (await begin.json()).publicKey;
+    options.challenge = toBuffer(options.challenge);
+    options.user.id = toBuffer(options.user.id);
+    (options.excludeCredentials || []).forEach((c) => (c.id = toBuffer(c.id)));
+
+    let credential;
+    try {
+      credential = await navigator.credentials.create({ publicKey: options });
+    } catch (err) {
+      return showError(errorId, "Passkey registration was cancelled.");
+    }
+
+    const name = document.getElementById(nameInputId).value;
+    const finish = await postJSON("/me/passkeys/finish?name=" + encodeURIComponent(name), {
+      id: credential.id,
+      rawId: toBase64URL(credential.rawId),
+      type: credential.type,
+      authenticatorAttachment: credential.authenticatorAttachment,
+      clientExtensionResults: credential.getClientExtensionResults(),
+      response: {
+        attestationObject: toBase64URL(credential.response.attestationObject),
+        clientDataJSON: toBase64URL(credential.response.clientDataJSON),
+        transports: credential.response.getTransports ? credential.response.getTransports() : [],
+      },
+    });
+    if (!finish.ok) {
+      return showError(errorId, await errorFrom(finish));
+    }
+    htmx.ajax("GET", "/me", { target: "#profile", swap: "outerHTML" });
+  };
+
+  window.playdateLoginWithPasskey = async function (errorId) {
+    const begin = await postJSON("/login/passkey/begin");
+    if (!begin.ok) {
+      return showError(errorId, await errorFrom(begin));
+    }
+    const options = (await begin.json()).publicKey;
+    options.challenge = toBuffer(options.challenge);
+    (options.allowCredentials || []).forEach((c) => (c.id = toBuffer(c.id)));
+
+    let assertion;
+    try {
+      assertion = await navigator.credentials.get({ publicKey: options });
+    } catch (err) {
+      return showError(errorId, "Passkey sign in was cancelled.");
+    }
+
+    const finish = await postJSON("/login/passkey/finish", {
+      id: assertion.id,
+      rawId: toBase64URL(assertion.rawId),
+      type: assertion.type,
+      authenticatorAttachment: assertion.authenticatorAttachment,
+      clientExtensionResults: assertion.getClientExtensionResults(),
+      response: {
+        authenticatorData: toBase64URL(assertion.response.authenticatorData),
+        clientDataJSON: toBase64URL(assertion.response.clientDataJSON),
+        signature: toBase64URL(assertion.response.signature),
+        userHandle: assertion.response.userHandle ? toBase64URL(assertion.response.userHandle) : null,
+      },
+    });
+    if (!finish.ok) {
+      return showError(errorId, await errorFrom(finish));
+    }
+    window.location = finish.headers.get("HX-Location") || "/";
+  };
+})();
@@ -0,0 +1,74 @@
+// Browser push notifications for the profile page. The browser hands out a subscription tied to the server's
+// VAPID key, the server keeps it and pushes to it. sw.js is what shows them.
+(function () {
+  function toBuffer(value) {
+    const base64 = value.replace(/-/g, "+").replace(/_/g, "/");
+    const padded = base64 + "=".repeat((4 - (base64.length % 4)) % 4);
+    return Uint8Array.from(atob(padded), (c) => c.charCodeAt(0)).buffer;
+  }
+
+  function sameKey(a, b) {
+    if (!a || a.byteLength !== b.byteLength) {
+      return false;
+    }
+    const left = new Uint8Array(a);
+    const right = new Uint8Array(b);
+    return left.every((byte, i) => byte === right[i]);
+  }
+
+  async function errorFrom(response) {
+    try {
+      return (await response.json()).error;
+    } catch {
+      return "Something went wrong, please try again.";
+    }
+  }
+
+  function showError(elementId, message) {
+    const element = document.getElementById(elementId);
+    if (element) {
+      element.textContent = message;
+      element.classList.remove("d-none");
+    }
+  }
+
+  window.playdateEnablePush = async function (publicKey, errorId) {
+    if (!("serviceWorker" in navigator) || !("PushManager" in window)) {
+      return showError(errorId, "This browser doesn't support push notifications.");
+    }
+    if ((await Notification.requestPermission()) !== "granted") {
+      return showError(errorId, "Notifications are blocked for PlayDate in this browser, allow them in its site settings.");
+    }
+
+    const registration = await navigator.serviceWorker.register("/sw.js");
+    await navigator.serviceWorker.ready;
+    const key = toBuffer(publicKey);
+    let subscription = await registration.pushManager.getSubscription();
+    // NOTE: a subscription made for another key can't be pushed to, and blocks subscribing with the new one
+    if (subscription && !sameKey(subscription.options.applicationServerKey, key)) {
+      await subscription.unsubscribe();
+      subscription = null;
+    }
+    if (!subscription) {
+      try {
+        subscription = await registration.pushManager.subscribe({ userVisibleOnly: true, applicationServerKey: key });
+      } catch (err) {
+        return showError(errorId, "The browser wouldn't subscribe to notifications, please try again.");
+      }
+    }
+
+    const response = await fetch("/me/push", {
+      method: "POST",
+      credentials: "same-origin",
+      headers: {
+        "Content-Type": "application/json",
+        "X-CSRF-Token": playdateCsrfToken(),
+      },
+      body: JSON.stringify(subscription.toJSON()),
+    });
+    if (!response.ok) {
+      return showError(errorId, await errorFrom(response));
+    }
+    htmx.ajax("GET", "/me", { target: "#profile", swap: "outerHTML" });
+  };
+})();
@@ -0,0 +1,16 @@
+// Service worker showing the pushes the server sends, see webpush.go for what's in them.
+self.addEventListener("push", (event) => {
+  const message = event.data ? event.data.json() : {};
+  event.waitUntil(
+    self.registration.showNotification(message.title || "PlayDate", {
+      body: message.body,
+      tag: message.tag,
+      data: { url: message.url || "/" },
+    }),
+  );
+});
+
+self.addEventListener("notificationclick", (event) => {
+  event.notification.close();
+  event.waitUntil(self.clients.openWindow(event.notification.data.url));
+});